@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"azure-ai-proxy/config"
+)
+
+// remoteTimeout bounds fetching the settings of App Configuration
+const remoteTimeout = 30 * time.Second
+
+// newRemoteConfig returns the App Configuration store of the configuration, or nil if
+// none is configured
+func newRemoteConfig(cfg *config.Config) (*config.AppConfig, error) {
+	if cfg.AppConfigEndpoint == "" {
+		return nil, nil
+	}
+	store, err := config.NewAppConfig(cfg.AppConfigEndpoint, cfg.AppConfigKeyPrefix, cfg.AppConfigLabel, cfg.AppConfigSentinelKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Reading settings from App Configuration %s", cfg.AppConfigEndpoint)
+	return store, nil
+}
+
+// fetchRemote returns the settings of store and whether they changed since the last
+// fetch. With a sentinel key, the settings are only fetched when force is set or the
+// sentinel changed.
+func fetchRemote(store *config.AppConfig, force bool) (map[string]interface{}, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	changed, err := store.Changed(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if !changed && !force {
+		return nil, false, nil
+	}
+	return store.Settings(ctx)
+}
+
+// watchRemote calls poll every interval until done is closed
+func watchRemote(interval time.Duration, poll func(), done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			poll()
+		case <-done:
+			return
+		}
+	}
+}
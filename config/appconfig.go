@@ -0,0 +1,147 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/data/azappconfig/v2"
+)
+
+// AppConfig reads settings from Azure App Configuration, authenticating with the
+// default Azure credential chain. Keys are the setting names after a common prefix,
+// e.g. proxy:log_sample_rate; values with a JSON content type may hold lists and
+// tables such as backends.
+type AppConfig struct {
+	client   *azappconfig.Client
+	prefix   string
+	label    string
+	sentinel string
+
+	mu           sync.Mutex
+	sentinelETag azcore.ETag
+	last         map[string]string // raw values of the last fetch, by setting name
+}
+
+// NewAppConfig creates a store for the App Configuration at endpoint, e.g.
+// https://myconfig.azconfig.io, reading the keys starting with prefix that have label,
+// or no label if label is empty. When sentinel is set, only that key is polled for
+// changes and the settings are fetched again once it changes.
+func NewAppConfig(endpoint, prefix, label, sentinel string) (*AppConfig, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure credential: %v", err)
+	}
+	client, err := azappconfig.NewClient(endpoint, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create App Configuration client: %v", err)
+	}
+	if label == "" {
+		label = "\x00" // App Configuration's filter for settings without a label
+	}
+	return &AppConfig{client: client, prefix: prefix, label: label, sentinel: sentinel}, nil
+}
+
+// SetSyncToken makes the next reads reflect at least the change a notification with
+// this sync token reported
+func (a *AppConfig) SetSyncToken(token string) error {
+	return a.client.SetSyncToken(azappconfig.SyncToken(token))
+}
+
+// Settings fetches the settings of the store and reports whether they changed since
+// the last fetch
+func (a *AppConfig) Settings(ctx context.Context) (map[string]interface{}, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	raw := make(map[string]string)
+	settings := make(map[string]interface{})
+	pager := a.client.NewListSettingsPager(azappconfig.SettingSelector{
+		KeyFilter:   toPtr(a.prefix + "*"),
+		LabelFilter: &a.label,
+		Fields:      []azappconfig.SettingFields{azappconfig.SettingFieldsKey, azappconfig.SettingFieldsValue, azappconfig.SettingFieldsContentType},
+	}, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to list App Configuration settings: %v", err)
+		}
+		for _, setting := range page.Settings {
+			if setting.Key == nil || *setting.Key == a.sentinel {
+				continue
+			}
+			name := strings.TrimPrefix(*setting.Key, a.prefix)
+			value := ""
+			if setting.Value != nil {
+				value = *setting.Value
+			}
+			raw[name] = value
+			if settings[name], err = settingFromStore(value, setting.ContentType); err != nil {
+				return nil, false, fmt.Errorf("invalid App Configuration setting %s: %v", *setting.Key, err)
+			}
+		}
+	}
+
+	changed := a.last == nil || !maps.Equal(raw, a.last)
+	a.last = raw
+	return settings, changed, nil
+}
+
+// Changed reports whether the sentinel key changed since it was last read, and so
+// whether the settings should be fetched. Without a sentinel it is always true.
+func (a *AppConfig) Changed(ctx context.Context) (bool, error) {
+	if a.sentinel == "" {
+		return true, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sentinelChanged(ctx)
+}
+
+// sentinelChanged reports whether the sentinel key changed since it was last read.
+// Callers must hold a.mu.
+func (a *AppConfig) sentinelChanged(ctx context.Context) (bool, error) {
+	options := &azappconfig.GetSettingOptions{Label: &a.label}
+	if a.sentinelETag != "" {
+		options.OnlyIfChanged = &a.sentinelETag
+	}
+	resp, err := a.client.GetSetting(ctx, a.sentinel, options)
+	if err != nil {
+		var respErr *azcore.ResponseError
+		if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotModified {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read App Configuration sentinel %s: %v", a.sentinel, err)
+	}
+	if resp.ETag != nil {
+		a.sentinelETag = *resp.ETag
+	}
+	return true, nil
+}
+
+// settingFromStore converts a stored value to a setting. JSON values are decoded so
+// they can hold lists and tables.
+func settingFromStore(value string, contentType *string) (interface{}, error) {
+	if contentType == nil || !strings.HasPrefix(*contentType, "application/json") {
+		return value, nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON value: %v", err)
+	}
+	return v, nil
+}
+
+// toPtr returns a pointer to v
+func toPtr[T any](v T) *T {
+	return &v
+}
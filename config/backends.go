@@ -0,0 +1,171 @@
+package config
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Backend is a named Azure OpenAI resource, the OpenAI API or a server compatible with
+// it the proxy forwards requests to
+type Backend struct {
+	Name     string
+	Endpoint string
+
+	// Type is "azure" for an Azure OpenAI resource, "openai" for the OpenAI API or
+	// "openai-compatible" for a server with the same API such as Ollama or vLLM, which
+	// requests are translated for; empty is "azure"
+	Type string
+
+	// APIKey is sent as the api-key header in place of the clients' credentials, or as a
+	// bearer token to the OpenAI API and compatible servers; EffectiveBackends defaults
+	// it to AzureOpenAIAPIKey for Azure backends
+	APIKey string
+
+	// Organization is sent to the OpenAI API as the OpenAI-Organization header when set
+	Organization string
+
+	// APIVersion replaces the api-version of requests sent to this backend when set
+	APIVersion string
+
+	// Weight is the backend's share of requests when they are spread over several. A
+	// backend that is another's Fallback may have 0 to only take over its requests, and
+	// one named by MODEL_ROUTES to only serve the models routed to it.
+	Weight int
+
+	// Auth is how requests to the backend are authenticated: "api-key" sends APIKey,
+	// "entra" a Microsoft Entra ID token, "passthrough" and "obo" the user's token or one
+	// obtained on the user's behalf. EffectiveBackends defaults it to AzureOpenAIAuth,
+	// or "api-key" for the OpenAI API, which only takes keys.
+	Auth string
+
+	// Fallback names the backend requests are retried on when this one answers 429 or
+	// 5xx or cannot be reached, e.g. one in another region or a pay-as-you-go resource
+	Fallback string
+}
+
+// BackendTypes are the kinds of upstream a backend can be
+var BackendTypes = []string{"azure", "openai", "openai-compatible"}
+
+// OpenAIEndpoint is the endpoint of backends of type "openai" that do not set one
+const OpenAIEndpoint = "https://api.openai.com"
+
+// BackendAuths are the ways requests to backends can be authenticated
+var BackendAuths = []string{"api-key", "entra", "passthrough", "obo"}
+
+// LoadBalancingStrategies are the ways requests can be spread over several backends
+var LoadBalancingStrategies = []string{"round-robin", "least-connections"}
+
+// IsOpenAI reports whether the backend takes the OpenAI API rather than that of Azure
+// OpenAI: it is the OpenAI API or compatible with it
+func (b Backend) IsOpenAI() bool {
+	return b.Type == "openai" || b.Type == "openai-compatible"
+}
+
+// UsesUserTokens reports whether requests to the backend need the user's bearer token
+func (b Backend) UsesUserTokens() bool {
+	return b.Auth == "passthrough" || b.Auth == "obo"
+}
+
+// backendKeys are the settings of a backend table in the config file
+var backendKeys = map[string]bool{"name": true, "type": true, "endpoint": true, "api_key": true, "organization": true, "api_version": true, "weight": true, "auth": true, "fallback": true}
+
+// EffectiveBackends returns the backends requests are forwarded to: Backends when
+// set, else one per UPSTREAMS URL named after its host, else AzureOpenAIEndpoint
+// named "default"
+func (c *Config) EffectiveBackends() []Backend {
+	backends := append([]Backend(nil), c.Backends...)
+	if len(backends) == 0 {
+		for endpoint, weight := range c.Upstreams {
+			name := endpoint
+			if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+				name = u.Host
+			}
+			backends = append(backends, Backend{Name: name, Endpoint: endpoint, Weight: weight})
+		}
+		sort.Slice(backends, func(i, j int) bool { return backends[i].Endpoint < backends[j].Endpoint })
+	}
+	if len(backends) == 0 {
+		backends = []Backend{{Name: "default", Endpoint: c.AzureOpenAIEndpoint, Weight: 1}}
+	}
+	for i := range backends {
+		if backends[i].IsOpenAI() {
+			if backends[i].Auth == "" {
+				backends[i].Auth = "api-key"
+			}
+			continue
+		}
+		if backends[i].APIKey == "" {
+			backends[i].APIKey = c.AzureOpenAIAPIKey
+		}
+		if backends[i].Auth == "" {
+			backends[i].Auth = c.AzureOpenAIAuth
+		}
+	}
+	return backends
+}
+
+// backendVar returns the name of the environment variable holding a backend setting,
+// e.g. BACKEND_EAST_US_API_KEY for the api_key of backend east-us
+func backendVar(name, setting string) string {
+	name = strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+	return "BACKEND_" + name + "_" + setting
+}
+
+// getBackends returns the backends of the BACKENDS setting. The config file lists them
+// as tables; the environment variable as name=endpoint pairs. The other settings of a
+// backend come from BACKEND_<NAME>_TYPE, _API_KEY, _ORGANIZATION, _API_VERSION, _WEIGHT,
+// _AUTH and _FALLBACK, which also override those of the tables. Backends of type
+// "openai" default to OpenAIEndpoint.
+func (src *source) getBackends() []Backend {
+	src.lookup("BACKENDS")
+	tables := src.tables["BACKENDS"]
+	if tables == nil || (os.Getenv("BACKENDS") != "" && !src.overridden["BACKENDS"]) {
+		tables = nil
+		for _, item := range src.getEnvListOrDefault("BACKENDS", nil) {
+			name, endpoint, ok := strings.Cut(item, "=")
+			if !ok {
+				log.Printf("Warning: ignoring malformed entry %q in BACKENDS, expected name=endpoint", item)
+				continue
+			}
+			tables = append(tables, map[string]string{"name": strings.TrimSpace(name), "endpoint": strings.TrimSpace(endpoint)})
+		}
+	}
+
+	var backends []Backend
+	for _, table := range tables {
+		for key := range table {
+			if !backendKeys[key] {
+				log.Printf("Warning: ignoring unknown setting %s of backend %q", key, table["name"])
+			}
+		}
+		name := table["name"]
+		backend := Backend{
+			Name:         name,
+			Type:         src.getEnvOrDefault(backendVar(name, "TYPE"), table["type"]),
+			Endpoint:     table["endpoint"],
+			APIKey:       src.getEnvOrDefault(backendVar(name, "API_KEY"), table["api_key"]),
+			Organization: src.getEnvOrDefault(backendVar(name, "ORGANIZATION"), table["organization"]),
+			APIVersion:   src.getEnvOrDefault(backendVar(name, "API_VERSION"), table["api_version"]),
+			Auth:         src.getEnvOrDefault(backendVar(name, "AUTH"), table["auth"]),
+			Fallback:     src.getEnvOrDefault(backendVar(name, "FALLBACK"), table["fallback"]),
+			Weight:       1,
+		}
+		if backend.Type == "openai" && backend.Endpoint == "" {
+			backend.Endpoint = OpenAIEndpoint
+		}
+		if weight := src.getEnvOrDefault(backendVar(name, "WEIGHT"), table["weight"]); weight != "" {
+			n, err := strconv.Atoi(weight)
+			if err != nil {
+				src.invalid("backend %q has weight %q, which is not an integer", name, weight)
+			} else {
+				backend.Weight = n
+			}
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClientKey is an API key clients send in X-API-Key, and the identity it was issued to
+type ClientKey struct {
+	// Name identifies the client in logs, limits and budgets, like the client ID of a
+	// certificate
+	Name string
+	Key  string
+
+	// Owner is the team or person responsible for the key's traffic
+	Owner string
+
+	// Deployments and Operations restrict the key to the deployments or models and the
+	// kinds of calls, such as chat or embeddings, listed. Empty allows all of them.
+	Deployments []string
+	Operations  []string
+
+	// NotAfter is when the key expires, as an RFC 3339 time or a date, through which
+	// the key is valid (UTC). Empty never expires.
+	NotAfter string
+
+	// Windows restrict the key to times of day on some days of the week, such as
+	// mon-fri/09:00-17:00, in Timezone, UTC when empty. Empty allows any time.
+	Windows  []string
+	Timezone string
+
+	// Tags such as team, project or cost center are logged with the key's requests for
+	// chargeback, and those in MetricTags label its metrics
+	Tags map[string]string
+}
+
+// Expiry returns when the key expires, or the zero time if it doesn't
+func (k ClientKey) Expiry() (time.Time, error) {
+	if k.NotAfter == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, k.NotAfter); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse(time.DateOnly, k.NotAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid not_after %q, expected a date or an RFC 3339 time", k.NotAfter)
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// clientKeyKeys are the settings of a PROXY_API_KEYS table in the config file
+var clientKeyKeys = map[string]bool{"name": true, "key": true, "owner": true, "deployments": true, "operations": true, "not_after": true, "windows": true, "timezone": true, "tags": true}
+
+// ClientKeyOperations are the kinds of calls a client key may be restricted to
+var ClientKeyOperations = []string{"chat", "completions", "embeddings", "images", "audio", "responses", "other"}
+
+// getClientKeys returns the keys of the PROXY_API_KEYS setting. The config file lists
+// them as tables; the environment variable as name=key pairs, with their owners in
+// PROXY_API_KEY_OWNERS, scopes in PROXY_API_KEY_DEPLOYMENTS and PROXY_API_KEY_OPERATIONS
+// expiry in PROXY_API_KEY_NOT_AFTER, access windows in PROXY_API_KEY_WINDOWS and
+// PROXY_API_KEY_TIMEZONES and tags in PROXY_API_KEY_TAGS, which also override those of
+// the tables.
+func (src *source) getClientKeys() []ClientKey {
+	src.lookup("PROXY_API_KEYS")
+	tables := src.tables["PROXY_API_KEYS"]
+	if tables == nil || (os.Getenv("PROXY_API_KEYS") != "" && !src.overridden["PROXY_API_KEYS"]) {
+		tables = nil
+		for _, item := range src.getEnvListOrDefault("PROXY_API_KEYS", nil) {
+			name, key, ok := strings.Cut(item, "=")
+			if !ok {
+				// The entry is left out of the message since it may be a key
+				log.Printf("Warning: ignoring malformed entry in PROXY_API_KEYS, expected name=key")
+				continue
+			}
+			tables = append(tables, map[string]string{"name": strings.TrimSpace(name), "key": strings.TrimSpace(key)})
+		}
+	}
+
+	owners := src.getEnvMapOrDefault("PROXY_API_KEY_OWNERS", nil)
+	deployments := src.getEnvMapOrDefault("PROXY_API_KEY_DEPLOYMENTS", nil)
+	operations := src.getEnvMapOrDefault("PROXY_API_KEY_OPERATIONS", nil)
+	notAfter := src.getEnvMapOrDefault("PROXY_API_KEY_NOT_AFTER", nil)
+	windows := src.getEnvMapOrDefault("PROXY_API_KEY_WINDOWS", nil)
+	timezones := src.getEnvMapOrDefault("PROXY_API_KEY_TIMEZONES", nil)
+	tags := src.getEnvMapOrDefault("PROXY_API_KEY_TAGS", nil)
+	var keys []ClientKey
+	for _, table := range tables {
+		for key := range table {
+			if !clientKeyKeys[key] {
+				log.Printf("Warning: ignoring unknown setting %s of client key %q", key, table["name"])
+			}
+		}
+		owner, ok := owners[table["name"]]
+		if !ok {
+			owner = table["owner"]
+		}
+		expiry, ok := notAfter[table["name"]]
+		if !ok {
+			expiry = table["not_after"]
+		}
+		timezone, ok := timezones[table["name"]]
+		if !ok {
+			timezone = table["timezone"]
+		}
+		keyTags, err := tagList(table["name"], table["tags"], tags)
+		if err != nil {
+			log.Printf("Warning: ignoring tags of client key %q: %v", table["name"], err)
+		}
+		keys = append(keys, ClientKey{
+			Name:        table["name"],
+			Key:         table["key"],
+			Owner:       owner,
+			Deployments: scopeList(table["name"], table["deployments"], deployments),
+			Operations:  scopeList(table["name"], table["operations"], operations),
+			NotAfter:    expiry,
+			Windows:     scopeList(table["name"], table["windows"], windows),
+			Timezone:    timezone,
+			Tags:        keyTags,
+		})
+	}
+	return keys
+}
+
+// scopeList returns the scope of the key name from the environment variable's
+// "name=a|b" entries when it has one, or else from the table's comma-separated value
+func scopeList(name, tableValue string, env map[string]string) []string {
+	separator := ","
+	if value, ok := env[name]; ok {
+		tableValue, separator = value, "|"
+	}
+	var list []string
+	for _, item := range strings.Split(tableValue, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// tagList returns the tags of the key name from the environment variable's
+// "name=tag=value|tag=value" entries when it has one, or else from the table's
+// comma-separated tag=value pairs
+func tagList(name, tableValue string, env map[string]string) (map[string]string, error) {
+	separator := ","
+	if value, ok := env[name]; ok {
+		tableValue, separator = value, "|"
+	}
+	var tags map[string]string
+	for _, pair := range strings.Split(tableValue, separator) {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tag, value, ok := strings.Cut(pair, "=")
+		if tag = strings.TrimSpace(tag); !ok || tag == "" {
+			return nil, fmt.Errorf("malformed tag %q, expected tag=value", pair)
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[tag] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// clientKeyVar returns the name a client key is reported under, e.g. in secret errors
+func clientKeyVar(name string) string {
+	return "PROXY_API_KEYS key of " + name
+}
+
+// HMACSecret is the secret a client signs its requests with
+type HMACSecret struct {
+	Client string
+	Secret string
+}
+
+// getHMACSecrets returns the client=secret pairs of HMAC_SECRETS, ordered by client
+func (src *source) getHMACSecrets() []HMACSecret {
+	var secrets []HMACSecret
+	for client, secret := range src.getEnvMapOrDefault("HMAC_SECRETS", nil) {
+		secrets = append(secrets, HMACSecret{Client: client, Secret: secret})
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Client < secrets[j].Client })
+	return secrets
+}
+
+// readClientKeys reads a file of client keys, one per line as "name key" with an
+// optional owner after the key, optional deployments=a,b and operations=a,b scopes, an
+// optional not_after expiry, optional windows=a,b with timezone= and optional
+// tags=tag=value,tag=value.
+// Blank lines and lines starting with # are skipped.
+func readClientKeys(path string) ([]ClientKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client keys: %v", err)
+	}
+	defer f.Close()
+
+	var keys []ClientKey
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name, a key and optionally an owner and scopes", path, lineNumber)
+		}
+		key := ClientKey{Name: fields[0], Key: fields[1]}
+		for _, field := range fields[2:] {
+			setting, value, ok := strings.Cut(field, "=")
+			switch {
+			case !ok && key.Owner == "":
+				key.Owner = field
+			case ok && setting == "deployments":
+				key.Deployments = scopeList(key.Name, value, nil)
+			case ok && setting == "operations":
+				key.Operations = scopeList(key.Name, value, nil)
+			case ok && setting == "not_after":
+				key.NotAfter = value
+			case ok && setting == "windows":
+				key.Windows = scopeList(key.Name, value, nil)
+			case ok && setting == "timezone":
+				key.Timezone = value
+			case ok && setting == "tags":
+				if key.Tags, err = tagList(key.Name, value, nil); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unexpected field %q, expected an owner, deployments=, operations=, not_after=, windows=, timezone= or tags=", path, lineNumber, field)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read client keys from %s: %v", path, err)
+	}
+	return keys, nil
+}
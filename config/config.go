@@ -1,31 +1,751 @@
 package config
 
 import (
+	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// SystemPromptModes are the ways SystemPrompt can be injected
+var SystemPromptModes = []string{"default", "enforce"}
+
 // Config holds application configuration
 type Config struct {
 	AzureOpenAIEndpoint string
 	ListenAddr          string
-	LogFilePath         string
-	APIKey              string
+
+	// Backends are the named Azure OpenAI resources requests are forwarded to. When
+	// empty, EffectiveBackends derives them from Upstreams or AzureOpenAIEndpoint.
+	Backends []Backend
+
+	// Upstreams maps Azure OpenAI base URLs to weights; when set, requests are spread
+	// over them in proportion to their weights instead of going to AzureOpenAIEndpoint
+	Upstreams map[string]int
+
+	// LoadBalancing is how requests are spread over several backends, by weight with
+	// "round-robin" or to the least busy with "least-connections". Either way backends
+	// failing requests get less traffic.
+	LoadBalancing string
+
+	// LatencyRouting sends requests to the healthy backend with the lowest recent p95
+	// latency instead of spreading them; routes may override it. Another backend is
+	// preferred only once it is faster by LatencyRoutingMargin, a fraction of the p95.
+	LatencyRouting       bool
+	LatencyRoutingMargin float64
+
+	LogFilePath string
+	APIKey      string
+	AdminAPIKey string
+
+	// ClientKeys are further keys clients authenticate with, each naming the client it
+	// was issued to; requests with APIKey are attributed to client "default". They
+	// include those of ClientKeysFile, which is watched so keys can be rotated.
+	ClientKeys     []ClientKey
+	ClientKeysFile string
+
+	// IPAllowlist and IPDenylist admit proxied requests by the network they come from,
+	// as CIDRs or addresses; AdminIPAllowlist and AdminIPDenylist do the same for the
+	// admin endpoints. Denied networks take precedence.
+	IPAllowlist      []string
+	IPDenylist       []string
+	AdminIPAllowlist []string
+	AdminIPDenylist  []string
+
+	// KeyExpiryWarningDays is how many days before they expire client keys are warned
+	// about in the log and the proxy_client_keys_expiring metric
+	KeyExpiryWarningDays int64
+
+	// VirtualKeysFile enables the admin API for creating client keys at runtime, and
+	// stores the keys created
+	VirtualKeysFile string
+
+	// JWTIssuer enables authenticating clients with bearer tokens of that issuer, e.g.
+	// https://login.microsoftonline.com/<tenant>/v2.0, issued for one of JWTAudiences.
+	// The client ID is the first of JWTClientClaims in the token. Signing keys come
+	// from JWTJWKSURL, or the issuer's OpenID configuration when empty.
+	JWTIssuer       string
+	JWTAudiences    []string
+	JWTClientClaims []string
+	JWTJWKSURL      string
+
+	// HMACSecrets enable clients to sign their requests with a shared secret instead
+	// of sending a key. Signatures made more than HMACMaxSkew ago are refused.
+	HMACSecrets []HMACSecret
+	HMACMaxSkew time.Duration
+
+	// AzureOpenAIAPIKey is sent upstream as the api-key header instead of the clients'
+	// credentials, so clients only need to authenticate to the proxy
+	AzureOpenAIAPIKey string
+
+	// AzureOpenAIAuth is "api-key" to authenticate upstream with AzureOpenAIAPIKey, or
+	// "entra" to send Microsoft Entra ID tokens for AzureOpenAITokenScope, obtained with
+	// the default Azure credential chain, as Authorization: Bearer. "passthrough" and
+	// "obo" send the tokens of users instead, see OBOClientID.
+	AzureOpenAIAuth       string
+	AzureOpenAITokenScope string
+
+	// With AzureOpenAIAuth "passthrough" the bearer tokens of users, checked like other
+	// JWTs, are forwarded upstream; with "obo" they are exchanged for tokens for
+	// AzureOpenAITokenScope on the users' behalf, by the app registration OBOClientID of
+	// OBOTenantID, so Azure enforces each user's role assignments
+	OBOTenantID     string
+	OBOClientID     string
+	OBOClientSecret string
+
+	// KeyVaultURL is the Azure Key Vault that secret settings, those with a
+	// "keyvault:<secret-name>" value, are fetched from at startup and every
+	// KeyVaultRefreshInterval
+	KeyVaultURL             string
+	KeyVaultRefreshInterval time.Duration
+
+	// AppConfigEndpoint is an Azure App Configuration store whose keys starting with
+	// AppConfigKeyPrefix and labelled AppConfigLabel are layered over the config file.
+	// They are polled every AppConfigPollInterval; with AppConfigSentinelKey, only that
+	// key is polled and the rest are fetched again once it changes.
+	AppConfigEndpoint     string
+	AppConfigKeyPrefix    string
+	AppConfigLabel        string
+	AppConfigSentinelKey  string
+	AppConfigPollInterval time.Duration
+
+	// TLSCertFile and TLSKeyFile make the proxy terminate TLS. With TLSClientCAFile,
+	// clients authenticate with certificates signed by that CA; TLSClientAuth is
+	// "require" to refuse connections without one or "optional" to also accept API keys.
+	// TLSClientIdentities, when set, maps the certificate names (common name or SAN)
+	// accepted to client IDs, and certificates with none of them are refused.
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSClientCAFile     string
+	TLSClientAuth       string
+	TLSClientIdentities map[string]string
+
+	// SPIFFEIdentities authenticate workloads by the SPIFFE ID of their X.509-SVID,
+	// verified against the trust bundle in TLSClientCAFile, so they need no key
+	SPIFFEIdentities []SPIFFEIdentity
+
+	// AuditLogPath enables an audit log of auth failures and admin actions, separate
+	// from the request log; "-" writes it to stdout
+	AuditLogPath string
+
+	// LogLevel is "info" or "debug"
+	LogLevel string
+
+	// Profile names the section of the config file's profiles layered over its other
+	// settings, e.g. "dev" or "prod"
+	Profile string
+
+	// LogBodies includes request and response bodies in log entries; routes may
+	// override it
+	LogBodies bool
+
+	// LogSampleRate is the fraction of requests logged. ClientLogSampling overrides it
+	// per client ID with "always", "never" or a rate.
+	LogSampleRate     float64
+	ClientLogSampling map[string]string
+
+	// LogDedupErrors logs only the first of identical error entries (same path, status
+	// and message) per LogDedupWindow, followed by a count of the suppressed duplicates
+	LogDedupErrors bool
+	LogDedupWindow time.Duration
+
+	// DebugLogClients are the client IDs allowed to request verbose logging of a single
+	// request with the X-Debug-Log header
+	DebugLogClients []string
+
+	// SSEDumpDir receives the raw bytes of streamed responses to debug requests and to
+	// SSEDumpDeployments, one file per response; empty disables dumps
+	SSEDumpDir         string
+	SSEDumpDeployments []string
+
+	// LogTimestampFormat is a Go time layout or a name such as "RFC3339Nano";
+	// LogTimezone is an IANA zone name such as "UTC" or "Europe/Brussels"
+	LogTimestampFormat string
+	LogTimezone        string
+
+	// LogEncryptionKey is a base64 AES key (16, 24 or 32 bytes) the RequestBody and
+	// Response of log entries are encrypted with; LogEncryptionKeyFile holds it instead
+	LogEncryptionKey     string
+	LogEncryptionKeyFile string
+
+	// Listener timeouts, zero means no timeout. WriteTimeout is lifted for streaming
+	// requests since it would otherwise cut off long streams.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// UpstreamTimeout bounds how long the upstream may take to answer a request, zero
+	// means no limit. DeadlineHeader names a grpc-timeout style request header that
+	// sets a shorter deadline per request; the remaining time is passed on upstream in it.
+	UpstreamTimeout time.Duration
+	DeadlineHeader  string
+
+	// StreamIdleTimeout abandons a streamed response when no data arrives from the
+	// upstream for this long, sending the client an error event; zero disables it
+	StreamIdleTimeout time.Duration
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish on shutdown
+	ShutdownTimeout time.Duration
+
+	// WarmupConnections is the number of upstream connections opened in the
+	// background at startup, bounded by WarmupTimeout; zero disables warmup
+	WarmupConnections int
+	WarmupTimeout     time.Duration
+
+	// CorrelationIDHeader is the request header carrying the correlation ID assigned
+	// by the calling gateway. It is logged, echoed in the response and forwarded upstream.
+	CorrelationIDHeader string
+
+	// RegionHeaders are response headers checked, in order, for the Azure region that served a request
+	RegionHeaders []string
+
+	// HeaderRenames copies incoming request headers to differently named upstream
+	// headers, e.g. api-key to Ocp-Apim-Subscription-Key. RemoveRenamedHeaders drops
+	// the original header once it has been copied.
+	HeaderRenames        map[string]string
+	RemoveRenamedHeaders bool
+
+	// PathPattern is a regular expression incoming paths must match, e.g.
+	// "^/openai/deployments/[^/]+/"; empty disables path validation
+	PathPattern string
+
+	// OpenAIPaths accepts the paths of the OpenAI API, such as /v1/chat/completions, and
+	// rewrites them to those of Azure OpenAI, for the deployment named by the model of
+	// the body. Requests without an api-version get OpenAIPathsAPIVersion.
+	OpenAIPaths           bool
+	OpenAIPathsAPIVersion string
+
+	// MaxRequestBodySize rejects larger request bodies with 413; zero means no limit
+	MaxRequestBodySize int64
+
+	// Routes override UpstreamTimeout, MaxRequestBodySize and body logging for
+	// requests to matching paths
+	Routes []Route
+
+	// Request bodies larger than MaxBufferedBodySize, or with one of the
+	// StreamingContentTypes, are forwarded without being buffered in memory
+	MaxBufferedBodySize   int64
+	StreamingContentTypes []string
+
+	// DecompressRequests forwards gzip or deflate request bodies decompressed; they are
+	// always decompressed for logging
+	DecompressRequests bool
+
+	// MinifyRequests forwards JSON request bodies with insignificant whitespace removed
+	MinifyRequests bool
+
+	// AllowedMethods lists the HTTP methods the proxy forwards, others are rejected with 405
+	AllowedMethods []string
+
+	// SystemPrompt is injected into chat requests; SystemPromptMode is "default"
+	// (only when the request has no system message) or "enforce" (always)
+	SystemPrompt     string
+	SystemPromptMode string
+
+	// Seed is injected into chat requests without one, for SeedDeployments only when
+	// set: an integer, or "client" to derive a stable seed from the client ID.
+	// ClientSeeds sets the seed of specific clients.
+	Seed            string
+	ClientSeeds     map[string]int
+	SeedDeployments []string
+
+	// JSONModeDeployments must answer chat requests with JSON: response_format is set
+	// to json_object unless the request already asks for JSON. A different format is
+	// replaced, or rejected when JSONModeConflicts is "reject".
+	JSONModeDeployments []string
+	JSONModeConflicts   string
+
+	// Adaptive rate limiting is enabled when AdaptiveRateInitial (requests per second) is non-zero
+	AdaptiveRateInitial  float64
+	AdaptiveRateMin      float64
+	AdaptiveRateMax      float64
+	AdaptiveRateIncrease float64
+	AdaptiveRateDecrease float64
+	AdaptiveRateInterval time.Duration
+
+	// ClientConcurrency caps the in-flight requests of each client, overridden per client
+	// ID by ClientConcurrencyLimits; zero means unlimited. ConcurrencyMode is "reject"
+	// to answer 429 at the limit or "queue" to wait up to ConcurrencyQueueTimeout for a slot.
+	ClientConcurrency       int
+	ClientConcurrencyLimits map[string]int
+	ConcurrencyMode         string
+	ConcurrencyQueueTimeout time.Duration
+
+	// QuotaReserveTokens rejects requests to a deployment with 429 while the last
+	// x-ratelimit-remaining-tokens Azure reported for it, no older than QuotaStaleAfter,
+	// is below this many tokens; zero disables it
+	QuotaReserveTokens int64
+	QuotaStaleAfter    time.Duration
+
+	// ShedLatencyTarget enables load shedding: new requests are rejected with 503 once
+	// the ShedLatencyPercentile of response latencies over ShedWindow has exceeded it,
+	// with at least ShedQueueDepth requests in flight, for ShedInterval
+	ShedLatencyTarget     time.Duration
+	ShedLatencyPercentile float64
+	ShedQueueDepth        int
+	ShedInterval          time.Duration
+	ShedWindow            time.Duration
+
+	// MetricsPath is where Prometheus metrics are served, empty disables the endpoint
+	MetricsPath string
+
+	// ResponseMetricLabels maps label names to dot-separated response fields whose values
+	// label proxy_requests_total, e.g. finish_reason=choices.finish_reason.
+	// ResponseMetricLabelValues lists each label's allowed values separated by "|"; other
+	// values are counted as "other"
+	ResponseMetricLabels      map[string]string
+	ResponseMetricLabelValues map[string]string
+
+	// MetricTags are the client key tags that label proxy_requests_total, so traffic
+	// can be charged back by team or cost center
+	MetricTags []string
+
+	// RuntimeCheckInterval is how often the goroutine count is checked for leaks, warning
+	// above GoroutineWarnThreshold or after sustained growth; zero disables the check
+	RuntimeCheckInterval   time.Duration
+	GoroutineWarnThreshold int
+
+	// CoalesceWindow lets identical completion requests sent with "X-Coalesce: true" share an
+	// upstream call that started at most this long ago; zero disables coalescing
+	CoalesceWindow time.Duration
+
+	// LogAttempts records every upstream attempt (e.g. hedged duplicates) in the log entry
+	LogAttempts bool
+
+	// APIVersion is the api-version requests without one are sent with, and with
+	// APIVersionForce the one every request is sent with; empty leaves them unchanged
+	APIVersion      string
+	APIVersionForce bool
+
+	// APIVersionUpgrade retries requests with this api-version when Azure answers an
+	// older one with a 400 or 404 whose body matches APIVersionUpgradePattern; empty disables it
+	APIVersionUpgrade        string
+	APIVersionUpgradePattern string
+
+	// HedgeDelay sends a duplicate of requests that haven't been answered after this
+	// long and uses whichever response arrives first; zero disables hedging. Only
+	// completions, embeddings and idempotent requests are hedged, and may be billed twice.
+	HedgeDelay time.Duration
+
+	// CacheBackend selects the response cache: "" (disabled), "memory" or "redis"
+	CacheBackend    string
+	CacheTTL        time.Duration
+	CacheMaxEntries int
+
+	// SemanticCacheDeployment is an embeddings deployment enabling semantic caching:
+	// requests missing the cache are answered with the cached response to a prompt whose
+	// embedding has at least SemanticCacheThreshold cosine similarity. Each scope keeps
+	// the SemanticCacheMaxCandidates most recent prompts.
+	SemanticCacheDeployment    string
+	SemanticCacheAPIVersion    string
+	SemanticCacheThreshold     float64
+	SemanticCacheMaxCandidates int
+	RedisAddr                  string
+	RedisPassword              string
+	RedisDB                    int
+	RedisTLS                   bool
+
+	// MaxToolCallRounds logs a warning when a task's tool-calling flow goes beyond this many rounds; zero disables the warning
+	MaxToolCallRounds int
+
+	// TaskRetention is how long per-task totals (grouped by X-Task-ID) are kept after a task's last request
+	TaskRetention time.Duration
+
+	// ModelContextLimits maps deployments/models to their context window in tokens.
+	// Prompts estimated to exceed it (at CharsPerToken characters per token) are
+	// rejected before forwarding; an empty map disables the check.
+	ModelContextLimits map[string]int
+	CharsPerToken      float64
+
+	// ModelAliases maps the model names clients use to deployments, e.g.
+	// gpt-4=my-gpt4o-deployment, in the deployment segment of paths and in the model
+	// field of request bodies
+	ModelAliases map[string]string
+
+	// ModelRoutes sends requests for a model, in the deployment segment of paths or the
+	// model field of request bodies, to a deployment on one of the backends, e.g.
+	// gpt-4o=east/gpt-4o-prod, or spreads them over several separated by "|", by the
+	// weights of their backends, e.g. gpt-4o=east/gpt-4o-prod|west/gpt-4o, or their own
+	// for canaries, e.g. gpt-4o=east/gpt-4o:95|east/gpt-4.1:5. A route naming just a
+	// backend keeps the model's name as deployment.
+	ModelRoutes map[string]string
+
+	// SizeRoutes reroutes large requests per deployment to deployments with bigger
+	// context windows or more capacity, e.g. gpt-4o=8000:gpt-4o-32k|32000:gpt-4o-128k.
+	// Thresholds are estimated prompt tokens, or body bytes with a "B" suffix.
+	SizeRoutes map[string]string
+
+	// DegradeDeployments maps premium deployments to cheaper fallbacks, e.g.
+	// gpt-4o=gpt-4o-mini. Requests from DegradeClients, or sent with X-Allow-Degrade: true,
+	// go to the fallback when the premium deployment is out of quota or throttled.
+	DegradeDeployments map[string]string
+
+	// FailoverDeployments renames deployments when their requests fail over to the
+	// fallback of their backend, e.g. gpt-4o-ptu=gpt-4o for a pay-as-you-go fallback
+	// whose deployment is named differently. Others keep their name.
+	FailoverDeployments map[string]string
+	DegradeClients      []string
+
+	// NoStreamClients, and requests carrying NoStreamHeader set to true, get streaming
+	// requests sent upstream without stream and the complete response returned at once,
+	// for clients behind intermediaries that buffer event streams
+	NoStreamClients []string
+	NoStreamHeader  string
+
+	// ContentSafetyEndpoint enables screening prompts with Azure AI Content Safety before
+	// forwarding them, for ContentSafetyDeployments only when set. Requests reaching a
+	// ContentSafetyThresholds severity in any category are blocked; if the check fails
+	// they are forwarded when ContentSafetyFailOpen is set and blocked otherwise.
+	ContentSafetyEndpoint    string
+	ContentSafetyKey         string
+	ContentSafetyThresholds  map[string]int
+	ContentSafetyDeployments []string
+	ContentSafetyTimeout     time.Duration
+	ContentSafetyFailOpen    bool
+
+	// RequestFieldPolicy is "" (disabled), "deny" (reject requests containing any of
+	// RequestFields) or "allow" (reject requests containing any other field). Fields
+	// are dot-separated paths such as "logit_bias" or "response_format.type".
+	RequestFieldPolicy string
+	RequestFields      []string
+
+	// StreamMergeChunks and StreamMergeWindow coarsen streamed chat responses by merging
+	// consecutive content chunks, up to this many upstream chunks or for this long;
+	// both zero disables merging
+	StreamMergeChunks int
+	StreamMergeWindow time.Duration
+
+	// StripResponseFields are removed, at any depth, from responses before they are
+	// returned to clients (they are still logged). Stripping is limited to
+	// StripResponseDeployments and StripResponseClients when either is set.
+	StripResponseFields      []string
+	StripResponseDeployments []string
+	StripResponseClients     []string
+
+	// ClientBudgets caps spend per client ID, as "amount" or "amount/period" with a
+	// daily, weekly or monthly (default) period. Spend is computed from ModelPrices,
+	// "prompt:completion" prices per 1,000 tokens, and persisted to BudgetFilePath.
+	ClientBudgets  map[string]string
+	ModelPrices    map[string]string
+	BudgetFilePath string
+
+	// StatsInterval enables a periodic summary log line when non-zero
+	StatsInterval time.Duration
+
+	// SchemaFilePath enables inferring request/response schemas per path, written to this file on shutdown
+	SchemaFilePath string
+
+	// DeadLetterFilePath enables writing failed requests to a replayable file when set
+	DeadLetterFilePath string
+
+	// FeatureFlags roll out experimental behaviors, as "on", "off" or a percentage of
+	// clients per flag name, or per "name@deployment" for a single deployment
+	FeatureFlags map[string]string
+
+	// parseErrors are the values that could not be parsed, reported by Validate
+	parseErrors []error
 }
 
 // NewDefaultConfig returns a config with values from environment variables or defaults
 func NewDefaultConfig() *Config {
-	return &Config{
-		AzureOpenAIEndpoint: getEnvOrDefault("AZURE_OPENAI_ENDPOINT", "your-deployment.openai.azure.com/"),
-		ListenAddr:          getEnvOrDefault("LISTEN_ADDR", ":8080"),
-		LogFilePath:         getEnvOrDefault("LOG_FILE_PATH", "openai_proxy.json"),
-		APIKey:              getEnvOrDefault("PROXY_API_KEY", ""),
+	return newConfig(&source{})
+}
+
+// newConfig returns a config with values from src or defaults
+func newConfig(src *source) *Config {
+	cfg := &Config{
+		AzureOpenAIEndpoint:        src.getEnvOrDefault("AZURE_OPENAI_ENDPOINT", "your-deployment.openai.azure.com/"),
+		Upstreams:                  src.getEnvIntMapOrDefault("UPSTREAMS", nil),
+		Backends:                   src.getBackends(),
+		LoadBalancing:              src.getEnvOrDefault("LOAD_BALANCING", "round-robin"),
+		LatencyRouting:             src.getEnvBoolOrDefault("LATENCY_ROUTING", false),
+		LatencyRoutingMargin:       src.getEnvFloatOrDefault("LATENCY_ROUTING_MARGIN", 0.2),
+		ListenAddr:                 src.getEnvOrDefault("LISTEN_ADDR", ":8080"),
+		LogFilePath:                src.getEnvOrDefault("LOG_FILE_PATH", "openai_proxy.json"),
+		APIKey:                     src.getEnvOrDefault("PROXY_API_KEY", ""),
+		ClientKeys:                 src.getClientKeys(),
+		ClientKeysFile:             src.getEnvOrDefault("PROXY_API_KEYS_FILE", ""),
+		VirtualKeysFile:            src.getEnvOrDefault("VIRTUAL_KEYS_FILE", ""),
+		KeyExpiryWarningDays:       src.getEnvInt64OrDefault("KEY_EXPIRY_WARNING_DAYS", 14),
+		IPAllowlist:                src.getEnvListOrDefault("IP_ALLOWLIST", nil),
+		IPDenylist:                 src.getEnvListOrDefault("IP_DENYLIST", nil),
+		AdminIPAllowlist:           src.getEnvListOrDefault("ADMIN_IP_ALLOWLIST", nil),
+		AdminIPDenylist:            src.getEnvListOrDefault("ADMIN_IP_DENYLIST", nil),
+		JWTIssuer:                  src.getEnvOrDefault("JWT_ISSUER", ""),
+		JWTAudiences:               src.getEnvListOrDefault("JWT_AUDIENCE", nil),
+		JWTClientClaims:            src.getEnvListOrDefault("JWT_CLIENT_CLAIMS", []string{"azp", "appid", "sub"}),
+		JWTJWKSURL:                 src.getEnvOrDefault("JWT_JWKS_URL", ""),
+		HMACSecrets:                src.getHMACSecrets(),
+		HMACMaxSkew:                src.getEnvDurationOrDefault("HMAC_MAX_SKEW", 5*time.Minute),
+		TLSCertFile:                src.getEnvOrDefault("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 src.getEnvOrDefault("TLS_KEY_FILE", ""),
+		TLSClientCAFile:            src.getEnvOrDefault("TLS_CLIENT_CA_FILE", ""),
+		TLSClientAuth:              src.getEnvOrDefault("TLS_CLIENT_AUTH", "require"),
+		TLSClientIdentities:        src.getEnvMapOrDefault("TLS_CLIENT_IDENTITIES", nil),
+		SPIFFEIdentities:           src.getSPIFFEIdentities(),
+		AdminAPIKey:                src.getEnvOrDefault("ADMIN_API_KEY", ""),
+		AzureOpenAIAPIKey:          src.getEnvOrDefault("AZURE_OPENAI_API_KEY", ""),
+		AzureOpenAIAuth:            src.getEnvOrDefault("AZURE_OPENAI_AUTH", "api-key"),
+		AzureOpenAITokenScope:      src.getEnvOrDefault("AZURE_OPENAI_TOKEN_SCOPE", "https://cognitiveservices.azure.com/.default"),
+		OBOTenantID:                src.getEnvOrDefault("OBO_TENANT_ID", src.getEnvOrDefault("AZURE_TENANT_ID", "")),
+		OBOClientID:                src.getEnvOrDefault("OBO_CLIENT_ID", src.getEnvOrDefault("AZURE_CLIENT_ID", "")),
+		OBOClientSecret:            src.getEnvOrDefault("OBO_CLIENT_SECRET", src.getEnvOrDefault("AZURE_CLIENT_SECRET", "")),
+		KeyVaultURL:                src.getEnvOrDefault("KEY_VAULT_URL", ""),
+		KeyVaultRefreshInterval:    src.getEnvDurationOrDefault("KEY_VAULT_REFRESH_INTERVAL", time.Hour),
+		AppConfigEndpoint:          src.getEnvOrDefault("APP_CONFIG_ENDPOINT", ""),
+		AppConfigKeyPrefix:         src.getEnvOrDefault("APP_CONFIG_KEY_PREFIX", "proxy:"),
+		AppConfigLabel:             src.getEnvOrDefault("APP_CONFIG_LABEL", ""),
+		AppConfigSentinelKey:       src.getEnvOrDefault("APP_CONFIG_SENTINEL_KEY", ""),
+		AppConfigPollInterval:      src.getEnvDurationOrDefault("APP_CONFIG_POLL_INTERVAL", 30*time.Second),
+		AuditLogPath:               src.getEnvOrDefault("AUDIT_LOG_PATH", ""),
+		LogLevel:                   src.getEnvOrDefault("LOG_LEVEL", "info"),
+		LogSampleRate:              src.getEnvFloatOrDefault("LOG_SAMPLE_RATE", 1),
+		Profile:                    src.getEnvOrDefault("PROFILE", ""),
+		LogBodies:                  src.getEnvBoolOrDefault("LOG_BODIES", true),
+		ClientLogSampling:          src.getEnvMapOrDefault("CLIENT_LOG_SAMPLING", nil),
+		LogDedupErrors:             src.getEnvBoolOrDefault("LOG_DEDUP_ERRORS", false),
+		LogDedupWindow:             src.getEnvDurationOrDefault("LOG_DEDUP_WINDOW", 10*time.Second),
+		DebugLogClients:            src.getEnvListOrDefault("DEBUG_LOG_CLIENTS", nil),
+		SSEDumpDir:                 src.getEnvOrDefault("SSE_DUMP_DIR", ""),
+		SSEDumpDeployments:         src.getEnvListOrDefault("SSE_DUMP_DEPLOYMENTS", nil),
+		LogTimestampFormat:         src.getEnvOrDefault("LOG_TIMESTAMP_FORMAT", "RFC3339Nano"),
+		LogTimezone:                src.getEnvOrDefault("LOG_TIMEZONE", "UTC"),
+		LogEncryptionKey:           src.getEnvOrDefault("LOG_ENCRYPTION_KEY", ""),
+		LogEncryptionKeyFile:       src.getEnvOrDefault("LOG_ENCRYPTION_KEY_FILE", ""),
+		ReadTimeout:                src.getEnvDurationOrDefault("READ_TIMEOUT", 5*time.Minute),
+		ReadHeaderTimeout:          src.getEnvDurationOrDefault("READ_HEADER_TIMEOUT", 10*time.Second),
+		WriteTimeout:               src.getEnvDurationOrDefault("WRITE_TIMEOUT", 0),
+		IdleTimeout:                src.getEnvDurationOrDefault("IDLE_TIMEOUT", 2*time.Minute),
+		UpstreamTimeout:            src.getEnvDurationOrDefault("UPSTREAM_TIMEOUT", 0),
+		DeadlineHeader:             src.getEnvOrDefault("DEADLINE_HEADER", "X-Deadline"),
+		StreamIdleTimeout:          src.getEnvDurationOrDefault("STREAM_IDLE_TIMEOUT", 0),
+		ShutdownTimeout:            src.getEnvDurationOrDefault("SHUTDOWN_TIMEOUT", 30*time.Second),
+		WarmupConnections:          int(src.getEnvInt64OrDefault("WARMUP_CONNECTIONS", 0)),
+		WarmupTimeout:              src.getEnvDurationOrDefault("WARMUP_TIMEOUT", 5*time.Second),
+		CorrelationIDHeader:        src.getEnvOrDefault("CORRELATION_ID_HEADER", "X-Correlation-ID"),
+		RegionHeaders:              src.getEnvListOrDefault("REGION_HEADERS", []string{"x-ms-region"}),
+		HeaderRenames:              src.getEnvMapOrDefault("HEADER_RENAMES", nil),
+		RemoveRenamedHeaders:       src.getEnvBoolOrDefault("REMOVE_RENAMED_HEADERS", false),
+		PathPattern:                src.getEnvOrDefault("PATH_PATTERN", ""),
+		OpenAIPaths:                src.getEnvBoolOrDefault("OPENAI_PATHS", false),
+		OpenAIPathsAPIVersion:      src.getEnvOrDefault("OPENAI_PATHS_API_VERSION", "2024-10-21"),
+		MaxRequestBodySize:         src.getEnvInt64OrDefault("MAX_REQUEST_BODY_SIZE", 0),
+		Routes:                     src.getRoutes(),
+		MaxBufferedBodySize:        src.getEnvInt64OrDefault("MAX_BUFFERED_BODY_SIZE", 10<<20),
+		StreamingContentTypes:      src.getEnvListOrDefault("STREAMING_CONTENT_TYPES", []string{"multipart/form-data", "application/octet-stream", "audio/", "video/"}),
+		DecompressRequests:         src.getEnvBoolOrDefault("DECOMPRESS_REQUESTS", false),
+		MinifyRequests:             src.getEnvBoolOrDefault("MINIFY_REQUESTS", false),
+		AllowedMethods:             src.getEnvListOrDefault("ALLOWED_METHODS", []string{http.MethodGet, http.MethodPost, http.MethodDelete}),
+		SystemPrompt:               src.getEnvOrDefault("SYSTEM_PROMPT", ""),
+		SystemPromptMode:           src.getEnvOrDefault("SYSTEM_PROMPT_MODE", "default"),
+		Seed:                       src.getEnvOrDefault("SEED", ""),
+		ClientSeeds:                src.getEnvIntMapOrDefault("CLIENT_SEEDS", nil),
+		SeedDeployments:            src.getEnvListOrDefault("SEED_DEPLOYMENTS", nil),
+		JSONModeDeployments:        src.getEnvListOrDefault("JSON_MODE_DEPLOYMENTS", nil),
+		JSONModeConflicts:          src.getEnvOrDefault("JSON_MODE_CONFLICTS", "override"),
+		AdaptiveRateInitial:        src.getEnvFloatOrDefault("ADAPTIVE_RATE_INITIAL", 0),
+		AdaptiveRateMin:            src.getEnvFloatOrDefault("ADAPTIVE_RATE_MIN", 1),
+		AdaptiveRateMax:            src.getEnvFloatOrDefault("ADAPTIVE_RATE_MAX", 100),
+		AdaptiveRateIncrease:       src.getEnvFloatOrDefault("ADAPTIVE_RATE_INCREASE", 1),
+		AdaptiveRateDecrease:       src.getEnvFloatOrDefault("ADAPTIVE_RATE_DECREASE", 0.5),
+		AdaptiveRateInterval:       src.getEnvDurationOrDefault("ADAPTIVE_RATE_INTERVAL", 10*time.Second),
+		ClientConcurrency:          int(src.getEnvInt64OrDefault("CLIENT_CONCURRENCY", 0)),
+		ClientConcurrencyLimits:    src.getEnvIntMapOrDefault("CLIENT_CONCURRENCY_LIMITS", nil),
+		ConcurrencyMode:            src.getEnvOrDefault("CONCURRENCY_MODE", "reject"),
+		ConcurrencyQueueTimeout:    src.getEnvDurationOrDefault("CONCURRENCY_QUEUE_TIMEOUT", 30*time.Second),
+		QuotaReserveTokens:         src.getEnvInt64OrDefault("QUOTA_RESERVE_TOKENS", 0),
+		QuotaStaleAfter:            src.getEnvDurationOrDefault("QUOTA_STALE_AFTER", 10*time.Second),
+		ShedLatencyTarget:          src.getEnvDurationOrDefault("SHED_LATENCY_TARGET", 0),
+		ShedLatencyPercentile:      src.getEnvFloatOrDefault("SHED_LATENCY_PERCENTILE", 0.95),
+		ShedQueueDepth:             int(src.getEnvInt64OrDefault("SHED_QUEUE_DEPTH", 0)),
+		ShedInterval:               src.getEnvDurationOrDefault("SHED_INTERVAL", 5*time.Second),
+		ShedWindow:                 src.getEnvDurationOrDefault("SHED_WINDOW", 30*time.Second),
+		MetricsPath:                src.getEnvOrDefault("METRICS_PATH", "/metrics"),
+		ResponseMetricLabels:       src.getEnvMapOrDefault("RESPONSE_METRIC_LABELS", nil),
+		ResponseMetricLabelValues:  src.getEnvMapOrDefault("RESPONSE_METRIC_LABEL_VALUES", nil),
+		MetricTags:                 src.getEnvListOrDefault("METRIC_TAGS", nil),
+		RuntimeCheckInterval:       src.getEnvDurationOrDefault("RUNTIME_CHECK_INTERVAL", time.Minute),
+		GoroutineWarnThreshold:     int(src.getEnvInt64OrDefault("GOROUTINE_WARN_THRESHOLD", 10000)),
+		CoalesceWindow:             src.getEnvDurationOrDefault("COALESCE_WINDOW", 0),
+		LogAttempts:                src.getEnvBoolOrDefault("LOG_ATTEMPTS", false),
+		APIVersion:                 src.getEnvOrDefault("API_VERSION", ""),
+		APIVersionForce:            src.getEnvBoolOrDefault("API_VERSION_FORCE", false),
+		APIVersionUpgrade:          src.getEnvOrDefault("API_VERSION_UPGRADE", ""),
+		APIVersionUpgradePattern:   src.getEnvOrDefault("API_VERSION_UPGRADE_PATTERN", `(?i)(api[- ]version|not supported|unsupported|requires a newer)`),
+		HedgeDelay:                 src.getEnvDurationOrDefault("HEDGE_DELAY", 0),
+		CacheBackend:               src.getEnvOrDefault("CACHE_BACKEND", ""),
+		CacheTTL:                   src.getEnvDurationOrDefault("CACHE_TTL", 5*time.Minute),
+		CacheMaxEntries:            int(src.getEnvInt64OrDefault("CACHE_MAX_ENTRIES", 1000)),
+		SemanticCacheDeployment:    src.getEnvOrDefault("SEMANTIC_CACHE_DEPLOYMENT", ""),
+		SemanticCacheAPIVersion:    src.getEnvOrDefault("SEMANTIC_CACHE_API_VERSION", "2024-02-01"),
+		SemanticCacheThreshold:     src.getEnvFloatOrDefault("SEMANTIC_CACHE_THRESHOLD", 0.95),
+		SemanticCacheMaxCandidates: int(src.getEnvInt64OrDefault("SEMANTIC_CACHE_MAX_CANDIDATES", 100)),
+		RedisAddr:                  src.getEnvOrDefault("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:              src.getEnvOrDefault("REDIS_PASSWORD", ""),
+		RedisDB:                    int(src.getEnvInt64OrDefault("REDIS_DB", 0)),
+		RedisTLS:                   src.getEnvBoolOrDefault("REDIS_TLS", false),
+		MaxToolCallRounds:          int(src.getEnvInt64OrDefault("MAX_TOOL_CALL_ROUNDS", 0)),
+		TaskRetention:              src.getEnvDurationOrDefault("TASK_RETENTION", time.Hour),
+		ModelContextLimits:         src.getEnvIntMapOrDefault("MODEL_CONTEXT_LIMITS", nil),
+		SizeRoutes:                 src.getEnvMapOrDefault("SIZE_ROUTES", nil),
+		DegradeDeployments:         src.getEnvMapOrDefault("DEGRADE_DEPLOYMENTS", nil),
+		FailoverDeployments:        src.getEnvMapOrDefault("FAILOVER_DEPLOYMENTS", nil),
+		ModelAliases:               src.getEnvMapOrDefault("MODEL_ALIASES", nil),
+		ModelRoutes:                src.getEnvMapOrDefault("MODEL_ROUTES", nil),
+		DegradeClients:             src.getEnvListOrDefault("DEGRADE_CLIENTS", nil),
+		NoStreamClients:            src.getEnvListOrDefault("NO_STREAM_CLIENTS", nil),
+		NoStreamHeader:             src.getEnvOrDefault("NO_STREAM_HEADER", "X-No-Streaming"),
+		CharsPerToken:              src.getEnvFloatOrDefault("CHARS_PER_TOKEN", 4),
+		ContentSafetyEndpoint:      src.getEnvOrDefault("CONTENT_SAFETY_ENDPOINT", ""),
+		ContentSafetyKey:           src.getEnvOrDefault("CONTENT_SAFETY_KEY", ""),
+		ContentSafetyThresholds:    src.getEnvIntMapOrDefault("CONTENT_SAFETY_THRESHOLDS", map[string]int{"Hate": 4, "SelfHarm": 4, "Sexual": 4, "Violence": 4}),
+		ContentSafetyDeployments:   src.getEnvListOrDefault("CONTENT_SAFETY_DEPLOYMENTS", nil),
+		ContentSafetyTimeout:       src.getEnvDurationOrDefault("CONTENT_SAFETY_TIMEOUT", 5*time.Second),
+		ContentSafetyFailOpen:      src.getEnvBoolOrDefault("CONTENT_SAFETY_FAIL_OPEN", false),
+		RequestFieldPolicy:         src.getEnvOrDefault("REQUEST_FIELD_POLICY", ""),
+		RequestFields:              src.getEnvListOrDefault("REQUEST_FIELDS", nil),
+		StreamMergeChunks:          int(src.getEnvInt64OrDefault("STREAM_MERGE_CHUNKS", 0)),
+		StreamMergeWindow:          src.getEnvDurationOrDefault("STREAM_MERGE_WINDOW", 0),
+		StripResponseFields:        src.getEnvListOrDefault("STRIP_RESPONSE_FIELDS", nil),
+		StripResponseDeployments:   src.getEnvListOrDefault("STRIP_RESPONSE_DEPLOYMENTS", nil),
+		StripResponseClients:       src.getEnvListOrDefault("STRIP_RESPONSE_CLIENTS", nil),
+		ClientBudgets:              src.getEnvMapOrDefault("CLIENT_BUDGETS", nil),
+		ModelPrices:                src.getEnvMapOrDefault("MODEL_PRICES", nil),
+		BudgetFilePath:             src.getEnvOrDefault("BUDGET_FILE_PATH", "budgets.json"),
+		StatsInterval:              src.getEnvDurationOrDefault("STATS_INTERVAL", 0),
+		SchemaFilePath:             src.getEnvOrDefault("SCHEMA_FILE_PATH", ""),
+		DeadLetterFilePath:         src.getEnvOrDefault("DEAD_LETTER_FILE_PATH", ""),
+		FeatureFlags:               src.getEnvMapOrDefault("FEATURE_FLAGS", nil),
 	}
+	cfg.parseErrors = src.errs
+	return cfg
 }
 
-// getEnvOrDefault returns the value of the environment variable or the default if not set
-func getEnvOrDefault(key, defaultVal string) string {
-	if val, ok := os.LookupEnv(key); ok && val != "" {
+// getEnvOrDefault returns the value of the environment variable, else of the setting in
+// the config file, or the default if neither is set. Overridden settings ignore the
+// environment.
+func (src *source) getEnvOrDefault(key, defaultVal string) string {
+	fileVal, _ := src.lookup(key)
+	if val, ok := os.LookupEnv(key); ok && val != "" && !src.overridden[key] {
 		return val
 	}
+	if fileVal != "" {
+		return fileVal
+	}
 	return defaultVal
 }
+
+// getEnvInt64OrDefault returns the environment variable parsed as an int64, or the default if not set.
+// Invalid values are reported by Validate.
+func (src *source) getEnvInt64OrDefault(key string, defaultVal int64) int64 {
+	val := src.getEnvOrDefault(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		src.invalid("%s %q is not an integer", key, val)
+		return defaultVal
+	}
+	return n
+}
+
+// getEnvBoolOrDefault returns the environment variable parsed as a bool, or the default if not set.
+// Invalid values are reported by Validate.
+func (src *source) getEnvBoolOrDefault(key string, defaultVal bool) bool {
+	val := src.getEnvOrDefault(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		src.invalid("%s %q is not a boolean, expected true or false", key, val)
+		return defaultVal
+	}
+	return b
+}
+
+// getEnvFloatOrDefault returns the environment variable parsed as a float64, or the default if not set.
+// Invalid values are reported by Validate.
+func (src *source) getEnvFloatOrDefault(key string, defaultVal float64) float64 {
+	val := src.getEnvOrDefault(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		src.invalid("%s %q is not a number", key, val)
+		return defaultVal
+	}
+	return f
+}
+
+// getEnvDurationOrDefault returns the environment variable parsed as a duration (e.g. "30s"), or the default if not set.
+// Invalid values are reported by Validate.
+func (src *source) getEnvDurationOrDefault(key string, defaultVal time.Duration) time.Duration {
+	val := src.getEnvOrDefault(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		src.invalid("%s %q is not a duration such as 30s", key, val)
+		return defaultVal
+	}
+	return d
+}
+
+// getEnvMapOrDefault returns a comma-separated list of key=value pairs as a map, or the default if not set
+func (src *source) getEnvMapOrDefault(key string, defaultVal map[string]string) map[string]string {
+	list := src.getEnvListOrDefault(key, nil)
+	if list == nil {
+		return defaultVal
+	}
+	m := make(map[string]string, len(list))
+	for _, item := range list {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Printf("Warning: ignoring malformed entry %q in %s, expected key=value", item, key)
+			continue
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m
+}
+
+// getEnvIntMapOrDefault returns a comma-separated list of key=integer pairs as a map, or the default if not set.
+// Invalid values are reported by Validate.
+func (src *source) getEnvIntMapOrDefault(key string, defaultVal map[string]int) map[string]int {
+	pairs := src.getEnvMapOrDefault(key, nil)
+	if pairs == nil {
+		return defaultVal
+	}
+	m := make(map[string]int, len(pairs))
+	for k, v := range pairs {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			src.invalid("%s has value %q for %s, which is not an integer", key, v, k)
+			continue
+		}
+		m[k] = n
+	}
+	return m
+}
+
+// getEnvListOrDefault returns the comma-separated environment variable as a slice, or the default if not set
+func (src *source) getEnvListOrDefault(key string, defaultVal []string) []string {
+	val := src.getEnvOrDefault(key, "")
+	if val == "" {
+		return defaultVal
+	}
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
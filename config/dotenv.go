@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// defaultEnvFile is the .env file read when ENV_FILE is not set
+const defaultEnvFile = ".env"
+
+// LoadEnvFile sets the environment variables of the .env file named by ENV_FILE, or
+// .env in the working directory, that are not set already. A missing file is not an
+// error and an empty ENV_FILE reads none. It returns the path of the file read, empty
+// if there was none.
+func LoadEnvFile() (string, error) {
+	path, ok := os.LookupEnv("ENV_FILE")
+	if !ok {
+		path = defaultEnvFile
+	}
+	if path == "" {
+		return "", nil
+	}
+
+	vars, err := readEnvFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for key, value := range vars {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return "", fmt.Errorf("failed to set %s from %s: %v", key, path, err)
+		}
+	}
+	return path, nil
+}
+
+// readEnvFile parses a .env file of KEY=value lines. Lines may start with "export",
+// blank lines and lines starting with # are skipped, and values may be quoted: single
+// quotes keep the value as is, double quotes allow \n, \" and \\ escapes. Unquoted
+// values end at a " #" comment.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, lineNumber)
+		}
+		value, err := envValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, lineNumber, key, err)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return vars, nil
+}
+
+// envValue unquotes the value of a .env line
+func envValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch quote := value[0]; quote {
+	case '\'', '"':
+		end := strings.LastIndexByte(value, quote)
+		if end == 0 {
+			return "", fmt.Errorf("missing closing quote")
+		}
+		if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after closing quote", rest)
+		}
+		value = value[1:end]
+		if quote == '"' {
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value)
+		}
+		return value, nil
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
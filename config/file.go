@@ -0,0 +1,344 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// source supplies the settings of a config file. Settings are named like the
+// environment variables, in any case, e.g. listen_addr for LISTEN_ADDR. Lists are
+// arrays and maps are tables/mappings; both may also be given in their environment
+// variable form as a single string. Settings such as BACKENDS may also be lists of
+// tables, which have no environment variable form.
+type source struct {
+	values     map[string]string              // by upper-case environment variable name
+	tables     map[string][]map[string]string // lists of tables, by upper-case name
+	overridden map[string]bool                // settings that take precedence over the environment
+	remote     map[string]bool                // settings from remote configuration
+	used       map[string]bool
+	errs       []error // values that could not be parsed
+}
+
+// invalid records a value that could not be parsed
+func (src *source) invalid(format string, args ...interface{}) {
+	src.errs = append(src.errs, fmt.Errorf(format, args...))
+}
+
+// lookup returns the value of a setting from the config file
+func (src *source) lookup(key string) (string, bool) {
+	if src.used == nil {
+		src.used = make(map[string]bool)
+	}
+	src.used[key] = true
+	val, ok := src.values[key]
+	return val, ok
+}
+
+// Load returns a config with values from environment variables, else from the YAML
+// (.yaml, .yml) or TOML (.toml) file at path, or defaults
+func Load(path string) (*Config, error) {
+	return LoadSources(Sources{Path: path})
+}
+
+// Sources are the layers of settings besides environment variables, from lowest to
+// highest precedence
+type Sources struct {
+	// Path is the config file, none if empty
+	Path string
+
+	// Remote settings, such as those of Azure App Configuration, take precedence over
+	// the file but not over the environment
+	Remote map[string]interface{}
+
+	// Overrides, such as settings changed at runtime, take precedence over everything.
+	// Unknown overrides are an error rather than a warning.
+	Overrides map[string]interface{}
+}
+
+// LoadSources returns a config with values from the layers of sources and environment
+// variables, or defaults
+func LoadSources(sources Sources) (*Config, error) {
+	path, overrides := sources.Path, sources.Overrides
+	src := &source{
+		values:     make(map[string]string),
+		tables:     make(map[string][]map[string]string),
+		overridden: make(map[string]bool),
+		remote:     make(map[string]bool),
+	}
+	if path != "" {
+		doc, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := selectProfile(doc, overrides)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := src.add(doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := src.add(profile); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := src.add(sources.Remote); err != nil {
+		return nil, fmt.Errorf("remote configuration: %v", err)
+	}
+	for name := range sources.Remote {
+		src.remote[strings.ToUpper(name)] = true
+	}
+	if err := src.add(overrides); err != nil {
+		return nil, err
+	}
+	for name := range overrides {
+		src.overridden[strings.ToUpper(name)] = true
+	}
+
+	cfg := newConfig(src)
+	if cfg.ClientKeysFile != "" {
+		keys, err := readClientKeys(cfg.ClientKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientKeys = append(cfg.ClientKeys, keys...)
+	}
+	for _, key := range src.unused() {
+		if src.overridden[key] {
+			return nil, fmt.Errorf("unknown setting %s", strings.ToLower(key))
+		}
+		if src.remote[key] {
+			log.Printf("Warning: ignoring unknown setting %s in remote configuration", strings.ToLower(key))
+			continue
+		}
+		log.Printf("Warning: ignoring unknown setting %s in %s", strings.ToLower(key), path)
+	}
+	return cfg, nil
+}
+
+// readFile parses the YAML or TOML config file at path
+func readFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var doc map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("unsupported config file format %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return doc, nil
+}
+
+// selectProfile removes the profiles section from a config file's settings and returns
+// the settings of the selected profile, which are layered over the others. The profile
+// is selected by an override of PROFILE, else the environment variable, else the
+// file's profile setting.
+func selectProfile(doc, overrides map[string]interface{}) (map[string]interface{}, error) {
+	var profiles map[string]interface{}
+	var fileProfile string
+	for name, value := range doc {
+		switch strings.ToUpper(name) {
+		case "PROFILES":
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("profiles must map profile names to settings")
+			}
+			profiles = m
+			delete(doc, name)
+		case "PROFILE":
+			fileProfile, _ = value.(string)
+		}
+	}
+
+	profile := os.Getenv("PROFILE")
+	for name, value := range overrides {
+		if strings.EqualFold(name, "PROFILE") {
+			profile, _ = value.(string)
+		}
+	}
+	if profile == "" {
+		profile = fileProfile
+	}
+	if profile == "" {
+		return nil, nil
+	}
+
+	section, ok := profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not defined", profile)
+	}
+	settings, ok := section.(map[string]interface{})
+	if !ok && section != nil {
+		return nil, fmt.Errorf("profile %q must be a section of settings", profile)
+	}
+	return settings, nil
+}
+
+// add sets the settings of doc, replacing any earlier value of the same setting
+func (src *source) add(doc map[string]interface{}) error {
+	for name, value := range doc {
+		key := strings.ToUpper(name)
+		delete(src.values, key)
+		delete(src.tables, key)
+		if tables, ok := tableList(value); ok {
+			src.tables[key] = tables
+			continue
+		}
+		val, err := settingValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid setting %s: %v", name, err)
+		}
+		src.values[key] = val
+	}
+	return nil
+}
+
+// unused returns the settings of the file that no config field asked for, in order
+func (src *source) unused() []string {
+	var keys []string
+	for key := range src.values {
+		if !src.used[key] {
+			keys = append(keys, key)
+		}
+	}
+	for key := range src.tables {
+		if !src.used[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// settingValue converts a parsed setting to the string form of its environment variable
+func settingValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := listValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(v))
+		for _, key := range keys {
+			s, err := listValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			if strings.ContainsAny(key, ",=") {
+				return "", fmt.Errorf("key %q may not contain ',' or '='", key)
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return scalarValue(v)
+	}
+}
+
+// tableList converts a non-empty list of tables, with lower-case keys and scalar
+// values, lists of them, which are joined with commas, or maps of them, which become
+// comma-separated key=value pairs. It reports false for any other setting.
+func tableList(value interface{}) ([]map[string]string, bool) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, false
+	}
+	tables := make([]map[string]string, 0, len(list))
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		table := make(map[string]string, len(m))
+		for key, value := range m {
+			s, err := scalarValue(value)
+			switch v := value.(type) {
+			case []interface{}:
+				s, err = joinedList(v)
+			case map[string]interface{}:
+				s, err = settingValue(v)
+			}
+			if err != nil {
+				return nil, false
+			}
+			table[strings.ToLower(key)] = s
+		}
+		tables = append(tables, table)
+	}
+	return tables, true
+}
+
+// listValue formats a value inside a list or map. It may not contain commas, which
+// separate values in the environment variable form.
+func listValue(value interface{}) (string, error) {
+	s, err := scalarValue(value)
+	if err == nil && strings.Contains(s, ",") {
+		err = fmt.Errorf("value %q may not contain ','", s)
+	}
+	return s, err
+}
+
+// joinedList formats a list of scalars inside a table as a comma-separated value
+func joinedList(items []interface{}) (string, error) {
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, err := listValue(item)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, s)
+	}
+	return strings.Join(values, ","), nil
+}
+
+// scalarValue formats a string, number or boolean setting
+func scalarValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+	case time.Time:
+		// YAML reads unquoted dates such as api-versions as timestamps
+		if v.Equal(v.Truncate(24 * time.Hour)) {
+			return v.Format(time.DateOnly), nil
+		}
+		return v.Format(time.RFC3339Nano), nil
+	case []interface{}, map[string]interface{}:
+		return "", fmt.Errorf("nested lists and maps are not supported")
+	default:
+		return "", fmt.Errorf("unsupported value %v of type %T", v, v)
+	}
+}
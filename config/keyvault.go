@@ -0,0 +1,41 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+)
+
+// KeyVault fetches secrets from Azure Key Vault, authenticating with the default Azure
+// credential chain: environment variables, workload identity, managed identity or the
+// Azure CLI login
+type KeyVault struct {
+	client *azsecrets.Client
+}
+
+// NewKeyVault creates a provider for the vault at vaultURL, e.g. https://myvault.vault.azure.net/
+func NewKeyVault(vaultURL string) (*KeyVault, error) {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure credential: %v", err)
+	}
+	client, err := azsecrets.NewClient(vaultURL, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Key Vault client: %v", err)
+	}
+	return &KeyVault{client: client}, nil
+}
+
+// GetSecret returns the latest version of a secret
+func (k *KeyVault) GetSecret(ctx context.Context, name string) (string, error) {
+	resp, err := k.client.GetSecret(ctx, name, "", nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.Value == nil {
+		return "", fmt.Errorf("secret %q has no value", name)
+	}
+	return *resp.Value, nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ModelTarget is one of the deployments requests for a routed model are sent to
+type ModelTarget struct {
+	Backend    string
+	Deployment string
+
+	// Weight is the target's share of the model's requests, e.g. 95 and 5 for a canary.
+	// 0 uses the backend's weight.
+	Weight int
+}
+
+// String returns the target as backend/deployment
+func (t ModelTarget) String() string {
+	return t.Backend + "/" + t.Deployment
+}
+
+// ParseModelRoute parses the targets of a MODEL_ROUTES entry for model, separated by
+// "|", each backend[/deployment][:weight]. Targets without a deployment keep the
+// model's name. Only an integer after the last ":" is a weight, so deployments may be
+// named with tags such as llama3.1:8b.
+func ParseModelRoute(model, value string) ([]ModelTarget, error) {
+	var targets []ModelTarget
+	seen := map[string]bool{}
+	for _, spec := range strings.Split(value, "|") {
+		spec = strings.TrimSpace(spec)
+		target, weight := spec, ""
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			if _, err := strconv.Atoi(spec[i+1:]); err == nil {
+				target, weight = spec[:i], spec[i+1:]
+			}
+		}
+		name, deployment, _ := strings.Cut(target, "/")
+		if deployment == "" {
+			deployment = model
+		}
+		if name == "" || strings.Contains(deployment, "/") {
+			return nil, fmt.Errorf("target %q of %s is not backend/deployment", spec, model)
+		}
+		t := ModelTarget{Backend: name, Deployment: deployment}
+		if weight != "" {
+			n, _ := strconv.Atoi(weight)
+			if n <= 0 {
+				return nil, fmt.Errorf("target %q of %s has invalid weight %q, expected a positive integer", spec, model, weight)
+			}
+			t.Weight = n
+		}
+		if seen[t.String()] {
+			return nil, fmt.Errorf("%s is routed to %s more than once", model, t)
+		}
+		seen[t.String()] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
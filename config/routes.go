@@ -0,0 +1,101 @@
+package config
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Route overrides settings for requests whose path matches Pattern. Zero values and a
+// nil LogBodies keep the global setting.
+type Route struct {
+	// Pattern is a path pattern as accepted by path.Match, e.g.
+	// /openai/deployments/*/embeddings; a trailing /* also matches deeper paths
+	Pattern string
+
+	// Timeout replaces UpstreamTimeout
+	Timeout time.Duration
+
+	// LogBodies replaces the global LogBodies
+	LogBodies *bool
+
+	// MaxBodySize replaces MaxRequestBodySize
+	MaxBodySize int64
+
+	// LatencyRouting replaces the global LatencyRouting
+	LatencyRouting *bool
+}
+
+// routeKeys are the settings of a route table in the config file
+var routeKeys = map[string]bool{"pattern": true, "timeout": true, "log_bodies": true, "max_body_size": true, "latency_routing": true}
+
+// getRoutes returns the route overrides, ordered by pattern. The config file lists
+// them as tables under ROUTES; ROUTE_TIMEOUTS, ROUTE_LOG_BODIES, ROUTE_MAX_BODY_SIZES
+// and ROUTE_LATENCY_ROUTING map patterns to a single setting each and override the
+// tables.
+func (src *source) getRoutes() []Route {
+	src.lookup("ROUTES")
+	settings := make(map[string]map[string]string)
+	for _, table := range src.tables["ROUTES"] {
+		for key := range table {
+			if !routeKeys[key] {
+				log.Printf("Warning: ignoring unknown setting %s of route %q", key, table["pattern"])
+			}
+		}
+		settings[table["pattern"]] = table
+	}
+	for key, setting := range map[string]string{
+		"ROUTE_TIMEOUTS":        "timeout",
+		"ROUTE_LOG_BODIES":      "log_bodies",
+		"ROUTE_MAX_BODY_SIZES":  "max_body_size",
+		"ROUTE_LATENCY_ROUTING": "latency_routing",
+	} {
+		for pattern, value := range src.getEnvMapOrDefault(key, nil) {
+			if settings[pattern] == nil {
+				settings[pattern] = map[string]string{"pattern": pattern}
+			}
+			settings[pattern][setting] = value
+		}
+	}
+
+	routes := make([]Route, 0, len(settings))
+	for pattern, table := range settings {
+		route := Route{Pattern: pattern}
+		if value := table["timeout"]; value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				src.invalid("route %q has timeout %q, which is not a duration such as 30s", pattern, value)
+			} else {
+				route.Timeout = d
+			}
+		}
+		if value := table["log_bodies"]; value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				src.invalid("route %q has log_bodies %q, which is not a boolean", pattern, value)
+			} else {
+				route.LogBodies = &b
+			}
+		}
+		if value := table["max_body_size"]; value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				src.invalid("route %q has max_body_size %q, which is not an integer", pattern, value)
+			} else {
+				route.MaxBodySize = n
+			}
+		}
+		if value := table["latency_routing"]; value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				src.invalid("route %q has latency_routing %q, which is not a boolean", pattern, value)
+			} else {
+				route.LatencyRouting = &b
+			}
+		}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Pattern < routes[j].Pattern })
+	return routes
+}
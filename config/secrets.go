@@ -0,0 +1,90 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// secretPrefix marks a setting whose value is the name of a secret to fetch from the
+// secret provider, e.g. PROXY_API_KEY=keyvault:proxy-api-key
+const secretPrefix = "keyvault:"
+
+// SecretProvider fetches secrets by name from a secret store such as Azure Key Vault
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+// secretSettings returns the settings that may refer to a secret, by environment
+// variable name
+func (c *Config) secretSettings() map[string]*string {
+	settings := map[string]*string{
+		"AZURE_OPENAI_API_KEY": &c.AzureOpenAIAPIKey,
+		"PROXY_API_KEY":        &c.APIKey,
+		"ADMIN_API_KEY":        &c.AdminAPIKey,
+		"CONTENT_SAFETY_KEY":   &c.ContentSafetyKey,
+		"REDIS_PASSWORD":       &c.RedisPassword,
+		"OBO_CLIENT_SECRET":    &c.OBOClientSecret,
+	}
+	for i := range c.Backends {
+		settings[backendVar(c.Backends[i].Name, "API_KEY")] = &c.Backends[i].APIKey
+	}
+	for i := range c.ClientKeys {
+		settings[clientKeyVar(c.ClientKeys[i].Name)] = &c.ClientKeys[i].Key
+	}
+	for i := range c.HMACSecrets {
+		settings["HMAC_SECRETS secret of "+c.HMACSecrets[i].Client] = &c.HMACSecrets[i].Secret
+	}
+	return settings
+}
+
+// UsesSecrets reports whether any setting refers to a secret
+func (c *Config) UsesSecrets() bool {
+	for _, value := range c.secretSettings() {
+		if strings.HasPrefix(*value, secretPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSecrets replaces the settings that refer to a secret with the secret's value
+// from provider
+func (c *Config) ResolveSecrets(ctx context.Context, provider SecretProvider) error {
+	for key, value := range c.secretSettings() {
+		name, ok := strings.CutPrefix(*value, secretPrefix)
+		if !ok {
+			continue
+		}
+		if provider == nil {
+			return fmt.Errorf("%s refers to secret %q but KEY_VAULT_URL is not set", key, name)
+		}
+		secret, err := provider.GetSecret(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to fetch secret %q for %s: %v", name, key, err)
+		}
+		*value = secret
+	}
+	return nil
+}
+
+// redacted replaces the value of secret settings in printed configurations
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the configuration with the values of secret settings
+// replaced, so it can be printed. References to secrets are kept since they are only
+// names.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	copied.Backends = append([]Backend(nil), c.Backends...)
+	copied.ClientKeys = append([]ClientKey(nil), c.ClientKeys...)
+	copied.HMACSecrets = append([]HMACSecret(nil), c.HMACSecrets...)
+	settings := copied.secretSettings()
+	settings["LOG_ENCRYPTION_KEY"] = &copied.LogEncryptionKey
+	for _, value := range settings {
+		if *value != "" && !strings.HasPrefix(*value, secretPrefix) {
+			*value = redacted
+		}
+	}
+	return &copied
+}
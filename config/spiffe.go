@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// SPIFFEIdentity maps the SPIFFE ID of workloads presenting an X.509-SVID to the
+// client ID their requests are attributed to, like the name of a client key
+type SPIFFEIdentity struct {
+	// ID is a SPIFFE ID such as spiffe://corp.example/ns/search/sa/indexer, or a
+	// prefix of them ending in /*, matching every ID below it
+	ID     string
+	Client string
+	Owner  string
+
+	// Deployments and Operations restrict the workload like the scope of a client key
+	Deployments []string
+	Operations  []string
+
+	Tags map[string]string
+}
+
+// spiffeIdentityKeys are the settings of a SPIFFE_IDS table in the config file
+var spiffeIdentityKeys = map[string]bool{"id": true, "client": true, "owner": true, "deployments": true, "operations": true, "tags": true}
+
+// getSPIFFEIdentities returns the identities of the SPIFFE_IDS setting. The config file
+// lists them as tables; the environment variable as id=client pairs, with the scopes of
+// each client in SPIFFE_ID_DEPLOYMENTS and SPIFFE_ID_OPERATIONS, which also override
+// those of the tables. They are ordered by ID.
+func (src *source) getSPIFFEIdentities() []SPIFFEIdentity {
+	src.lookup("SPIFFE_IDS")
+	tables := src.tables["SPIFFE_IDS"]
+	if tables == nil || (os.Getenv("SPIFFE_IDS") != "" && !src.overridden["SPIFFE_IDS"]) {
+		tables = nil
+		for id, client := range src.getEnvMapOrDefault("SPIFFE_IDS", nil) {
+			tables = append(tables, map[string]string{"id": id, "client": client})
+		}
+	}
+
+	deployments := src.getEnvMapOrDefault("SPIFFE_ID_DEPLOYMENTS", nil)
+	operations := src.getEnvMapOrDefault("SPIFFE_ID_OPERATIONS", nil)
+	var identities []SPIFFEIdentity
+	for _, table := range tables {
+		for key := range table {
+			if !spiffeIdentityKeys[key] {
+				log.Printf("Warning: ignoring unknown setting %s of SPIFFE ID %q", key, table["id"])
+			}
+		}
+		tags, err := tagList("", table["tags"], nil)
+		if err != nil {
+			log.Printf("Warning: ignoring tags of SPIFFE ID %q: %v", table["id"], err)
+		}
+		identities = append(identities, SPIFFEIdentity{
+			ID:          table["id"],
+			Client:      table["client"],
+			Owner:       table["owner"],
+			Deployments: scopeList(table["client"], table["deployments"], deployments),
+			Operations:  scopeList(table["client"], table["operations"], operations),
+			Tags:        tags,
+		})
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+	return identities
+}
+
+// validateSPIFFEIdentities checks that the SPIFFE IDs are well-formed and distinct and
+// that each maps to a client
+func validateSPIFFEIdentities(identities []SPIFFEIdentity) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, id := range identities {
+		if err := checkSPIFFEID(strings.TrimSuffix(id.ID, "/*")); err != nil {
+			errs = append(errs, fmt.Errorf("SPIFFE_IDS entry %q %v", id.ID, err))
+		}
+		if seen[id.ID] {
+			errs = append(errs, fmt.Errorf("SPIFFE_IDS has more than one entry for %q", id.ID))
+		}
+		seen[id.ID] = true
+		if id.Client == "" {
+			errs = append(errs, fmt.Errorf("SPIFFE_IDS entry %q has no client", id.ID))
+		}
+		for _, op := range id.Operations {
+			if !slices.Contains(ClientKeyOperations, op) {
+				errs = append(errs, fmt.Errorf("SPIFFE ID %q has unknown operation %q in its scope, expected one of %s",
+					id.ID, op, strings.Join(ClientKeyOperations, ", ")))
+			}
+		}
+	}
+	return errs
+}
+
+// checkSPIFFEID checks that id is a SPIFFE ID: spiffe://<trust domain>/<path>, without
+// port, user info, query or fragment
+func checkSPIFFEID(id string) error {
+	u, err := url.Parse(id)
+	switch {
+	case err != nil:
+		return fmt.Errorf("is not a valid URI: %v", err)
+	case u.Scheme != "spiffe" || u.Host == "":
+		return fmt.Errorf("is not a SPIFFE ID, expected spiffe://<trust domain>/<path>")
+	case u.Port() != "" || u.User != nil || u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("may not have a port, user info, query or fragment")
+	case strings.HasSuffix(u.Path, "/"):
+		return fmt.Errorf("may not end in '/'")
+	}
+	return nil
+}
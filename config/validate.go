@@ -0,0 +1,360 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the settings the proxy cannot start without, returning every problem
+// found with a hint on how to fix it
+func (c *Config) Validate() error {
+	errs := slices.Clone(c.parseErrors)
+	if len(c.Backends) > 0 {
+		errs = append(errs, validateBackends(c.Backends, c.routedBackends())...)
+	} else if len(c.Upstreams) > 0 {
+		upstreams := make([]string, 0, len(c.Upstreams))
+		for upstream := range c.Upstreams {
+			upstreams = append(upstreams, upstream)
+		}
+		sort.Strings(upstreams)
+		for _, upstream := range upstreams {
+			if err := validateEndpoint(upstream); err != nil {
+				errs = append(errs, fmt.Errorf("UPSTREAMS entry %q %v", upstream, err))
+			}
+		}
+	} else if err := validateEndpoint(c.AzureOpenAIEndpoint); err != nil {
+		errs = append(errs, fmt.Errorf("AZURE_OPENAI_ENDPOINT %q %v", c.AzureOpenAIEndpoint, err))
+	}
+
+	if !slices.Contains(LoadBalancingStrategies, c.LoadBalancing) {
+		errs = append(errs, fmt.Errorf("LOAD_BALANCING %q is not supported, expected %s", c.LoadBalancing, strings.Join(LoadBalancingStrategies, " or ")))
+	}
+	if c.LatencyRoutingMargin < 0 || c.LatencyRoutingMargin >= 1 {
+		errs = append(errs, fmt.Errorf("LATENCY_ROUTING_MARGIN must be at least 0 and below 1, got %v", c.LatencyRoutingMargin))
+	}
+	if !slices.Contains(SystemPromptModes, c.SystemPromptMode) {
+		errs = append(errs, fmt.Errorf("SYSTEM_PROMPT_MODE %q is not supported, expected %s", c.SystemPromptMode, strings.Join(SystemPromptModes, " or ")))
+	}
+	if !(c.CharsPerToken > 0) {
+		errs = append(errs, fmt.Errorf("CHARS_PER_TOKEN must be positive, got %v", c.CharsPerToken))
+	}
+	if !slices.Contains(BackendAuths, c.AzureOpenAIAuth) {
+		errs = append(errs, fmt.Errorf("AZURE_OPENAI_AUTH %q is not supported, expected %s", c.AzureOpenAIAuth, strings.Join(BackendAuths, ", ")))
+	}
+	if c.APIVersionForce && c.APIVersion == "" {
+		errs = append(errs, fmt.Errorf("API_VERSION_FORCE is set without API_VERSION, set the api-version every request is sent with"))
+	}
+	errs = append(errs, c.validateUserTokens()...)
+	errs = append(errs, validateRoutes(c.Routes)...)
+	errs = append(errs, c.validateModelRoutes()...)
+	errs = append(errs, validateClientKeys(c.APIKey, c.ClientKeys)...)
+	errs = append(errs, validateSPIFFEIdentities(c.SPIFFEIdentities)...)
+	if c.JWTIssuer != "" {
+		if err := validateEndpoint(c.JWTIssuer); err != nil {
+			errs = append(errs, fmt.Errorf("JWT_ISSUER %q %v", c.JWTIssuer, err))
+		}
+		if len(c.JWTAudiences) == 0 {
+			errs = append(errs, fmt.Errorf("JWT_AUDIENCE is not set, tokens must be checked for being issued to the proxy"))
+		}
+		if len(c.JWTClientClaims) == 0 {
+			errs = append(errs, fmt.Errorf("JWT_CLIENT_CLAIMS is empty, expected claims identifying the client such as azp"))
+		}
+	}
+
+	for _, h := range c.HMACSecrets {
+		if h.Secret == "" {
+			errs = append(errs, fmt.Errorf("client %q has an empty secret in HMAC_SECRETS", h.Client))
+		}
+	}
+	if len(c.HMACSecrets) > 0 && c.HMACMaxSkew <= 0 {
+		errs = append(errs, fmt.Errorf("HMAC_MAX_SKEW must be positive, got %v", c.HMACMaxSkew))
+	}
+	for _, tag := range c.MetricTags {
+		if !isLabelName(tag) {
+			errs = append(errs, fmt.Errorf("METRIC_TAGS entry %q is not a valid metric label name, use letters, digits and underscores", tag))
+		} else if _, ok := c.ResponseMetricLabels[tag]; ok || tag == "status" {
+			errs = append(errs, fmt.Errorf("METRIC_TAGS entry %q clashes with a label of proxy_requests_total", tag))
+		}
+	}
+
+	for name, networks := range map[string][]string{
+		"IP_ALLOWLIST":       c.IPAllowlist,
+		"IP_DENYLIST":        c.IPDenylist,
+		"ADMIN_IP_ALLOWLIST": c.AdminIPAllowlist,
+		"ADMIN_IP_DENYLIST":  c.AdminIPDenylist,
+	} {
+		for _, network := range networks {
+			if _, _, err := net.ParseCIDR(network); err != nil && net.ParseIP(network) == nil {
+				errs = append(errs, fmt.Errorf("%s has invalid network %q, expected a CIDR or an IP address", name, network))
+			}
+		}
+	}
+
+	if err := validateListenAddr(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("LISTEN_ADDR %q %v", c.ListenAddr, err))
+	}
+	return errors.Join(errs...)
+}
+
+// validateBackends checks that backends have unique names, valid endpoints, positive
+// weights unless they are a fallback or in routed, fallbacks among the other backends
+// and settings their type supports
+func validateBackends(backends []Backend, routed map[string]bool) []error {
+	var errs []error
+	names := make(map[string]bool, len(backends))
+	fallbacks := map[string]bool{}
+	var positive bool
+	for _, b := range backends {
+		names[b.Name] = false
+		fallbacks[b.Fallback] = true
+		positive = positive || b.Weight > 0
+	}
+	if !positive {
+		errs = append(errs, fmt.Errorf("BACKENDS has no backend with a positive weight"))
+	}
+	for _, b := range backends {
+		switch {
+		case b.Name == "":
+			errs = append(errs, fmt.Errorf("BACKENDS entry for %q has no name", b.Endpoint))
+		case names[b.Name]:
+			errs = append(errs, fmt.Errorf("BACKENDS has more than one backend named %q", b.Name))
+		}
+		if _, ok := names[b.Fallback]; b.Fallback != "" && (!ok || b.Fallback == b.Name) {
+			errs = append(errs, fmt.Errorf("backend %q has fallback %q, expected the name of another backend", b.Name, b.Fallback))
+		}
+		names[b.Name] = true
+		// Local model servers are often reached by a service name, such as http://vllm:8000
+		if err := validateEndpoint(b.Endpoint); errors.Is(err, errPlainHTTP) && b.Type == "openai-compatible" {
+			log.Printf("Warning: backend %q is reached over plain http at %s, so its traffic is not encrypted", b.Name, b.Endpoint)
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("backend %q endpoint %q %v", b.Name, b.Endpoint, err))
+		}
+		if b.Weight < 0 || b.Weight == 0 && !fallbacks[b.Name] && !routed[b.Name] {
+			errs = append(errs, fmt.Errorf("backend %q has weight %d, expected a positive weight, or 0 for the fallback of another backend or one named by MODEL_ROUTES", b.Name, b.Weight))
+		}
+		if b.Auth != "" && !slices.Contains(BackendAuths, b.Auth) {
+			errs = append(errs, fmt.Errorf("backend %q has auth %q, expected %s", b.Name, b.Auth, strings.Join(BackendAuths, ", ")))
+		}
+		if b.Type != "" && !slices.Contains(BackendTypes, b.Type) {
+			errs = append(errs, fmt.Errorf("backend %q has type %q, expected %s", b.Name, b.Type, strings.Join(BackendTypes, " or ")))
+		}
+		if b.IsOpenAI() {
+			switch {
+			case b.Auth != "" && b.Auth != "api-key":
+				errs = append(errs, fmt.Errorf("backend %q of type %s has auth %q, the OpenAI API only takes api-key", b.Name, b.Type, b.Auth))
+			case b.APIKey == "" && b.Type == "openai":
+				errs = append(errs, fmt.Errorf("backend %q of type openai has no api_key, set %s to an OpenAI API key", b.Name, backendVar(b.Name, "API_KEY")))
+			}
+			if b.APIVersion != "" {
+				errs = append(errs, fmt.Errorf("backend %q of type %s has api_version %q, the OpenAI API has none", b.Name, b.Type, b.APIVersion))
+			}
+		}
+	}
+	return errs
+}
+
+// validateUserTokens checks that backends forwarding users' tokens or exchanging them
+// have tokens to work with, and credentials for the exchange
+func (c *Config) validateUserTokens() []error {
+	var passthrough, obo bool
+	for _, b := range c.EffectiveBackends() {
+		passthrough = passthrough || b.Auth == "passthrough"
+		obo = obo || b.Auth == "obo"
+	}
+	var errs []error
+	if (passthrough || obo) && c.JWTIssuer == "" {
+		errs = append(errs, fmt.Errorf("passthrough and obo auth need the tokens of users, set JWT_ISSUER and JWT_AUDIENCE"))
+	}
+	if obo && (c.OBOTenantID == "" || c.OBOClientID == "" || c.OBOClientSecret == "") {
+		errs = append(errs, fmt.Errorf("obo auth needs OBO_TENANT_ID, OBO_CLIENT_ID and OBO_CLIENT_SECRET of the app registration exchanging tokens"))
+	}
+	return errs
+}
+
+// isLabelName reports whether name is a valid Prometheus label name
+func isLabelName(name string) bool {
+	for i, r := range name {
+		if !(r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || i > 0 && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return name != "" && !strings.HasPrefix(name, "__")
+}
+
+// validateRoutes checks that route patterns are absolute, well-formed paths and that
+// their limits are not negative
+func validateRoutes(routes []Route) []error {
+	var errs []error
+	for _, r := range routes {
+		if _, err := path.Match(r.Pattern, ""); err != nil || !strings.HasPrefix(r.Pattern, "/") {
+			errs = append(errs, fmt.Errorf("route pattern %q is not a path pattern such as /openai/deployments/gpt-4o/*", r.Pattern))
+		}
+		if r.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("route %q has negative timeout %v", r.Pattern, r.Timeout))
+		}
+		if r.MaxBodySize < 0 {
+			errs = append(errs, fmt.Errorf("route %q has negative max_body_size %d", r.Pattern, r.MaxBodySize))
+		}
+	}
+	return errs
+}
+
+// routedBackends returns the names of the backends MODEL_ROUTES sends models to
+func (c *Config) routedBackends() map[string]bool {
+	routed := map[string]bool{}
+	for model, value := range c.ModelRoutes {
+		targets, _ := ParseModelRoute(model, value)
+		for _, t := range targets {
+			routed[t.Backend] = true
+		}
+	}
+	return routed
+}
+
+// validateModelRoutes checks that the targets of each model route are well-formed,
+// distinct and on one of the backends
+func (c *Config) validateModelRoutes() []error {
+	backends := map[string]bool{}
+	for _, b := range c.EffectiveBackends() {
+		backends[b.Name] = true
+	}
+	models := make([]string, 0, len(c.ModelRoutes))
+	for model := range c.ModelRoutes {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+
+	var errs []error
+	for _, model := range models {
+		targets, err := ParseModelRoute(model, c.ModelRoutes[model])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MODEL_ROUTES: %v", err))
+			continue
+		}
+		for _, t := range targets {
+			if !backends[t.Backend] {
+				errs = append(errs, fmt.Errorf("MODEL_ROUTES sends %s to unknown backend %q", model, t.Backend))
+			}
+		}
+	}
+	return errs
+}
+
+// validateClientKeys checks that client keys have unique names and distinct, non-empty
+// keys, none of which is the "default" client of PROXY_API_KEY, known operations and
+// valid expiry times
+func validateClientKeys(defaultKey string, keys []ClientKey) []error {
+	var errs []error
+	names := map[string]bool{}
+	seen := map[string]string{}
+	if defaultKey != "" {
+		names["default"] = true
+		seen[defaultKey] = "default"
+	}
+	for _, k := range keys {
+		switch {
+		case k.Name == "":
+			errs = append(errs, fmt.Errorf("PROXY_API_KEYS has a key without a name"))
+		case names[k.Name]:
+			errs = append(errs, fmt.Errorf("PROXY_API_KEYS has more than one key for client %q", k.Name))
+		}
+		names[k.Name] = true
+		if k.Key == "" {
+			errs = append(errs, fmt.Errorf("client %q has an empty key in PROXY_API_KEYS", k.Name))
+			continue
+		}
+		if other, ok := seen[k.Key]; ok {
+			errs = append(errs, fmt.Errorf("clients %q and %q share the same key, keys must identify a single client", other, k.Name))
+		}
+		seen[k.Key] = k.Name
+		if _, err := k.Expiry(); err != nil {
+			errs = append(errs, fmt.Errorf("client %q: %v", k.Name, err))
+		}
+		if _, err := k.AccessWindows(); err != nil {
+			errs = append(errs, fmt.Errorf("client %q: %v", k.Name, err))
+		}
+		for _, op := range k.Operations {
+			if !slices.Contains(ClientKeyOperations, op) {
+				errs = append(errs, fmt.Errorf("client %q has unknown operation %q in its scope, expected one of %s",
+					k.Name, op, strings.Join(ClientKeyOperations, ", ")))
+			}
+		}
+	}
+	return errs
+}
+
+// errPlainHTTP is returned by validateEndpoint for http endpoints on other hosts than
+// loopback ones
+var errPlainHTTP = errors.New("uses http, which is only allowed for localhost and openai-compatible backends; use https")
+
+// validateEndpoint checks that an endpoint is an absolute https URL. Plain http is
+// accepted for loopback hosts, such as local emulators.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("is not an absolute URL, expected https://<resource>.openai.azure.com/")
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !isLoopback(u.Hostname()) {
+			return errPlainHTTP
+		}
+	default:
+		return fmt.Errorf("has scheme %q, expected https", u.Scheme)
+	}
+	return nil
+}
+
+// isLoopback reports whether host is localhost or a loopback address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validateListenAddr checks that addr has the host:port form with a valid port
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("is not a host:port address such as :8080: %v", err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("has invalid port %q", port)
+	}
+	return nil
+}
+
+// CheckLogFile reports whether the log file at path can be written, creating it if
+// needed, so a wrong path is reported before the proxy starts
+func CheckLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("LOG_FILE_PATH %q is not writable: %v", path, err)
+	}
+	return file.Close()
+}
+
+// CheckListen reports whether addr can be listened on, so a port that is taken or
+// needs privileges is reported before the proxy starts
+func CheckListen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on LISTEN_ADDR %q: %v", addr, err)
+	}
+	return ln.Close()
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the day names of access windows, by time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// AccessWindow is a time of day a key may be used at on some days of the week. A
+// window whose end is not after its start runs past midnight into the next day.
+type AccessWindow struct {
+	Days       [7]bool       // by time.Weekday
+	Start, End time.Duration // since midnight
+
+	spec string
+}
+
+// AccessWindows are the times a key may be used at, in the key's time zone
+type AccessWindows struct {
+	Location *time.Location
+	Windows  []AccessWindow
+}
+
+// AccessWindows returns the times the key may be used at, or nil if it may be used
+// at any time
+func (k ClientKey) AccessWindows() (*AccessWindows, error) {
+	return ParseAccessWindows(k.Windows, k.Timezone)
+}
+
+// ParseAccessWindows parses windows such as "mon-fri/09:00-17:00", "sat/10:00-14:00"
+// or "22:00-06:00" for every day, in the IANA time zone timezone, UTC when empty. It
+// returns nil without windows.
+func ParseAccessWindows(specs []string, timezone string) (*AccessWindows, error) {
+	if len(specs) == 0 {
+		if timezone != "" {
+			return nil, fmt.Errorf("timezone %q is set without windows", timezone)
+		}
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+	}
+	w := &AccessWindows{Location: location}
+	for _, spec := range specs {
+		window, err := parseAccessWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		w.Windows = append(w.Windows, window)
+	}
+	return w, nil
+}
+
+// parseAccessWindow parses a single window, [day[-day]/]HH:MM-HH:MM
+func parseAccessWindow(spec string) (AccessWindow, error) {
+	window := AccessWindow{spec: spec}
+	days, hours, ok := strings.Cut(spec, "/")
+	if !ok {
+		days, hours = "", spec
+	}
+	invalid := fmt.Errorf("invalid window %q, expected e.g. mon-fri/09:00-17:00", spec)
+
+	if days == "" {
+		window.Days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		first, last, _ := strings.Cut(days, "-")
+		if last == "" {
+			last = first
+		}
+		from, to := weekday(first), weekday(last)
+		if from < 0 || to < 0 {
+			return AccessWindow{}, invalid
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(hours, "-")
+	if !ok {
+		return AccessWindow{}, invalid
+	}
+	var err error
+	if window.Start, err = timeOfDay(start); err != nil {
+		return AccessWindow{}, invalid
+	}
+	if window.End, err = timeOfDay(end); err != nil {
+		return AccessWindow{}, invalid
+	}
+	return window, nil
+}
+
+// weekday returns the index of a day name, or -1 if it is none
+func weekday(name string) int {
+	for i, day := range weekdays {
+		if strings.EqualFold(name, day) {
+			return i
+		}
+	}
+	return -1
+}
+
+// timeOfDay parses HH:MM, from 00:00 to 24:00, as the time since midnight
+func timeOfDay(s string) (time.Duration, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil || len(s) != len("00:00") {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || hour == 24 && minute > 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// Allows reports whether t falls within one of the windows
+func (w *AccessWindows) Allows(t time.Time) bool {
+	t = t.In(w.Location)
+	day := t.Weekday()
+	previous := (day + 6) % 7
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, window := range w.Windows {
+		if window.Start < window.End {
+			if window.Days[day] && since >= window.Start && since < window.End {
+				return true
+			}
+			continue
+		}
+		// The window runs past midnight, so it started today or yesterday
+		if window.Days[day] && since >= window.Start || window.Days[previous] && since < window.End {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the windows and their time zone, e.g. for error messages
+func (w *AccessWindows) String() string {
+	specs := make([]string, len(w.Windows))
+	for i, window := range w.Windows {
+		specs[i] = window.spec
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(specs, ", "), w.Location)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/auth"
+)
+
+// runConfig implements the `config` subcommand. `config check` validates the
+// configuration the proxy would start with and `config print` writes it to stdout as
+// JSON, with secrets redacted. Both take the proxy's flags, so they see exactly the
+// configuration a proxy started with the same environment and flags would run with.
+// `config hash-key` hashes a client key read from stdin, to be stored instead of it.
+func runConfig(args []string) error {
+	if len(args) == 1 && args[0] == "hash-key" {
+		return hashKey(os.Stdin, os.Stdout)
+	}
+	if len(args) == 0 || (args[0] != "check" && args[0] != "print") {
+		return fmt.Errorf("usage: azure-ai-proxy config check|print [flags] or config hash-key")
+	}
+	command := args[0]
+
+	var opts options
+	flags := flag.NewFlagSet("config "+command, flag.ExitOnError)
+	opts.register(flags)
+	offline := flags.Bool("offline", false, "skip reading App Configuration and Key Vault")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	var cfg *config.Config
+	var err error
+	if *offline {
+		cfg, err = loadOptions(opts, nil, nil)
+	} else {
+		cfg, _, _, err = loadRemote(opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	if command == "print" {
+		return printConfig(os.Stdout, cfg.Redacted())
+	}
+
+	// Fetching the secrets makes sure every referenced one exists and is readable
+	if !*offline {
+		secrets, err := newSecretProvider(cfg)
+		if err != nil {
+			return err
+		}
+		if err := resolveSecrets(cfg, secrets); err != nil {
+			return err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	if err := config.CheckLogFile(cfg.LogFilePath); err != nil {
+		return err
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+// hashKey reads a key from the first line of r and writes its argon2id hash to w
+func hashKey(r io.Reader, w io.Writer) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read key: %v", err)
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return fmt.Errorf("no key on stdin, e.g. echo \"$KEY\" | azure-ai-proxy config hash-key")
+	}
+	hash, err := auth.HashKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, hash)
+	return err
+}
+
+// printConfig writes cfg to w as JSON. Fields keep their declaration order and
+// durations are written like "1m30s" instead of nanoseconds.
+func printConfig(w io.Writer, cfg *config.Config) error {
+	data, err := json.MarshalIndent(printable(reflect.ValueOf(*cfg)), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// durationType is the type of time.Duration fields
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// printable converts v to a value that encodes to readable JSON
+func printable(v reflect.Value) interface{} {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return printable(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = printable(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[fmt.Sprint(iter.Key().Interface())] = printable(iter.Value())
+		}
+		return entries
+	case reflect.Struct:
+		var fields orderedFields
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.IsExported() {
+				fields = append(fields, orderedField{field.Name, printable(v.Field(i))})
+			}
+		}
+		return fields
+	default:
+		return v.Interface()
+	}
+}
+
+// orderedField is a field of a struct converted by printable
+type orderedField struct {
+	name  string
+	value interface{}
+}
+
+// orderedFields encodes to a JSON object with the fields in order, unlike a map
+type orderedFields []orderedField
+
+// MarshalJSON implements json.Marshaler
+func (f orderedFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.name)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field.name, err)
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
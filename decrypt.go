@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// runDecryptLogs implements the `decrypt-logs` subcommand, which writes a log file to
+// stdout with the encrypted request and response bodies of its entries decrypted.
+// The configuration is loaded like the proxy's, so a key kept in Key Vault is found.
+func runDecryptLogs(args []string) error {
+	var opts options
+	flags := flag.NewFlagSet("decrypt-logs", flag.ExitOnError)
+	opts.register(flags)
+	file := flags.String("file", "", "log file to decrypt (default LOG_FILE_PATH)")
+	keyFile := flags.String("key-file", "", "file holding the base64 encryption key (default LOG_ENCRYPTION_KEY_FILE or LOG_ENCRYPTION_KEY)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, _, _, _, err := loadValidated(opts)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		*file = cfg.LogFilePath
+	}
+	keyValue, keyPath := cfg.LogEncryptionKey, cfg.LogEncryptionKeyFile
+	if *keyFile != "" {
+		keyValue, keyPath = "", *keyFile // an explicit -key-file wins over the environment
+	}
+	key, err := logging.LoadKey(keyValue, keyPath)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("no encryption key given, use -key-file, LOG_ENCRYPTION_KEY or LOG_ENCRYPTION_KEY_FILE")
+	}
+	aead, err := logging.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", *file, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			decrypted, decryptErr := logging.DecryptLine(aead, line)
+			if decryptErr != nil {
+				return fmt.Errorf("%s:%d: %v", *file, lineNumber, decryptErr)
+			}
+			if _, err := out.Write(decrypted); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", *file, err)
+		}
+	}
+}
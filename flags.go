@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"azure-ai-proxy/config"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "none"
+)
+
+// options holds the settings given on the command line, which take precedence over
+// environment variables and the config file
+type options struct {
+	configFile string
+	listen     string
+	endpoint   string
+	logFile    string
+	apiKeyFile string
+}
+
+// parseFlags parses the command line of the proxy. It reports false when the program
+// should exit after printing the version or usage.
+func parseFlags(args []string) (options, bool, error) {
+	var opts options
+	flags := flag.NewFlagSet("azure-ai-proxy", flag.ContinueOnError)
+	opts.register(flags)
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: azure-ai-proxy [flags]\n       azure-ai-proxy replay|decrypt-logs [flags]\n       azure-ai-proxy config check|print [flags]\n       azure-ai-proxy config hash-key\n\n"+
+			"Flags override environment variables, which override the config file.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return opts, false, nil
+		}
+		return opts, false, err
+	}
+	if flags.NArg() > 0 {
+		return opts, false, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if *showVersion {
+		fmt.Printf("azure-ai-proxy %s (commit %s)\n", version, commit)
+		return opts, false, nil
+	}
+	return opts, true, nil
+}
+
+// register defines the flags of the options on flags
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file (CONFIG_FILE)")
+	flags.StringVar(&o.listen, "listen", "", "address to listen on (LISTEN_ADDR)")
+	flags.StringVar(&o.endpoint, "endpoint", "", "Azure OpenAI endpoint URL (AZURE_OPENAI_ENDPOINT)")
+	flags.StringVar(&o.logFile, "log-file", "", "file to log requests and responses to (LOG_FILE_PATH)")
+	flags.StringVar(&o.apiKeyFile, "api-key-file", "", "file holding the key clients must send in X-API-Key (PROXY_API_KEY)")
+}
+
+// apply overrides cfg with the settings given on the command line
+func (o options) apply(cfg *config.Config) error {
+	if o.listen != "" {
+		cfg.ListenAddr = o.listen
+	}
+	if o.endpoint != "" {
+		cfg.AzureOpenAIEndpoint = o.endpoint
+	}
+	if o.logFile != "" {
+		cfg.LogFilePath = o.logFile
+	}
+	if o.apiKeyFile != "" {
+		key, err := os.ReadFile(o.apiKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read API key file: %v", err)
+		}
+		cfg.APIKey = strings.TrimSpace(string(key))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of audited actions
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is an administrative or security-relevant action
+type Event struct {
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`  // who performed the action: a client ID, "admin" or "system", with the remote address if known
+	Action    string    `json:"action"` // what was attempted, e.g. "auth" or "POST /admin/ratelimits/adaptive/reset"
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// Logger records audit events
+type Logger interface {
+	Record(event Event)
+	Close()
+}
+
+// FileLogger writes audit events as JSON lines to a file, or to stdout for "-"
+type FileLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+// NewFileLogger creates an audit logger appending to filename
+func NewFileLogger(filename string) (*FileLogger, error) {
+	if filename == "-" {
+		return &FileLogger{out: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return &FileLogger{out: file, closer: file}, nil
+}
+
+// Record writes an event, stamping it with the current time if it has none
+func (l *FileLogger) Record(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit event %s by %s: %v", event.Action, event.Actor, err)
+	}
+}
+
+// Close closes the audit log file
+func (l *FileLogger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closer != nil {
+		if err := l.closer.Close(); err != nil {
+			log.Printf("Error closing audit log: %v", err)
+		}
+	}
+}
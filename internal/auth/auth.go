@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoCredentials is returned when a request carries no credentials of the kind an
+	// authenticator understands, letting a Chain fall through to the next one
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned when credentials are present but not valid
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrExpiredCredentials is returned for credentials that were valid but have expired
+	ErrExpiredCredentials = errors.New("expired credentials")
+	// ErrConflictingCredentials is returned when a credential header is sent several
+	// times with different values, so it is unclear which one the client meant
+	ErrConflictingCredentials = errors.New("conflicting credentials")
+)
+
+// Identity is who an authenticated request comes from
+type Identity struct {
+	ClientID string
+	Subject  string // user, service principal or certificate name the credentials were issued to, if not the client ID
+
+	User string // name of the user a bearer token was issued to, if it was issued to one
+
+	// Header is the request header that carried the credentials, which the proxy
+	// removes rather than forward upstream
+	Header string
+	// Token is the client's bearer token, for backends that forward it or exchange it
+	// on the user's behalf
+	Token string
+}
+
+// Authenticator verifies the credentials of an incoming request and identifies the client
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// HeaderCredential returns the value of a credential header. Repeating the header with
+// the same value is tolerated, different values are rejected rather than letting the
+// first one win silently.
+func HeaderCredential(r *http.Request, name string) (string, error) {
+	values := r.Header.Values(name)
+	if len(values) == 0 || values[0] == "" {
+		return "", ErrNoCredentials
+	}
+	for _, value := range values[1:] {
+		if value != values[0] {
+			return "", ErrConflictingCredentials
+		}
+	}
+	return values[0], nil
+}
+
+// KeyHeaders are the headers clients may send their key in, in order of precedence:
+// the proxy's own X-API-Key, Azure's api-key and the Authorization: Bearer header of
+// OpenAI SDKs
+var KeyHeaders = []string{"X-API-Key", "api-key", "Authorization"}
+
+// KeyCredential returns a client key and the header it was sent in, the first of
+// KeyHeaders present. Clients keeping an Azure key in api-key for the backend can so
+// still send their proxy key in X-API-Key.
+func KeyCredential(r *http.Request) (string, string, error) {
+	for _, header := range KeyHeaders {
+		value, err := HeaderCredential(r, header)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if header == "Authorization" {
+			token, ok := BearerToken(value)
+			if !ok {
+				continue
+			}
+			value = token
+		}
+		return value, header, nil
+	}
+	return "", "", ErrNoCredentials
+}
+
+// BearerToken returns the token of an Authorization header value of the Bearer scheme
+func BearerToken(header string) (string, bool) {
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// KeyRegistry checks the client key of a request, in any of KeyHeaders, against a set
+// of keys, each identifying the client it was issued to. Keys may be stored as bcrypt or argon2id hashes, so the
+// registry's source does not reveal them.
+type KeyRegistry struct {
+	Keys   map[string]string    // client ID by key or key hash
+	Expiry map[string]time.Time // when the key of a client expires, by client ID
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]string // client ID by SHA-256 of keys that matched a hash
+}
+
+// Authenticate implements the Authenticator interface. Every plain key is compared, in
+// constant time, so the time taken does not reveal which key came close. Hashes are
+// only checked for keys matching none of them, and keys that matched a hash are
+// remembered, since hashes are deliberately slow to check.
+func (k *KeyRegistry) Authenticate(r *http.Request) (Identity, error) {
+	key, header, err := KeyCredential(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	var clientID string
+	found := false
+	for candidate, id := range k.Keys {
+		if !IsKeyHash(candidate) && subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			clientID, found = id, true
+		}
+	}
+	if !found {
+		clientID, found = k.matchHash(key)
+	}
+	if !found {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if expiry, ok := k.Expiry[clientID]; ok && !time.Now().Before(expiry) {
+		log.Printf("Rejected key of client %s from %s: expired at %s", clientID, r.RemoteAddr, expiry.UTC().Format(time.RFC3339))
+		return Identity{ClientID: clientID}, ErrExpiredCredentials
+	}
+	return Identity{ClientID: clientID, Header: header}, nil
+}
+
+// matchHash returns the client whose hashed key key is
+func (k *KeyRegistry) matchHash(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	k.mu.Lock()
+	clientID, ok := k.verified[sum]
+	k.mu.Unlock()
+	if ok {
+		return clientID, true
+	}
+
+	for candidate, id := range k.Keys {
+		if IsKeyHash(candidate) && matchKeyHash(candidate, key) {
+			k.mu.Lock()
+			if k.verified == nil {
+				k.verified = make(map[[sha256.Size]byte]string)
+			}
+			k.verified[sum] = id
+			k.mu.Unlock()
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// CertificateAuthenticator identifies clients by the TLS client certificate they
+// presented, which the server has already verified against its client CA. The client
+// ID is the certificate's common name, or its first DNS, URI or email SAN. With
+// Identities, only certificates whose common name or a SAN is listed are accepted, and
+// the client ID is the one listed for it.
+type CertificateAuthenticator struct {
+	Identities map[string]string // client ID by certificate name
+}
+
+// Authenticate implements the Authenticator interface
+func (a CertificateAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if a.Identities == nil {
+			return Identity{ClientID: name}, nil
+		}
+		if clientID, ok := a.Identities[name]; ok {
+			return Identity{ClientID: clientID, Subject: name}, nil
+		}
+	}
+	if a.Identities != nil {
+		log.Printf("Rejected client certificate %q from %s: none of its names is a known identity", cert.Subject.CommonName, r.RemoteAddr)
+	}
+	return Identity{}, ErrInvalidCredentials
+}
+
+// Chain tries each authenticator in order. Authenticators that find no credentials of
+// their kind are skipped; the first success or the first real failure decides.
+type Chain []Authenticator
+
+// Authenticate implements the Authenticator interface
+func (c Chain) Authenticate(r *http.Request) (Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return Identity{}, ErrNoCredentials
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultHMACMaxBodySize bounds the bodies read to check their signature. Signed
+// bodies are held in memory instead of streamed, so it is far below the request limit.
+const DefaultHMACMaxBodySize = 4 << 20
+
+// HMACAuthenticator verifies requests signed with a secret shared with each client.
+// Clients send their client ID in X-Client-ID, the Unix time of signing in X-Timestamp
+// and in X-Signature the hex HMAC-SHA256, keyed with their secret, of
+//
+//	METHOD \n PATH?QUERY \n TIMESTAMP \n hex(SHA-256(body))
+//
+// Requests signed more than MaxSkew away from the proxy's clock are refused, and so are
+// signatures already used within that window, so a captured request cannot be replayed.
+type HMACAuthenticator struct {
+	Secrets     map[string]string // secret by client ID
+	MaxSkew     time.Duration
+	MaxBodySize int64 // larger bodies are refused, since they are hashed in memory; DefaultHMACMaxBodySize when 0
+	Replays     *ReplayCache
+}
+
+// Authenticate implements the Authenticator interface. The body is read to check its
+// hash and replaced with a copy for the rest of the request's handling.
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	signature, err := HeaderCredential(r, "X-Signature")
+	if err != nil {
+		return Identity{}, err
+	}
+	clientID, err := HeaderCredential(r, "X-Client-ID")
+	if err != nil {
+		log.Printf("Rejected signed request from %s: no X-Client-ID", r.RemoteAddr)
+		return Identity{}, ErrInvalidCredentials
+	}
+	timestamp, err := HeaderCredential(r, "X-Timestamp")
+	if err != nil {
+		log.Printf("Rejected signed request from %s for client %s: no X-Timestamp", r.RemoteAddr, clientID)
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	secret, ok := a.Secrets[clientID]
+	if !ok {
+		log.Printf("Rejected signed request from %s: unknown client %s", r.RemoteAddr, clientID)
+		return Identity{}, ErrInvalidCredentials
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		log.Printf("Rejected signed request from %s for client %s: X-Timestamp %q is not a Unix time", r.RemoteAddr, clientID, timestamp)
+		return Identity{}, ErrInvalidCredentials
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > a.MaxSkew || skew < -a.MaxSkew {
+		log.Printf("Rejected signed request from %s for client %s: signed at %s, more than %v from now",
+			r.RemoteAddr, clientID, signedAt.UTC().Format(time.RFC3339), a.MaxSkew)
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	bodyHash, err := a.hashBody(r)
+	if err != nil {
+		log.Printf("Rejected signed request from %s for client %s: %v", r.RemoteAddr, clientID, err)
+		return Identity{}, ErrInvalidCredentials
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), timestamp, bodyHash)
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		log.Printf("Rejected signed request from %s for client %s: signature does not match", r.RemoteAddr, clientID)
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	// Keyed by the decoded MAC, so re-encoding the signature in another case is a replay
+	if a.Replays != nil && !a.Replays.Add(clientID+":"+hex.EncodeToString(got), signedAt.Add(a.MaxSkew)) {
+		log.Printf("Rejected signed request from %s for client %s: signature was already used", r.RemoteAddr, clientID)
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{ClientID: clientID}, nil
+}
+
+// hashBody returns the hex SHA-256 of the request body, leaving a copy of it in its place
+func (a *HMACAuthenticator) hashBody(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	limit := a.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultHMACMaxBodySize
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return "", fmt.Errorf("body exceeds the %d bytes that can be checked", limit)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ReplayCache remembers the signatures accepted recently, so each is accepted only once.
+// It outlives the authenticators of reloaded configurations.
+type ReplayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time // expiry by signature
+	pruned time.Time
+}
+
+// NewReplayCache creates an empty replay cache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// Add records a signature until expires and reports whether it was new
+func (c *ReplayCache) Add(signature string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for s, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, s)
+			}
+		}
+		c.pruned = now
+	}
+	if exp, ok := c.seen[signature]; ok && !now.After(exp) {
+		return false
+	}
+	c.seen[signature] = expires
+	return true
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACRejectsReplayWithRecasedSignature(t *testing.T) {
+	const secret = "s3cret"
+	a := &HMACAuthenticator{
+		Secrets: map[string]string{"batch": secret},
+		MaxSkew: 5 * time.Minute,
+		Replays: NewReplayCache(),
+	}
+	body := `{"messages":[{"role":"user","content":"hi"}]}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", "POST", "/openai/deployments/gpt-4o/chat/completions", timestamp, hex.EncodeToString(bodyHash[:]))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	send := func(signature string) error {
+		r := httptest.NewRequest("POST", "/openai/deployments/gpt-4o/chat/completions", strings.NewReader(body))
+		r.Header.Set("X-Client-ID", "batch")
+		r.Header.Set("X-Timestamp", timestamp)
+		r.Header.Set("X-Signature", signature)
+		_, err := a.Authenticate(r)
+		return err
+	}
+
+	if err := send(signature); err != nil {
+		t.Fatalf("first request rejected: %v", err)
+	}
+	mixed := []byte(signature)
+	for i := 0; i < len(mixed); i += 2 {
+		mixed[i] = strings.ToUpper(string(mixed[i]))[0]
+	}
+	for _, replay := range []string{signature, strings.ToUpper(signature), string(mixed)} {
+		if err := send(replay); err != ErrInvalidCredentials {
+			t.Errorf("replay with signature %s: got %v, want %v", replay, err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func TestHMACRejectsBodiesOverTheLimit(t *testing.T) {
+	a := &HMACAuthenticator{Secrets: map[string]string{"batch": "s3cret"}, MaxSkew: 5 * time.Minute}
+	r := httptest.NewRequest("POST", "/openai/files", strings.NewReader(strings.Repeat("x", DefaultHMACMaxBodySize+1)))
+	r.Header.Set("X-Client-ID", "batch")
+	r.Header.Set("X-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set("X-Signature", strings.Repeat("0", 64))
+	if _, err := a.Authenticate(r); err != ErrInvalidCredentials {
+		t.Errorf("got %v, want %v", err, ErrInvalidCredentials)
+	}
+}
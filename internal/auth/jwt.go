@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are used before being fetched again
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefetch limits fetching keys again for tokens signed with an unknown key
+	jwksMinRefetch = time.Minute
+	// jwksTimeout bounds fetching the signing keys or the issuer's metadata
+	jwksTimeout = 10 * time.Second
+	// jwtLeeway tolerates clock skew between the proxy and the issuer
+	jwtLeeway = time.Minute
+)
+
+// userClaims name the user a token was issued to, in Entra ID v2.0 and v1.0 tokens
+var userClaims = []string{"preferred_username", "upn", "unique_name"}
+
+// JWTAuthenticator validates the bearer tokens of the Authorization header, such as
+// Microsoft Entra ID access tokens: their signature by one of the issuer's keys, their
+// issuer, audience and expiry. The client ID is the first of ClientClaims the token
+// has, and its sub claim is the subject.
+type JWTAuthenticator struct {
+	Issuer       string
+	Audiences    []string
+	ClientClaims []string
+
+	// JWKSURL serves the issuer's signing keys; when empty it is discovered from the
+	// issuer's OpenID configuration
+	JWKSURL string
+
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time
+}
+
+// NewJWTAuthenticator creates an authenticator for tokens of issuer for one of audiences
+func NewJWTAuthenticator(issuer string, audiences, clientClaims []string, jwksURL string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Issuer:       issuer,
+		Audiences:    audiences,
+		ClientClaims: clientClaims,
+		JWKSURL:      jwksURL,
+		client:       &http.Client{Timeout: jwksTimeout},
+	}
+}
+
+// Authenticate implements the Authenticator interface
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	header, err := HeaderCredential(r, "Authorization")
+	if err != nil {
+		return Identity{}, err
+	}
+	raw, ok := BearerToken(header)
+	// Bearer tokens that are no JWTs are client keys, left to the key authenticators
+	if !ok || strings.Count(raw, ".") != 2 {
+		return Identity{}, ErrNoCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, a.key,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384"}),
+		jwt.WithIssuer(a.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway))
+	if err != nil {
+		log.Printf("Rejected token from %s: %v", r.RemoteAddr, err)
+		return Identity{}, ErrInvalidCredentials
+	}
+	if !a.hasAudience(claims) {
+		log.Printf("Rejected token from %s: audience %v not accepted", r.RemoteAddr, claims["aud"])
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	identity := Identity{Header: "Authorization", Token: raw}
+	identity.Subject, _ = claims["sub"].(string)
+	for _, claim := range userClaims {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			identity.User = value
+			break
+		}
+	}
+	for _, claim := range a.ClientClaims {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			identity.ClientID = value
+			break
+		}
+	}
+	if identity.ClientID == "" {
+		log.Printf("Rejected token from %s: none of the claims %s identifies the client", r.RemoteAddr, strings.Join(a.ClientClaims, ", "))
+		return Identity{}, ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// hasAudience reports whether the token was issued for one of the accepted audiences
+func (a *JWTAuthenticator) hasAudience(claims jwt.MapClaims) bool {
+	audiences, err := claims.GetAudience()
+	if err != nil {
+		return false
+	}
+	for _, aud := range audiences {
+		for _, accepted := range a.Audiences {
+			if aud == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the public key a token was signed with, fetching the issuer's keys when
+// they are stale or the token names a key they do not have, e.g. after a rotation
+func (a *JWTAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetched) > jwksRefreshInterval
+	if ok && !stale {
+		return key, nil
+	}
+	if !ok && !stale && time.Since(a.fetched) < jwksMinRefetch {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	keys, err := a.fetchKeys()
+	if err != nil {
+		if ok {
+			log.Printf("Warning: using the previous signing keys of %s: %v", a.Issuer, err)
+			return key, nil
+		}
+		return nil, err
+	}
+	a.keys, a.fetched = keys, time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys fetches the issuer's signing keys from its JWKS document. Callers must hold a.mu.
+func (a *JWTAuthenticator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	if a.JWKSURL == "" {
+		var metadata struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(strings.TrimSuffix(a.Issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+			return nil, fmt.Errorf("failed to discover the signing keys of %s: %v", a.Issuer, err)
+		}
+		if metadata.JWKSURI == "" {
+			return nil, fmt.Errorf("the OpenID configuration of %s has no jwks_uri", a.Issuer)
+		}
+		a.JWKSURL = metadata.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(a.JWKSURL, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys from %s: %v", a.JWKSURL, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Warning: skipping signing key %q of %s: %v", jwk.KeyID, a.JWKSURL, err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+// getJSON decodes the JSON document at url into v
+func (a *JWTAuthenticator) getJSON(url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key of a JWKS document
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// publicKey decodes an RSA or EC signing key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("key is for %q, not signatures", k.Use)
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid coordinates")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parameters of the argon2id hashes HashKey creates, as recommended by OWASP
+const (
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// HashKey returns a salted argon2id hash of key in the PHC string format, e.g.
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>, to be stored instead of the key
+func HashKey(key string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	hash := argon2.IDKey([]byte(key), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// IsKeyHash reports whether a stored key is a bcrypt or argon2id hash rather than the
+// key itself
+func IsKeyHash(stored string) bool {
+	for _, prefix := range []string{"$argon2id$", "$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckKeyHash checks that a bcrypt or argon2id hash is well-formed
+func CheckKeyHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("invalid bcrypt hash: %v", err)
+	}
+	return nil
+}
+
+// matchKeyHash reports whether key is the one hash was made from
+func matchKeyHash(hash, key string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(key)) == nil
+	}
+	p, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(key), p.salt, p.time, p.memory, p.threads, uint32(len(p.hash)))
+	return subtle.ConstantTimeCompare(got, p.hash) == 1
+}
+
+// argon2Hash is a decoded argon2id hash
+type argon2Hash struct {
+	memory, time uint32
+	threads      uint8
+	salt, hash   []byte
+}
+
+// parseArgon2 decodes an argon2id hash in the PHC string format
+func parseArgon2(s string) (argon2Hash, error) {
+	var p argon2Hash
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, fmt.Errorf("invalid argon2id hash, expected $argon2id$v=19$m=...,t=...,p=...$<salt>$<hash>")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, fmt.Errorf("invalid argon2id parameters %q: %v", parts[3], err)
+	}
+	if p.memory == 0 || p.time == 0 || p.threads == 0 {
+		return p, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if p.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.hash) == 0 {
+		return p, fmt.Errorf("invalid argon2id hash value")
+	}
+	return p, nil
+}
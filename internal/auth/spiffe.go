@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// SPIFFEAuthenticator identifies workloads by the SPIFFE ID of the X.509-SVID they
+// presented as client certificate, which the server has already verified against the
+// trust bundle. Certificates without a SPIFFE ID are left to the other authenticators.
+type SPIFFEAuthenticator struct {
+	// IDs maps SPIFFE IDs to client IDs. An ID ending in /* matches every ID below it;
+	// the longest match wins.
+	IDs map[string]string
+}
+
+// Authenticate implements the Authenticator interface
+func (a SPIFFEAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var id string
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			id = uri.String()
+		}
+	}
+	if id == "" {
+		return Identity{}, ErrNoCredentials
+	}
+	// An X.509-SVID has exactly one URI SAN and is no CA certificate
+	if len(cert.URIs) != 1 || cert.IsCA {
+		log.Printf("Rejected SVID %s from %s: not a valid X.509-SVID", id, r.RemoteAddr)
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	clientID, ok := a.IDs[id]
+	if !ok {
+		clientID, ok = a.matchPrefix(id)
+	}
+	if !ok {
+		log.Printf("Rejected SVID %s from %s: SPIFFE ID is not a known identity", id, r.RemoteAddr)
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{ClientID: clientID, Subject: id}, nil
+}
+
+// matchPrefix returns the client of the longest /* pattern matching id
+func (a SPIFFEAuthenticator) matchPrefix(id string) (string, bool) {
+	var clientID, longest string
+	for pattern, client := range a.IDs {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(id, prefix) && len(prefix) > len(longest) {
+			clientID, longest = client, prefix
+		}
+	}
+	return clientID, longest != ""
+}
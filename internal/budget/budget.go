@@ -0,0 +1,226 @@
+package budget
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reset periods
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// Limit is the spend a client may incur per period
+type Limit struct {
+	Amount float64
+	Period string
+}
+
+// Price is the cost of a model per 1,000 prompt and completion tokens
+type Price struct {
+	Prompt     float64
+	Completion float64
+}
+
+// Account is a client's spend in its current period
+type Account struct {
+	PeriodStart time.Time `json:"period_start"`
+	Spent       float64   `json:"spent"`
+}
+
+// Ledger tracks spend per client against their limits and persists it to a file,
+// so totals survive restarts
+type Ledger struct {
+	mu       sync.Mutex
+	path     string
+	limits   map[string]Limit
+	prices   map[string]Price
+	accounts map[string]*Account
+}
+
+// NewLedger creates a ledger backed by path, loading previously recorded spend if the file exists
+func NewLedger(path string, limits map[string]Limit, prices map[string]Price) (*Ledger, error) {
+	l := &Ledger{
+		path:     path,
+		limits:   limits,
+		prices:   prices,
+		accounts: make(map[string]*Account),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.accounts); err != nil {
+		return nil, fmt.Errorf("invalid budget file %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// Check reports a client's spend and limit in the current period, and whether the
+// budget is exhausted. Clients without a limit are never exhausted.
+func (l *Ledger) Check(clientID string) (spent float64, limit Limit, exhausted bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.limits[clientID]
+	if !ok {
+		return 0, Limit{}, false
+	}
+	account := l.account(clientID, limit, time.Now())
+	return account.Spent, limit, account.Spent >= limit.Amount
+}
+
+// Limited reports whether a client has a budget
+func (l *Ledger) Limited(clientID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.limits[clientID]
+	return ok
+}
+
+// Chargeable reports whether a client's requests to model can be charged: the client
+// has no budget, or the model has a price
+func (l *Ledger) Chargeable(clientID, model string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.limits[clientID]; !ok {
+		return true
+	}
+	_, ok := l.prices[model]
+	return ok
+}
+
+// Charge adds the cost of a request to a client's spend and returns it. It reports
+// false when the model has no configured price.
+func (l *Ledger) Charge(clientID, model string, promptTokens, completionTokens int64) (float64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.limits[clientID]
+	if !ok {
+		return 0, true, nil
+	}
+	price, ok := l.prices[model]
+	if !ok {
+		return 0, false, nil
+	}
+	cost := (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1000
+	l.account(clientID, limit, time.Now()).Spent += cost
+	return cost, true, l.save()
+}
+
+// SetLimit sets the limit of a client, or removes it when limit is nil, e.g. for keys
+// created and deleted at runtime
+func (l *Ledger) SetLimit(clientID string, limit *Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit == nil {
+		delete(l.limits, clientID)
+		return
+	}
+	if l.limits == nil {
+		l.limits = make(map[string]Limit)
+	}
+	l.limits[clientID] = *limit
+}
+
+// account returns the client's account, starting a new one when the period has rolled over
+func (l *Ledger) account(clientID string, limit Limit, now time.Time) *Account {
+	start := PeriodStart(limit.Period, now)
+	account, ok := l.accounts[clientID]
+	if !ok || !account.PeriodStart.Equal(start) {
+		account = &Account{PeriodStart: start}
+		l.accounts[clientID] = account
+	}
+	return account
+}
+
+// save writes the accounts to the ledger file, replacing it atomically
+func (l *Ledger) save() error {
+	data, err := json.MarshalIndent(l.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// PeriodStart returns the start of the period containing t, in UTC
+func PeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case Daily:
+		return day
+	case Weekly:
+		// Weeks start on Monday
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// ParseLimits parses limits of the form "100" or "100/daily", keyed by client ID.
+// The period defaults to monthly.
+func ParseLimits(values map[string]string) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(values))
+	for clientID, value := range values {
+		amount, period, _ := strings.Cut(value, "/")
+		if period == "" {
+			period = Monthly
+		}
+		if period != Daily && period != Weekly && period != Monthly {
+			return nil, fmt.Errorf("invalid budget period %q for %s", period, clientID)
+		}
+		a, err := strconv.ParseFloat(amount, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid budget %q for %s", amount, clientID)
+		}
+		limits[clientID] = Limit{Amount: a, Period: period}
+	}
+	return limits, nil
+}
+
+// ParsePrices parses prices of the form "prompt:completion" per 1,000 tokens, keyed by model
+func ParsePrices(values map[string]string) (map[string]Price, error) {
+	prices := make(map[string]Price, len(values))
+	for model, value := range values {
+		prompt, completion, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid price %q for %s, expected prompt:completion", value, model)
+		}
+		p, err := strconv.ParseFloat(prompt, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prompt price %q for %s", prompt, model)
+		}
+		c, err := strconv.ParseFloat(completion, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid completion price %q for %s", completion, model)
+		}
+		prices[model] = Price{Prompt: p, Completion: c}
+	}
+	return prices, nil
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Entry is a cached upstream response
+type Entry struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Cache stores upstream responses by canonical request hash
+type Cache interface {
+	// Get returns the entry stored under key, or nil when there is none
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Set stores an entry under key for the given time to live
+	Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) error
+}
+
+// MemoryCache is an in-process LRU cache bounded by a maximum number of entries
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // front is most recently used
+	items      map[string]*list.Element
+}
+
+// memoryItem is an element of the LRU list
+type memoryItem struct {
+	key     string
+	entry   *Entry
+	expires time.Time
+}
+
+// NewMemoryCache creates an in-memory cache holding at most maxEntries responses
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// Get implements the Cache interface
+func (c *MemoryCache) Get(_ context.Context, key string) (*Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return nil, nil
+	}
+	item := element.Value.(*memoryItem)
+	if time.Now().After(item.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		return nil, nil
+	}
+	c.order.MoveToFront(element)
+	return item.entry, nil
+}
+
+// Set implements the Cache interface
+func (c *MemoryCache) Set(_ context.Context, key string, entry *Entry, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		element.Value = &memoryItem{key: key, entry: entry, expires: time.Now().Add(ttl)}
+		c.order.MoveToFront(element)
+		return nil
+	}
+
+	c.items[key] = c.order.PushFront(&memoryItem{key: key, entry: entry, expires: time.Now().Add(ttl)})
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds each Redis command so a slow Redis can't stall requests
+	redisTimeout = 2 * time.Second
+	// redisBackoff is how long Redis is skipped after a failure before it is retried
+	redisBackoff = 30 * time.Second
+	// redisMaxIdle is the number of idle connections kept for reuse
+	redisMaxIdle = 8
+)
+
+// RedisOptions configures a RedisCache
+type RedisOptions struct {
+	Addr     string
+	Password string
+	DB       int
+	TLS      bool   // required by Azure Cache for Redis on port 6380
+	Prefix   string // prepended to every key
+}
+
+// RedisCache stores responses in Redis so that cache hits are shared across proxy
+// replicas and survive restarts. It speaks just enough of the RESP protocol for GET
+// and SET. When Redis is unavailable the cache degrades to always missing and is
+// retried after a backoff.
+type RedisCache struct {
+	opts RedisOptions
+
+	mu               sync.Mutex
+	idle             []*redisConn
+	unavailableUntil time.Time
+}
+
+// redisConn is a single connection to Redis
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// errRedisUnavailable is returned while Redis is in its failure backoff
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// NewRedisCache creates a Redis-backed cache. The connection is checked eagerly so
+// misconfiguration shows up in the startup logs, but a failure is not fatal.
+func NewRedisCache(opts RedisOptions) *RedisCache {
+	c := &RedisCache{opts: opts}
+	if _, err := c.do(context.Background(), "PING"); err == nil {
+		log.Printf("Connected to Redis at %s", opts.Addr)
+	}
+	return c
+}
+
+// Get implements the Cache interface
+func (c *RedisCache) Get(ctx context.Context, key string) (*Entry, error) {
+	reply, err := c.do(ctx, "GET", c.opts.Prefix+key)
+	if errors.Is(err, errRedisUnavailable) {
+		// Already reported when Redis failed; behave as an empty cache meanwhile
+		return nil, nil
+	}
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected Redis reply %T", reply)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Set implements the Cache interface
+func (c *RedisCache) Set(ctx context.Context, key string, entry *Entry, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "SET", c.opts.Prefix+key, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if errors.Is(err, errRedisUnavailable) {
+		return nil
+	}
+	return err
+}
+
+// do runs a single command, tracking availability
+func (c *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(redisTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.conn.SetDeadline(deadline); err != nil {
+		c.fail(conn, err)
+		return nil, err
+	}
+
+	if err := writeCommand(conn.conn, args); err != nil {
+		c.fail(conn, err)
+		return nil, err
+	}
+	reply, err := readReply(conn.reader)
+	if err != nil {
+		var redisErr redisError
+		if errors.As(err, &redisErr) {
+			// The server answered, so the connection is still usable
+			c.put(conn)
+		} else {
+			c.fail(conn, err)
+		}
+		return nil, err
+	}
+
+	c.put(conn)
+	return reply, nil
+}
+
+// get returns an idle connection or dials a new one
+func (c *RedisCache) get(ctx context.Context) (*redisConn, error) {
+	c.mu.Lock()
+	if time.Now().Before(c.unavailableUntil) {
+		c.mu.Unlock()
+		return nil, errRedisUnavailable
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		c.fail(nil, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial opens and prepares a new connection
+func (c *RedisCache) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.opts.TLS {
+		host, _, _ := net.SplitHostPort(c.opts.Addr)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", c.opts.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	var setup [][]string
+	if c.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", c.opts.Password})
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.DB)})
+	}
+	for _, args := range setup {
+		if err := conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := writeCommand(conn, args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := readReply(rc.reader); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis %s failed: %v", args[0], err)
+		}
+	}
+	return rc, nil
+}
+
+// put returns a healthy connection to the idle pool
+func (c *RedisCache) put(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= redisMaxIdle {
+		conn.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// fail closes a broken connection and backs off from Redis
+func (c *RedisCache) fail(conn *redisConn, err error) {
+	if conn != nil {
+		conn.conn.Close()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.unavailableUntil) {
+		return
+	}
+	c.unavailableUntil = time.Now().Add(redisBackoff)
+	for _, idle := range c.idle {
+		idle.conn.Close()
+	}
+	c.idle = nil
+	log.Printf("Warning: Redis at %s unavailable, caching disabled for %v: %v", c.opts.Addr, redisBackoff, err)
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// writeCommand encodes a command as a RESP array of bulk strings
+func writeCommand(w io.Writer, args []string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readReply decodes a single RESP reply. Bulk strings are returned as []byte, nil
+// bulk strings as nil, integers as int64 and simple strings as string.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed Redis reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type %q", line[0])
+}
@@ -0,0 +1,149 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a full-fidelity copy of a request that failed upstream
+type Record struct {
+	Timestamp time.Time
+	Method    string
+	Path      string
+	RawQuery  string
+	Header    http.Header
+	Body      []byte // encoded as base64 so binary bodies survive the round trip
+	Status    int    // upstream status code, 0 when the request failed at the transport level
+	Error     string
+}
+
+// Writer appends dead-letter records to a file
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewWriter creates a writer that appends to the given file
+func NewWriter(filename string) (*Writer, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file}, nil
+}
+
+// Write appends a record to the dead-letter file
+func (w *Writer) Write(record Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return json.NewEncoder(w.file).Encode(record)
+}
+
+// Close closes the dead-letter file
+func (w *Writer) Close() {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			log.Printf("Error closing dead-letter file: %v", err)
+		}
+	}
+}
+
+// Replay sends every record in the dead-letter file to the target, with the
+// credentials authorize sets, as records are stored without any. Records that fail
+// again are written to failed, if provided, so they can be replayed later.
+func Replay(filename string, target *url.URL, client *http.Client, authorize func(*http.Request), failed *Writer) (replayed, failedCount int, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record Record
+			if err := json.Unmarshal(line, &record); err != nil {
+				return replayed, failedCount, fmt.Errorf("failed to parse dead-letter record: %v", err)
+			}
+
+			if err := send(client, target, authorize, record); err != nil {
+				log.Printf("Replay of %s %s failed: %v", record.Method, record.Path, err)
+				failedCount++
+				if failed != nil {
+					record.Timestamp = time.Now()
+					record.Error = err.Error()
+					if err := failed.Write(record); err != nil {
+						return replayed, failedCount, fmt.Errorf("failed to write dead-letter record: %v", err)
+					}
+				}
+			} else {
+				log.Printf("Replayed %s %s", record.Method, record.Path)
+				replayed++
+			}
+		}
+
+		if readErr == io.EOF {
+			return replayed, failedCount, nil
+		}
+		if readErr != nil {
+			return replayed, failedCount, readErr
+		}
+	}
+}
+
+// send replays a single record against the target, with the credentials authorize sets.
+// Responses other than 2xx are failures.
+func send(client *http.Client, target *url.URL, authorize func(*http.Request), record Record) error {
+	reqURL := *target
+	reqURL.Path = singleJoiningSlash(target.Path, record.Path)
+	reqURL.RawQuery = record.RawQuery
+
+	req, err := http.NewRequest(record.Method, reqURL.String(), bytes.NewReader(record.Body))
+	if err != nil {
+		return err
+	}
+	for key, values := range record.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	authorize(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+
+	// Anything but success keeps the record, so a wrong key or target loses nothing
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return nil
+}
+
+// singleJoiningSlash joins two URL paths the same way httputil.ReverseProxy does
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
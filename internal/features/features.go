@@ -0,0 +1,153 @@
+// Package features gates experimental behaviors of the proxy behind flags, so they can
+// be rolled out gradually, per deployment, without separate builds
+package features
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flags of the proxy's experimental behaviors. A behavior whose flag is not configured
+// is enabled whenever its own settings enable it.
+const (
+	// SemanticCache serves responses to similar prompts from the semantic cache
+	SemanticCache = "semantic_cache"
+	// SSEDump writes the raw streams of SSE_DUMP_DEPLOYMENTS to SSE_DUMP_DIR
+	SSEDump = "sse_dump"
+)
+
+// known are the flags that may be configured
+var known = map[string]bool{
+	SemanticCache: true,
+	SSEDump:       true,
+}
+
+// Flag is the rollout of a feature: the percentage of clients it is enabled for, which
+// may differ per deployment
+type Flag struct {
+	Rollout     int            `json:"rollout"`
+	Deployments map[string]int `json:"deployments,omitempty"`
+}
+
+// Flags holds the rollout of every known feature. The zero value and nil enable all of
+// them.
+type Flags struct {
+	flags map[string]Flag
+}
+
+// Parse parses flag settings such as "semantic_cache=10%" and, for a single
+// deployment, "semantic_cache@gpt-4o=on". Values are "on", "off" or a percentage.
+func Parse(values map[string]string) (*Flags, error) {
+	f := &Flags{flags: make(map[string]Flag)}
+	for name := range known {
+		f.flags[name] = Flag{Rollout: 100}
+	}
+
+	// Apply the feature-wide settings first, so the order of the deployment ones does not matter
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return !strings.Contains(keys[i], "@") && strings.Contains(keys[j], "@")
+	})
+
+	for _, key := range keys {
+		name, deployment, perDeployment := strings.Cut(key, "@")
+		if !known[name] {
+			return nil, fmt.Errorf("unknown feature flag %q, expected one of %s", name, strings.Join(Names(), ", "))
+		}
+		rollout, err := parseRollout(values[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollout %q for feature flag %s: %v", values[key], key, err)
+		}
+
+		flag := f.flags[name]
+		if !perDeployment {
+			flag.Rollout = rollout
+		} else {
+			if deployment == "" {
+				return nil, fmt.Errorf("feature flag %s names no deployment after @", key)
+			}
+			if flag.Deployments == nil {
+				flag.Deployments = make(map[string]int)
+			}
+			flag.Deployments[deployment] = rollout
+		}
+		f.flags[name] = flag
+	}
+	return f, nil
+}
+
+// parseRollout parses "on", "off" or a percentage such as "25%" or "25"
+func parseRollout(value string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "on", "true":
+		return 100, nil
+	case "off", "false":
+		return 0, nil
+	}
+	percent, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "%"))
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("expected on, off or a percentage between 0 and 100")
+	}
+	return percent, nil
+}
+
+// Names returns the known feature flags in order
+func Names() []string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled reports whether a feature is enabled for a request to deployment. Requests
+// with the same key, such as a client ID, get the same answer for a given rollout, so
+// raising it enables the feature for more clients without switching it off for any.
+// Without a key, the request is enabled at random.
+func (f *Flags) Enabled(name, deployment, key string) bool {
+	if f == nil {
+		return true
+	}
+	flag, ok := f.flags[name]
+	if !ok {
+		return true
+	}
+	rollout := flag.Rollout
+	if r, ok := flag.Deployments[deployment]; ok {
+		rollout = r
+	}
+
+	switch {
+	case rollout >= 100:
+		return true
+	case rollout <= 0:
+		return false
+	case key == "":
+		return rand.IntN(100) < rollout
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + key))
+	return int(h.Sum32()%100) < rollout
+}
+
+// All returns the rollout of every known feature, by flag name
+func (f *Flags) All() map[string]Flag {
+	all := make(map[string]Flag, len(known))
+	for name := range known {
+		all[name] = Flag{Rollout: 100}
+		if f != nil {
+			if flag, ok := f.flags[name]; ok {
+				all[name] = flag
+			}
+		}
+	}
+	return all
+}
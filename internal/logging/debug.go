@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// debug controls whether Debugf messages are written
+var debug atomic.Bool
+
+// SetDebug enables or disables debug messages
+func SetDebug(enabled bool) {
+	debug.Store(enabled)
+}
+
+// Debugf writes a message to the standard logger when debug messages are enabled
+func Debugf(format string, v ...interface{}) {
+	if debug.Load() {
+		log.Printf("Debug: "+format, v...)
+	}
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupKey identifies entries that are duplicates of one another
+type dedupKey struct {
+	path   string
+	status int
+	err    string
+}
+
+// dedupState tracks an error logged in the current window
+type dedupState struct {
+	method     string
+	suppressed int
+}
+
+// DedupLogger logs the first of a run of identical error entries, keyed by path, status
+// and error message, and suppresses the rest until the window ends. Every window it
+// logs how many duplicates were suppressed, so floods during an outage stay visible
+// without drowning out other entries.
+type DedupLogger struct {
+	Logger
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[dedupKey]*dedupState
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDedupLogger wraps logger so that duplicate error entries within window are
+// suppressed. Close must be called to stop it and log the final counts.
+func NewDedupLogger(logger Logger, window time.Duration) *DedupLogger {
+	l := &DedupLogger{
+		Logger: logger,
+		window: window,
+		seen:   make(map[dedupKey]*dedupState),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// LogRequest logs the entry unless it duplicates an error already logged in this
+// window. Successful and debug entries are always logged.
+func (l *DedupLogger) LogRequest(entry Entry) {
+	if entry.Debug || (entry.Status < 400 && entry.Error == "") {
+		l.Logger.LogRequest(entry)
+		return
+	}
+
+	key := dedupKey{path: entry.Path, status: entry.Status, err: entry.Error}
+	l.mu.Lock()
+	if state, ok := l.seen[key]; ok {
+		state.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	l.seen[key] = &dedupState{method: entry.Method}
+	l.mu.Unlock()
+
+	l.Logger.LogRequest(entry)
+}
+
+// run flushes the suppressed counts at the end of every window
+func (l *DedupLogger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// flush logs a summary entry for every error with suppressed duplicates and starts a
+// new window, in which the next occurrence of each error is logged again
+func (l *DedupLogger) flush() {
+	l.mu.Lock()
+	seen := l.seen
+	l.seen = make(map[dedupKey]*dedupState)
+	l.mu.Unlock()
+
+	for key, state := range seen {
+		if state.suppressed == 0 {
+			continue
+		}
+		l.Logger.LogRequest(Entry{
+			Timestamp:  time.Now(),
+			Path:       key.path,
+			Method:     state.method,
+			Status:     key.status,
+			Error:      key.err,
+			Suppressed: state.suppressed,
+		})
+	}
+}
+
+// Degraded reports whether the wrapped logger has failed over, if it can
+func (l *DedupLogger) Degraded() bool {
+	degradable, ok := l.Logger.(interface{ Degraded() bool })
+	return ok && degradable.Degraded()
+}
+
+// Close logs the remaining suppressed counts and closes the wrapped logger
+func (l *DedupLogger) Close() {
+	close(l.stop)
+	<-l.done
+	l.flush()
+	l.Logger.Close()
+}
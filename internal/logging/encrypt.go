@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// encrypted names the Entry fields holding prompt and response content, which are
+// encrypted when the logger has a key
+var encrypted = []string{"RequestBody", "Response"}
+
+// LoadKey decodes a base64 AES key given directly or, when value is empty, read from file
+func LoadKey(value, file string) ([]byte, error) {
+	if value == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key: %v", err)
+		}
+		value = string(data)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return key, nil
+}
+
+// NewCipher returns the AES-GCM cipher for a 16, 24 or 32 byte key
+func NewCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// WithEncryption encrypts the RequestBody and Response of every entry with aead. Other
+// fields stay in plaintext so the log can still be queried.
+func WithEncryption(aead cipher.AEAD) Option {
+	return func(l *FileLogger) {
+		l.aead = aead
+	}
+}
+
+// encryptEntry replaces the content fields of entry with their base64 ciphertext. A
+// field that cannot be encrypted is left out rather than logged in plaintext.
+func encryptEntry(aead cipher.AEAD, entry *Entry) {
+	fields := []*interface{}{&entry.RequestBody, &entry.Response}
+	for i, field := range fields {
+		ciphertext, err := encryptField(aead, encrypted[i], *field)
+		if err != nil {
+			log.Printf("Error encrypting %s of log entry, leaving it out: %v", encrypted[i], err)
+		}
+		*field = ciphertext
+	}
+	entry.Encrypted = true
+}
+
+// encryptField seals the JSON encoding of v with a random nonce, authenticating the
+// field name so ciphertexts cannot be swapped between fields. The result is the
+// base64 of the nonce followed by the ciphertext.
+func encryptField(aead cipher.AEAD, name string, v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	plaintext := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+// decryptField reverses encryptField, returning the JSON encoding of the field
+func decryptField(aead cipher.AEAD, name, value string) (json.RawMessage, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// DecryptLine decrypts the content fields of one encoded log entry. Lines of entries
+// that were not encrypted are returned unchanged.
+func DecryptLine(aead cipher.AEAD, line []byte) ([]byte, error) {
+	var entry formattedEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("invalid log entry: %v", err)
+	}
+	if !entry.Encrypted {
+		return line, nil
+	}
+
+	fields := []*interface{}{&entry.RequestBody, &entry.Response}
+	for i, field := range fields {
+		value, _ := (*field).(string)
+		if value == "" {
+			*field = nil
+			continue
+		}
+		plaintext, err := decryptField(aead, encrypted[i], value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", encrypted[i], err)
+		}
+		*field = plaintext
+	}
+	entry.Encrypted = false
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
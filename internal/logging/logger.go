@@ -1,21 +1,85 @@
 package logging
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"encoding/json"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
+const (
+	// failoverThreshold is the number of consecutive write failures after which
+	// entries are written to stdout instead of the log file
+	failoverThreshold = 3
+	// recoveryInterval is how often a failed-over logger tries to reopen its file
+	recoveryInterval = 30 * time.Second
+)
+
 // Entry represents a single request/response pair log entry
 type Entry struct {
-	Timestamp     time.Time
-	RequestBody   interface{}
-	Response      interface{}
-	Duration      time.Duration
-	Path          string
-	Method        string
-	CorrelationID string // Azure APIM correlation ID for linking with diagnostic logs
+	Timestamp             time.Time
+	RequestBody           interface{}
+	Response              interface{}
+	Duration              time.Duration
+	Path                  string
+	Method                string
+	Status                int               // response status code, 0 when no response was received
+	CorrelationID         string            // Azure APIM correlation ID for linking with diagnostic logs
+	ExternalCorrelationID string            `json:",omitempty"` // correlation ID assigned by the calling gateway (X-Correlation-ID by default)
+	ClientID              string            `json:",omitempty"` // identity of the authenticated client
+	ClientOwner           string            `json:",omitempty"` // team or person owning the client's API key
+	Tags                  map[string]string `json:",omitempty"` // tags of the client's API key, such as team or cost center
+	Subject               string            `json:",omitempty"` // subject (sub claim) of the client's bearer token
+	User                  string            `json:",omitempty"` // user name (preferred_username or upn claim) of the client's bearer token
+	TaskID                string            `json:",omitempty"` // client-supplied X-Task-ID grouping the calls of one logical task
+	RejectedBy            string            `json:",omitempty"` // check that rejected the request before it was forwarded
+	Error                 string            `json:",omitempty"` // error message of rejected or failed requests
+	Suppressed            int               `json:",omitempty"` // duplicates of this error left out of the log during the last window
+	CacheHit              bool              `json:",omitempty"` // response was served from the proxy's cache
+	Region                string            `json:",omitempty"` // Azure region that served the request, from response headers
+	RoutedFrom            string            `json:",omitempty"` // deployment the client targeted when the request was rerouted by size
+	ModelTarget           string            `json:",omitempty"` // backend/deployment the requested model was routed to, e.g. to compare canaries
+	DegradedFrom          string            `json:",omitempty"` // premium deployment the request was moved away from under load
+	DegradedTo            string            `json:",omitempty"` // cheaper deployment that served the degraded request
+	Upstream              string            `json:",omitempty"` // host of the upstream that answered the request
+	APIVersion            string            `json:",omitempty"` // api-version the request was finally sent with, after any upgrade
+	Trailers              map[string]string `json:",omitempty"` // HTTP trailers sent after the response body
+	RequestSize           int64             `json:",omitempty"` // body size of requests rejected as too large, a lower bound if it had no Content-Length
+	Attempts              []Attempt         `json:",omitempty"` // every upstream attempt made for the request, when enabled
+	Moderation            map[string]int    `json:",omitempty"` // Content Safety severity per category of the prompt
+	ImageCount            int               `json:",omitempty"` // image parts in the request messages, inline or by URL
+	Multimodal            bool              `json:",omitempty"` // request messages contained non-text parts such as images or audio
+	ToolCallRound         int               `json:",omitempty"` // tool-call round within the task when the response requested tool calls
+	ToolCalls             []string          `json:",omitempty"` // names of the tools the response requested
+	StreamTiming          *StreamTiming     `json:",omitempty"` // arrival of the events of streamed responses
+	StreamDump            string            `json:",omitempty"` // file holding the raw event stream, when dumped
+	Encrypted             bool              `json:",omitempty"` // RequestBody and Response hold base64 AES-GCM ciphertext
+
+	// Debug entries were requested with X-Debug-Log by a trusted client. They are never
+	// sampled out and include the headers of the exchange, with credentials redacted.
+	Debug           bool        `json:",omitempty"`
+	RequestHeaders  http.Header `json:",omitempty"`
+	ResponseHeaders http.Header `json:",omitempty"`
+}
+
+// StreamTiming describes how the events of a streamed response arrived
+type StreamTiming struct {
+	Chunks      int
+	FirstToLast time.Duration // time between the first and last event
+	MaxGap      time.Duration // longest wait between two consecutive events
+}
+
+// Attempt is one upstream call made for a client request
+type Attempt struct {
+	Upstream string
+	Status   int `json:",omitempty"` // 0 when the attempt failed without a response
+	Duration time.Duration
+	Error    string `json:",omitempty"`
 }
 
 // Logger interface defines logging behavior
@@ -24,34 +88,161 @@ type Logger interface {
 	Close()
 }
 
-// FileLogger implements logging to a file
+// FileLogger implements logging to a file. When the file becomes unwritable it
+// fails over to stdout, so the platform still captures entries, and periodically
+// tries to recover the file.
 type FileLogger struct {
-	file *os.File
+	mu              sync.Mutex
+	filename        string
+	file            *os.File
+	fallback        io.Writer
+	timestampLayout string
+	location        *time.Location
+	aead            cipher.AEAD // encrypts entry content when set
+
+	failures     int // consecutive failed writes to the file
+	failedOver   bool
+	lastRecovery time.Time
+}
+
+// Option configures a FileLogger
+type Option func(*FileLogger)
+
+// namedLayouts maps layout names accepted by WithTimestampFormat to time layouts
+var namedLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"DateTime":    time.DateTime,
+	"StampMilli":  time.StampMilli,
 }
 
-// NewFileLogger creates a new file logger
-func NewFileLogger(filename string) (*FileLogger, error) {
+// WithTimestampFormat sets the layout and time zone of logged timestamps. The layout
+// is either a Go time layout or the name of a standard one such as "RFC3339".
+func WithTimestampFormat(layout string, location *time.Location) Option {
+	return func(l *FileLogger) {
+		if named, ok := namedLayouts[layout]; ok {
+			layout = named
+		}
+		l.timestampLayout = layout
+		l.location = location
+	}
+}
+
+// NewFileLogger creates a new file logger. Timestamps default to RFC3339Nano in UTC.
+func NewFileLogger(filename string, opts ...Option) (*FileLogger, error) {
 	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
 		return nil, err
 	}
-	return &FileLogger{file: file}, nil
+
+	logger := &FileLogger{
+		filename:        filename,
+		file:            file,
+		fallback:        os.Stdout,
+		timestampLayout: time.RFC3339Nano,
+		location:        time.UTC,
+	}
+	for _, opt := range opts {
+		opt(logger)
+	}
+	return logger, nil
+}
+
+// formattedEntry is an Entry whose timestamp is rendered with the logger's layout and
+// time zone instead of the host's local zone. The Timestamp field shadows Entry.Timestamp.
+type formattedEntry struct {
+	Timestamp string
+	Entry
 }
 
 // LogRequest logs a request and response to the file
 func (l *FileLogger) LogRequest(entry Entry) {
-	enc := json.NewEncoder(l.file)
+	if l.aead != nil {
+		encryptEntry(l.aead, &entry)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
 	enc.SetEscapeHTML(false) // prevents HTML escaping for cleaner logs
-	if err := enc.Encode(entry); err != nil {
+	if err := enc.Encode(formattedEntry{
+		Timestamp: entry.Timestamp.In(l.location).Format(l.timestampLayout),
+		Entry:     entry,
+	}); err != nil {
 		log.Printf("Error encoding log entry: %v", err)
-	} else {
-		// Log a brief confirmation to stdout
-		log.Printf("Logged %s %s - %v", entry.Method, entry.Path, entry.Duration)
+		return
 	}
+
+	l.mu.Lock()
+	l.write(buf.Bytes())
+	l.mu.Unlock()
+
+	// Log a brief confirmation to stdout
+	log.Printf("Logged %s %s - %v", entry.Method, entry.Path, entry.Duration)
+}
+
+// write writes an encoded entry to the log file, or to the fallback writer when the
+// file is unwritable. Callers must hold l.mu.
+func (l *FileLogger) write(data []byte) {
+	if l.failedOver {
+		l.tryRecover()
+	}
+
+	if !l.failedOver {
+		_, err := l.file.Write(data)
+		if err == nil {
+			l.failures = 0
+			return
+		}
+
+		l.failures++
+		log.Printf("Error writing log entry to %s: %v", l.filename, err)
+		if l.failures >= failoverThreshold {
+			log.Printf("Warning: %d consecutive write failures, logging entries to stdout until %s is writable again", l.failures, l.filename)
+			l.failedOver = true
+			l.lastRecovery = time.Now()
+		}
+	}
+
+	// Never drop the entry: the platform still captures stdout
+	if _, err := l.fallback.Write(data); err != nil {
+		log.Printf("Error writing log entry to stdout: %v", err)
+	}
+}
+
+// tryRecover reopens the log file at most once per recovery interval. Callers must hold l.mu.
+func (l *FileLogger) tryRecover() {
+	if time.Since(l.lastRecovery) < recoveryInterval {
+		return
+	}
+	l.lastRecovery = time.Now()
+
+	file, err := os.OpenFile(l.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Log file %s still unavailable: %v", l.filename, err)
+		return
+	}
+
+	if err := l.file.Close(); err != nil {
+		log.Printf("Error closing log file: %v", err)
+	}
+	l.file = file
+	l.failures = 0
+	l.failedOver = false
+	log.Printf("Log file %s recovered, no longer logging entries to stdout", l.filename)
+}
+
+// Degraded reports whether the logger has failed over to stdout
+func (l *FileLogger) Degraded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failedOver
 }
 
 // Close closes the log file
 func (l *FileLogger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	if l.file != nil {
 		if err := l.file.Close(); err != nil {
 			log.Printf("Error closing log file: %v", err)
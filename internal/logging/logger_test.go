@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRequestTimestampIsUTC(t *testing.T) {
+	t.Setenv("TZ", "Europe/Berlin")
+	local := time.Local
+	time.Local = time.FixedZone("CEST", 2*60*60)
+	defer func() { time.Local = local }()
+
+	filename := filepath.Join(t.TempDir(), "log.json")
+	logger, err := NewFileLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	logger.LogRequest(Entry{Timestamp: now, Method: "POST", Path: "/openai/deployments/gpt-4o/chat/completions"})
+	logger.Close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry struct{ Timestamp string }
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("decoding %q: %v", data, err)
+	}
+	if !strings.HasSuffix(entry.Timestamp, "Z") {
+		t.Errorf("timestamp %q is not in UTC", entry.Timestamp)
+	}
+	if logged, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err != nil || !logged.Equal(now) {
+		t.Errorf("timestamp %q does not parse to %v: %v", entry.Timestamp, now, err)
+	}
+}
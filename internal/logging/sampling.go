@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+)
+
+// SampledLogger logs a fraction of entries, with per-client rates overriding the
+// global rate so selected clients can always (or never) be logged
+type SampledLogger struct {
+	Logger
+	mu          sync.RWMutex
+	rate        float64
+	clientRates map[string]float64
+}
+
+// NewSampledLogger wraps logger so that entries are logged with probability rate, or
+// the rate of their ClientID in clientRates
+func NewSampledLogger(logger Logger, rate float64, clientRates map[string]float64) *SampledLogger {
+	return &SampledLogger{Logger: logger, rate: rate, clientRates: clientRates}
+}
+
+// LogRequest logs the entry if it is sampled. Debug entries are always logged.
+func (l *SampledLogger) LogRequest(entry Entry) {
+	if entry.Debug {
+		l.Logger.LogRequest(entry)
+		return
+	}
+	l.mu.RLock()
+	rate, ok := l.clientRates[entry.ClientID]
+	if !ok {
+		rate = l.rate
+	}
+	l.mu.RUnlock()
+	if rate >= 1 || (rate > 0 && rand.Float64() < rate) {
+		l.Logger.LogRequest(entry)
+	}
+}
+
+// SetRates replaces the sampling rates, e.g. when the configuration is reloaded
+func (l *SampledLogger) SetRates(rate float64, clientRates map[string]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.clientRates = clientRates
+}
+
+// Degraded reports whether the wrapped logger has failed over, if it can
+func (l *SampledLogger) Degraded() bool {
+	degradable, ok := l.Logger.(interface{ Degraded() bool })
+	return ok && degradable.Degraded()
+}
+
+// ParseSampleRates parses per-client sampling overrides: "always", "never" or a rate between 0 and 1
+func ParseSampleRates(values map[string]string) (map[string]float64, error) {
+	rates := make(map[string]float64, len(values))
+	for clientID, value := range values {
+		switch value {
+		case "always":
+			rates[clientID] = 1
+		case "never":
+			rates[clientID] = 0
+		default:
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q for %s, expected always, never or 0-1", value, clientID)
+			}
+			rates[clientID] = rate
+		}
+	}
+	return rates, nil
+}
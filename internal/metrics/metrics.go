@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and renders them in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// metric is implemented by every metric type in the registry
+type metric interface {
+	write(sb *strings.Builder, name string)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Counter registers a counter with the given label names
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	v := newVec("counter", help, labels)
+	r.register(name, v)
+	return v
+}
+
+// Gauge registers a gauge with the given label names
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	v := newVec("gauge", help, labels)
+	r.register(name, v)
+	return v
+}
+
+// GaugeFunc registers a gauge whose value is read from fn at scrape time
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &gaugeFunc{help: help, fn: fn})
+}
+
+// register adds a metric to the registry, panicking on duplicate names
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.metrics[name]; exists {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		r.metrics[name].write(&sb, name)
+	}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(sb.String()))
+}
+
+// Vec is a counter or gauge partitioned by label values
+type Vec struct {
+	kind   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+// newVec creates an empty Vec
+func newVec(kind, help string, labels []string) *Vec {
+	return &Vec{
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		keys:   make(map[string][]string),
+	}
+}
+
+// Inc adds one to the series with the given label values
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Add adds delta to the series with the given label values
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+// Set sets the series with the given label values
+func (v *Vec) Set(value float64, labelValues ...string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+// Reset removes every series, e.g. before setting those of a changed set of clients
+func (v *Vec) Reset() {
+	v.mu.Lock()
+	v.values = make(map[string]float64)
+	v.keys = make(map[string][]string)
+	v.mu.Unlock()
+}
+
+// key returns the map key for a set of label values, remembering the values for output
+func (v *Vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	if _, ok := v.keys[key]; !ok {
+		v.keys[key] = append([]string(nil), labelValues...)
+	}
+	v.mu.Unlock()
+	return key
+}
+
+// write renders the Vec
+func (v *Vec) write(sb *strings.Builder, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeHeader(sb, name, v.help, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sb.WriteString(name)
+		writeLabels(sb, v.labels, v.keys[key])
+		sb.WriteString(" ")
+		sb.WriteString(formatValue(v.values[key]))
+		sb.WriteString("\n")
+	}
+}
+
+// gaugeFunc is a gauge computed at scrape time
+type gaugeFunc struct {
+	help string
+	fn   func() float64
+}
+
+// write renders the gauge
+func (g *gaugeFunc) write(sb *strings.Builder, name string) {
+	writeHeader(sb, name, g.help, "gauge")
+	sb.WriteString(name + " " + formatValue(g.fn()) + "\n")
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(sb *strings.Builder, name, help, kind string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLabels writes a label set such as {status="200"}
+func writeLabels(sb *strings.Builder, names, values []string) {
+	if len(names) == 0 {
+		return
+	}
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(name + "=" + strconv.Quote(values[i]))
+	}
+	sb.WriteString("}")
+}
+
+// formatValue formats a sample value
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"log"
+	"runtime"
+	rtmetrics "runtime/metrics"
+	"time"
+)
+
+// leakSamples is the number of consecutive increases in goroutine count after which a
+// possible leak is reported
+const leakSamples = 5
+
+// RegisterRuntime adds Go runtime metrics to the registry: goroutines, heap usage and
+// garbage collection
+func (r *Registry) RegisterRuntime() {
+	r.GaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.GaugeFunc("go_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		return readRuntimeMetric("/memory/classes/heap/objects:bytes")
+	})
+	r.GaugeFunc("go_memory_total_bytes", "Bytes of memory mapped by the Go runtime.", func() float64 {
+		return readRuntimeMetric("/memory/classes/total:bytes")
+	})
+	r.GaugeFunc("go_gc_cycles_total", "Completed garbage collection cycles.", func() float64 {
+		return readRuntimeMetric("/gc/cycles/total:gc-cycles")
+	})
+	r.GaugeFunc("go_gc_pause_total_seconds", "Cumulative time the program was stopped for garbage collection.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return time.Duration(stats.PauseTotalNs).Seconds()
+	})
+}
+
+// readRuntimeMetric reads a single scalar metric from runtime/metrics
+func readRuntimeMetric(name string) float64 {
+	sample := []rtmetrics.Sample{{Name: name}}
+	rtmetrics.Read(sample)
+	switch sample[0].Value.Kind() {
+	case rtmetrics.KindUint64:
+		return float64(sample[0].Value.Uint64())
+	case rtmetrics.KindFloat64:
+		return sample[0].Value.Float64()
+	}
+	return 0
+}
+
+// WatchGoroutines checks the goroutine count every interval until stop is closed, and
+// logs a warning when it exceeds threshold or keeps growing, both signs of a leak
+func WatchGoroutines(interval time.Duration, threshold int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous, increases := runtime.NumGoroutine(), 0
+	for {
+		select {
+		case <-ticker.C:
+			count := runtime.NumGoroutine()
+			if threshold > 0 && count > threshold {
+				log.Printf("Warning: %d goroutines running, above the threshold of %d", count, threshold)
+			}
+			if count > previous {
+				increases++
+			} else {
+				increases = 0
+			}
+			if increases >= leakSamples {
+				log.Printf("Warning: goroutine count has grown for %d consecutive checks to %d, possible leak", increases, count)
+			}
+			previous = count
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// apiVersion is the Content Safety API version used for text analysis
+	apiVersion = "2023-10-01"
+	// maxTextLength is the most characters Content Safety analyzes in one call
+	maxTextLength = 10000
+)
+
+// Client analyzes text with Azure AI Content Safety
+type Client struct {
+	endpoint   string
+	key        string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for a Content Safety resource such as
+// https://my-resource.cognitiveservices.azure.com
+func NewClient(endpoint, key string, timeout time.Duration) *Client {
+	return &Client{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		key:        key,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// analyzeRequest is the body of a text:analyze call
+type analyzeRequest struct {
+	Text string `json:"text"`
+}
+
+// analyzeResponse is the result of a text:analyze call
+type analyzeResponse struct {
+	CategoriesAnalysis []struct {
+		Category string `json:"category"`
+		Severity int    `json:"severity"`
+	} `json:"categoriesAnalysis"`
+}
+
+// Analyze returns the highest severity found per category (Hate, SelfHarm, Sexual,
+// Violence). Text longer than a single call allows is analyzed in chunks.
+func (c *Client) Analyze(ctx context.Context, text string) (map[string]int, error) {
+	severities := make(map[string]int)
+	runes := []rune(text)
+	for start := 0; start < len(runes); start += maxTextLength {
+		end := min(start+maxTextLength, len(runes))
+		if err := c.analyze(ctx, string(runes[start:end]), severities); err != nil {
+			return nil, err
+		}
+	}
+	return severities, nil
+}
+
+// analyze analyzes one chunk of text, raising the severities found so far
+func (c *Client) analyze(ctx context.Context, text string, severities map[string]int) error {
+	body, err := json.Marshal(analyzeRequest{Text: text})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/contentsafety/text:analyze?api-version=%s", c.endpoint, apiVersion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ocp-Apim-Subscription-Key", c.key)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("content safety returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	var result analyzeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid content safety response: %v", err)
+	}
+	for _, analysis := range result.CategoriesAnalysis {
+		severities[analysis.Category] = max(severities[analysis.Category], analysis.Severity)
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"azure-ai-proxy/internal/audit"
+	"azure-ai-proxy/internal/auth"
+	"azure-ai-proxy/internal/ratelimit"
+)
+
+// maxConfigPatchSize caps the body of PUT /admin/config
+const maxConfigPatchSize = 1 << 20
+
+// registerAdminRoutes adds the admin endpoints to mux. They are only served while an
+// admin key is configured.
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /admin/ratelimits", s.requireAdmin(s.handleRateLimits))
+	mux.Handle("POST /admin/ratelimits/{name}/reset", s.requireAdmin(s.handleRateLimitReset))
+	mux.Handle("POST /admin/ratelimits/clients/{client}/reset", s.requireAdmin(s.handleClientLimitReset))
+	mux.Handle("POST /admin/ratelimits/deployments/{deployment}/reset", s.requireAdmin(s.handleQuotaReset))
+	mux.Handle("GET /admin/tasks", s.requireAdmin(s.handleTasks))
+	mux.Handle("GET /admin/tasks/{id}", s.requireAdmin(s.handleTask))
+	mux.Handle("GET /admin/features", s.requireAdmin(s.handleFeatures))
+	mux.Handle("GET /admin/keys", s.requireAdmin(s.requireVirtualKeys(s.handleKeys)))
+	mux.Handle("POST /admin/keys", s.requireAdmin(s.requireVirtualKeys(s.handleKeyCreate)))
+	mux.Handle("POST /admin/keys/{name}/disable", s.requireAdmin(s.requireVirtualKeys(s.handleKeyDisable)))
+	mux.Handle("POST /admin/keys/{name}/enable", s.requireAdmin(s.requireVirtualKeys(s.handleKeyEnable)))
+	mux.Handle("DELETE /admin/keys/{name}", s.requireAdmin(s.requireVirtualKeys(s.handleKeyDelete)))
+	mux.Handle("PUT /admin/config", s.requireAdmin(s.handleConfigUpdate))
+	mux.Handle("POST /admin/config/refresh", s.requireAdmin(s.handleConfigRefresh))
+}
+
+// requireAdmin rejects requests that do not carry the admin key in the X-API-Key header
+func (s *Server) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminKey := s.current().adminKey
+		if adminKey == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if addr, ok := s.current().adminIPFilter.allows(r.RemoteAddr); !ok {
+			log.Printf("Rejected %s %s: address %s is not allowed to use admin endpoints", r.Method, r.URL.Path, addr)
+			s.audit(r, "anonymous", "ip filter", audit.Failure, fmt.Sprintf("%s %s: address %s not allowed", r.Method, r.URL.Path, addr))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		action := r.Method + " " + r.URL.Path
+		key, err := auth.HeaderCredential(r, "X-API-Key")
+		if errors.Is(err, auth.ErrConflictingCredentials) {
+			log.Printf("Rejected %s %s: conflicting admin keys from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+			s.audit(r, "anonymous", action, audit.Failure, err.Error())
+			http.Error(w, "Bad Request: X-API-Key header sent more than once with different values", http.StatusBadRequest)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+			log.Printf("Rejected %s %s: invalid admin key", r.Method, r.URL.Path)
+			s.audit(r, "anonymous", action, audit.Failure, "invalid admin key")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		outcome := audit.Success
+		if recorder.status >= 400 {
+			outcome = audit.Failure
+		}
+		s.audit(r, "admin", action, outcome, "")
+	})
+}
+
+// rateLimiters returns the proxy's rate limiters by name
+func (s *Server) rateLimiters() map[string]*ratelimit.AdaptiveLimiter {
+	limiters := make(map[string]*ratelimit.AdaptiveLimiter)
+	if s.limiter != nil {
+		limiters["adaptive"] = s.limiter
+	}
+	return limiters
+}
+
+// handleRateLimits reports the state of every rate limiter by name, the concurrency
+// slots of each client under "clients" and the token quota Azure last reported for
+// each deployment under "deployments"
+func (s *Server) handleRateLimits(w http.ResponseWriter, _ *http.Request) {
+	states := make(map[string]interface{})
+	for name, limiter := range s.rateLimiters() {
+		states[name] = limiter.State()
+	}
+	if s.concurrency != nil {
+		states["clients"] = s.concurrency.States()
+	}
+	if s.quota != nil {
+		states["deployments"] = s.quota.States()
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// handleRateLimitReset resets a single rate limiter
+func (s *Server) handleRateLimitReset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	limiter, ok := s.rateLimiters()[name]
+	if !ok {
+		http.Error(w, "Unknown rate limiter", http.StatusNotFound)
+		return
+	}
+
+	limiter.Reset()
+	log.Printf("Rate limiter %s reset via admin endpoint", name)
+	writeJSON(w, http.StatusOK, map[string]ratelimit.State{name: limiter.State()})
+}
+
+// handleClientLimitReset frees the concurrency slots of a single client
+func (s *Server) handleClientLimitReset(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	if s.concurrency == nil || !s.concurrency.Reset(client) {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	}
+	log.Printf("Concurrency slots of client %s reset via admin endpoint", client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQuotaReset forgets the token quota readings of a single deployment
+func (s *Server) handleQuotaReset(w http.ResponseWriter, r *http.Request) {
+	deployment := r.PathValue("deployment")
+	if s.quota == nil || !s.quota.Reset(deployment) {
+		http.Error(w, "Unknown deployment", http.StatusNotFound)
+		return
+	}
+	log.Printf("Quota of deployment %s reset via admin endpoint", deployment)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTasks lists the latency and token totals of recent tasks
+func (s *Server) handleTasks(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.tasks.List())
+}
+
+// handleTask reports the latency and token totals of a single task
+func (s *Server) handleTask(w http.ResponseWriter, r *http.Request) {
+	summary, ok := s.tasks.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Unknown task", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// ErrNoRemoteConfig is returned by ConfigManager.Refresh when there is no remote
+// configuration to fetch
+var ErrNoRemoteConfig = errors.New("no remote configuration is set up")
+
+// ConfigManager changes the configuration of the running proxy for the admin endpoints.
+// Both methods return an error, leaving the configuration unchanged, if the result
+// would be invalid. The change is audited as done by actor.
+type ConfigManager interface {
+	// Update applies a patch of settings on top of the current configuration. It
+	// refuses settings that only take effect on restart.
+	Update(patch map[string]interface{}, actor string) error
+	// Refresh fetches remote settings after a change notification with sync tokens
+	Refresh(syncTokens []string, actor string) error
+}
+
+// SetConfigManager sets the manager of PUT /admin/config and POST /admin/config/refresh
+func (s *Server) SetConfigManager(manager ConfigManager) {
+	s.configManager = manager
+}
+
+// handleConfigUpdate applies a JSON object of settings, named like the config file's,
+// to the running proxy. A null value removes an earlier runtime change to a setting.
+func (s *Server) handleConfigUpdate(w http.ResponseWriter, r *http.Request) {
+	if s.configManager == nil {
+		http.Error(w, "Runtime configuration updates are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	var patch map[string]interface{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigPatchSize))
+	dec.UseNumber()
+	if err := dec.Decode(&patch); err != nil || patch == nil {
+		http.Error(w, "Bad Request: expected a JSON object of settings", http.StatusBadRequest)
+		return
+	}
+	if err := s.configManager.Update(patch, auditActor(r, "admin")); err != nil {
+		log.Printf("Rejected configuration update via admin endpoint: %v", err)
+		http.Error(w, "Configuration not applied: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	settings := make([]string, 0, len(patch))
+	for name := range patch {
+		settings = append(settings, name)
+	}
+	sort.Strings(settings)
+	log.Printf("Configuration updated via admin endpoint: %s", strings.Join(settings, ", "))
+	writeJSON(w, http.StatusOK, map[string][]string{"applied": settings})
+}
+
+// eventGridEvent is the part of an Event Grid event that POST /admin/config/refresh reads
+type eventGridEvent struct {
+	EventType string `json:"eventType"`
+	Data      struct {
+		ValidationCode string `json:"validationCode"`
+		SyncToken      string `json:"syncToken"`
+	} `json:"data"`
+}
+
+// handleConfigRefresh fetches the remote configuration again. The body is empty or an
+// Event Grid delivery of App Configuration change events, whose sync tokens make sure
+// the changes they report are read; subscription validation events are answered with
+// their validation code.
+func (s *Server) handleConfigRefresh(w http.ResponseWriter, r *http.Request) {
+	if s.configManager == nil {
+		http.Error(w, "Runtime configuration updates are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigPatchSize))
+	if err != nil {
+		http.Error(w, "Bad Request: could not read body", http.StatusBadRequest)
+		return
+	}
+	var events []eventGridEvent
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &events); err != nil {
+			http.Error(w, "Bad Request: expected an array of Event Grid events", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var syncTokens []string
+	for _, event := range events {
+		if event.EventType == "Microsoft.EventGrid.SubscriptionValidationEvent" {
+			log.Printf("Validated Event Grid subscription for configuration changes")
+			writeJSON(w, http.StatusOK, map[string]string{"validationResponse": event.Data.ValidationCode})
+			return
+		}
+		if event.Data.SyncToken != "" {
+			syncTokens = append(syncTokens, event.Data.SyncToken)
+		}
+	}
+
+	err = s.configManager.Refresh(syncTokens, auditActor(r, "admin"))
+	if errors.Is(err, ErrNoRemoteConfig) {
+		http.Error(w, "Remote configuration is not set up", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: configuration not refreshed via admin endpoint: %v", err)
+		http.Error(w, "Configuration not refreshed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
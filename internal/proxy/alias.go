@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+)
+
+// resolveAliasPath points a request whose deployment segment is a model alias at the
+// deployment the alias stands for
+func (s *Server) resolveAliasPath(r *http.Request) {
+	alias := deploymentFromPath(r.URL.Path)
+	deployment, ok := s.current().modelAliases[alias]
+	if !ok || alias == "" {
+		return
+	}
+	setDeployment(r, alias, deployment)
+	log.Printf("Resolved model alias %s to deployment %s for %s %s", alias, deployment, r.Method, r.URL.Path)
+}
+
+// resolveAliasModel replaces a model alias in the model field of a request body and
+// reports whether it did
+func (s *Server) resolveAliasModel(r *http.Request, body map[string]interface{}) bool {
+	alias, _ := body["model"].(string)
+	deployment, ok := s.current().modelAliases[alias]
+	if !ok || alias == "" {
+		return false
+	}
+	body["model"] = deployment
+	log.Printf("Resolved model alias %s to %s in the body of %s %s", alias, deployment, r.Method, r.URL.Path)
+	return true
+}
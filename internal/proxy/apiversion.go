@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// maxErrorBodySize bounds how much of an error response is inspected for the api-version pattern
+const maxErrorBodySize = 64 << 10
+
+// resolvedAPIVersion holds the api-version a request was finally sent with. The
+// Director records the version it forwards and transports that change it update it.
+type resolvedAPIVersion struct {
+	mu      sync.Mutex
+	version string
+}
+
+// set records the api-version of an outgoing request
+func (v *resolvedAPIVersion) set(req *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.version = req.URL.Query().Get("api-version")
+}
+
+// get returns the recorded api-version
+func (v *resolvedAPIVersion) get() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.version
+}
+
+// recordAPIVersion stores the api-version of an outgoing request in its resolved version, if it has one
+func recordAPIVersion(req *http.Request) {
+	if resolved, ok := req.Context().Value(apiVersionKey).(*resolvedAPIVersion); ok {
+		resolved.set(req)
+	}
+}
+
+// pinAPIVersion sends requests without an api-version with the configured one, or
+// every request when it is forced. The api-version of a backend still overrides it.
+func (s *Server) pinAPIVersion(req *http.Request) {
+	st := s.current()
+	query := req.URL.Query()
+	if st.apiVersion == "" || query.Get("api-version") != "" && !st.forceAPIVersion {
+		return
+	}
+	query.Set("api-version", st.apiVersion)
+	req.URL.RawQuery = query.Encode()
+}
+
+// apiVersionOf returns the api-version a request was finally sent with
+func apiVersionOf(req *http.Request) string {
+	if resolved, ok := req.Context().Value(apiVersionKey).(*resolvedAPIVersion); ok {
+		return resolved.get()
+	}
+	return req.URL.Query().Get("api-version")
+}
+
+// apiVersionTransport retries requests with a newer api-version when Azure rejects
+// the requested one with an error matching pattern. Only requests whose body was
+// buffered, or that have none, can be retried.
+type apiVersionTransport struct {
+	transport http.RoundTripper
+	version   string
+	pattern   *regexp.Regexp
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *apiVersionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, buffered := req.Context().Value(rawBodyKey).([]byte)
+	replayable := buffered || req.Body == nil || req.Body == http.NoBody
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || !replayable || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound) {
+		return resp, err
+	}
+	current := req.URL.Query().Get("api-version")
+	if current == "" || current >= t.version {
+		return resp, nil
+	}
+
+	errorBody, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if !t.pattern.Match(errorBody) {
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(errorBody), resp.Body), Closer: resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	log.Printf("Upgrading api-version of %s %s from %s to %s after upstream error: %s",
+		req.Method, req.URL.Path, current, t.version, bytes.TrimSpace(errorBody))
+
+	retry := req.Clone(req.Context())
+	query := retry.URL.Query()
+	query.Set("api-version", t.version)
+	retry.URL.RawQuery = query.Encode()
+	recordAPIVersion(retry)
+	if buffered {
+		retry.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return t.transport.RoundTrip(retry)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// attemptLog accumulates the upstream attempts made for one client request. Hedged
+// attempts run concurrently, so it is safe for concurrent use.
+type attemptLog struct {
+	mu       sync.Mutex
+	attempts []logging.Attempt
+}
+
+// add records an attempt
+func (a *attemptLog) add(attempt logging.Attempt) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attempts = append(a.attempts, attempt)
+}
+
+// list returns the attempts recorded so far
+func (a *attemptLog) list() []logging.Attempt {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]logging.Attempt(nil), a.attempts...)
+}
+
+// attemptTransport records every upstream attempt in the request's attempt log. It
+// sits below the transports that may send a request more than once.
+type attemptTransport struct {
+	transport http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+
+	attempts, ok := req.Context().Value(attemptsKey).(*attemptLog)
+	if !ok {
+		return resp, err
+	}
+	attempt := logging.Attempt{
+		Upstream: req.URL.Host,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.Status = resp.StatusCode
+	}
+	attempts.add(attempt)
+	return resp, err
+}
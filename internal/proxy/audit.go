@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"azure-ai-proxy/internal/audit"
+)
+
+// audit records an audit event for a request, if audit logging is enabled. The actor
+// is qualified with the request's remote address.
+func (s *Server) audit(r *http.Request, actor, action, outcome, detail string) {
+	if s.auditLogger == nil {
+		return
+	}
+	s.auditLogger.Record(audit.Event{
+		Actor:   auditActor(r, actor),
+		Action:  action,
+		Outcome: outcome,
+		Detail:  detail,
+	})
+}
+
+// auditActor returns actor with the remote address of r, as recorded in the audit log
+func auditActor(r *http.Request, actor string) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		actor += "@" + host
+	}
+	return actor
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
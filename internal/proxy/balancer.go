@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/config"
+)
+
+// backend is an upstream the balancer distributes requests over
+type backend struct {
+	name         string
+	url          *url.URL
+	apiKey       string
+	tokens       *tokenSource // set when the backend authenticates with Entra ID tokens
+	userAuth     string       // "passthrough" or "obo" when the backend is sent users' tokens
+	obo          *oboSource   // exchanges users' tokens with "obo" auth
+	apiVersion   string
+	openAI       bool   // the OpenAI API or a compatible server, which requests are translated for
+	organization string // OpenAI organization requests to the OpenAI API are billed to
+	weight       int
+	state        *backendState // requests in flight and health, kept across reloads
+	fallback     *backend      // retried when this backend fails, if set
+}
+
+// target points an outgoing request at the backend, under its base path and with its
+// api-version if it has one
+func (b *backend) target(req *http.Request) {
+	req.URL.Scheme = b.url.Scheme
+	req.URL.Host = b.url.Host
+	req.Host = b.url.Host
+	if base := strings.TrimSuffix(b.url.Path, "/"); base != "" {
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimSuffix(b.url.EscapedPath(), "/") + req.URL.RawPath
+		}
+		req.URL.Path = base + req.URL.Path
+	}
+	if b.apiVersion != "" {
+		query := req.URL.Query()
+		query.Set("api-version", b.apiVersion)
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// authorize replaces the client's credentials with the backend's Entra ID token or API
+// key, if it has one, or the user's token. The OpenAI API and compatible servers are
+// sent the key as a bearer token, or no credentials without one.
+func (b *backend) authorize(req *http.Request) {
+	if b.openAI {
+		req.Header.Del("Authorization")
+		req.Header.Del("api-key")
+		if b.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+b.apiKey)
+		}
+		if b.organization != "" {
+			req.Header.Set("OpenAI-Organization", b.organization)
+		}
+		return
+	}
+	if b.userAuth != "" {
+		b.authorizeUser(req)
+		return
+	}
+	if b.tokens != nil {
+		bearer, err := b.tokens.bearer(req.Context())
+		if err != nil {
+			log.Printf("Error: forwarding %s to %s without a token: %v", req.URL.Path, b.name, err)
+			return
+		}
+		req.Header.Set("Authorization", bearer)
+		req.Header.Del("api-key")
+		return
+	}
+	if b.apiKey == "" {
+		return
+	}
+	req.Header.Set("api-key", b.apiKey)
+	req.Header.Del("Authorization")
+}
+
+// authorizeUser sends the user's token upstream, or the token it is exchanged for
+func (b *backend) authorizeUser(req *http.Request) {
+	req.Header.Del("api-key")
+	req.Header.Del("Authorization")
+	token, _ := req.Context().Value(userTokenKey).(string)
+	if token == "" {
+		log.Printf("Error: forwarding %s to %s without a token: the request carries no user token", req.URL.Path, b.name)
+		return
+	}
+	if b.userAuth == "passthrough" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	bearer, err := b.obo.bearer(req.Context(), token)
+	if err != nil {
+		log.Printf("Error: forwarding %s to %s without a token: %v", req.URL.Path, b.name, err)
+		return
+	}
+	req.Header.Set("Authorization", bearer)
+}
+
+// String returns the backend's name and URL for logging
+func (b *backend) String() string {
+	return fmt.Sprintf("%s (%s)", b.name, b.url)
+}
+
+// rotation spreads requests over backends in proportion to their weights, each scaled
+// by the backend's health so a degraded one gets less traffic. By default it uses smooth
+// weighted round-robin, as in nginx: every pick raises each backend's current weight by
+// its weight and lowers the chosen one's by the total, so heavier backends are picked
+// more often without being picked in bursts. With leastConnections it picks the backend
+// with the fewest requests in flight per weight, breaking ties by round-robin. A backend
+// may appear more than once, e.g. for several deployments on it.
+type rotation struct {
+	backends         []*backend
+	weights          []int // by backend
+	leastConnections bool
+
+	mu      sync.Mutex
+	current []float64 // by backend
+}
+
+// newRotation creates a rotation over backends with their own weights
+func newRotation(backends []*backend, leastConnections bool) *rotation {
+	weights := make([]int, len(backends))
+	for i, be := range backends {
+		weights[i] = be.weight
+	}
+	return newWeightedRotation(backends, weights, leastConnections)
+}
+
+// newWeightedRotation creates a rotation over backends with the given weights
+func newWeightedRotation(backends []*backend, weights []int, leastConnections bool) *rotation {
+	return &rotation{backends: backends, weights: weights, leastConnections: leastConnections, current: make([]float64, len(backends))}
+}
+
+// next returns the backend that should serve the next request
+func (r *rotation) next() *backend {
+	return r.backends[r.pick()]
+}
+
+// pick returns the index of the backend that should serve the next request
+func (r *rotation) pick() int {
+	if len(r.backends) == 1 {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Backends without weight, which only model routes may name, share the requests
+	// evenly if the others have none
+	weights := make([]float64, len(r.backends))
+	var total float64
+	for i, be := range r.backends {
+		weights[i] = float64(r.weights[i]) * be.state.factor()
+		total += weights[i]
+	}
+	if total == 0 {
+		for i, be := range r.backends {
+			weights[i] = be.state.factor()
+			total += weights[i]
+		}
+	}
+	for i := range r.backends {
+		r.current[i] += weights[i]
+	}
+	best := -1
+	for i := range r.backends {
+		switch {
+		case weights[i] == 0:
+		case best < 0:
+			best = i
+		case r.leastConnections:
+			load := float64(r.backends[i].state.active.Load()) / weights[i]
+			bestLoad := float64(r.backends[best].state.active.Load()) / weights[best]
+			if load < bestLoad || load == bestLoad && r.current[i] > r.current[best] {
+				best = i
+			}
+		case r.current[i] > r.current[best]:
+			best = i
+		}
+	}
+	r.current[best] -= total
+	return best
+}
+
+// balancer spreads requests over all backends
+type balancer struct {
+	backends []*backend
+	rotation *rotation
+
+	mu        sync.Mutex
+	preferred *backend // fastest backend picked for latency-sensitive requests
+}
+
+// newBalancer creates a balancer over the configured backends, keeping their order,
+// picking them by strategy, "round-robin" or "least-connections". A single backend may
+// have a base path, which is prefixed to request paths; several may not, since
+// requests are moved between them by host. Backends with "entra" auth get their tokens
+// from tokens, and those with "obo" auth exchange users' tokens with obo.
+func newBalancer(backends []config.Backend, strategy string, tokens *tokenSource, obo *oboSource) (*balancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	b := &balancer{}
+	for _, cb := range backends {
+		u, err := url.Parse(cb.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q for backend %q", cb.Endpoint, cb.Name)
+		}
+		if len(backends) > 1 && strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("URL %q of backend %q must not have a path when there are several backends", cb.Endpoint, cb.Name)
+		}
+		if cb.Weight < 0 {
+			return nil, fmt.Errorf("backend %q must not have a negative weight", cb.Name)
+		}
+		be := &backend{
+			name:         cb.Name,
+			url:          u,
+			apiKey:       cb.APIKey,
+			apiVersion:   cb.APIVersion,
+			openAI:       cb.IsOpenAI(),
+			organization: cb.Organization,
+			weight:       cb.Weight,
+			state:        newBackendState(),
+		}
+		switch {
+		case cb.Auth == "entra":
+			be.tokens = tokens
+		case cb.UsesUserTokens():
+			be.userAuth, be.obo = cb.Auth, obo
+		}
+		b.backends = append(b.backends, be)
+	}
+	// Backends without weight only take over the requests of those they are the
+	// fallback of
+	var weighted []*backend
+	for i, cb := range backends {
+		if cb.Fallback != "" {
+			if b.backends[i].fallback = b.named(cb.Fallback); b.backends[i].fallback == nil {
+				return nil, fmt.Errorf("backend %q has unknown fallback %q", cb.Name, cb.Fallback)
+			}
+		}
+		if cb.Weight > 0 {
+			weighted = append(weighted, b.backends[i])
+		}
+	}
+	if len(weighted) == 0 {
+		return nil, fmt.Errorf("no backend has a positive weight")
+	}
+	b.rotation = newRotation(weighted, strategy == "least-connections")
+	return b, nil
+}
+
+// checkReachable checks that every backend without weight is still sent requests, as
+// the fallback of another backend or a target of one of routes
+func (b *balancer) checkReachable(routes map[string]*modelRoute) error {
+	reachable := map[*backend]bool{}
+	for _, be := range b.backends {
+		reachable[be.fallback] = true
+	}
+	for _, route := range routes {
+		for _, be := range route.rotation.backends {
+			reachable[be] = true
+		}
+	}
+	for _, be := range b.backends {
+		if be.weight == 0 && !reachable[be] {
+			return fmt.Errorf("backend %q must have a positive weight unless it is the fallback of another or serves a model route", be.name)
+		}
+	}
+	return nil
+}
+
+// inherit carries the requests in flight and health of the backends of old over to
+// those of b with the same name and URL, so a reload does not forget them. It returns
+// the other backends, which are new.
+func (b *balancer) inherit(old *balancer) (added []*backend) {
+	for _, be := range b.backends {
+		if previous := old.named(be.name); previous != nil && previous.url.String() == be.url.String() {
+			be.state = previous.state
+		} else {
+			added = append(added, be)
+		}
+	}
+	if old.preferred != nil {
+		if be := b.named(old.preferred.name); be != nil && be.state == old.preferred.state {
+			b.preferred = be
+		}
+	}
+	return added
+}
+
+// named returns the backend called name, or nil if there is none
+func (b *balancer) named(name string) *backend {
+	for _, be := range b.backends {
+		if be.name == name {
+			return be
+		}
+	}
+	return nil
+}
+
+// byHost returns the backend requests to host are sent to, or nil if there is none
+func (b *balancer) byHost(host string) *backend {
+	for _, be := range b.backends {
+		if be.url.Host == host {
+			return be
+		}
+	}
+	return nil
+}
+
+// usesTokens reports whether any backend authenticates with Entra ID tokens
+func (b *balancer) usesTokens() bool {
+	for _, be := range b.backends {
+		if be.tokens != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// usesUserTokens reports whether any backend is sent users' tokens
+func (b *balancer) usesUserTokens() bool {
+	for _, be := range b.backends {
+		if be.userAuth != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the backend that should serve the next request
+func (b *balancer) next() *backend {
+	return b.rotation.next()
+}
+
+// fastest returns the healthy backend of the rotation with the lowest p95 latency. It
+// keeps the one it picked last until another is faster by margin, a fraction of its
+// p95, or it is degraded, so close backends do not take turns. Without enough latencies
+// to compare, it returns the next backend.
+func (b *balancer) fastest(margin float64) *backend {
+	var best *backend
+	var bestP95 time.Duration
+	p95s := make(map[*backend]time.Duration, len(b.rotation.backends))
+	for _, be := range b.rotation.backends {
+		_, p95, samples := be.state.latency()
+		if samples < minLatencySamples || !be.state.healthy() {
+			continue
+		}
+		p95s[be] = p95
+		if best == nil || p95 < bestP95 {
+			best, bestP95 = be, p95
+		}
+	}
+	if best == nil {
+		return b.next()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.preferred
+	if p95, ok := p95s[previous]; ok && float64(bestP95) >= float64(p95)*(1-margin) {
+		return previous
+	}
+	if best != previous {
+		if previous != nil {
+			log.Printf("Preferring backend %s for latency-sensitive requests over %s, p95 %v", best.name, previous.name, bestP95)
+		} else {
+			log.Printf("Preferring backend %s for latency-sensitive requests, p95 %v", best.name, bestP95)
+		}
+		b.preferred = best
+	}
+	return best
+}
+
+// retarget points an outgoing request at the next backend and returns it
+func (b *balancer) retarget(req *http.Request) *backend {
+	target := b.next()
+	target.target(req)
+	return target
+}
+
+// multiple reports whether requests are spread over several backends
+func (b *balancer) multiple() bool {
+	return len(b.backends) > 1
+}
+
+// String lists the backends for logging
+func (b *balancer) String() string {
+	list := make([]string, len(b.backends))
+	for i, backend := range b.backends {
+		list[i] = backend.String()
+	}
+	return strings.Join(list, ", ")
+}
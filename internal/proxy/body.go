@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// shouldStreamBody reports whether the request body should be forwarded without buffering,
+// based on its declared size and content type
+func (s *Server) shouldStreamBody(r *http.Request) bool {
+	if s.maxBufferedBodySize > 0 && r.ContentLength > s.maxBufferedBodySize {
+		return true
+	}
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	for _, prefix := range s.streamingContentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the request body into memory and replaces r.Body with a reader over
+// the same content. If the body exceeds the buffering limit, the bytes read so far are
+// stitched back in front of the remaining stream and complete is false.
+func (s *Server) readBody(r *http.Request) (body []byte, complete bool, err error) {
+	reader := io.Reader(r.Body)
+	if s.maxBufferedBodySize > 0 {
+		reader = io.LimitReader(r.Body, s.maxBufferedBodySize+1)
+	}
+
+	bodyBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.maxBufferedBodySize > 0 && int64(len(bodyBytes)) > s.maxBufferedBodySize {
+		r.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(bodyBytes), r.Body),
+			Closer: r.Body,
+		}
+		return nil, false, nil
+	}
+
+	if err := r.Body.Close(); err != nil {
+		log.Printf("Error closing request body: %v", err)
+	}
+
+	// Create a new reader with the same content
+	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	return bodyBytes, true, nil
+}
+
+// bodyMetadata describes a request body that was forwarded without being buffered
+func bodyMetadata(r *http.Request) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"streamed":     true,
+		"content_type": r.Header.Get("Content-Type"),
+	}
+	if r.ContentLength >= 0 {
+		metadata["content_length"] = r.ContentLength
+	}
+	return metadata
+}
+
+// multiReadCloser reads from Reader and closes the underlying Closer
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decompressBody returns the decoded content of a body sent with a gzip or deflate
+// Content-Encoding. At most limit bytes are decoded, so small compressed bodies can't
+// expand without bound; zero means no limit.
+func decompressBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var reader io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	case "deflate":
+		// HTTP deflate is zlib-wrapped, though some clients send raw deflate data
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			reader = zr
+		} else {
+			reader = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	if limit > 0 {
+		reader = io.LimitReader(reader, limit+1)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", limit)
+	}
+	return decoded, nil
+}
+
+// contentEncoding returns the normalized Content-Encoding of a request, or "" for identity
+func contentEncoding(r *http.Request) string {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
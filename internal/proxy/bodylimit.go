@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// tooLargeResponse is the body of a 413 response, so clients can tell how far over the limit they were
+type tooLargeResponse struct {
+	Error        apiError `json:"error"`
+	LimitBytes   int64    `json:"limit_bytes"`
+	SizeBytes    int64    `json:"size_bytes,omitempty"`     // declared Content-Length
+	MinSizeBytes int64    `json:"min_size_bytes,omitempty"` // lower bound when the body had no declared length
+}
+
+// apiError mirrors the error object of Azure OpenAI responses
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// limitRequestBody rejects requests whose declared size exceeds the limit of their
+// route and caps the body of the others, so undeclared sizes fail once the limit is
+// read. It reports whether the request may proceed.
+func (s *Server) limitRequestBody(w http.ResponseWriter, r *http.Request, start time.Time) bool {
+	limit := s.routeOf(r.Context()).maxBodySize
+	if limit <= 0 {
+		return true
+	}
+	if r.ContentLength > limit {
+		s.rejectTooLarge(w, r, start, r.ContentLength, limit, true)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// rejectTooLarge answers a request whose body exceeds the limit with a 413 describing
+// the limit and the request size. When exact is false, size is only a lower bound since
+// reading stops as soon as the limit is crossed.
+func (s *Server) rejectTooLarge(w http.ResponseWriter, r *http.Request, start time.Time, size, limit int64, exact bool) {
+	response := tooLargeResponse{
+		Error: apiError{
+			Code:    "RequestTooLarge",
+			Message: fmt.Sprintf("Request body exceeds the limit of %d bytes", limit),
+		},
+		LimitBytes: limit,
+	}
+	if exact {
+		response.SizeBytes = size
+	} else {
+		response.MinSizeBytes = size
+	}
+
+	log.Printf("Rejected %s %s by %s: body of %d bytes exceeds limit of %d", r.Method, r.URL.Path, rejectedBySize, size, limit)
+	writeJSON(w, http.StatusRequestEntityTooLarge, response)
+
+	s.logger.LogRequest(logging.Entry{
+		Timestamp:             time.Now(),
+		Duration:              time.Since(start),
+		Path:                  r.URL.Path,
+		Method:                r.Method,
+		Status:                http.StatusRequestEntityTooLarge,
+		RejectedBy:            rejectedBySize,
+		RequestSize:           size,
+		Error:                 response.Error.Message,
+		ExternalCorrelationID: s.externalCorrelationID(r),
+	})
+}
+
+// errorHandler answers requests the reverse proxy could not complete. Bodies that were
+// streamed upstream only hit the size limit here, so those get the same 413 as buffered ones.
+// Requests whose deadline passed before the upstream answered get a 504.
+func (s *Server) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		start, _ := r.Context().Value(startTimeKey).(time.Time)
+		s.rejectTooLarge(w, r, start, tooLarge.Limit+1, tooLarge.Limit, false)
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		log.Printf("Upstream deadline exceeded for %s %s: %v", r.Method, r.URL.Path, err)
+		s.failUpstream(w, r, http.StatusGatewayTimeout, "Gateway Timeout: upstream did not respond before the request deadline", err)
+		return
+	}
+
+	log.Printf("http: proxy error: %v", err)
+	s.failUpstream(w, r, http.StatusBadGateway, "Bad Gateway: upstream request failed", err)
+}
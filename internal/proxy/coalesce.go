@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/internal/metrics"
+)
+
+// coalesceHeader lets clients opt into sharing an upstream call with identical in-flight requests
+const coalesceHeader = "X-Coalesce"
+
+// coalesceKeyFor returns the key under which a request may be coalesced, or "" when it
+// is not eligible. Only non-streaming completions and embeddings that opted in are
+// coalesced, and only with those of the same client.
+func coalesceKeyFor(r *http.Request, body map[string]interface{}, clientID string) string {
+	if !strings.EqualFold(r.Header.Get(coalesceHeader), "true") {
+		return ""
+	}
+	if !isCompletionPath(r.URL.Path) || body["stream"] == true {
+		return ""
+	}
+
+	return requestHash(r, body, clientID)
+}
+
+// coalescedCall is an upstream call shared by identical requests
+type coalescedCall struct {
+	started time.Time
+	done    chan struct{}
+	waiters int                // requests still waiting for the call, guarded by the transport's mu
+	cancel  context.CancelFunc // cancels the call once every waiter has left
+
+	resp *http.Response // body already drained into body
+	body []byte
+	err  error
+}
+
+// coalescingTransport lets identical requests that arrive within the window share a
+// single upstream call, singleflight style. The call runs detached from the request
+// that started it and is only cancelled when every request waiting for it has left,
+// so one client disconnecting does not fail the others. It keeps that request's
+// deadline, such as the route timeout or X-Deadline.
+type coalescingTransport struct {
+	transport http.RoundTripper
+	window    time.Duration
+	coalesced *metrics.Vec
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, _ := req.Context().Value(coalesceKey).(string)
+	if key == "" {
+		return t.transport.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	if call, ok := t.calls[key]; ok && time.Since(call.started) <= t.window {
+		call.waiters++
+		t.mu.Unlock()
+		log.Printf("Coalesced %s %s with an identical in-flight request", req.Method, req.URL.Path)
+		t.coalesced.Inc()
+		return t.wait(req, key, call)
+	}
+
+	// Detached from the starting request's cancellation, but not from its deadline
+	detached := context.WithoutCancel(req.Context())
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := req.Context().Deadline(); ok {
+		ctx, cancel = context.WithDeadline(detached, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(detached)
+	}
+	call := &coalescedCall{started: time.Now(), done: make(chan struct{}), waiters: 1, cancel: cancel}
+	t.calls[key] = call
+	t.mu.Unlock()
+
+	go t.run(req.WithContext(ctx), key, call)
+	return t.wait(req, key, call)
+}
+
+// run makes the shared upstream call and releases its waiters
+func (t *coalescingTransport) run(req *http.Request, key string, call *coalescedCall) {
+	defer call.cancel()
+	call.resp, call.err = t.transport.RoundTrip(req)
+	if call.err == nil {
+		call.body, call.err = io.ReadAll(call.resp.Body)
+		if err := call.resp.Body.Close(); err != nil {
+			log.Printf("Error closing response body: %v", err)
+		}
+	}
+	close(call.done)
+
+	t.mu.Lock()
+	if t.calls[key] == call {
+		delete(t.calls, key)
+	}
+	t.mu.Unlock()
+}
+
+// wait returns the response of the shared call to req, or leaves the call when req is
+// cancelled first, cancelling it if no other request is waiting
+func (t *coalescingTransport) wait(req *http.Request, key string, call *coalescedCall) (*http.Response, error) {
+	select {
+	case <-call.done:
+		return call.response(req)
+	case <-req.Context().Done():
+	}
+
+	t.mu.Lock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		if t.calls[key] == call {
+			delete(t.calls, key)
+		}
+	}
+	t.mu.Unlock()
+	return nil, req.Context().Err()
+}
+
+// response returns a private copy of the shared response for req
+func (c *coalescedCall) response(req *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Trailer = c.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(c.body))
+	resp.Request = req
+	return &resp, nil
+}
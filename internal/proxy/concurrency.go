@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Concurrency limit modes
+const (
+	// ConcurrencyReject rejects requests of clients at their concurrency limit
+	ConcurrencyReject = "reject"
+	// ConcurrencyQueue makes requests of clients at their limit wait for a free slot
+	ConcurrencyQueue = "queue"
+)
+
+// acquireSlot takes one of the client's concurrency slots, queueing for it if
+// configured. On success the returned function releases the slot.
+func (s *Server) acquireSlot(r *http.Request, clientID string) (release func(), ok bool) {
+	if s.concurrency == nil {
+		return func() {}, true
+	}
+	if s.concurrencyMode != ConcurrencyQueue {
+		return s.concurrency.Acquire(r.Context(), clientID, false)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.concurrencyTimeout)
+	defer cancel()
+	return s.concurrency.Acquire(ctx, clientID, true)
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// externalCorrelationID returns the correlation ID the calling gateway assigned to a
+// request, or "" when none is configured or sent
+func (s *Server) externalCorrelationID(r *http.Request) string {
+	if s.correlationHeader == "" {
+		return ""
+	}
+	return r.Header.Get(s.correlationHeader)
+}
+
+// echoCorrelationID returns the request's external correlation ID in the response.
+// Upstream headers are added to the client response after this, so the header is
+// removed from upstream responses in modifyResponse to avoid repeating it.
+func (s *Server) echoCorrelationID(w http.ResponseWriter, r *http.Request) {
+	if id := s.externalCorrelationID(r); id != "" {
+		w.Header().Set(s.correlationHeader, id)
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// grpcTimeoutUnits maps the unit suffixes of grpc-timeout style values to durations
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseTimeout parses a grpc-timeout style value: up to eight digits followed by a
+// unit, e.g. "30S" or "500m"
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// formatTimeout formats a duration as a grpc-timeout style value in milliseconds
+func formatTimeout(d time.Duration) string {
+	return strconv.FormatInt(max(d.Milliseconds(), 1), 10) + "m"
+}
+
+// requestTimeout returns how long the upstream may take to answer a request: the
+// client's deadline header if it is valid, capped by the upstream timeout of the
+// request's route, which also applies when the header is absent or malformed. Zero
+// means no deadline.
+func (s *Server) requestTimeout(r *http.Request) time.Duration {
+	upstreamTimeout := s.routeOf(r.Context()).timeout
+	if s.deadlineHeader == "" {
+		return upstreamTimeout
+	}
+	value := r.Header.Get(s.deadlineHeader)
+	if value == "" {
+		return upstreamTimeout
+	}
+	timeout, ok := parseTimeout(value)
+	if !ok {
+		log.Printf("Warning: ignoring malformed %s header %q on %s %s", s.deadlineHeader, value, r.Method, r.URL.Path)
+		return upstreamTimeout
+	}
+	if upstreamTimeout > 0 {
+		timeout = min(timeout, upstreamTimeout)
+	}
+	return timeout
+}
+
+// withDeadline bounds a request's context by its timeout. The returned cancel
+// function must be called once the request is done.
+func (s *Server) withDeadline(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	if timeout := s.requestTimeout(r); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {}
+}
+
+// propagateDeadline tells Azure how much time is left to answer an outgoing request,
+// so the rest of the chain can respect the same deadline
+func (s *Server) propagateDeadline(req *http.Request) {
+	if s.deadlineHeader == "" {
+		return
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		req.Header.Set(s.deadlineHeader, formatTimeout(time.Until(deadline)))
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// debugLogHeader lets trusted clients request verbose logging of a single request
+const debugLogHeader = "X-Debug-Log"
+
+// redactedHeaders carry credentials and are never logged verbatim
+var redactedHeaders = []string{"Api-Key", "Authorization", "X-Api-Key", "Ocp-Apim-Subscription-Key", "Cookie"}
+
+// deadLetterDroppedHeaders are left out of dead-letter records: the credentials and
+// the identity of the client that signed the request
+var deadLetterDroppedHeaders = append([]string{"X-Client-ID", "X-Signature"}, redactedHeaders...)
+
+// debugRequested reports whether a request asked for verbose logging and its client
+// is allowed to. The header is removed so it isn't forwarded upstream.
+func (s *Server) debugRequested(r *http.Request, clientID string) bool {
+	value := r.Header.Get(debugLogHeader)
+	if value == "" {
+		return false
+	}
+	r.Header.Del(debugLogHeader)
+	if !strings.EqualFold(value, "true") {
+		return false
+	}
+	if !s.current().debugClients[clientID] {
+		logging.Debugf("Ignoring %s from untrusted client %q on %s %s", debugLogHeader, clientID, r.Method, r.URL.Path)
+		return false
+	}
+	return true
+}
+
+// redactHeaders returns a copy of headers with credential values masked
+func redactHeaders(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for _, name := range redactedHeaders {
+		if values := redacted.Values(name); len(values) > 0 {
+			for i := range values {
+				values[i] = "[REDACTED]"
+			}
+		}
+	}
+	return redacted
+}
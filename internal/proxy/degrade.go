@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// degradeHeader lets a client opt a single request into degradation
+const degradeHeader = "X-Allow-Degrade"
+
+// degradation records whether a request opted into degradation was moved from its
+// premium deployment to the cheaper fallback
+type degradation struct {
+	mu       sync.Mutex
+	from, to string
+}
+
+// set records that the request was degraded
+func (d *degradation) set(from, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.from, d.to = from, to
+}
+
+// get returns the premium and fallback deployments, or "" if the request was not degraded
+func (d *degradation) get() (from, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.from, d.to
+}
+
+// degradationFor returns the degradation record of a request that may be degraded:
+// one from a client configured for it or sent with X-Allow-Degrade: true. It returns
+// nil for requests that must not be degraded.
+func (s *Server) degradationFor(r *http.Request, clientID string) *degradation {
+	st := s.current()
+	if len(st.degradeDeployments) == 0 {
+		return nil
+	}
+	requested := strings.EqualFold(r.Header.Get(degradeHeader), "true")
+	r.Header.Del(degradeHeader)
+	if !requested && !st.degradeClients[clientID] {
+		return nil
+	}
+	return &degradation{}
+}
+
+// setDeployment replaces the deployment in the path of a deployment-scoped request
+func setDeployment(r *http.Request, from, to string) {
+	r.URL.Path = deploymentPrefix + to + strings.TrimPrefix(r.URL.Path, deploymentPrefix+from)
+	r.URL.RawPath = ""
+}
+
+// degradeTransport retries requests that may be degraded on their fallback deployment
+// when Azure throttles the premium one. Only requests whose body was buffered, or
+// that have none, can be retried.
+type degradeTransport struct {
+	transport   http.RoundTripper
+	deployments func() map[string]string // premium deployment -> fallback, as currently configured
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *degradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	degrade, ok := req.Context().Value(degradeKey).(*degradation)
+	if !ok {
+		return resp, nil
+	}
+	from := deploymentFromPath(req.URL.Path)
+	to, ok := t.deployments()[from]
+	if !ok {
+		return resp, nil
+	}
+	body, buffered := req.Context().Value(rawBodyKey).([]byte)
+	if !buffered && req.Body != nil && req.Body != http.NoBody {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	log.Printf("Degrading %s %s from deployment %s to %s after upstream 429", req.Method, req.URL.Path, from, to)
+	degrade.set(from, to)
+	retry := req.Clone(req.Context())
+	setDeployment(retry, from, to)
+	if buffered {
+		retry.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return t.transport.RoundTrip(retry)
+}
+
+// markDegraded tells the client which deployment actually served a degraded request
+func markDegraded(resp *http.Response) {
+	degrade, ok := resp.Request.Context().Value(degradeKey).(*degradation)
+	if !ok {
+		return
+	}
+	if from, to := degrade.get(); from != "" {
+		resp.Header.Set("X-Degraded-From", from)
+		resp.Header.Set("X-Deployment", to)
+	}
+}
+
+// degradeForQuota moves a request that may be degraded from a deployment out of quota
+// to its fallback, provided the fallback still has quota. It reports whether it did.
+func (s *Server) degradeForQuota(r *http.Request, degrade *degradation, deployment string, remaining int64) bool {
+	fallback, ok := s.current().degradeDeployments[deployment]
+	if !ok || degrade == nil {
+		return false
+	}
+	if _, _, exhausted := s.quota.Exhausted(fallback); exhausted {
+		return false
+	}
+	log.Printf("Degrading %s %s from deployment %s to %s: %d tokens of quota left", r.Method, r.URL.Path, deployment, fallback, remaining)
+	setDeployment(r, deployment, fallback)
+	degrade.set(deployment, fallback)
+	return true
+}
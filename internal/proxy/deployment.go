@@ -0,0 +1,42 @@
+package proxy
+
+import "strings"
+
+// deploymentPrefix starts the path of every deployment-scoped Azure OpenAI request
+const deploymentPrefix = "/openai/deployments/"
+
+// completionOperations are the operations identical requests get equivalent responses
+// from without creating anything upstream, so they may be cached, coalesced and hedged.
+// Others, such as runs, files and batches, create an object per request.
+var completionOperations = []string{"/chat/completions", "/completions", "/embeddings"}
+
+// isCompletionPath reports whether path calls one of the completionOperations
+func isCompletionPath(path string) bool {
+	for _, operation := range completionOperations {
+		if strings.HasSuffix(path, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// deploymentFromPath returns the deployment name in an Azure OpenAI path such as
+// /openai/deployments/gpt-4o/chat/completions, or "" if the path has none
+func deploymentFromPath(path string) string {
+	rest, ok := strings.CutPrefix(path, deploymentPrefix)
+	if !ok {
+		return ""
+	}
+	deployment, _, _ := strings.Cut(rest, "/")
+	return deployment
+}
+
+// modelName returns the deployment targeted by a request, falling back to the
+// "model" field of the body for paths without a deployment segment
+func modelName(path string, body map[string]interface{}) string {
+	if deployment := deploymentFromPath(path); deployment != "" {
+		return deployment
+	}
+	model, _ := body["model"].(string)
+	return model
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	// tokenRefreshMargin is how long before it expires a token is replaced
+	tokenRefreshMargin = 5 * time.Minute
+	// tokenRetryInterval is how long a failed background refresh waits to try again
+	tokenRetryInterval = 30 * time.Second
+	// tokenTimeout bounds fetching a single token
+	tokenTimeout = 30 * time.Second
+)
+
+// tokenSource supplies Microsoft Entra ID access tokens for the backends that
+// authenticate with them, from the default Azure credential chain: environment
+// variables (client secret or certificate), workload identity, managed identity or the
+// Azure CLI login. The token is cached and refreshed in the background before it
+// expires, so requests rarely wait for one.
+type tokenSource struct {
+	scope string
+	stop  <-chan struct{}
+
+	mu         sync.Mutex
+	credential azcore.TokenCredential
+	token      azcore.AccessToken
+	timer      *time.Timer // refreshes the token
+}
+
+// newTokenSource creates a source of tokens for scope, whose background refreshes end
+// once stop is closed. The credential is only created when a token is first needed.
+func newTokenSource(scope string, stop <-chan struct{}) *tokenSource {
+	return &tokenSource{scope: scope, stop: stop}
+}
+
+// bearer returns the Authorization header value for an upstream request, fetching a
+// token if none is cached or the cached one has expired
+func (t *tokenSource) bearer(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token.Token == "" || time.Now().After(t.token.ExpiresOn) {
+		token, err := t.fetch(ctx)
+		if err != nil {
+			return "", err
+		}
+		t.store(token)
+	}
+	return "Bearer " + t.token.Token, nil
+}
+
+// fetch gets a new token. Callers must hold t.mu.
+func (t *tokenSource) fetch(ctx context.Context) (azcore.AccessToken, error) {
+	if t.credential == nil {
+		credential, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return azcore.AccessToken{}, fmt.Errorf("failed to create Azure credential: %v", err)
+		}
+		t.credential = credential
+	}
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	token, err := t.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{t.scope}})
+	if err != nil {
+		return azcore.AccessToken{}, fmt.Errorf("failed to get Entra ID token for %s: %v", t.scope, err)
+	}
+	return token, nil
+}
+
+// store caches a token and schedules its refresh. Callers must hold t.mu.
+func (t *tokenSource) store(token azcore.AccessToken) {
+	t.token = token
+	wait := time.Until(token.ExpiresOn) - tokenRefreshMargin
+	if wait < tokenRetryInterval {
+		wait = tokenRetryInterval
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(wait, t.refresh)
+}
+
+// refresh replaces the cached token ahead of its expiry. Requests keep using the old
+// token while the new one is fetched.
+func (t *tokenSource) refresh() {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+
+	t.mu.Lock()
+	credential, expiresOn := t.credential, t.token.ExpiresOn
+	t.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+	defer cancel()
+	token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{t.scope}})
+	if err != nil {
+		log.Printf("Warning: failed to refresh Entra ID token, current one expires at %s, retrying in %v: %v",
+			expiresOn.Format(time.RFC3339), tokenRetryInterval, err)
+		t.mu.Lock()
+		if t.token.ExpiresOn.Equal(expiresOn) { // unless a request fetched a token meanwhile
+			t.timer = time.AfterFunc(tokenRetryInterval, t.refresh)
+		}
+		t.mu.Unlock()
+		return
+	}
+
+	t.mu.Lock()
+	t.store(token)
+	t.mu.Unlock()
+}
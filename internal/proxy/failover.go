@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"azure-ai-proxy/internal/metrics"
+)
+
+// failoverTransport retries requests on the fallback of their backend, and on its
+// fallback in turn, when the backend answers 429 or 5xx or cannot be reached. Only
+// requests whose body was buffered, or that have none, can be retried.
+type failoverTransport struct {
+	transport   http.RoundTripper
+	backends    func() *balancer
+	deployments func() map[string]string // deployment -> its name on fallbacks, as currently configured
+	failovers   *metrics.Vec
+	rename      func(*http.Request) // renames the headers of retries once authorized
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	from := t.backends().byHost(req.URL.Host)
+	tried := map[*backend]bool{from: true}
+	for from != nil && from.fallback != nil && !tried[from.fallback] && failed(req, resp, err) {
+		body, buffered := req.Context().Value(rawBodyKey).([]byte)
+		if !buffered && req.Body != nil && req.Body != http.NoBody {
+			break
+		}
+		to := from.fallback
+		tried[to] = true
+		reason := "error"
+		if err == nil {
+			reason = strconv.Itoa(resp.StatusCode)
+			resp.Body.Close()
+		}
+		t.failovers.Inc(from.name, to.name)
+
+		retry := req.Clone(req.Context())
+		to.target(retry)
+		to.authorize(retry)
+		t.rename(retry)
+		deployment := deploymentFromPath(req.URL.Path)
+		if renamed, ok := t.deployments()[deployment]; ok && deployment != "" {
+			setDeployment(retry, deployment, renamed)
+		}
+		if buffered {
+			retry.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		log.Printf("Failing over %s %s from backend %s to %s after upstream %s", req.Method, req.URL.Path, from.name, to.name, reason)
+		req, from = retry, to
+		resp, err = t.transport.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// failed reports whether an upstream attempt failed in a way another backend may not:
+// throttled, a server error or unreachable, but not cancelled by the client
+func failed(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
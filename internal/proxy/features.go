@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"azure-ai-proxy/internal/features"
+)
+
+// featureEnabled reports whether a feature is enabled for a client's request to path,
+// by the feature flags in effect when the request arrived
+func featureEnabled(ctx context.Context, name, path, clientID string) bool {
+	flags, _ := ctx.Value(featuresKey).(*features.Flags)
+	return flags.Enabled(name, deploymentFromPath(path), clientID)
+}
+
+// handleFeatures reports the rollout of every feature flag
+func (s *Server) handleFeatures(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.current().features.All())
+}
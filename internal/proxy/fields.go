@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// Request field policy modes
+const (
+	// FieldPolicyDeny rejects requests containing any of the listed fields
+	FieldPolicyDeny = "deny"
+	// FieldPolicyAllow rejects requests containing any field that is not listed
+	FieldPolicyAllow = "allow"
+)
+
+// forbiddenField returns the dot-separated path of the first field in body that the
+// configured policy forbids, or "" if the body is acceptable. Array elements share
+// their parent's path, so "messages.name" matches the name of every message.
+func (s *Server) forbiddenField(body map[string]interface{}) string {
+	switch s.fieldPolicy {
+	case FieldPolicyDeny:
+		return s.deniedField("", body)
+	case FieldPolicyAllow:
+		return s.unlistedField("", body)
+	}
+	return ""
+}
+
+// deniedField returns the first listed field found in v
+func (s *Server) deniedField(prefix string, v interface{}) string {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(value) {
+			path := prefix + key
+			if s.policyFields[path] {
+				return path
+			}
+			if field := s.deniedField(path+".", value[key]); field != "" {
+				return field
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			if field := s.deniedField(prefix, element); field != "" {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// unlistedField returns the first field in v that is neither listed nor the parent of
+// a listed field. Listing a field permits everything below it.
+func (s *Server) unlistedField(prefix string, v interface{}) string {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(value) {
+			path := prefix + key
+			if s.policyFields[path] {
+				continue
+			}
+			if !s.hasListedChild(path) {
+				return path
+			}
+			if field := s.unlistedField(path+".", value[key]); field != "" {
+				return field
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			if field := s.unlistedField(prefix, element); field != "" {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// hasListedChild reports whether any listed field is nested below path
+func (s *Server) hasListedChild(path string) bool {
+	for field := range s.policyFields {
+		if strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in order, so the same body always reports the same field
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
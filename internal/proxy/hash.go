@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// requestHash returns a canonical hash identifying a request of a client and its parsed
+// body. The client and its credentials are part of the hash so responses are never
+// shared across clients or keys, even once the credentials are removed from the
+// request, nor across users whose tokens are sent upstream. It returns "" if the body
+// cannot be encoded.
+func requestHash(r *http.Request, body map[string]interface{}, clientID string) string {
+	// Marshaling the parsed body sorts object keys, giving a canonical form
+	canonical, err := json.Marshal(body)
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.New()
+	userToken, _ := r.Context().Value(userTokenKey).(string)
+	for _, part := range []string{clientID, r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("api-key"), r.Header.Get("Authorization"), userToken} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(canonical)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net/http"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// renameHeaders copies the values of configured request headers to the header names
+// the upstream expects, optionally removing the originals
+func (s *Server) renameHeaders(req *http.Request) {
+	for from, to := range s.headerRenames {
+		values := req.Header.Values(from)
+		if len(values) == 0 {
+			continue
+		}
+
+		req.Header.Del(to)
+		for _, value := range values {
+			req.Header.Add(to, value)
+		}
+		if s.removeRenamedHeaders {
+			req.Header.Del(from)
+		}
+		logging.Debugf("Renamed header %s to %s for %s %s", from, to, req.Method, req.URL.Path)
+	}
+}
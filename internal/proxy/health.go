@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"azure-ai-proxy/internal/metrics"
+)
+
+// healthDecay is the weight of each outcome in a backend's health, so it mostly
+// reflects the last few dozen requests
+const healthDecay = 0.1
+
+// minHealth is the share of its traffic a failing backend keeps, so requests still
+// probe it and find out when it recovers
+const minHealth = 0.05
+
+// A backend whose health falls below degradedHealth is logged as degraded, and as
+// recovered once it is back above recoveredHealth
+const (
+	degradedHealth  = 0.5
+	recoveredHealth = 0.9
+)
+
+// latencySamples is how many of a backend's latest successful requests its latency
+// percentiles are taken over
+const latencySamples = 100
+
+// minLatencySamples is how many requests a backend must have answered before its
+// latency is compared with that of the others
+const minLatencySamples = 10
+
+// backendState is what the balancer tracks about a backend: the requests in flight to
+// it, its health, the decaying share of its recent requests that succeeded, and the
+// latency of its latest successful requests
+type backendState struct {
+	active atomic.Int64
+
+	mu        sync.Mutex
+	health    float64
+	degraded  bool
+	latencies []time.Duration // ring of the latest latencies, at most latencySamples
+	oldest    int             // index of the oldest latency once the ring is full
+}
+
+// newBackendState returns the state of a backend with nothing in flight, healthy until
+// its requests fail
+func newBackendState() *backendState {
+	return &backendState{health: 1}
+}
+
+// record counts the outcome of a request to the backend in its health and reports
+// whether the backend became degraded or recovered from it
+func (st *backendState) record(ok bool) (health float64, changed bool) {
+	outcome := 0.0
+	if ok {
+		outcome = 1
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.health += healthDecay * (outcome - st.health)
+	switch {
+	case !st.degraded && st.health < degradedHealth:
+		st.degraded, changed = true, true
+	case st.degraded && st.health > recoveredHealth:
+		st.degraded, changed = false, true
+	}
+	return st.health, changed
+}
+
+// observe adds the time a backend took to answer a request to its latencies and
+// returns their p50 and p95
+func (st *backendState) observe(latency time.Duration) (p50, p95 time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.latencies) < latencySamples {
+		st.latencies = append(st.latencies, latency)
+	} else {
+		st.latencies[st.oldest] = latency
+		st.oldest = (st.oldest + 1) % latencySamples
+	}
+	p50, p95, _ = st.percentiles()
+	return p50, p95
+}
+
+// latency returns the p50 and p95 of the backend's latest latencies, and how many
+// there are
+func (st *backendState) latency() (p50, p95 time.Duration, samples int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.percentiles()
+}
+
+// percentiles returns the p50 and p95 of the latencies and how many there are; st.mu
+// must be held
+func (st *backendState) percentiles() (p50, p95 time.Duration, samples int) {
+	if len(st.latencies) == 0 {
+		return 0, 0, 0
+	}
+	sorted := append([]time.Duration(nil), st.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1)+0.5)]
+	}
+	return rank(0.5), rank(0.95), len(sorted)
+}
+
+// healthy reports whether the backend is not degraded
+func (st *backendState) healthy() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return !st.degraded
+}
+
+// factor returns how much of its weight the backend gets for its health
+func (st *backendState) factor() float64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return max(st.health, minHealth)
+}
+
+// healthTransport counts the requests in flight to each backend, until their response
+// body is closed, and tracks each backend's health: errors, 5xx and 429 responses count
+// against it, and requests the client gave up on not at all. The time until the
+// response headers of the others is the backend's latency.
+type healthTransport struct {
+	transport http.RoundTripper
+	backends  func() *balancer
+	health    *metrics.Vec
+	latency   *metrics.Vec
+	recovered func(target *url.URL) // warms up connections to a backend that recovered
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *healthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	be := t.backends().byHost(req.URL.Host)
+	if be == nil {
+		return t.transport.RoundTrip(req)
+	}
+	state := be.state
+	state.active.Add(1)
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		state.active.Add(-1)
+		if req.Context().Err() == nil {
+			t.record(be, state, false)
+		}
+		return nil, err
+	}
+	ok := resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests
+	t.record(be, state, ok)
+	if ok {
+		p50, p95 := state.observe(time.Since(start))
+		t.latency.Set(p50.Seconds(), be.name, "0.5")
+		t.latency.Set(p95.Seconds(), be.name, "0.95")
+	}
+	// Upgraded connections keep their body writable and are not counted as in flight
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		state.active.Add(-1)
+		return resp, nil
+	}
+	resp.Body = &activeBody{ReadCloser: resp.Body, state: state}
+	return resp, nil
+}
+
+// record counts the outcome of a request in the health of its backend and logs changes
+// between healthy and degraded
+func (t *healthTransport) record(be *backend, state *backendState, ok bool) {
+	health, changed := state.record(ok)
+	t.health.Set(health, be.name)
+	switch {
+	case changed && health < degradedHealth:
+		log.Printf("Warning: backend %s is degraded, %.0f%% of its recent requests succeeded; sending it less traffic", be.name, health*100)
+	case changed:
+		log.Printf("Backend %s recovered, %.0f%% of its recent requests succeeded", be.name, health*100)
+		t.recovered(be.url)
+	}
+}
+
+// activeBody is a response body that ends its request's time in flight when closed
+type activeBody struct {
+	io.ReadCloser
+	state *backendState
+	once  sync.Once
+}
+
+// Close implements the io.Closer interface
+func (b *activeBody) Close() error {
+	b.once.Do(func() { b.state.active.Add(-1) })
+	return b.ReadCloser.Close()
+}
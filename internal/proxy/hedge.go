@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"azure-ai-proxy/internal/metrics"
+)
+
+// hedgeable reports whether a request may be sent twice: it is idempotent, or a
+// completion whose duplicate creates nothing
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return isCompletionPath(req.URL.Path)
+}
+
+// hedgeResult is the outcome of one of the attempts of a hedged request
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+}
+
+// hedgingTransport sends a duplicate of a request that hasn't been answered within
+// delay and returns whichever response arrives first, cancelling the other attempt.
+// Only idempotent requests and completions, whose body was buffered, are duplicated;
+// others, such as creating a run or a batch, would create it twice.
+type hedgingTransport struct {
+	transport http.RoundTripper
+	delay     time.Duration
+	hedged    *metrics.Vec
+	retarget  func(req *http.Request) // points the duplicate at another upstream, if set
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, buffered := req.Context().Value(rawBodyKey).([]byte)
+	if !buffered && req.Body != nil && req.Body != http.NoBody || !hedgeable(req) {
+		return t.transport.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	results := make(chan hedgeResult, 2)
+	send := func(hedge bool) context.CancelFunc {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := req.Clone(ctx)
+		if buffered {
+			attempt.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if hedge && t.retarget != nil {
+			t.retarget(attempt)
+		}
+		go func() {
+			resp, err := t.transport.RoundTrip(attempt)
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge, cancel: cancel}
+		}()
+		return cancel
+	}
+
+	cancelPrimary := send(false)
+	timer := time.NewTimer(t.delay)
+	select {
+	case result := <-results:
+		timer.Stop()
+		return result.response()
+	case <-timer.C:
+	}
+
+	log.Printf("Hedging %s %s: no response after %v, sending a duplicate request", req.Method, req.URL.Path, t.delay)
+	cancelHedge := send(true)
+
+	// Prefer the first successful attempt, falling back to the other one if it failed
+	winner := <-results
+	if winner.err == nil {
+		// Cancel the losing attempt and wait for it, so it is released before returning
+		if winner.hedge {
+			cancelPrimary()
+		} else {
+			cancelHedge()
+		}
+		if loser := <-results; loser.resp != nil {
+			loser.resp.Body.Close()
+		}
+	} else if other := <-results; other.err == nil {
+		winner.cancel()
+		winner = other
+	} else {
+		other.cancel()
+	}
+
+	label := "primary"
+	if winner.hedge {
+		label = "hedge"
+	}
+	log.Printf("Hedged %s %s won by the %s request", req.Method, req.URL.Path, label)
+	t.hedged.Inc(label)
+
+	return winner.response()
+}
+
+// response returns the attempt's response, cancelling its context once the body is closed
+func (r hedgeResult) response() (*http.Response, error) {
+	if r.err != nil {
+		r.cancel()
+		return nil, r.err
+	}
+	r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: r.cancel}
+	return r.resp, nil
+}
+
+// cancelOnClose cancels a request's context when its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// idleTimeoutBody abandons a streamed response body when no bytes arrive for the
+// timeout. The wait restarts with every read that returns data, so slow streams that
+// keep progressing are never cut off. On timeout the upstream body is closed and the
+// client receives an error event in place of the rest of the stream.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	target  string // method and path, for logging
+
+	mu       sync.Mutex
+	timedOut bool
+	ended    bool   // the upstream body is done with and only pending is returned
+	pending  []byte // unread part of the error event
+	last     []byte // final bytes received, to tell whether an event was cut off
+}
+
+// newIdleTimeoutBody wraps body, starting the idle timer
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, target string) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout, target: target}
+	b.timer = time.AfterFunc(timeout, b.expire)
+	return b
+}
+
+// expire closes the upstream body, unblocking the pending read
+func (b *idleTimeoutBody) expire() {
+	b.mu.Lock()
+	b.timedOut = true
+	b.mu.Unlock()
+	log.Printf("Warning: abandoning stream of %s after %v without data", b.target, b.timeout)
+	b.ReadCloser.Close()
+}
+
+// Read implements io.Reader
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.ended {
+		defer b.mu.Unlock()
+		if len(b.pending) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, b.pending)
+		b.pending = b.pending[n:]
+		return n, nil
+	}
+	b.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+		b.mu.Lock()
+		b.last = append(b.last[:0], p[max(n-2, 0):n]...)
+		b.mu.Unlock()
+	}
+	if err == nil {
+		return n, nil
+	}
+	b.timer.Stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.timedOut {
+		return n, err
+	}
+	b.ended = true
+	b.pending = b.errorEvent()
+	copied := copy(p[n:], b.pending)
+	b.pending = b.pending[copied:]
+	return n + copied, nil
+}
+
+// errorEvent returns the event reporting the timeout, starting on a new event if the
+// stream stopped in the middle of one. Callers must hold b.mu.
+func (b *idleTimeoutBody) errorEvent() []byte {
+	event := fmt.Sprintf(`data: {"error":{"code":"stream_idle_timeout","message":"No data received from upstream for %v"}}`+"\n\n", b.timeout)
+	if len(b.last) > 0 && string(b.last) != "\n\n" {
+		event = "\n\n" + event
+	}
+	return []byte(event)
+}
+
+// Close implements io.Closer
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,54 @@
+package proxy
+
+// contentParts returns the content parts of the chat messages in a request body.
+// Messages whose content is a plain string have no parts.
+func contentParts(body map[string]interface{}) []map[string]interface{} {
+	var parts []map[string]interface{}
+	messages, _ := body["messages"].([]interface{})
+	for _, message := range messages {
+		m, _ := message.(map[string]interface{})
+		content, _ := m["content"].([]interface{})
+		for _, part := range content {
+			if p, ok := part.(map[string]interface{}); ok {
+				parts = append(parts, p)
+			}
+		}
+	}
+	return parts
+}
+
+// countImages returns the number of image parts in the messages of a request body
+// and whether any part is not text. Images are counted whether they are sent
+// inline as base64 data URLs or referenced by remote URL.
+func countImages(body interface{}) (images int, multimodal bool) {
+	b, ok := body.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	for _, part := range contentParts(b) {
+		switch part["type"] {
+		case "text":
+		case "image_url":
+			if imageURL(part["image_url"]) != "" {
+				images++
+			}
+			multimodal = true
+		default:
+			multimodal = true
+		}
+	}
+	return images, multimodal
+}
+
+// imageURL returns the URL of an image_url part, which is either an object with a
+// "url" field or, in older requests, the URL itself. Data URLs are returned as-is.
+func imageURL(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case map[string]interface{}:
+		url, _ := value["url"].(string)
+		return url
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"azure-ai-proxy/internal/audit"
+)
+
+// ipFilter admits clients by the network they connect from. Denied networks take
+// precedence; when allowed networks are listed, clients must be in one of them.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newIPFilter parses allow and deny lists of CIDRs or single addresses, returning nil
+// when both are empty
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parsePrefixes parses CIDRs such as 10.0.0.0/8, and single addresses as /32 or /128
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid network %q, expected a CIDR or an IP address", value)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allows reports whether a client connecting from remoteAddr is admitted, and returns
+// its address. A nil filter admits everyone.
+func (f *ipFilter) allows(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, f == nil
+	}
+	addr = addr.Unmap()
+	if f == nil {
+		return addr, true
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return addr, false
+		}
+	}
+	if len(f.allow) == 0 {
+		return addr, true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return addr, true
+		}
+	}
+	return addr, false
+}
+
+// rejectAddress refuses a request from an address the filter does not admit and
+// records it in the audit log as a security event
+func (s *Server) rejectAddress(w http.ResponseWriter, r *http.Request, start time.Time, addr netip.Addr) {
+	message := fmt.Sprintf("Forbidden: address %s is not allowed", addr)
+	s.audit(r, "anonymous", "ip filter", audit.Failure, fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, message))
+	s.reject(w, r, start, rejectedByAddress, http.StatusForbidden, message)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// JSON mode conflict handling
+const (
+	// JSONModeOverride replaces a conflicting response_format with JSON mode
+	JSONModeOverride = "override"
+	// JSONModeReject rejects requests with a conflicting response_format
+	JSONModeReject = "reject"
+)
+
+// requiresJSONMode reports whether a chat request targets a deployment that must use JSON mode
+func (s *Server) requiresJSONMode(r *http.Request, body map[string]interface{}) bool {
+	if _, ok := body["messages"]; !ok {
+		return false
+	}
+	return s.jsonModeDeployments[modelName(r.URL.Path, body)]
+}
+
+// responseFormatType returns the type of a request's response_format, or "" if unset
+func responseFormatType(body map[string]interface{}) string {
+	format, _ := body["response_format"].(map[string]interface{})
+	formatType, _ := format["type"].(string)
+	return formatType
+}
+
+// jsonModeConflict returns a message for the client when a request to a JSON-mode
+// deployment asks for a different format and conflicts are rejected
+func (s *Server) jsonModeConflict(r *http.Request, body map[string]interface{}) (string, bool) {
+	if s.jsonModeConflicts != JSONModeReject || !s.requiresJSONMode(r, body) {
+		return "", false
+	}
+	switch formatType := responseFormatType(body); formatType {
+	case "", "json_object", "json_schema":
+		return "", false
+	default:
+		return fmt.Sprintf("Bad Request: deployment requires JSON output, response_format %q is not allowed", formatType), true
+	}
+}
+
+// enforceJSONMode sets response_format to json_object on requests to JSON-mode
+// deployments that don't already ask for JSON, and returns the format it replaced
+func (s *Server) enforceJSONMode(r *http.Request, body map[string]interface{}) (string, bool) {
+	if !s.requiresJSONMode(r, body) {
+		return "", false
+	}
+	switch formatType := responseFormatType(body); formatType {
+	case "json_object", "json_schema":
+		return "", false
+	default:
+		body["response_format"] = map[string]interface{}{"type": "json_object"}
+		return formatType, true
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// keyExpiryCheckInterval is how often client keys are checked for nearing their expiry
+const keyExpiryCheckInterval = 24 * time.Hour
+
+// expiredKeyResponse is the body of the 401 answering an expired key, so clients can
+// tell it apart from a wrong one
+type expiredKeyResponse struct {
+	Error apiError `json:"error"`
+}
+
+// rejectExpiredKey answers a request made with an expired client key
+func (s *Server) rejectExpiredKey(w http.ResponseWriter, r *http.Request, start time.Time, clientID string) {
+	message := "The API key has expired, request a new one from the proxy's operators"
+	log.Printf("Rejected %s %s by %s: key of client %s has expired", r.Method, r.URL.Path, rejectedByAuth, clientID)
+	writeJSON(w, http.StatusUnauthorized, expiredKeyResponse{Error: apiError{Code: "KeyExpired", Message: message}})
+
+	s.logger.LogRequest(logging.Entry{
+		Timestamp:             time.Now(),
+		Duration:              time.Since(start),
+		Path:                  r.URL.Path,
+		Method:                r.Method,
+		Status:                http.StatusUnauthorized,
+		ClientID:              clientID,
+		RejectedBy:            rejectedByAuth,
+		Error:                 message,
+		ExternalCorrelationID: s.externalCorrelationID(r),
+	})
+}
+
+// watchKeyExpiry checks the client keys for nearing their expiry now and then every
+// keyExpiryCheckInterval, until the server stops
+func (s *Server) watchKeyExpiry() {
+	s.checkKeyExpiry()
+	ticker := time.NewTicker(keyExpiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.checkKeyExpiry()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// checkKeyExpiry exports when each client key expires and logs a warning for those
+// that expire within the warning window or already have
+func (s *Server) checkKeyExpiry() {
+	st := s.current()
+	expiry := make(map[string]time.Time, len(st.keyExpiry))
+	for clientID, t := range st.keyExpiry {
+		expiry[clientID] = t
+	}
+	if s.virtualKeys != nil {
+		for _, k := range s.virtualKeys.List() {
+			if k.ExpiresAt != nil && !k.Disabled {
+				expiry[k.Name] = *k.ExpiresAt
+			}
+		}
+	}
+
+	clients := make([]string, 0, len(expiry))
+	for clientID := range expiry {
+		clients = append(clients, clientID)
+	}
+	sort.Strings(clients)
+
+	now := time.Now()
+	expiring := 0
+	s.keyExpiryTimes.Reset()
+	for _, clientID := range clients {
+		t := expiry[clientID]
+		s.keyExpiryTimes.Set(float64(t.Unix()), clientID)
+		switch left := t.Sub(now); {
+		case left <= 0:
+			log.Printf("Warning: key of client %s expired at %s", clientID, t.UTC().Format(time.RFC3339))
+		case left <= st.keyExpiryWarning:
+			expiring++
+			log.Printf("Warning: key of client %s expires at %s, in %d days", clientID, t.UTC().Format(time.RFC3339), int(left.Hours()/24))
+		}
+	}
+	s.keysExpiring.Set(float64(expiring))
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// inheritedListenerEnv names the environment variable through which a restarted
+// process learns the file descriptor of the listening socket it inherited
+const inheritedListenerEnv = "AZURE_AI_PROXY_LISTENER_FD"
+
+// listen returns the listening socket inherited from the previous process during a
+// graceful restart, or a new one on addr
+func listen(addr string) (net.Listener, error) {
+	value := os.Getenv(inheritedListenerEnv)
+	if value == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	// Don't pass the descriptor on to processes started later
+	os.Unsetenv(inheritedListenerEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", inheritedListenerEnv, value, err)
+	}
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited listener: %v", err)
+	}
+	return ln, nil
+}
+
+// readyEnv names the environment variable through which a restarted process learns
+// the file descriptor it reports serving on, so its predecessor can stop
+const readyEnv = "AZURE_AI_PROXY_READY_FD"
+
+// signalReady tells the process that started this one in a graceful restart that it
+// serves, if it did
+func signalReady() {
+	value := os.Getenv(readyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q: %v", readyEnv, value, err)
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		log.Printf("Warning: could not report serving to the previous process: %v", err)
+	}
+}
+
+// InheritsListener reports whether the process was started by a graceful restart and
+// takes over its predecessor's listening socket
+func InheritsListener() bool {
+	return os.Getenv(inheritedListenerEnv) != ""
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// chunkMerger coalesces consecutive content-only chat completion chunks of a stream
+// into larger chunks, emitted after maxChunks upstream chunks or once window has passed
+// since the first buffered one. Other events are passed through unchanged.
+type chunkMerger struct {
+	maxChunks int
+	window    time.Duration
+
+	pending map[string]interface{} // merged chunk waiting to be emitted
+	index   interface{}            // choice index of the pending chunk
+	merged  int                    // number of upstream chunks in pending
+}
+
+// streamEvent is an event read from upstream, or the error that ended the stream
+type streamEvent struct {
+	data []byte
+	err  error
+}
+
+// run reads events from body and writes the coarsened stream to w
+func (m *chunkMerger) run(body io.Reader, w io.Writer) error {
+	events := make(chan streamEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		reader := bufio.NewReader(body)
+		for {
+			event, err := readEvent(reader)
+			select {
+			case events <- streamEvent{data: event, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			if err := m.flush(w); err != nil {
+				return err
+			}
+		case event := <-events:
+			if len(event.data) > 0 {
+				started, err := m.add(event.data, w)
+				if err != nil {
+					return err
+				}
+				if started && m.window > 0 {
+					timer = time.After(m.window)
+				}
+			}
+			if event.err != nil {
+				if err := m.flush(w); err != nil {
+					return err
+				}
+				if event.err == io.EOF {
+					return nil
+				}
+				return event.err
+			}
+			if m.pending == nil {
+				timer = nil
+			}
+		}
+	}
+}
+
+// add merges an event into the pending chunk or writes it out. It reports whether
+// the event started a new pending chunk.
+func (m *chunkMerger) add(event []byte, w io.Writer) (bool, error) {
+	chunk, index, content, ok := mergeableChunk(event)
+	if !ok {
+		if err := m.flush(w); err != nil {
+			return false, err
+		}
+		_, err := w.Write(event)
+		return false, err
+	}
+
+	// A role starts a new message, so it is never merged into a pending chunk
+	_, hasRole := chunk["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})["role"]
+
+	started := false
+	if m.pending != nil && (m.index != index || hasRole) {
+		if err := m.flush(w); err != nil {
+			return false, err
+		}
+	}
+	if m.pending == nil {
+		m.pending, m.index, m.merged = chunk, index, 0
+		started = true
+	} else {
+		choice := m.pending["choices"].([]interface{})[0].(map[string]interface{})
+		delta := choice["delta"].(map[string]interface{})
+		existing, _ := delta["content"].(string)
+		delta["content"] = existing + content
+		// Keep the latest content filter annotations
+		if results, ok := chunk["choices"].([]interface{})[0].(map[string]interface{})["content_filter_results"]; ok {
+			choice["content_filter_results"] = results
+		}
+	}
+	m.merged++
+
+	if m.maxChunks > 0 && m.merged >= m.maxChunks {
+		return false, m.flush(w)
+	}
+	return started, nil
+}
+
+// flush writes the pending chunk, if any
+func (m *chunkMerger) flush(w io.Writer) error {
+	if m.pending == nil {
+		return nil
+	}
+	data, err := json.Marshal(m.pending)
+	m.pending = nil
+	if err != nil {
+		return err
+	}
+	var event bytes.Buffer
+	event.WriteString("data: ")
+	event.Write(data)
+	event.WriteString("\n\n")
+	_, err = w.Write(event.Bytes())
+	return err
+}
+
+// mergeableChunk parses an event holding a chat completion chunk whose only choice
+// carries nothing but content, returning the chunk, the choice index and the content
+func mergeableChunk(event []byte) (map[string]interface{}, interface{}, string, bool) {
+	data, ok := eventData(event)
+	if !ok {
+		return nil, nil, "", false
+	}
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, nil, "", false
+	}
+	chunk, ok := v.(map[string]interface{})
+	if !ok || chunk["usage"] != nil {
+		return nil, nil, "", false
+	}
+	choices, ok := chunk["choices"].([]interface{})
+	if !ok || len(choices) != 1 {
+		return nil, nil, "", false
+	}
+	choice, ok := choices[0].(map[string]interface{})
+	if !ok {
+		return nil, nil, "", false
+	}
+	for key, value := range choice {
+		switch key {
+		case "index", "delta", "content_filter_results":
+		default:
+			// finish_reason, logprobs and anything else must be null to merge
+			if value != nil {
+				return nil, nil, "", false
+			}
+		}
+	}
+	delta, ok := choice["delta"].(map[string]interface{})
+	if !ok {
+		return nil, nil, "", false
+	}
+	content := ""
+	for key, value := range delta {
+		switch key {
+		case "content":
+			if content, ok = value.(string); !ok {
+				return nil, nil, "", false
+			}
+		case "role":
+		default:
+			return nil, nil, "", false
+		}
+	}
+	return chunk, choice["index"], content, true
+}
+
+// mergeChunks coarsens the chunks of streamed responses, if configured
+func (s *Server) mergeChunks(resp *http.Response) {
+	if (s.mergeMaxChunks <= 0 && s.mergeWindow <= 0) || !isEventStream(resp) {
+		return
+	}
+	merger := &chunkMerger{maxChunks: s.mergeMaxChunks, window: s.mergeWindow}
+	resp.Body = pipeBody(resp.Body, merger.run)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// otherLabelValue replaces response field values that are not on a label's allowlist
+const otherLabelValue = "other"
+
+// responseLabel is a metrics label whose value is read from a response field
+type responseLabel struct {
+	name    string
+	path    []string
+	allowed map[string]bool
+}
+
+// responseLabels label the request-count metric with response field values
+type responseLabels []responseLabel
+
+// newResponseLabels creates labels from label name to dot-separated field path, e.g.
+// finish_reason=choices.finish_reason, and label name to "|"-separated allowed values.
+// Every label needs an allowlist so a misbehaving upstream cannot explode the number of series.
+func newResponseLabels(fields, values map[string]string) (responseLabels, error) {
+	var labels responseLabels
+	for name, path := range fields {
+		if name == "status" {
+			return nil, fmt.Errorf("response metric label %s clashes with the status label", name)
+		}
+		allowlist, ok := values[name]
+		if !ok {
+			return nil, fmt.Errorf("response metric label %s has no allowed values", name)
+		}
+		allowed := make(map[string]bool)
+		for _, value := range strings.Split(allowlist, "|") {
+			allowed[strings.TrimSpace(value)] = true
+		}
+		labels = append(labels, responseLabel{name: name, path: strings.Split(path, "."), allowed: allowed})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels, nil
+}
+
+// names returns the metric's label names, starting with the status
+func (l responseLabels) names() []string {
+	names := []string{"status"}
+	for _, label := range l {
+		names = append(names, label.name)
+	}
+	return names
+}
+
+// values returns the label values for a response with the given status and body. The
+// body is either JSON or an event stream, whose last event carrying a field wins.
+// Fields missing from the body are empty and values not on the allowlist are "other".
+func (l responseLabels) values(status string, body []byte) []string {
+	values := make([]string, len(l)+1)
+	values[0] = status
+	if len(l) == 0 || len(body) == 0 {
+		return values
+	}
+
+	var documents []interface{}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err == nil {
+		documents = append(documents, document)
+	} else {
+		for _, line := range strings.Split(string(body), "\n") {
+			data, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "data: ")
+			if !ok || json.Unmarshal([]byte(data), &document) != nil {
+				continue
+			}
+			documents = append(documents, document)
+		}
+	}
+
+	for i, label := range l {
+		for _, document := range documents {
+			if value, ok := fieldValue(document, label.path); ok {
+				values[i+1] = value
+			}
+		}
+		if values[i+1] != "" && !label.allowed[values[i+1]] {
+			values[i+1] = otherLabelValue
+		}
+	}
+	return values
+}
+
+// countRequest counts a forwarded request in proxy_requests_total, labeled with its
+// status, the response labels and the metric tags of the client's key
+func (t *loggingTransport) countRequest(req *http.Request, status string, body []byte) {
+	values := t.labels.values(status, body)
+	tags, _ := req.Context().Value(clientTagsKey).(map[string]string)
+	for _, tag := range t.metricTags {
+		values = append(values, tags[tag])
+	}
+	t.requestsTotal.Inc(values...)
+}
+
+// fieldValue returns the scalar at path in v. Arrays share their parent's path, so the
+// first element holding the field is used, as with the request field policy.
+func fieldValue(v interface{}, path []string) (string, bool) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return "", false
+		}
+		return fieldValue(value[path[0]], path[1:])
+	case []interface{}:
+		for _, element := range value {
+			if field, ok := fieldValue(element, path); ok {
+				return field, true
+			}
+		}
+		return "", false
+	}
+	if len(path) > 0 {
+		return "", false
+	}
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
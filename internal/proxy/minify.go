@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// minifyRequestBody removes insignificant whitespace from a JSON request body. Only
+// whitespace between tokens is dropped, so the forwarded document is semantically
+// identical. It returns the new body, or false when the body is not JSON, is still
+// compressed or was already compact.
+func minifyRequestBody(r *http.Request, body []byte) ([]byte, bool) {
+	if contentEncoding(r) != "" {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil || buf.Len() >= len(body) {
+		return nil, false
+	}
+	compact := buf.Bytes()
+
+	r.Body = io.NopCloser(bytes.NewReader(compact))
+	r.ContentLength = int64(len(compact))
+	r.Header.Set("Content-Length", strconv.Itoa(len(compact)))
+	return compact, true
+}
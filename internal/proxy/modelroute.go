@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"azure-ai-proxy/config"
+)
+
+// modelRoute sends the requests for a model to deployments on one or more backends,
+// spread over them like requests over all backends
+type modelRoute struct {
+	rotation *rotation
+	targets  []config.ModelTarget // by backend of the rotation
+}
+
+// next returns the backend that should serve the model's next request and the target
+// it was picked for
+func (m *modelRoute) next() (*backend, config.ModelTarget) {
+	i := m.rotation.pick()
+	return m.rotation.backends[i], m.targets[i]
+}
+
+// parseModelRoutes parses routes per model, as config.ParseModelRoute does, against the
+// balancer's backends
+func parseModelRoutes(values map[string]string, b *balancer) (map[string]*modelRoute, error) {
+	routes := make(map[string]*modelRoute, len(values))
+	for model, value := range values {
+		targets, err := config.ParseModelRoute(model, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid model route: %v", err)
+		}
+		backends := make([]*backend, len(targets))
+		weights := make([]int, len(targets))
+		for i, t := range targets {
+			if backends[i] = b.named(t.Backend); backends[i] == nil {
+				return nil, fmt.Errorf("model route for %s names unknown backend %q", model, t.Backend)
+			}
+			weights[i] = t.Weight
+			if weights[i] == 0 {
+				weights[i] = backends[i].weight
+			}
+		}
+		routes[model] = &modelRoute{
+			rotation: newWeightedRotation(backends, weights, b.rotation.leastConnections),
+			targets:  targets,
+		}
+	}
+	return routes, nil
+}
+
+// routeModelPath points a request whose deployment segment names a routed model at the
+// route's deployment and backend
+func (s *Server) routeModelPath(r *http.Request) *http.Request {
+	model := deploymentFromPath(r.URL.Path)
+	route, ok := s.current().modelRoutes[model]
+	if !ok || model == "" {
+		return r
+	}
+	be, target := route.next()
+	log.Printf("Routing model %s of %s %s to deployment %s on %s", model, r.Method, r.URL.Path, target.Deployment, be.name)
+	setDeployment(r, model, target.Deployment)
+	return withModelTarget(r, be, target)
+}
+
+// routeModelBody points a request whose body names a routed model, or an alias of one,
+// at the route's deployment and backend, replacing the model field. It reports whether
+// it did.
+func (s *Server) routeModelBody(r *http.Request, body map[string]interface{}) (*http.Request, bool) {
+	model, _ := body["model"].(string)
+	// Aliases apply before routes, as they do in paths
+	if deployment, ok := s.current().modelAliases[model]; ok {
+		model = deployment
+	}
+	route, ok := s.current().modelRoutes[model]
+	if !ok || model == "" {
+		return r, false
+	}
+	be, target := route.next()
+	body["model"] = target.Deployment
+	log.Printf("Routing model %s in the body of %s %s to deployment %s on %s", model, r.Method, r.URL.Path, target.Deployment, be.name)
+	return withModelTarget(r, be, target), true
+}
+
+// withModelTarget pins a request to the backend its model was routed to and records
+// the target for its log entry
+func withModelTarget(r *http.Request, be *backend, target config.ModelTarget) *http.Request {
+	ctx := context.WithValue(r.Context(), backendKey, be)
+	ctx = context.WithValue(ctx, modelTargetKey, target.String())
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// moderate runs the prompt of a request through Content Safety. It returns the
+// severities found, or false with a status and message when the request must be blocked.
+func (s *Server) moderate(r *http.Request, body map[string]interface{}) (map[string]int, int, string, bool) {
+	if len(s.moderationDeployments) > 0 && !s.moderationDeployments[modelName(r.URL.Path, body)] {
+		return nil, 0, "", true
+	}
+	text := promptText(body)
+	if text == "" {
+		return nil, 0, "", true
+	}
+
+	severities, err := s.moderation.Analyze(r.Context(), text)
+	if err != nil {
+		if s.moderationFailOpen {
+			log.Printf("Warning: content safety check failed for %s %s, forwarding: %v", r.Method, r.URL.Path, err)
+			return nil, 0, "", true
+		}
+		log.Printf("Error: content safety check failed for %s %s: %v", r.Method, r.URL.Path, err)
+		return nil, http.StatusServiceUnavailable, "Service Unavailable: content safety check failed", false
+	}
+
+	var exceeded []string
+	for _, category := range sortedCategories(severities) {
+		if threshold, ok := s.moderationThresholds[category]; ok && severities[category] >= threshold {
+			exceeded = append(exceeded, fmt.Sprintf("%s (severity %d)", category, severities[category]))
+		}
+	}
+	if len(exceeded) > 0 {
+		return severities, http.StatusForbidden, "Forbidden: prompt blocked by content safety: " + strings.Join(exceeded, ", "), false
+	}
+
+	log.Printf("Content safety passed %s %s: %v", r.Method, r.URL.Path, severities)
+	return severities, 0, "", true
+}
+
+// inspectionRequired returns the check a request's body must pass, and the reason
+// to log refusing it under, if the body cannot be inspected: the field policy, or a
+// content safety check that fails closed on the request's deployment
+func (s *Server) inspectionRequired(r *http.Request) (check, reason string) {
+	if s.fieldPolicy != "" {
+		return "the field policy", rejectedByField
+	}
+	if s.moderation != nil && !s.moderationFailOpen && (len(s.moderationDeployments) == 0 || s.moderationDeployments[deploymentFromPath(r.URL.Path)]) {
+		return "content safety", rejectedByModeration
+	}
+	return "", ""
+}
+
+// promptText concatenates the text of a request's messages, prompt and input
+func promptText(body map[string]interface{}) string {
+	var parts []string
+	if messages, ok := body["messages"].([]interface{}); ok {
+		for _, message := range messages {
+			if m, ok := message.(map[string]interface{}); ok {
+				parts = appendText(parts, m["content"])
+			}
+		}
+	}
+	parts = appendText(parts, body["prompt"])
+	parts = appendText(parts, body["input"])
+	return strings.Join(parts, "\n")
+}
+
+// appendText appends the text of a content value, see textLength for the accepted shapes
+func appendText(parts []string, content interface{}) []string {
+	switch c := content.(type) {
+	case string:
+		if c != "" {
+			parts = append(parts, c)
+		}
+	case []interface{}:
+		for _, part := range c {
+			if p, ok := part.(map[string]interface{}); ok {
+				parts = appendText(parts, p["text"])
+			} else {
+				parts = appendText(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// sortedCategories returns the categories of severities in order
+func sortedCategories(severities map[string]int) []string {
+	categories := make([]string, 0, len(severities))
+	for category := range severities {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
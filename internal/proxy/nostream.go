@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// disableStreaming turns a streaming request into a non-streaming one for clients that
+// cannot receive event streams, so they get the complete response in one piece. A
+// client opts in through config or by sending the no-streaming header set to true.
+func (s *Server) disableStreaming(r *http.Request, body map[string]interface{}, clientID string) bool {
+	requested := false
+	if s.noStreamHeader != "" {
+		requested = strings.EqualFold(r.Header.Get(s.noStreamHeader), "true")
+		r.Header.Del(s.noStreamHeader)
+	}
+	if body["stream"] != true || !requested && !s.noStreamClients[clientID] {
+		return false
+	}
+	delete(body, "stream")
+	delete(body, "stream_options") // only valid on streaming requests
+	return true
+}
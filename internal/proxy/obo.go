@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// oboExpiryMargin is how long before it expires an exchanged token is no longer used,
+// so it does not expire on its way to the backend
+const oboExpiryMargin = time.Minute
+
+// oboSource exchanges the tokens of users for tokens for the backends on their behalf,
+// with the on-behalf-of flow of an app registration. Exchanged tokens are cached by the
+// token they were exchanged for, until they expire.
+type oboSource struct {
+	tenantID, clientID, secret string
+	scope                      string
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]azcore.AccessToken // by SHA-256 of the user's token
+}
+
+// newOBOSource creates a source exchanging users' tokens for tokens for scope
+func newOBOSource(tenantID, clientID, secret, scope string) *oboSource {
+	return &oboSource{
+		tenantID: tenantID,
+		clientID: clientID,
+		secret:   secret,
+		scope:    scope,
+		tokens:   make(map[[sha256.Size]byte]azcore.AccessToken),
+	}
+}
+
+// bearer returns the Authorization header value for an upstream request on behalf of
+// the user whose token assertion is
+func (o *oboSource) bearer(ctx context.Context, assertion string) (string, error) {
+	sum := sha256.Sum256([]byte(assertion))
+	o.mu.Lock()
+	token, ok := o.tokens[sum]
+	o.mu.Unlock()
+	if ok && time.Until(token.ExpiresOn) > oboExpiryMargin {
+		return "Bearer " + token.Token, nil
+	}
+
+	credential, err := azidentity.NewOnBehalfOfCredentialWithSecret(o.tenantID, o.clientID, assertion, o.secret, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create on-behalf-of credential: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	defer cancel()
+	token, err = credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{o.scope}})
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange user token for %s: %v", o.scope, err)
+	}
+
+	o.mu.Lock()
+	now := time.Now()
+	for key, cached := range o.tokens {
+		if now.After(cached.ExpiresOn) {
+			delete(o.tokens, key)
+		}
+	}
+	o.tokens[sum] = token
+	o.mu.Unlock()
+	return "Bearer " + token.Token, nil
+}
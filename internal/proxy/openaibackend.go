@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// openAIBackendTransport translates requests to backends of type "openai" and
+// "openai-compatible" from the Azure OpenAI API to the OpenAI one: deployment paths
+// become OpenAI paths with the deployment as the model of the body, and the
+// api-version is dropped. Requests to Azure backends pass unchanged, so those failing
+// over or split between the two are translated only when sent to OpenAI.
+type openAIBackendTransport struct {
+	transport http.RoundTripper
+	backends  func() *balancer
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *openAIBackendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	be := t.backends().byHost(req.URL.Host)
+	if be == nil || !be.openAI {
+		return t.transport.RoundTrip(req)
+	}
+	out, err := toOpenAI(req, be)
+	if err != nil {
+		return nil, err
+	}
+	return t.transport.RoundTrip(out)
+}
+
+// toOpenAI returns a copy of an Azure OpenAI request for the OpenAI API served by be,
+// e.g. /openai/deployments/gpt-4o/chat/completions as /v1/chat/completions with
+// "model": "gpt-4o" in its JSON body, and /openai/files as /v1/files
+func toOpenAI(req *http.Request, be *backend) (*http.Request, error) {
+	base := strings.TrimSuffix(be.url.Path, "/")
+	path := strings.TrimPrefix(req.URL.Path, base)
+	model := deploymentFromPath(path)
+	switch {
+	case model != "":
+		path = openAIPrefix + strings.TrimPrefix(path, deploymentPrefix+model+"/")
+	case strings.HasPrefix(path, "/openai"+openAIPrefix):
+		path = strings.TrimPrefix(path, "/openai")
+	case strings.HasPrefix(path, "/openai/"):
+		path = openAIPrefix + strings.TrimPrefix(path, "/openai/")
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Path = base + path
+	out.URL.RawPath = ""
+	query := out.URL.Query()
+	query.Del("api-version")
+	out.URL.RawQuery = query.Encode()
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if model == "" || mediaType != "application/json" || req.Body == nil || req.Body == http.NoBody {
+		return out, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	if json.Unmarshal(data, &body) == nil && body != nil {
+		body["model"] = model
+		if encoded, err := json.Marshal(body); err == nil {
+			data = encoded
+		}
+	}
+	out.Body = io.NopCloser(bytes.NewReader(data))
+	out.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	out.ContentLength = int64(len(data))
+	return out, nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// openAIPrefix starts the paths of the OpenAI API, such as /v1/chat/completions
+const openAIPrefix = "/v1/"
+
+// openAIDeploymentOperations are the OpenAI operations Azure OpenAI serves per
+// deployment; the others are served under /openai/ for the whole resource
+var openAIDeploymentOperations = map[string]bool{
+	"chat/completions":     true,
+	"completions":          true,
+	"embeddings":           true,
+	"images/generations":   true,
+	"images/edits":         true,
+	"audio/speech":         true,
+	"audio/transcriptions": true,
+	"audio/translations":   true,
+}
+
+// isOpenAIPath reports whether path is one of the OpenAI API
+func isOpenAIPath(path string) bool {
+	return strings.HasPrefix(path, openAIPrefix)
+}
+
+// translateOpenAIPath rewrites the OpenAI path of a request to the Azure OpenAI one:
+// operations served per deployment go to the deployment the model of body names, the
+// others under /openai/, e.g. /v1/files to /openai/files. Requests without an
+// api-version get the configured one. It returns why the request cannot be translated,
+// or "" once it is.
+func (s *Server) translateOpenAIPath(r *http.Request, body map[string]interface{}) string {
+	operation := strings.TrimPrefix(r.URL.Path, openAIPrefix)
+	path := "/openai/" + operation
+	if openAIDeploymentOperations[operation] {
+		model, _ := body["model"].(string)
+		if model == "" || strings.Contains(model, "/") {
+			return fmt.Sprintf("Bad Request: %s needs a model in a JSON body, or use %s{deployment}/%s instead", r.URL.Path, deploymentPrefix, operation)
+		}
+		path = deploymentPrefix + model + "/" + operation
+	}
+	log.Printf("Translated OpenAI path %s %s to %s", r.Method, r.URL.Path, path)
+	r.URL.Path = path
+	r.URL.RawPath = ""
+
+	query := r.URL.Query()
+	if !query.Has("api-version") {
+		query.Set("api-version", s.openAIAPIVersion)
+		r.URL.RawQuery = query.Encode()
+	}
+	return ""
+}
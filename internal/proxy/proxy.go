@@ -3,16 +3,41 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/audit"
+	"azure-ai-proxy/internal/auth"
+	"azure-ai-proxy/internal/budget"
+	"azure-ai-proxy/internal/cache"
+	"azure-ai-proxy/internal/deadletter"
+	"azure-ai-proxy/internal/features"
 	"azure-ai-proxy/internal/logging"
+	"azure-ai-proxy/internal/metrics"
+	"azure-ai-proxy/internal/moderation"
+	"azure-ai-proxy/internal/ratelimit"
+	"azure-ai-proxy/internal/schema"
+	"azure-ai-proxy/internal/stats"
+	"azure-ai-proxy/internal/tasks"
+	"azure-ai-proxy/internal/virtualkeys"
 )
 
 // Define custom context key types to avoid collisions
@@ -20,128 +45,1153 @@ type contextKey string
 
 const (
 	requestBodyKey contextKey = "requestBody"
+	rawBodyKey     contextKey = "rawBody"
+	coalesceKey    contextKey = "coalesce"
+	cacheKey       contextKey = "cache"
 	pathKey        contextKey = "path"
 	methodKey      contextKey = "method"
 	startTimeKey   contextKey = "startTime"
+	clientIDKey    contextKey = "clientID"
+	clientOwnerKey contextKey = "clientOwner"
+	clientTagsKey  contextKey = "clientTags"
+	subjectKey     contextKey = "subject"
+	userKey        contextKey = "user"
+	userTokenKey   contextKey = "userToken"
+	taskIDKey      contextKey = "taskID"
+	attemptsKey    contextKey = "attempts"
+	moderationKey  contextKey = "moderation"
+	debugKey       contextKey = "debug"
+	apiVersionKey  contextKey = "apiVersion"
+	correlationKey contextKey = "correlation"
+	routedFromKey  contextKey = "routedFrom"
+	semanticKey    contextKey = "semantic"
+	degradeKey     contextKey = "degrade"
+	routeKey       contextKey = "route"
+	featuresKey    contextKey = "features"
+	backendKey     contextKey = "backend"
+	modelTargetKey contextKey = "modelTarget"
 )
 
 // Server represents the proxy server
 type Server struct {
-	targetURL *url.URL
-	proxy     *httputil.ReverseProxy
-	logger    logging.Logger
-	apiKey    string
+	settings              atomic.Pointer[settings]
+	proxy                 *httputil.ReverseProxy
+	logger                logging.Logger
+	auditLogger           audit.Logger
+	maxRequestBodySize    int64
+	routes                []config.Route // route overrides, most specific first
+	latencyRouting        bool           // send requests to the fastest backend unless routes say otherwise
+	latencyMargin         float64        // how much faster another backend must be to be preferred
+	logBodies             bool
+	maxBufferedBodySize   int64
+	decompressRequests    bool
+	minifyRequests        bool
+	streamingContentTypes []string
+	allowedMethods        map[string]bool
+	pathPattern           *regexp.Regexp
+	openAIPaths           bool
+	openAIAPIVersion      string
+	systemPrompt          string
+	systemPromptMode      string
+	jsonModeDeployments   map[string]bool
+	seedSource            string
+	seed                  int64
+	clientSeeds           map[string]int
+	seedDeployments       map[string]bool
+	jsonModeConflicts     string
+	coalesceWindow        time.Duration
+	mergeMaxChunks        int
+	mergeWindow           time.Duration
+	logAttempts           bool
+	correlationHeader     string
+	contextLimits         map[string]int
+	noStreamClients       map[string]bool
+	noStreamHeader        string
+	charsPerToken         float64
+	headerRenames         map[string]string
+	removeRenamedHeaders  bool
+	moderation            *moderation.Client
+	moderationThresholds  map[string]int
+	moderationDeployments map[string]bool
+	moderationFailOpen    bool
+	fieldPolicy           string
+	policyFields          map[string]bool
+	stripFields           map[string]bool
+	stripDeployments      map[string]bool
+	stripClients          map[string]bool
+	cache                 cache.Cache
+	semantic              *semanticCache
+	tasks                 *tasks.Tracker
+	budgets               *budget.Ledger
+	virtualKeys           *virtualkeys.Store
+	keyExpiryTimes        *metrics.Vec
+	keysExpiring          *metrics.Vec
+	cacheRequests         *metrics.Vec
+	deadLetters           *deadletter.Writer
+	stats                 *stats.Collector
+	limiter               *ratelimit.AdaptiveLimiter
+	quota                 *ratelimit.QuotaTracker
+	concurrency           *ratelimit.ConcurrencyLimiter
+	configManager         ConfigManager // serves PUT /admin/config and POST /admin/config/refresh
+	concurrencyMode       string
+	concurrencyTimeout    time.Duration
+	quotaRejectedTotal    *metrics.Vec
+	shedder               *ratelimit.LoadShedder
+	shedTotal             *metrics.Vec
+	metrics               *metrics.Registry
+	metricsPath           string
+	requestsTotal         *metrics.Vec
+	rateLimitedTotal      *metrics.Vec
+	schemas               *schema.Inferrer
+	schemaFilePath        string
+	baseTransport         *http.Transport
+	upstreamTransport     http.RoundTripper // baseTransport translating requests to the OpenAI API
+	warmupConnections     int
+	warmupTimeout         time.Duration
+	httpServer            *http.Server
+	tlsConfig             *tls.Config
+	shutdownTimeout       time.Duration
+	upstreamTimeout       time.Duration
+	deadlineHeader        string
+	tokens                *tokenSource      // Entra ID tokens of the backends that use them
+	obo                   *oboSource        // exchanges users' tokens for backends with obo auth
+	replays               *auth.ReplayCache // signatures of signed requests already accepted
+	stop                  chan struct{}
 }
 
-// New creates a new proxy server
-func New(targetURL *url.URL, logger logging.Logger, apiKey string) *Server {
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+// New creates a new proxy server forwarding to backends
+func New(backends []config.Backend, logger logging.Logger, cfg *config.Config) (*Server, error) {
+	// The Director below points requests at a backend
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{})
 
 	server := &Server{
-		targetURL: targetURL,
-		proxy:     proxy,
-		logger:    logger,
-		apiKey:    apiKey,
+		proxy:                 proxy,
+		logger:                logger,
+		maxRequestBodySize:    cfg.MaxRequestBodySize,
+		routes:                sortRoutes(cfg.Routes),
+		latencyRouting:        cfg.LatencyRouting,
+		latencyMargin:         cfg.LatencyRoutingMargin,
+		logBodies:             cfg.LogBodies,
+		maxBufferedBodySize:   cfg.MaxBufferedBodySize,
+		decompressRequests:    cfg.DecompressRequests,
+		minifyRequests:        cfg.MinifyRequests,
+		streamingContentTypes: cfg.StreamingContentTypes,
+		allowedMethods:        make(map[string]bool),
+		openAIPaths:           cfg.OpenAIPaths,
+		openAIAPIVersion:      cfg.OpenAIPathsAPIVersion,
+		systemPrompt:          cfg.SystemPrompt,
+		systemPromptMode:      cfg.SystemPromptMode,
+		jsonModeDeployments:   make(map[string]bool),
+		seedSource:            cfg.Seed,
+		clientSeeds:           cfg.ClientSeeds,
+		seedDeployments:       make(map[string]bool),
+		jsonModeConflicts:     cfg.JSONModeConflicts,
+		coalesceWindow:        cfg.CoalesceWindow,
+		mergeMaxChunks:        cfg.StreamMergeChunks,
+		mergeWindow:           cfg.StreamMergeWindow,
+		logAttempts:           cfg.LogAttempts,
+		correlationHeader:     cfg.CorrelationIDHeader,
+		contextLimits:         cfg.ModelContextLimits,
+		charsPerToken:         cfg.CharsPerToken,
+		noStreamClients:       make(map[string]bool),
+		noStreamHeader:        cfg.NoStreamHeader,
+		metrics:               metrics.NewRegistry(),
+		tasks:                 tasks.NewTracker(cfg.TaskRetention, maxTrackedTasks),
+		metricsPath:           cfg.MetricsPath,
+		schemaFilePath:        cfg.SchemaFilePath,
+		shutdownTimeout:       cfg.ShutdownTimeout,
+		upstreamTimeout:       cfg.UpstreamTimeout,
+		deadlineHeader:        cfg.DeadlineHeader,
+		warmupConnections:     cfg.WarmupConnections,
+		warmupTimeout:         cfg.WarmupTimeout,
+		headerRenames:         cfg.HeaderRenames,
+		removeRenamedHeaders:  cfg.RemoveRenamedHeaders,
+		moderationThresholds:  cfg.ContentSafetyThresholds,
+		moderationDeployments: make(map[string]bool),
+		moderationFailOpen:    cfg.ContentSafetyFailOpen,
+		fieldPolicy:           cfg.RequestFieldPolicy,
+		policyFields:          make(map[string]bool),
+		stripFields:           make(map[string]bool),
+		stripDeployments:      make(map[string]bool),
+		stripClients:          make(map[string]bool),
+		stop:                  make(chan struct{}),
+	}
+
+	server.httpServer = &http.Server{
+		Handler:           server.Handler(),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	// Terminate TLS, verifying client certificates if a client CA is configured
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	server.tlsConfig = tlsConfig
+
+	// Routing, authentication and the other settings ApplyConfig can replace
+	server.tokens = newTokenSource(cfg.AzureOpenAITokenScope, server.stop)
+	server.obo = newOBOSource(cfg.OBOTenantID, cfg.OBOClientID, cfg.OBOClientSecret, cfg.AzureOpenAITokenScope)
+	server.replays = auth.NewReplayCache()
+	st, err := newSettings(backends, cfg, tlsConfig != nil && tlsConfig.ClientCAs != nil, server.tokens, server.obo, server.replays)
+	if err != nil {
+		return nil, err
+	}
+	server.settings.Store(st)
+
+	// Refuse to start with Entra ID authentication that cannot get a token
+	if st.balancer.usesTokens() {
+		if _, err := server.tokens.bearer(context.Background()); err != nil {
+			return nil, err
+		}
+		log.Printf("Authenticating to Azure OpenAI with Entra ID tokens for %s", cfg.AzureOpenAITokenScope)
+	}
+	if st.balancer.usesUserTokens() {
+		log.Printf("Authenticating to Azure OpenAI with the tokens of users")
+	}
+
+	for _, clientID := range cfg.NoStreamClients {
+		server.noStreamClients[clientID] = true
+	}
+
+	for _, method := range cfg.AllowedMethods {
+		server.allowedMethods[strings.ToUpper(method)] = true
+	}
+
+	switch cfg.JSONModeConflicts {
+	case JSONModeOverride, JSONModeReject:
+	default:
+		return nil, fmt.Errorf("unknown JSON mode conflict handling %q", cfg.JSONModeConflicts)
+	}
+	for _, deployment := range cfg.JSONModeDeployments {
+		server.jsonModeDeployments[deployment] = true
+	}
+
+	if cfg.Seed != "" && cfg.Seed != SeedFromClient {
+		seed, err := strconv.ParseInt(cfg.Seed, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed %q, expected an integer or %q", cfg.Seed, SeedFromClient)
+		}
+		server.seed = seed
+	}
+	for _, deployment := range cfg.SeedDeployments {
+		server.seedDeployments[deployment] = true
+	}
+
+	// Screen prompts with Azure AI Content Safety
+	if cfg.ContentSafetyEndpoint != "" {
+		server.moderation = moderation.NewClient(cfg.ContentSafetyEndpoint, cfg.ContentSafetyKey, cfg.ContentSafetyTimeout)
+		for _, deployment := range cfg.ContentSafetyDeployments {
+			server.moderationDeployments[deployment] = true
+		}
+	}
+
+	switch cfg.RequestFieldPolicy {
+	case "", FieldPolicyDeny, FieldPolicyAllow:
+	default:
+		return nil, fmt.Errorf("unknown request field policy %q", cfg.RequestFieldPolicy)
+	}
+	for _, field := range cfg.RequestFields {
+		server.policyFields[field] = true
+	}
+
+	for _, field := range cfg.StripResponseFields {
+		server.stripFields[field] = true
+	}
+	for _, deployment := range cfg.StripResponseDeployments {
+		server.stripDeployments[deployment] = true
+	}
+	for _, clientID := range cfg.StripResponseClients {
+		server.stripClients[clientID] = true
+	}
+
+	if cfg.PathPattern != "" {
+		pattern, err := regexp.Compile(cfg.PathPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern: %v", err)
+		}
+		server.pathPattern = pattern
+	}
+
+	// Keep the client keys created through the admin API
+	if cfg.VirtualKeysFile != "" {
+		if server.virtualKeys, err = virtualkeys.Open(cfg.VirtualKeysFile); err != nil {
+			return nil, fmt.Errorf("failed to load virtual keys: %v", err)
+		}
+	}
+
+	// Enforce per-client spend limits, including those of virtual keys
+	if len(cfg.ClientBudgets) > 0 || server.virtualKeys != nil {
+		limits, err := budget.ParseLimits(cfg.ClientBudgets)
+		if err != nil {
+			return nil, err
+		}
+		prices, err := budget.ParsePrices(cfg.ModelPrices)
+		if err != nil {
+			return nil, err
+		}
+		if server.budgets, err = budget.NewLedger(cfg.BudgetFilePath, limits, prices); err != nil {
+			return nil, fmt.Errorf("failed to load budgets: %v", err)
+		}
+		if server.virtualKeys != nil {
+			for _, k := range server.virtualKeys.List() {
+				limit, err := virtualKeyLimit(k)
+				if err != nil {
+					return nil, err
+				}
+				server.budgets.SetLimit(k.Name, limit)
+			}
+		}
+	}
+
+	// Keep administrative and auth events in their own log
+	if cfg.AuditLogPath != "" {
+		auditLogger, err := audit.NewFileLogger(cfg.AuditLogPath)
+		if err != nil {
+			return nil, err
+		}
+		server.auditLogger = auditLogger
+	}
+
+	// Open the dead-letter queue if enabled
+	if cfg.DeadLetterFilePath != "" {
+		deadLetters, err := deadletter.NewWriter(cfg.DeadLetterFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dead-letter file: %v", err)
+		}
+		server.deadLetters = deadLetters
+	}
+
+	responseLabels, err := newResponseLabels(cfg.ResponseMetricLabels, cfg.ResponseMetricLabelValues)
+	if err != nil {
+		return nil, err
+	}
+	server.requestsTotal = server.metrics.Counter("proxy_requests_total", "Requests forwarded upstream by response status.", append(responseLabels.names(), cfg.MetricTags...)...)
+	server.rateLimitedTotal = server.metrics.Counter("proxy_rate_limited_total", "Requests rejected by the proxy's rate limiter.")
+
+	// Set up the response cache
+	switch cfg.CacheBackend {
+	case "":
+	case "memory":
+		server.cache = cache.NewMemoryCache(cfg.CacheMaxEntries)
+	case "redis":
+		server.cache = cache.NewRedisCache(cache.RedisOptions{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			TLS:      cfg.RedisTLS,
+			Prefix:   "azure-ai-proxy:",
+		})
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.CacheBackend)
+	}
+	if server.cache != nil {
+		server.cacheRequests = server.metrics.Counter("proxy_cache_requests_total", "Response cache lookups by result.", "result")
+	}
+
+	// Also answer prompts similar to cached ones
+	if cfg.SemanticCacheDeployment != "" {
+		if server.cache == nil {
+			return nil, fmt.Errorf("semantic caching requires a cache backend")
+		}
+		server.semantic = &semanticCache{
+			deployment: cfg.SemanticCacheDeployment,
+			apiVersion: cfg.SemanticCacheAPIVersion,
+			threshold:  cfg.SemanticCacheThreshold,
+		}
+	}
+
+	// Surface storage problems of loggers that can fail over
+	if degradable, ok := logger.(interface{ Degraded() bool }); ok {
+		server.metrics.GaugeFunc("proxy_logger_degraded", "1 when the request logger has failed over to stdout.", func() float64 {
+			if degradable.Degraded() {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	// Adapt the request rate to upstream throttling
+	if cfg.AdaptiveRateInitial > 0 {
+		server.limiter = ratelimit.NewAdaptiveLimiter(cfg.AdaptiveRateInitial, cfg.AdaptiveRateMin, cfg.AdaptiveRateMax,
+			cfg.AdaptiveRateIncrease, cfg.AdaptiveRateDecrease, cfg.AdaptiveRateInterval)
+		server.metrics.GaugeFunc("proxy_adaptive_rate_limit", "Current effective rate limit in requests per second.", server.limiter.Rate)
+	}
+
+	// Cap the in-flight requests of each client
+	if cfg.ClientConcurrency > 0 || len(cfg.ClientConcurrencyLimits) > 0 {
+		if cfg.ConcurrencyMode != ConcurrencyReject && cfg.ConcurrencyMode != ConcurrencyQueue {
+			return nil, fmt.Errorf("unknown concurrency mode %q", cfg.ConcurrencyMode)
+		}
+		server.concurrency = ratelimit.NewConcurrencyLimiter(cfg.ClientConcurrency, cfg.ClientConcurrencyLimits)
+		server.concurrencyMode = cfg.ConcurrencyMode
+		server.concurrencyTimeout = cfg.ConcurrencyQueueTimeout
+	}
+
+	// Hold back requests Azure has no token quota left for
+	if cfg.QuotaReserveTokens > 0 {
+		server.quota = ratelimit.NewQuotaTracker(cfg.QuotaReserveTokens, cfg.QuotaStaleAfter, len(st.balancer.backends))
+		server.quotaRejectedTotal = server.metrics.Counter("proxy_quota_rejected_total", "Requests rejected because Azure reported too few remaining tokens.")
+	}
+
+	// Shed load while latency and queue depth show the proxy is overloaded
+	if cfg.ShedLatencyTarget > 0 {
+		if cfg.ShedLatencyPercentile <= 0 || cfg.ShedLatencyPercentile > 1 {
+			return nil, fmt.Errorf("load shedding percentile must be in (0, 1], got %v", cfg.ShedLatencyPercentile)
+		}
+		server.shedder = ratelimit.NewLoadShedder(cfg.ShedLatencyTarget, cfg.ShedLatencyPercentile, cfg.ShedQueueDepth, cfg.ShedInterval, cfg.ShedWindow)
+		server.shedTotal = server.metrics.Counter("proxy_shed_requests_total", "Requests rejected by load shedding.")
+		server.metrics.GaugeFunc("proxy_in_flight_requests", "Requests admitted and not yet completed.", func() float64 {
+			return float64(server.shedder.InFlight())
+		})
+	}
+
+	// Infer request and response schemas from live traffic
+	if cfg.SchemaFilePath != "" {
+		server.schemas = schema.NewInferrer()
+	}
+
+	// Periodically log a summary of recent traffic
+	if cfg.StatsInterval > 0 {
+		server.stats = stats.NewCollector()
+		go server.stats.Run(cfg.StatsInterval, server.stop)
+	}
+
+	// Warn about client keys nearing their expiry
+	server.keyExpiryTimes = server.metrics.Gauge("proxy_client_key_expiry_timestamp_seconds", "Unix time at which the key of a client expires.", "client")
+	server.keysExpiring = server.metrics.Gauge("proxy_client_keys_expiring", "Client keys expiring within KEY_EXPIRY_WARNING_DAYS.")
+	go server.watchKeyExpiry()
+
+	// Export the proxy's own resource usage and watch for goroutine leaks
+	server.metrics.RegisterRuntime()
+	if cfg.RuntimeCheckInterval > 0 {
+		go metrics.WatchGoroutines(cfg.RuntimeCheckInterval, cfg.GoroutineWarnThreshold, server.stop)
 	}
 
 	// Override the Director function to modify the request
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
-		req.Host = targetURL.Host
+		server.pinAPIVersion(req)
+		backend := server.retarget(req)
+		// Renames act on the credentials actually sent upstream
+		backend.authorize(req)
+		server.renameHeaders(req)
+		server.propagateDeadline(req)
+		recordAPIVersion(req)
+		// Coalescing is between clients and the proxy only
+		req.Header.Del(coalesceHeader)
 	}
 
+	// Transform responses once they have been logged
+	proxy.ModifyResponse = server.modifyResponse
+	proxy.ErrorHandler = server.errorHandler
+
+	// Keep enough idle connections per host for the warmed-up pool to survive
+	server.baseTransport = http.DefaultTransport.(*http.Transport).Clone()
+	server.baseTransport.MaxIdleConnsPerHost = max(server.baseTransport.MaxIdleConnsPerHost, cfg.WarmupConnections)
+
 	// Create a custom transport that captures the response
-	originalTransport := http.DefaultTransport
-	proxy.Transport = &loggingTransport{
+	var originalTransport http.RoundTripper = server.baseTransport
+
+	// Translate requests to the OpenAI API and compatible backends
+	originalTransport = &openAIBackendTransport{
+		transport: originalTransport,
+		backends:  func() *balancer { return server.current().balancer },
+	}
+	server.upstreamTransport = originalTransport
+
+	// Track the load and health of each backend, which the balancer spreads requests by
+	originalTransport = &healthTransport{
 		transport: originalTransport,
-		logger:    logger,
+		backends:  func() *balancer { return server.current().balancer },
+		health:    server.metrics.Gauge("proxy_backend_health", "Decaying share of recent requests each backend answered without an error, 5xx or 429.", "backend"),
+		recovered: server.warmup,
+		latency:   server.metrics.Gauge("proxy_backend_latency_seconds", "Percentiles of the time each backend took to answer its latest successful requests.", "backend", "quantile"),
+	}
+	if cfg.LogAttempts {
+		originalTransport = &attemptTransport{transport: originalTransport}
+	}
+	if cfg.APIVersionUpgrade != "" {
+		pattern, err := regexp.Compile(cfg.APIVersionUpgradePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api-version upgrade pattern: %v", err)
+		}
+		originalTransport = &apiVersionTransport{
+			transport: originalTransport,
+			version:   cfg.APIVersionUpgrade,
+			pattern:   pattern,
+		}
+	}
+	originalTransport = &failoverTransport{
+		transport:   originalTransport,
+		backends:    func() *balancer { return server.current().balancer },
+		deployments: func() map[string]string { return server.current().failoverDeployments },
+		failovers:   server.metrics.Counter("proxy_failovers_total", "Requests retried on the fallback of their backend.", "from", "to"),
+		rename:      server.renameHeaders,
+	}
+	originalTransport = &degradeTransport{
+		transport:   originalTransport,
+		deployments: func() map[string]string { return server.current().degradeDeployments },
+	}
+	if cfg.HedgeDelay > 0 {
+		hedger := &hedgingTransport{
+			transport: originalTransport,
+			delay:     cfg.HedgeDelay,
+			hedged:    server.metrics.Counter("proxy_hedged_requests_total", "Hedged requests by the attempt that won.", "winner"),
+		}
+		// Send the duplicate to another backend when there are several, unless the
+		// request's model is routed to one
+		hedger.retarget = func(req *http.Request) {
+			if _, routed := req.Context().Value(backendKey).(*backend); routed {
+				return
+			}
+			if balancer := server.current().balancer; balancer.multiple() {
+				balancer.retarget(req).authorize(req)
+				server.renameHeaders(req)
+			}
+		}
+		originalTransport = hedger
 	}
+	if cfg.CoalesceWindow > 0 {
+		originalTransport = &coalescingTransport{
+			transport: originalTransport,
+			window:    cfg.CoalesceWindow,
+			coalesced: server.metrics.Counter("proxy_coalesced_requests_total", "Requests that shared an identical in-flight upstream call."),
+			calls:     make(map[string]*coalescedCall),
+		}
+	}
+	maxChunkGap := &gapTracker{}
+	var sseDumps *sseDumper
+	if cfg.SSEDumpDir != "" {
+		if err := os.MkdirAll(cfg.SSEDumpDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create stream dump directory: %v", err)
+		}
+		sseDumps = &sseDumper{dir: cfg.SSEDumpDir, deployments: make(map[string]bool)}
+		for _, deployment := range cfg.SSEDumpDeployments {
+			sseDumps.deployments[deployment] = true
+		}
+	}
+	server.metrics.GaugeFunc("proxy_stream_max_chunk_gap_seconds", "Longest gap between two events of a streamed response since the last scrape.", maxChunkGap.reset)
+	proxy.Transport = &loggingTransport{
+		transport:     originalTransport,
+		logger:        logger,
+		deadLetters:   server.deadLetters,
+		stats:         server.stats,
+		limiter:       server.limiter,
+		quota:         server.quota,
+		shedder:       server.shedder,
+		requestsTotal: server.requestsTotal,
+		labels:        responseLabels,
+		metricTags:    cfg.MetricTags,
+		schemas:       server.schemas,
+		regionHeaders: cfg.RegionHeaders,
+		cache:         server.cache,
+		cacheTTL:      cfg.CacheTTL,
+
+		semanticMaxCandidates: cfg.SemanticCacheMaxCandidates,
+		tasks:                 server.tasks,
+		budgets:               server.budgets,
+		maxChunkGap:           maxChunkGap,
+		sseDumps:              sseDumps,
+		idleTimeout:           cfg.StreamIdleTimeout,
 
-	return server
+		maxToolCallRounds: cfg.MaxToolCallRounds,
+	}
+
+	return server, nil
+}
+
+// Close releases resources held by the server
+func (s *Server) Close() {
+	close(s.stop)
+	if s.auditLogger != nil {
+		s.auditLogger.Close()
+	}
+	if s.deadLetters != nil {
+		s.deadLetters.Close()
+	}
+	if s.schemas != nil {
+		if err := s.schemas.WriteFile(s.schemaFilePath); err != nil {
+			log.Printf("Error writing schema file: %v", err)
+		} else {
+			log.Printf("Wrote inferred schemas to %s", s.schemaFilePath)
+		}
+	}
 }
 
 // ServeHTTP implements the http.Handler interface
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check API key if configured
-	if s.apiKey != "" {
-		clientKey := r.Header.Get("X-API-Key")
-		if clientKey != s.apiKey {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	start := time.Now()
+	s.echoCorrelationID(w, r)
+
+	// Apply the timeout, body size limit and body logging of the request's route, and
+	// the feature flags in effect now for the whole request
+	r = r.WithContext(context.WithValue(r.Context(), routeKey, s.routeFor(r.URL.Path)))
+	r = r.WithContext(context.WithValue(r.Context(), featuresKey, s.current().features))
+
+	// Refuse clients outside the allowed networks before looking at their credentials
+	if addr, ok := s.current().ipFilter.allows(r.RemoteAddr); !ok {
+		s.rejectAddress(w, r, start, addr)
+		return
+	}
+
+	// Authenticate the client if configured
+	var clientID string
+	if authenticator := s.authenticator(); authenticator != nil {
+		identity, err := authenticator.Authenticate(r)
+		if err != nil {
+			s.audit(r, "anonymous", "auth", audit.Failure, err.Error())
+			if errors.Is(err, auth.ErrConflictingCredentials) {
+				log.Printf("Client %s (%s) sent conflicting credential headers", r.RemoteAddr, r.UserAgent())
+				s.reject(w, r, start, rejectedByAuth, http.StatusBadRequest,
+					"Bad Request: credential header sent more than once with different values")
+				return
+			}
+			if errors.Is(err, auth.ErrExpiredCredentials) {
+				s.rejectExpiredKey(w, r, start, identity.ClientID)
+				return
+			}
+			s.reject(w, r, start, rejectedByAuth, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		clientID = identity.ClientID
+		// Credentials for the proxy are of no use to the backend, which gets its own
+		// key or token instead
+		if identity.Header != "" {
+			r.Header.Del(identity.Header)
+		}
+		if identity.Subject != "" {
+			r = r.WithContext(context.WithValue(r.Context(), subjectKey, identity.Subject))
+		}
+		if identity.User != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userKey, identity.User))
+		}
+		if identity.Token != "" && s.current().balancer.usesUserTokens() {
+			r = r.WithContext(context.WithValue(r.Context(), userTokenKey, identity.Token))
+		}
+	}
+	if owner := s.ownerOf(clientID); owner != "" {
+		r = r.WithContext(context.WithValue(r.Context(), clientOwnerKey, owner))
+	}
+	if tags := s.tagsOf(clientID); len(tags) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), clientTagsKey, tags))
+	}
+	// Keys restricted to some times of day or days of the week are refused outside them
+	if windows := s.windowsOf(clientID); windows != nil && !windows.Allows(start) {
+		s.rejectOutsideWindow(w, r, start, clientID, windows)
+		return
+	}
+	// Backends sent users' tokens cannot serve clients that authenticated otherwise
+	if s.current().balancer.usesUserTokens() {
+		if token, _ := r.Context().Value(userTokenKey).(string); token == "" {
+			s.reject(w, r, start, rejectedByAuth, http.StatusUnauthorized, "Unauthorized: a user's bearer token is required")
 			return
 		}
 	}
 
-	// Read and store the request body
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+	// Turn new requests away while the proxy is too overloaded to serve them in time
+	if s.shedder != nil {
+		if !s.shedder.Allow() {
+			s.shedTotal.Inc()
+			w.Header().Set("Retry-After", "1")
+			s.reject(w, r, start, rejectedByShed, http.StatusServiceUnavailable,
+				fmt.Sprintf("Service Unavailable: shedding load, recent latency %v is above target", s.shedder.Latency().Round(time.Millisecond)))
+			return
+		}
+		done := s.shedder.Begin()
+		defer done()
+	}
+
+	// Keep a single client from monopolizing upstream concurrency
+	release, ok := s.acquireSlot(r, clientID)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		s.reject(w, r, start, rejectedByConcurrency, http.StatusTooManyRequests,
+			fmt.Sprintf("Too Many Requests: client has %d requests in flight", s.concurrency.Limit(clientID)))
+		return
+	}
+	defer release()
+
+	// Only relay the methods Azure OpenAI actually uses
+	if !s.allowedMethods[r.Method] {
+		w.Header().Set("Allow", s.allowHeader())
+		s.reject(w, r, start, rejectedByMethod, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	// Reject malformed paths here rather than forwarding them to a confusing Azure 404
+	if s.pathPattern != nil && !s.pathPattern.MatchString(r.URL.Path) {
+		s.reject(w, r, start, rejectedByPath, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: path %s does not target a deployment (expected %s)", r.URL.Path, s.pathPattern))
+		return
+	}
+
+	// Send requests for model aliases to the deployments they stand for
+	requested := deploymentFromPath(r.URL.Path)
+	s.resolveAliasPath(r)
+
+	// Refuse operations and deployments outside the scope of the client's key. Requests
+	// without a deployment in the path are checked against the model of their body.
+	scope := s.scopeOf(clientID)
+	if message := scope.deniedOperation(r.URL.Path); message != "" {
+		s.rejectOutOfScope(w, r, start, clientID, message)
+		return
+	}
+	scoped := requested != ""
+	if message := scope.deniedDeployment(requested, deploymentFromPath(r.URL.Path)); scoped && message != "" {
+		s.rejectOutOfScope(w, r, start, clientID, message)
 		return
 	}
-	if err := r.Body.Close(); err != nil {
-		log.Printf("Error closing request body: %v", err)
+
+	// Send requests for routed models to the deployments and backends serving them
+	r = s.routeModelPath(r)
+
+	// Stay under the rate Azure is currently accepting
+	if s.limiter != nil && !s.limiter.Allow() {
+		s.rateLimitedTotal.Inc()
+		w.Header().Set("Retry-After", "1")
+		s.reject(w, r, start, rejectedByRateLimit, http.StatusTooManyRequests,
+			fmt.Sprintf("Too Many Requests: rate limit of %.2f requests/s exceeded", s.limiter.Rate()))
+		return
 	}
 
-	// Create a new reader with the same content
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	// Don't forward requests Azure would throttle for lack of token quota, unless they
+	// can be degraded to a fallback deployment that has quota
+	degrade := s.degradationFor(r, clientID)
+	if s.quota != nil {
+		deployment := deploymentFromPath(r.URL.Path)
+		if remaining, retryAfter, exhausted := s.quota.Exhausted(deployment); exhausted && !s.degradeForQuota(r, degrade, deployment, remaining) {
+			s.quotaRejectedTotal.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			s.reject(w, r, start, rejectedByQuota, http.StatusTooManyRequests,
+				fmt.Sprintf("Too Many Requests: deployment %s has %d tokens of quota left, below the reserve", deployment, remaining))
+			return
+		}
+	}
+
+	// Refuse bodies over the hard size limit
+	if !s.limitRequestBody(w, r, start) {
+		return
+	}
+
+	// Stop clients that have spent their budget for the period
+	if s.budgets != nil {
+		if spent, limit, exhausted := s.budgets.Check(clientID); exhausted {
+			s.reject(w, r, start, rejectedByBudget, http.StatusPaymentRequired,
+				fmt.Sprintf("Payment Required: %s budget of %.2f exhausted (spent %.2f)", limit.Period, limit.Amount, spent))
+			return
+		}
+	}
 
-	// Parse the request body to log it
 	var requestBody interface{}
-	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
-		log.Printf("Warning: Could not parse request body as JSON: %v", err)
-		requestBody = string(bodyBytes)
+	var rawBody []byte
+	var coalesce string
+	var cached string
+	var moderated map[string]int
+	var routedFrom string
+	var semantic *semanticLookup
+	var uninspected int // status refusing the request if its body must be inspected but was not
+	if s.shouldStreamBody(r) {
+		// Large uploads (audio, files) are forwarded as-is and only their metadata is logged
+		requestBody = bodyMetadata(r)
+		if r.ContentLength != 0 {
+			uninspected = http.StatusRequestEntityTooLarge
+		}
+	} else {
+		// Read and store the request body
+		bodyBytes, complete, err := s.readBody(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.rejectTooLarge(w, r, start, tooLarge.Limit+1, tooLarge.Limit, false)
+			return
+		}
+		if err != nil {
+			s.reject(w, r, start, rejectedByBody, http.StatusInternalServerError, "Error reading request body")
+			return
+		}
+
+		if complete {
+			rawBody = bodyBytes
+
+			// Compressed bodies are parsed from a decompressed copy, which is also
+			// forwarded when configured
+			if encoding := contentEncoding(r); encoding != "" {
+				decoded, err := decompressBody(encoding, bodyBytes, s.maxBufferedBodySize)
+				if err != nil {
+					log.Printf("Warning: Could not decompress %s request body: %v", encoding, err)
+				} else {
+					bodyBytes = decoded
+					if s.decompressRequests {
+						rawBody = decoded
+						r.Body = io.NopCloser(bytes.NewReader(decoded))
+						r.ContentLength = int64(len(decoded))
+						r.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+						r.Header.Del("Content-Encoding")
+					}
+				}
+			}
+
+			// Parse the request body to log it
+			if requestBody, err = decodeJSON(bodyBytes); err != nil {
+				log.Printf("Warning: Could not parse request body as JSON: %v", err)
+				requestBody = string(bodyBytes)
+			}
+			if _, ok := requestBody.(map[string]interface{}); !ok && len(bodyBytes) > 0 {
+				uninspected = http.StatusBadRequest
+			}
+
+			// Enforce the request field policy on what the client sent
+			if body, ok := requestBody.(map[string]interface{}); ok && s.fieldPolicy != "" {
+				if field := s.forbiddenField(body); field != "" {
+					s.reject(w, r, start, rejectedByField, http.StatusBadRequest,
+						fmt.Sprintf("Bad Request: field %q is not permitted", field))
+					return
+				}
+			}
+
+			// Check the model of the body against the scope of the client's key
+			if body, ok := requestBody.(map[string]interface{}); ok && !scoped {
+				model, _ := body["model"].(string)
+				if message := scope.deniedDeployment(model, s.current().modelAliases[model]); message != "" {
+					s.rejectOutOfScope(w, r, start, clientID, message)
+					return
+				}
+				scoped = true
+			}
+
+			// Refuse formats that conflict with deployments restricted to JSON output
+			if body, ok := requestBody.(map[string]interface{}); ok {
+				if message, conflict := s.jsonModeConflict(r, body); conflict {
+					s.reject(w, r, start, rejectedByJSONMode, http.StatusBadRequest, message)
+					return
+				}
+			}
+
+			// Streams can legitimately outlast the write timeout, so lift it for them
+			if body, ok := requestBody.(map[string]interface{}); ok && body["stream"] == true && s.httpServer.WriteTimeout > 0 {
+				if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+					log.Printf("Warning: Could not lift write timeout for streaming request: %v", err)
+				}
+			}
+
+			// Send requests for routed models to the deployments and backends serving
+			// them, unless the path already named the deployment
+			var routed bool
+			if body, ok := requestBody.(map[string]interface{}); ok && deploymentFromPath(r.URL.Path) == "" {
+				r, routed = s.routeModelBody(r, body)
+			}
+
+			// Apply configured rewrites before the body is forwarded
+			if body, ok := requestBody.(map[string]interface{}); ok && (s.rewriteRequestBody(r, body, clientID) || routed) {
+				if rawBody, err = setRequestBody(r, body); err != nil {
+					s.reject(w, r, start, rejectedByRewrite, http.StatusInternalServerError, fmt.Sprintf("Internal Server Error: rewriting the request body failed: %v", err))
+					return
+				}
+			} else if s.minifyRequests && rawBody != nil {
+				// Rewritten bodies are already compact, others are minified if configured
+				if compact, ok := minifyRequestBody(r, rawBody); ok {
+					rawBody = compact
+				}
+			}
+
+			// Point OpenAI paths at the deployment the model of the body names
+			if s.openAIPaths && isOpenAIPath(r.URL.Path) {
+				body, _ := requestBody.(map[string]interface{})
+				if message := s.translateOpenAIPath(r, body); message != "" {
+					s.reject(w, r, start, rejectedByPath, http.StatusBadRequest, message)
+					return
+				}
+			}
+
+			// Reroute large requests before checking them against the context window
+			if body, ok := requestBody.(map[string]interface{}); ok && len(s.current().sizeRoutes) > 0 {
+				routedFrom = s.routeBySize(r, rawBody, body)
+			}
+
+			// Don't waste a round trip on prompts that can't fit the model's context window
+			if body, ok := requestBody.(map[string]interface{}); ok && len(s.contextLimits) > 0 {
+				if message, ok := s.checkPromptSize(r, body); !ok {
+					s.reject(w, r, start, rejectedByTokenLimit, http.StatusBadRequest, message)
+					return
+				}
+			}
+
+			// Block prompts Content Safety flags before they reach the model
+			if body, ok := requestBody.(map[string]interface{}); ok && s.moderation != nil {
+				severities, status, message, allowed := s.moderate(r, body)
+				if !allowed {
+					s.reject(w, r, start, rejectedByModeration, status, message)
+					return
+				}
+				moderated = severities
+			}
+
+			// Serve repeated requests from the response cache
+			if body, ok := requestBody.(map[string]interface{}); ok && s.cache != nil && cacheable(r, body) {
+				if cached = requestHash(r, body, clientID); cached != "" {
+					if s.serveCached(w, r, start, cached, requestBody, clientID) {
+						return
+					}
+					if s.semantic != nil && featureEnabled(r.Context(), features.SemanticCache, r.URL.Path, clientID) {
+						var served bool
+						if semantic, served = s.serveSimilar(w, r, start, body, clientID); served {
+							return
+						}
+					}
+					s.cacheRequests.Inc("miss")
+				}
+			}
+
+			// Opted-in duplicate chat requests may share one upstream call
+			if body, ok := requestBody.(map[string]interface{}); ok && s.coalesceWindow > 0 {
+				coalesce = coalesceKeyFor(r, body, clientID)
+			}
+		} else {
+			// The body had no Content-Length and turned out to exceed the buffering limit
+			requestBody = bodyMetadata(r)
+			uninspected = http.StatusRequestEntityTooLarge
+		}
+	}
+
+	// Bodies that could not be inspected must not slip past the checks that fail closed
+	if check, reason := s.inspectionRequired(r); uninspected != 0 && check != "" {
+		message := "Bad Request: the request body is not a JSON object and cannot be checked against " + check
+		if uninspected == http.StatusRequestEntityTooLarge {
+			message = "Payload Too Large: the request body is too large to be checked against " + check
+		}
+		s.reject(w, r, start, reason, uninspected, message)
+		return
+	}
+
+	// OpenAI paths whose body was not read can only be translated if they need no model
+	if s.openAIPaths && isOpenAIPath(r.URL.Path) {
+		if message := s.translateOpenAIPath(r, nil); message != "" {
+			s.reject(w, r, start, rejectedByPath, http.StatusBadRequest, message)
+			return
+		}
+	}
+
+	// Clients with a budget may only use models whose usage can be priced
+	if s.budgets != nil {
+		body, _ := requestBody.(map[string]interface{})
+		if model := modelName(r.URL.Path, body); model != "" && !s.budgets.Chargeable(clientID, model) {
+			s.reject(w, r, start, rejectedByBudget, http.StatusForbidden,
+				fmt.Sprintf("Forbidden: %s has no price in MODEL_PRICES, so clients with a budget cannot use it", model))
+			return
+		}
+	}
+
+	// Requests whose deployment could not be read are refused to keys restricted to some
+	if message := scope.deniedDeployment(); !scoped && message != "" {
+		s.rejectOutOfScope(w, r, start, clientID, message)
+		return
 	}
 
 	// Store the request in context for the transport to access
 	ctx := r.Context()
 	ctx = context.WithValue(ctx, requestBodyKey, requestBody)
+	if rawBody != nil {
+		ctx = context.WithValue(ctx, rawBodyKey, rawBody)
+	}
+	if coalesce != "" {
+		ctx = context.WithValue(ctx, coalesceKey, coalesce)
+	}
+	if cached != "" {
+		ctx = context.WithValue(ctx, cacheKey, cached)
+	}
+	if semantic != nil {
+		ctx = context.WithValue(ctx, semanticKey, semantic)
+	}
 	ctx = context.WithValue(ctx, pathKey, r.URL.Path)
 	ctx = context.WithValue(ctx, methodKey, r.Method)
-	ctx = context.WithValue(ctx, startTimeKey, time.Now())
+	ctx = context.WithValue(ctx, startTimeKey, start)
+	ctx = context.WithValue(ctx, clientIDKey, clientID)
+	ctx = context.WithValue(ctx, taskIDKey, taskID(r))
+	if s.logAttempts {
+		ctx = context.WithValue(ctx, attemptsKey, &attemptLog{})
+	}
+	if moderated != nil {
+		ctx = context.WithValue(ctx, moderationKey, moderated)
+	}
+	if routedFrom != "" {
+		ctx = context.WithValue(ctx, routedFromKey, routedFrom)
+	}
+	if degrade != nil {
+		ctx = context.WithValue(ctx, degradeKey, degrade)
+	}
+	if s.debugRequested(r, clientID) {
+		ctx = context.WithValue(ctx, debugKey, true)
+	}
+	ctx = context.WithValue(ctx, apiVersionKey, &resolvedAPIVersion{})
+	if id := s.externalCorrelationID(r); id != "" {
+		ctx = context.WithValue(ctx, correlationKey, id)
+	}
+
+	// Give up on the upstream once the request's deadline passes
+	ctx, cancel := s.withDeadline(ctx, r)
+	defer cancel()
 
 	// Serve the request with the modified context
 	s.proxy.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// allowHeader returns the value of the Allow header sent with 405 responses
+func (s *Server) allowHeader() string {
+	methods := make([]string, 0, len(s.allowedMethods))
+	for method := range s.allowedMethods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
 // Run starts the proxy server
 func (s *Server) Run(listenAddr string) error {
-	log.Printf("Starting proxy server on %s, forwarding to %s", listenAddr, s.targetURL)
-	if s.apiKey != "" {
-		log.Printf("API key authentication enabled")
+	st := s.current()
+	log.Printf("Starting proxy server on %s, forwarding to %s", listenAddr, st.balancer)
+	if st.authenticator != nil {
+		log.Printf("Client authentication enabled")
 	} else {
 		log.Printf("Warning: API key authentication disabled, proxy is open to all requests")
 	}
-	return http.ListenAndServe(listenAddr, s)
+	s.httpServer.Addr = listenAddr
+
+	ln, err := listen(listenAddr)
+	if err != nil {
+		return err
+	}
+	for _, backend := range st.balancer.backends {
+		s.warmup(backend.url)
+	}
+
+	serveErr := make(chan error, 1)
+	// The plain listener is kept for graceful restarts, which hand over its socket
+	serveLn := ln
+	if s.tlsConfig != nil {
+		serveLn = tls.NewListener(ln, s.tlsConfig)
+		log.Printf("Terminating TLS")
+	}
+	go func() {
+		serveErr <- s.httpServer.Serve(serveLn)
+	}()
+	signalReady()
+
+	// Shut down gracefully on SIGINT/SIGTERM, letting in-flight requests complete
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Hand the listening socket to a new process on SIGUSR2, then drain like a shutdown
+	restart := make(chan os.Signal, 1)
+	if len(restartSignals) > 0 {
+		signal.Notify(restart, restartSignals...)
+		defer signal.Stop(restart)
+	}
+
+	for {
+		select {
+		case err := <-serveErr:
+			return err
+		case <-restart:
+			pid, err := startSuccessor(ln)
+			if err != nil {
+				log.Printf("Error: graceful restart failed, still serving: %v", err)
+				continue
+			}
+			log.Printf("Started process %d on the inherited listener", pid)
+		case <-ctx.Done():
+		}
+
+		log.Printf("Shutting down, waiting up to %v for in-flight requests", s.shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		return s.httpServer.Shutdown(shutdownCtx)
+	}
+}
+
+// Handler returns the HTTP handler serving the proxy and its built-in endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.metricsPath != "" {
+		mux.Handle("GET "+s.metricsPath, s.metrics)
+	}
+	s.registerAdminRoutes(mux)
+	mux.Handle("/", s)
+	return mux
 }
 
 // loggingTransport is a custom transport that logs responses
 type loggingTransport struct {
-	transport http.RoundTripper
-	logger    logging.Logger
+	transport     http.RoundTripper
+	logger        logging.Logger
+	deadLetters   *deadletter.Writer
+	stats         *stats.Collector
+	limiter       *ratelimit.AdaptiveLimiter
+	quota         *ratelimit.QuotaTracker
+	shedder       *ratelimit.LoadShedder
+	requestsTotal *metrics.Vec
+	labels        responseLabels
+	metricTags    []string
+	schemas       *schema.Inferrer
+	regionHeaders []string
+	cache         cache.Cache
+	cacheTTL      time.Duration
+
+	semanticMaxCandidates int
+	tasks                 *tasks.Tracker
+	budgets               *budget.Ledger
+	maxChunkGap           *gapTracker
+	sseDumps              *sseDumper
+	idleTimeout           time.Duration
+
+	maxToolCallRounds int
 }
 
 // RoundTrip implements the http.RoundTripper interface
 func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Get the stored request info from context
-	requestBody := req.Context().Value(requestBodyKey)
 	path := req.Context().Value(pathKey).(string)
-	method := req.Context().Value(methodKey).(string)
+	taskID, _ := req.Context().Value(taskIDKey).(string)
 	startTime := req.Context().Value(startTimeKey).(time.Time)
 
 	// Make the original request
 	resp, err := t.transport.RoundTrip(req)
+	if t.shedder != nil {
+		t.shedder.Observe(time.Since(startTime))
+	}
 	if err != nil {
+		t.countRequest(req, "error", nil)
+		if t.stats != nil {
+			t.stats.Record(path, 0, time.Since(startTime), 0)
+		}
+		if taskID != "" {
+			t.tasks.Record(taskID, 0, time.Since(startTime), 0)
+		}
+		t.deadLetter(req, 0, err)
 		return nil, err
 	}
 
-	// Capture correlation ID from response headers
-	correlationID := resp.Header.Get("apim-request-id")
-	if correlationID == "" {
-		// Fallback to other possible correlation headers
-		correlationID = resp.Header.Get("x-ms-request-id")
-		if correlationID == "" {
-			correlationID = resp.Header.Get("x-ms-correlation-request-id")
+	if t.limiter != nil {
+		t.limiter.Observe(resp.StatusCode)
+	}
+	if t.quota != nil {
+		t.quota.Observe(deploymentFromPath(resp.Request.URL.Path), resp.Request.URL.Host, resp.Header)
+	}
+
+	// Relay event streams to the client as they arrive and log them once they end
+	if isEventStream(resp) {
+		if t.idleTimeout > 0 {
+			resp.Body = newIdleTimeoutBody(resp.Body, t.idleTimeout, req.Method+" "+path)
 		}
+		resp.Body = &streamRecorder{
+			ReadCloser: resp.Body,
+			done: func(body []byte, timing *logging.StreamTiming) {
+				t.maxChunkGap.observe(timing.MaxGap)
+				t.complete(req, resp, body, timing)
+			},
+		}
+		return resp, nil
 	}
 
 	// Read the full response body
@@ -156,6 +1206,57 @@ func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	// Create a new response body for the client
 	resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
+	t.storeCached(req, resp, bodyBytes)
+	t.complete(req, resp, bodyBytes, nil)
+
+	return resp, nil
+}
+
+// complete logs a response once its body has been fully received and records it in
+// the dead-letter queue, stats, task, budget and schema trackers. Streamed responses
+// come with the timing of their events.
+func (t *loggingTransport) complete(req *http.Request, resp *http.Response, bodyBytes []byte, timing *logging.StreamTiming) {
+	// Get the stored request info from context
+	requestBody := req.Context().Value(requestBodyKey)
+	path := req.Context().Value(pathKey).(string)
+	method := req.Context().Value(methodKey).(string)
+	clientID, _ := req.Context().Value(clientIDKey).(string)
+	clientOwner, _ := req.Context().Value(clientOwnerKey).(string)
+	clientTags, _ := req.Context().Value(clientTagsKey).(map[string]string)
+	subject, _ := req.Context().Value(subjectKey).(string)
+	user, _ := req.Context().Value(userKey).(string)
+	taskID, _ := req.Context().Value(taskIDKey).(string)
+	startTime := req.Context().Value(startTimeKey).(time.Time)
+
+	// Capture correlation ID from response headers
+	correlationID := resp.Header.Get("apim-request-id")
+	if correlationID == "" {
+		// Fallback to other possible correlation headers
+		correlationID = resp.Header.Get("x-ms-request-id")
+		if correlationID == "" {
+			correlationID = resp.Header.Get("x-ms-correlation-request-id")
+		}
+	}
+
+	// Capture the region that served the request
+	var region string
+	for _, header := range t.regionHeaders {
+		if region = resp.Header.Get(header); region != "" {
+			break
+		}
+	}
+
+	// Count the response once its body is known, so it can be labeled with response fields
+	t.countRequest(req, strconv.Itoa(resp.StatusCode), bodyBytes)
+
+	// Trailers are only populated once the body has been read to the end
+	trailers := trailerValues(resp.Trailer)
+
+	// Keep throttled and failed requests so they can be replayed later
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		t.deadLetter(req, resp.StatusCode, nil)
+	}
+
 	// Parse the response for logging
 	var responseBody interface{}
 	if err := json.Unmarshal(bodyBytes, &responseBody); err != nil {
@@ -167,23 +1268,235 @@ func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		}
 	}
 
+	var upstreamError string
+	if resp.StatusCode >= 400 {
+		upstreamError = errorMessage(responseBody)
+	}
+
+	moderated, _ := req.Context().Value(moderationKey).(map[string]int)
+	routedFrom, _ := req.Context().Value(routedFromKey).(string)
+	modelTarget, _ := req.Context().Value(modelTargetKey).(string)
+	var degradedFrom, degradedTo string
+	if degrade, ok := req.Context().Value(degradeKey).(*degradation); ok {
+		degradedFrom, degradedTo = degrade.get()
+	}
+	images, multimodal := countImages(requestBody)
+
+	// Trusted clients can ask for the headers of a single exchange to be logged
+	var requestHeaders, responseHeaders http.Header
+	debug, _ := req.Context().Value(debugKey).(bool)
+	externalCorrelationID, _ := req.Context().Value(correlationKey).(string)
+	if debug {
+		requestHeaders = redactHeaders(req.Header)
+		responseHeaders = redactHeaders(resp.Header)
+	}
+
+	// Keep the raw bytes of selected streams for debugging
+	var streamDump string
+	if timing != nil && t.sseDumps.shouldDump(req, path) {
+		id := correlationID
+		if id == "" {
+			id = externalCorrelationID
+		}
+		streamDump = t.sseDumps.dump(id, bodyBytes)
+	}
+
+	// Follow tool-calling flows across the requests of a task
+	toolCalls := toolCallNames(responseBody)
+	var toolCallRound int
+	if taskID != "" && len(toolCalls) > 0 {
+		toolCallRound = t.tasks.RecordToolCalls(taskID, toolCalls)
+		if t.maxToolCallRounds > 0 && toolCallRound > t.maxToolCallRounds {
+			log.Printf("Warning: task %s reached tool-call round %d, above the maximum of %d", taskID, toolCallRound, t.maxToolCallRounds)
+		}
+	}
+
+	var attempts []logging.Attempt
+	if recorded, ok := req.Context().Value(attemptsKey).(*attemptLog); ok {
+		attempts = recorded.list()
+	}
+
 	// Log the entry with the parsed response
 	t.logger.LogRequest(logging.Entry{
-		Timestamp:     time.Now(),
-		RequestBody:   requestBody,
-		Response:      responseBody,
-		Duration:      time.Since(startTime),
-		Path:          path,
-		Method:        method,
-		CorrelationID: correlationID,
+		Timestamp:             time.Now(),
+		RequestBody:           loggedBody(req.Context(), requestBody),
+		Response:              loggedBody(req.Context(), responseBody),
+		Duration:              time.Since(startTime),
+		Path:                  path,
+		Method:                method,
+		Status:                resp.StatusCode,
+		CorrelationID:         correlationID,
+		Error:                 upstreamError,
+		ExternalCorrelationID: externalCorrelationID,
+		ClientID:              clientID,
+		ClientOwner:           clientOwner,
+		Tags:                  clientTags,
+		Subject:               subject,
+		User:                  user,
+		TaskID:                taskID,
+		Region:                region,
+		RoutedFrom:            routedFrom,
+		ModelTarget:           modelTarget,
+		DegradedFrom:          degradedFrom,
+		DegradedTo:            degradedTo,
+		Upstream:              resp.Request.URL.Host,
+		APIVersion:            apiVersionOf(req),
+		Trailers:              trailers,
+		Attempts:              attempts,
+		Moderation:            moderated,
+		ImageCount:            images,
+		Multimodal:            multimodal,
+		ToolCallRound:         toolCallRound,
+		ToolCalls:             toolCalls,
+		StreamTiming:          timing,
+		StreamDump:            streamDump,
+		Debug:                 debug,
+		RequestHeaders:        requestHeaders,
+		ResponseHeaders:       responseHeaders,
 	})
 
-	return resp, nil
+	if t.stats != nil {
+		t.stats.Record(path, resp.StatusCode, time.Since(startTime), usageTokens(responseBody))
+	}
+
+	if taskID != "" {
+		t.tasks.Record(taskID, resp.StatusCode, time.Since(startTime), usageTokens(responseBody))
+	}
+
+	if t.budgets != nil && clientID != "" {
+		t.charge(clientID, path, requestBody, responseBody)
+	}
+
+	if t.schemas != nil {
+		// Streamed request bodies were never parsed, so only their response is observed
+		var request interface{}
+		if _, buffered := req.Context().Value(rawBodyKey).([]byte); buffered {
+			request = requestBody
+		}
+		t.schemas.Observe(path, request, responseBody)
+	}
+}
+
+// deadLetter writes a failed request to the dead-letter queue, if one is configured
+func (t *loggingTransport) deadLetter(req *http.Request, status int, upstreamErr error) {
+	if t.deadLetters == nil {
+		return
+	}
+
+	path, _ := req.Context().Value(pathKey).(string)
+	body, ok := req.Context().Value(rawBodyKey).([]byte)
+	if !ok {
+		log.Printf("Not writing %s %s to dead-letter queue: request body was streamed", req.Method, path)
+		return
+	}
+
+	// Never persist credentials, the upstream ones included; replays get current ones
+	header := req.Header.Clone()
+	for _, name := range deadLetterDroppedHeaders {
+		header.Del(name)
+	}
+
+	record := deadletter.Record{
+		Timestamp: time.Now(),
+		Method:    req.Method,
+		Path:      path,
+		RawQuery:  req.URL.RawQuery,
+		Header:    header,
+		Body:      body,
+		Status:    status,
+	}
+	if upstreamErr != nil {
+		record.Error = upstreamErr.Error()
+	}
+
+	if err := t.deadLetters.Write(record); err != nil {
+		log.Printf("Error writing dead-letter record: %v", err)
+		return
+	}
+	log.Printf("Wrote failed %s %s to dead-letter queue", req.Method, path)
+}
+
+// charge adds the cost of a response's token usage to the client's budget
+func (t *loggingTransport) charge(clientID, path string, requestBody, responseBody interface{}) {
+	promptTokens, completionTokens := usageCounts(responseBody)
+	if promptTokens+completionTokens == 0 {
+		return
+	}
+
+	body, _ := requestBody.(map[string]interface{})
+	model := modelName(path, body)
+	cost, priced, err := t.budgets.Charge(clientID, model, promptTokens, completionTokens)
+	if !priced {
+		log.Printf("Warning: no price configured for %s, not charging %s for %d tokens", model, clientID, promptTokens+completionTokens)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving budgets: %v", err)
+	}
+	logging.Debugf("Charged %s %.6f for %d prompt and %d completion tokens on %s", clientID, cost, promptTokens, completionTokens, model)
+}
+
+// trailerValues flattens the trailers of a response for logging, returning nil if there are none
+func trailerValues(trailer http.Header) map[string]string {
+	var values map[string]string
+	for name, vals := range trailer {
+		if len(vals) == 0 {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[name] = strings.Join(vals, ", ")
+	}
+	return values
+}
+
+// usageTokens returns the total token count reported in a parsed response body
+func usageTokens(responseBody interface{}) int64 {
+	body, ok := responseBody.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	usage, ok := body["usage"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	total, _ := usage["total_tokens"].(float64)
+	return int64(total)
+}
+
+// errorMessage returns the message of an Azure error response body, falling back to
+// its error code
+func errorMessage(responseBody interface{}) string {
+	body, _ := responseBody.(map[string]interface{})
+	apiErr, _ := body["error"].(map[string]interface{})
+	if message, ok := apiErr["message"].(string); ok && message != "" {
+		return message
+	}
+	code, _ := apiErr["code"].(string)
+	return code
+}
+
+// usageCounts returns the prompt and completion token counts of a response
+func usageCounts(responseBody interface{}) (promptTokens, completionTokens int64) {
+	body, ok := responseBody.(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	usage, ok := body["usage"].(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	prompt, _ := usage["prompt_tokens"].(float64)
+	completion, _ := usage["completion_tokens"].(float64)
+	return int64(prompt), int64(completion)
 }
 
 // processStreamingResponse extracts the full content from a server-sent events stream
 func processStreamingResponse(responseText string) map[string]interface{} {
 	fullContent := ""
+	var usage interface{}
+	var toolCalls []map[string]interface{}
 	lines := strings.Split(responseText, "\n")
 
 	for _, line := range lines {
@@ -198,6 +1511,11 @@ func processStreamingResponse(responseText string) map[string]interface{} {
 				continue
 			}
 
+			// The final chunk carries usage when the client asked for it with stream_options
+			if u, ok := chunk["usage"].(map[string]interface{}); ok {
+				usage = u
+			}
+
 			// Extract content from choices
 			if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) > 0 {
 				if choice, ok := choices[0].(map[string]interface{}); ok {
@@ -206,6 +1524,7 @@ func processStreamingResponse(responseText string) map[string]interface{} {
 						if content, ok := delta["content"].(string); ok {
 							fullContent += content
 						}
+						toolCalls = mergeToolCallDeltas(toolCalls, delta["tool_calls"])
 					}
 					// Check for content in message (non-streaming format)
 					if message, ok := choice["message"].(map[string]interface{}); ok {
@@ -219,7 +1538,7 @@ func processStreamingResponse(responseText string) map[string]interface{} {
 	}
 
 	// Return a simplified response object with the full content
-	return map[string]interface{}{
+	response := map[string]interface{}{
 		"choices": []map[string]interface{}{
 			{
 				"message": map[string]interface{}{
@@ -229,4 +1548,83 @@ func processStreamingResponse(responseText string) map[string]interface{} {
 			},
 		},
 	}
+	if usage != nil {
+		response["usage"] = usage
+	}
+	if len(toolCalls) > 0 {
+		response["choices"].([]map[string]interface{})[0]["message"].(map[string]interface{})["tool_calls"] = toolCalls
+	}
+	return response
+}
+
+// mergeToolCallDeltas accumulates the tool call fragments of a streaming delta. The
+// first fragment of a call carries its id and name, later ones append to its arguments.
+func mergeToolCallDeltas(toolCalls []map[string]interface{}, deltas interface{}) []map[string]interface{} {
+	fragments, _ := deltas.([]interface{})
+	for _, fragment := range fragments {
+		f, ok := fragment.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		index, _ := f["index"].(float64)
+		for len(toolCalls) <= int(index) {
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": "", "arguments": ""},
+			})
+		}
+		call := toolCalls[int(index)]
+		if id, ok := f["id"].(string); ok {
+			call["id"] = id
+		}
+		if function, ok := f["function"].(map[string]interface{}); ok {
+			target := call["function"].(map[string]interface{})
+			if name, ok := function["name"].(string); ok {
+				target["name"] = target["name"].(string) + name
+			}
+			if arguments, ok := function["arguments"].(string); ok {
+				target["arguments"] = target["arguments"].(string) + arguments
+			}
+		}
+	}
+	return toolCalls
+}
+
+// toolCallNames returns the names of the tools a response requested
+func toolCallNames(responseBody interface{}) []string {
+	var names []string
+	var choices []interface{}
+	switch body := responseBody.(type) {
+	case map[string]interface{}:
+		switch c := body["choices"].(type) {
+		case []interface{}:
+			choices = c
+		case []map[string]interface{}:
+			// Reconstructed streaming responses
+			for _, choice := range c {
+				choices = append(choices, choice)
+			}
+		}
+	}
+	for _, choice := range choices {
+		c, _ := choice.(map[string]interface{})
+		message, _ := c["message"].(map[string]interface{})
+		var calls []interface{}
+		switch tc := message["tool_calls"].(type) {
+		case []interface{}:
+			calls = tc
+		case []map[string]interface{}:
+			for _, call := range tc {
+				calls = append(calls, call)
+			}
+		}
+		for _, call := range calls {
+			callMap, _ := call.(map[string]interface{})
+			function, _ := callMap["function"].(map[string]interface{})
+			if name, ok := function["name"].(string); ok && name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
 }
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// Rejection reasons recorded in Entry.RejectedBy
+const (
+	rejectedByAuth        = "auth"
+	rejectedByMethod      = "method"
+	rejectedByPath        = "path"
+	rejectedByRateLimit   = "ratelimit"
+	rejectedByQuota       = "quota"
+	rejectedByConcurrency = "concurrency"
+	rejectedByShed        = "shed"
+	rejectedByBody        = "body"
+	rejectedByTokenLimit  = "tokenlimit"
+	rejectedByField       = "field"
+	rejectedBySize        = "size"
+	rejectedByBudget      = "budget"
+	rejectedByModeration  = "moderation"
+	rejectedByJSONMode    = "jsonmode"
+	rejectedByScope       = "scope"
+	rejectedByAddress     = "address"
+	rejectedByWindow      = "window"
+	rejectedByRewrite     = "rewrite"
+)
+
+// reject answers a request the proxy refuses to forward and logs it as an entry, so
+// rejections are observable in the log stream alongside forwarded requests
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, start time.Time, rejectedBy string, status int, message string) {
+	log.Printf("Rejected %s %s by %s: %s", r.Method, r.URL.Path, rejectedBy, message)
+	http.Error(w, message, status)
+
+	s.logger.LogRequest(logging.Entry{
+		Timestamp:             time.Now(),
+		Duration:              time.Since(start),
+		Path:                  r.URL.Path,
+		Method:                r.Method,
+		Status:                status,
+		RejectedBy:            rejectedBy,
+		Error:                 message,
+		ExternalCorrelationID: s.externalCorrelationID(r),
+	})
+}
+
+// failUpstream answers a request the upstream did not complete, with a timeout or a
+// failed connection, and logs it as an entry like requests that got a response
+func (s *Server) failUpstream(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	http.Error(w, message, status)
+
+	// r is the request sent upstream, the client's path is in its context
+	ctx := r.Context()
+	path, ok := ctx.Value(pathKey).(string)
+	if !ok {
+		path = r.URL.Path
+	}
+	start, _ := ctx.Value(startTimeKey).(time.Time)
+	clientID, _ := ctx.Value(clientIDKey).(string)
+	clientOwner, _ := ctx.Value(clientOwnerKey).(string)
+	clientTags, _ := ctx.Value(clientTagsKey).(map[string]string)
+	subject, _ := ctx.Value(subjectKey).(string)
+	user, _ := ctx.Value(userKey).(string)
+	taskID, _ := ctx.Value(taskIDKey).(string)
+	debug, _ := ctx.Value(debugKey).(bool)
+	var attempts []logging.Attempt
+	if recorded, ok := ctx.Value(attemptsKey).(*attemptLog); ok {
+		attempts = recorded.list()
+	}
+	var requestHeaders http.Header
+	if debug {
+		requestHeaders = redactHeaders(r.Header)
+	}
+
+	s.logger.LogRequest(logging.Entry{
+		Timestamp:             time.Now(),
+		RequestBody:           loggedBody(ctx, ctx.Value(requestBodyKey)),
+		Duration:              time.Since(start),
+		Path:                  path,
+		Method:                r.Method,
+		Status:                status,
+		Upstream:              r.URL.Host,
+		Error:                 fmt.Sprintf("%s: %v", message, err),
+		ExternalCorrelationID: s.externalCorrelationID(r),
+		ClientID:              clientID,
+		ClientOwner:           clientOwner,
+		Tags:                  clientTags,
+		Subject:               subject,
+		User:                  user,
+		TaskID:                taskID,
+		APIVersion:            apiVersionOf(r),
+		Attempts:              attempts,
+		Debug:                 debug,
+		RequestHeaders:        requestHeaders,
+	})
+}
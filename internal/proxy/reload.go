@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/audit"
+	"azure-ai-proxy/internal/auth"
+	"azure-ai-proxy/internal/features"
+)
+
+// settings is the part of the server's state that ApplyConfig replaces while the
+// proxy is serving. Requests in flight keep using the settings they started with.
+type settings struct {
+	balancer            *balancer
+	authenticator       auth.Authenticator
+	adminKey            string
+	ipFilter            *ipFilter                        // networks proxied requests are admitted from
+	adminIPFilter       *ipFilter                        // networks admin requests are admitted from
+	clientKeys          map[string]bool                  // names of the configured client keys
+	clientOwners        map[string]string                // owner of each client key, by client ID
+	clientTags          map[string]map[string]string     // tags of each client key, by client ID
+	scopes              map[string]*keyScope             // deployments and operations each client key may call
+	keyExpiry           map[string]time.Time             // when each expiring client key expires, by client ID
+	keyExpiryWarning    time.Duration                    // how long before their expiry keys are warned about
+	windows             map[string]*config.AccessWindows // times each restricted client key may be used at
+	debugClients        map[string]bool
+	sizeRoutes          map[string][]sizeRoute
+	modelAliases        map[string]string
+	modelRoutes         map[string]*modelRoute // backends and deployments serving each routed model
+	degradeDeployments  map[string]string
+	failoverDeployments map[string]string
+	apiVersion          string // api-version of requests without one, or of all with forceAPIVersion
+	forceAPIVersion     bool
+	degradeClients      map[string]bool
+	features            *features.Flags
+}
+
+// newSettings builds the reloadable settings from a config. Client certificates are
+// accepted for authentication when clientCerts is set, backends authenticating with
+// Entra ID get their tokens from tokens and those exchanging users' tokens from obo,
+// and signed requests are checked for replays against replays.
+func newSettings(backends []config.Backend, cfg *config.Config, clientCerts bool, tokens *tokenSource, obo *oboSource, replays *auth.ReplayCache) (*settings, error) {
+	st := &settings{
+		adminKey:            cfg.AdminAPIKey,
+		clientKeys:          make(map[string]bool),
+		clientOwners:        make(map[string]string),
+		clientTags:          make(map[string]map[string]string),
+		scopes:              make(map[string]*keyScope),
+		keyExpiry:           make(map[string]time.Time),
+		windows:             make(map[string]*config.AccessWindows),
+		keyExpiryWarning:    time.Duration(cfg.KeyExpiryWarningDays) * 24 * time.Hour,
+		debugClients:        make(map[string]bool),
+		degradeDeployments:  cfg.DegradeDeployments,
+		failoverDeployments: cfg.FailoverDeployments,
+		apiVersion:          cfg.APIVersion,
+		forceAPIVersion:     cfg.APIVersionForce,
+		modelAliases:        cfg.ModelAliases,
+		degradeClients:      make(map[string]bool),
+	}
+
+	// Admit clients by the network they connect from
+	var err error
+	if st.ipFilter, err = newIPFilter(cfg.IPAllowlist, cfg.IPDenylist); err != nil {
+		return nil, fmt.Errorf("IP_ALLOWLIST or IP_DENYLIST: %v", err)
+	}
+	if st.adminIPFilter, err = newIPFilter(cfg.AdminIPAllowlist, cfg.AdminIPDenylist); err != nil {
+		return nil, fmt.Errorf("ADMIN_IP_ALLOWLIST or ADMIN_IP_DENYLIST: %v", err)
+	}
+
+	// Authenticate clients by SPIFFE ID, certificate, bearer token, request signature
+	// and/or proxy API keys, whichever are configured
+	var authenticators auth.Chain
+	if clientCerts && len(cfg.SPIFFEIdentities) > 0 {
+		workloads := auth.SPIFFEAuthenticator{IDs: make(map[string]string, len(cfg.SPIFFEIdentities))}
+		for _, id := range cfg.SPIFFEIdentities {
+			workloads.IDs[id.ID] = id.Client
+			if id.Owner != "" {
+				st.clientOwners[id.Client] = id.Owner
+			}
+			if len(id.Tags) > 0 {
+				st.clientTags[id.Client] = id.Tags
+			}
+			if scope := newKeyScope(config.ClientKey{Deployments: id.Deployments, Operations: id.Operations}); scope != nil {
+				st.scopes[id.Client] = scope
+			}
+		}
+		authenticators = append(authenticators, workloads)
+	}
+	if clientCerts {
+		authenticators = append(authenticators, auth.CertificateAuthenticator{Identities: cfg.TLSClientIdentities})
+	}
+	if cfg.JWTIssuer != "" {
+		authenticators = append(authenticators, auth.NewJWTAuthenticator(cfg.JWTIssuer, cfg.JWTAudiences, cfg.JWTClientClaims, cfg.JWTJWKSURL))
+	}
+	if len(cfg.HMACSecrets) > 0 {
+		signed := &auth.HMACAuthenticator{
+			Secrets: make(map[string]string, len(cfg.HMACSecrets)),
+			MaxSkew: cfg.HMACMaxSkew,
+			Replays: replays,
+		}
+		for _, h := range cfg.HMACSecrets {
+			signed.Secrets[h.Client] = h.Secret
+		}
+		authenticators = append(authenticators, signed)
+	}
+	if cfg.APIKey != "" || len(cfg.ClientKeys) > 0 {
+		registry := &auth.KeyRegistry{Keys: make(map[string]string, len(cfg.ClientKeys)+1), Expiry: st.keyExpiry}
+		if cfg.APIKey != "" {
+			registry.Keys[cfg.APIKey] = "default"
+		}
+		for _, k := range cfg.ClientKeys {
+			registry.Keys[k.Key] = k.Name
+			st.clientKeys[k.Name] = true
+			if k.Owner != "" {
+				st.clientOwners[k.Name] = k.Owner
+			}
+			if len(k.Tags) > 0 {
+				st.clientTags[k.Name] = k.Tags
+			}
+			if scope := newKeyScope(k); scope != nil {
+				st.scopes[k.Name] = scope
+			}
+			expiry, err := k.Expiry()
+			if err != nil {
+				return nil, fmt.Errorf("client %q: %v", k.Name, err)
+			}
+			if !expiry.IsZero() {
+				st.keyExpiry[k.Name] = expiry
+			}
+			windows, err := k.AccessWindows()
+			if err != nil {
+				return nil, fmt.Errorf("client %q: %v", k.Name, err)
+			}
+			if windows != nil {
+				st.windows[k.Name] = windows
+			}
+		}
+		for key, clientID := range registry.Keys {
+			if auth.IsKeyHash(key) {
+				if err := auth.CheckKeyHash(key); err != nil {
+					return nil, fmt.Errorf("key of client %q: %v", clientID, err)
+				}
+			}
+		}
+		authenticators = append(authenticators, registry)
+	}
+	switch len(authenticators) {
+	case 0:
+	case 1:
+		st.authenticator = authenticators[0]
+	default:
+		st.authenticator = authenticators
+	}
+
+	// Spread requests over the backends in proportion to their weights
+	if st.balancer, err = newBalancer(backends, cfg.LoadBalancing, tokens, obo); err != nil {
+		return nil, err
+	}
+
+	// Send requests for routed models to the backends serving them
+	if st.modelRoutes, err = parseModelRoutes(cfg.ModelRoutes, st.balancer); err != nil {
+		return nil, err
+	}
+	if err = st.balancer.checkReachable(st.modelRoutes); err != nil {
+		return nil, err
+	}
+
+	// Send large requests to deployments that can take them
+	if st.sizeRoutes, err = parseSizeRoutes(cfg.SizeRoutes); err != nil {
+		return nil, err
+	}
+
+	// Roll experimental behaviors out as far as their flags say
+	if st.features, err = features.Parse(cfg.FeatureFlags); err != nil {
+		return nil, err
+	}
+
+	for _, clientID := range cfg.DebugLogClients {
+		st.debugClients[clientID] = true
+	}
+	for _, clientID := range cfg.DegradeClients {
+		st.degradeClients[clientID] = true
+	}
+	return st, nil
+}
+
+// current returns the settings in effect
+func (s *Server) current() *settings {
+	return s.settings.Load()
+}
+
+// reloadableSettings are the settings ApplyConfig applies, named as in the config file.
+// Those starting with one of reloadablePrefixes are too.
+var (
+	reloadableSettings = map[string]bool{
+		"azure_openai_endpoint": true, "azure_openai_api_key": true, "upstreams": true, "backends": true,
+		"proxy_api_key": true, "proxy_api_keys": true, "key_expiry_warning_days": true,
+		"tls_client_identities": true, "spiffe_ids": true, "admin_api_key": true,
+		"ip_allowlist": true, "ip_denylist": true, "admin_ip_allowlist": true, "admin_ip_denylist": true,
+		"debug_log_clients": true, "load_balancing": true, "api_version": true, "api_version_force": true,
+		"failover_deployments": true, "model_aliases": true, "model_routes": true, "size_routes": true,
+		"degrade_deployments": true, "degrade_clients": true, "feature_flags": true,
+		"log_level": true, "log_sample_rate": true, "client_log_sampling": true,
+	}
+	reloadablePrefixes = []string{"backend_", "jwt_", "hmac_"}
+)
+
+// RequiresRestart returns, in order, the settings among names that ApplyConfig cannot
+// change in the running proxy, including the limits of limiters disabled at startup
+func (s *Server) RequiresRestart(names []string) []string {
+	var restart []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		switch {
+		case reloadableSettings[name]:
+		case slices.ContainsFunc(reloadablePrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }):
+		case s.limiter != nil && slices.Contains([]string{"adaptive_rate_min", "adaptive_rate_max", "adaptive_rate_increase", "adaptive_rate_decrease"}, name):
+		case s.concurrency != nil && (name == "client_concurrency" || name == "client_concurrency_limits"):
+		default:
+			restart = append(restart, name)
+		}
+	}
+	sort.Strings(restart)
+	return restart
+}
+
+// ApplyConfig replaces the backends and their keys, the client keys and admin key,
+// debug-log clients, model aliases, size routes, degradation settings, feature flags and
+// the limits of enabled rate and concurrency limiters with those of cfg, without
+// interrupting requests in flight. Other settings only take effect on restart, see
+// RequiresRestart. If cfg is invalid nothing changes. The reload is audited as done
+// by actor.
+func (s *Server) ApplyConfig(cfg *config.Config, actor string) error {
+	clientCerts := s.tlsConfig != nil && s.tlsConfig.ClientCAs != nil
+	st, err := newSettings(cfg.EffectiveBackends(), cfg, clientCerts, s.tokens, s.obo, s.replays)
+	if err != nil {
+		s.auditReload(actor, audit.Failure, err.Error())
+		return err
+	}
+	added := st.balancer.inherit(s.current().balancer)
+	s.settings.Store(st)
+	for _, be := range added {
+		s.warmup(be.url)
+	}
+	s.checkKeyExpiry()
+	if s.limiter != nil {
+		s.limiter.SetBounds(cfg.AdaptiveRateMin, cfg.AdaptiveRateMax, cfg.AdaptiveRateIncrease, cfg.AdaptiveRateDecrease)
+	}
+	if s.concurrency != nil {
+		s.concurrency.SetLimits(cfg.ClientConcurrency, cfg.ClientConcurrencyLimits)
+	}
+	s.auditReload(actor, audit.Success, "")
+	log.Printf("Configuration applied, forwarding to %s", st.balancer)
+	return nil
+}
+
+// auditReload records a configuration reload by actor in the audit log, if enabled
+func (s *Server) auditReload(actor, outcome, detail string) {
+	if s.auditLogger == nil {
+		return
+	}
+	s.auditLogger.Record(audit.Event{
+		Actor:   actor,
+		Action:  "reload config",
+		Outcome: outcome,
+		Detail:  detail,
+	})
+}
+
+// retarget points a request at the backend its model is routed to, or else at the
+// fastest backend if its route is latency-sensitive or the next one, and returns it
+func (s *Server) retarget(req *http.Request) *backend {
+	if routed, ok := req.Context().Value(backendKey).(*backend); ok {
+		routed.target(req)
+		return routed
+	}
+	balancer := s.current().balancer
+	if s.routeOf(req.Context()).latencyRouting && balancer.multiple() {
+		be := balancer.fastest(s.latencyMargin)
+		be.target(req)
+		return be
+	}
+	return balancer.retarget(req)
+}
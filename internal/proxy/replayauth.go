@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"azure-ai-proxy/config"
+)
+
+// ReplayAuthorizer returns what gives replayed dead letters to target the current
+// credentials of the configured backend at that host, since they are stored without
+// any. A target that is no backend gets AZURE_OPENAI_API_KEY, or an Entra ID token as
+// AZURE_OPENAI_AUTH says. Token refreshes end once stop is closed.
+func ReplayAuthorizer(cfg *config.Config, target *url.URL, stop <-chan struct{}) (func(*http.Request), error) {
+	tokens := newTokenSource(cfg.AzureOpenAITokenScope, stop)
+	b, err := newBalancer(cfg.EffectiveBackends(), cfg.LoadBalancing, tokens, nil)
+	if err != nil {
+		return nil, err
+	}
+	if be := b.byHost(target.Host); be != nil {
+		return be.authorize, nil
+	}
+	b, err = newBalancer([]config.Backend{{Name: target.Host, Endpoint: target.String(), APIKey: cfg.AzureOpenAIAPIKey, Auth: cfg.AzureOpenAIAuth, Weight: 1}}, cfg.LoadBalancing, tokens, nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.backends[0].authorize, nil
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/internal/cache"
+	"azure-ai-proxy/internal/logging"
+)
+
+// cacheable reports whether a request's response may be served from or stored in the
+// cache. Only completions and embeddings are cached, never streaming requests, and
+// clients can bypass the cache with Cache-Control: no-cache or no-store.
+func cacheable(r *http.Request, body map[string]interface{}) bool {
+	if r.Method != http.MethodPost || !isCompletionPath(r.URL.Path) || body["stream"] == true {
+		return false
+	}
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "no-cache") && !strings.Contains(cacheControl, "no-store")
+}
+
+// serveCached writes the cached response for key, if any, and reports whether it did.
+// Misses are counted by the caller, which may still find a similar response.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, start time.Time, key string, requestBody interface{}, clientID string) bool {
+	entry, err := s.cache.Get(r.Context(), key)
+	if err != nil {
+		log.Printf("Warning: cache lookup failed, forwarding request: %v", err)
+	}
+	if entry == nil {
+		return false
+	}
+	s.cacheRequests.Inc("hit")
+	s.writeCached(w, r, start, entry, requestBody, clientID)
+	return true
+}
+
+// writeCached answers a request with a cached response and logs it
+func (s *Server) writeCached(w http.ResponseWriter, r *http.Request, start time.Time, entry *cache.Entry, requestBody interface{}, clientID string) {
+
+	// The cache holds unmodified responses, strip them the same way forwarded ones are
+	data := entry.Body
+	if body, _ := requestBody.(map[string]interface{}); s.shouldStrip(modelName(r.URL.Path, body), clientID) {
+		data = s.stripResponseFields(data)
+	}
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(entry.Status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing cached response: %v", err)
+	}
+
+	responseBody, err := decodeJSON(entry.Body)
+	if err != nil {
+		responseBody = string(entry.Body)
+	}
+	images, multimodal := countImages(requestBody)
+	clientOwner, _ := r.Context().Value(clientOwnerKey).(string)
+	clientTags, _ := r.Context().Value(clientTagsKey).(map[string]string)
+	subject, _ := r.Context().Value(subjectKey).(string)
+	user, _ := r.Context().Value(userKey).(string)
+	s.logger.LogRequest(logging.Entry{
+		Timestamp:             time.Now(),
+		RequestBody:           loggedBody(r.Context(), requestBody),
+		Response:              loggedBody(r.Context(), responseBody),
+		Duration:              time.Since(start),
+		Path:                  r.URL.Path,
+		Method:                r.Method,
+		Status:                entry.Status,
+		ClientID:              clientID,
+		ClientOwner:           clientOwner,
+		Tags:                  clientTags,
+		Subject:               subject,
+		User:                  user,
+		TaskID:                taskID(r),
+		CacheHit:              true,
+		ImageCount:            images,
+		Multimodal:            multimodal,
+		APIVersion:            r.URL.Query().Get("api-version"),
+		ExternalCorrelationID: s.externalCorrelationID(r),
+	})
+	if id := taskID(r); id != "" {
+		s.tasks.Record(id, entry.Status, time.Since(start), 0)
+	}
+	if s.stats != nil {
+		s.stats.Record(r.URL.Path, entry.Status, time.Since(start), 0)
+	}
+}
+
+// storeCached saves a successful upstream response in the cache
+func (t *loggingTransport) storeCached(req *http.Request, resp *http.Response, body []byte) {
+	key, _ := req.Context().Value(cacheKey).(string)
+	if key == "" || t.cache == nil {
+		return
+	}
+	resp.Header.Set("X-Cache", "MISS")
+
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || strings.HasPrefix(contentType, "text/event-stream") {
+		return
+	}
+
+	// Store the response even if the client has gone away
+	ctx := context.WithoutCancel(req.Context())
+	entry := &cache.Entry{Status: resp.StatusCode, ContentType: contentType, Body: body}
+	if err := t.cache.Set(ctx, key, entry, t.cacheTTL); err != nil {
+		log.Printf("Warning: could not store response in cache: %v", err)
+		return
+	}
+
+	// Let similar prompts find the response
+	if lookup, ok := req.Context().Value(semanticKey).(*semanticLookup); ok {
+		t.indexSemantic(ctx, lookup, key)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// restartSignals trigger a graceful restart, which is only supported on Unix
+var restartSignals []os.Signal
+
+// startSuccessor is not supported on this platform
+func startSuccessor(net.Listener) (int, error) {
+	return 0, errors.New("graceful restart is not supported on this platform")
+}
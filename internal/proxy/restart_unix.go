@@ -0,0 +1,90 @@
+//go:build unix
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// restartSignals trigger a graceful restart
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// successorTimeout bounds how long a new process may take to start serving
+const successorTimeout = 30 * time.Second
+
+// startSuccessor starts a new instance of the running binary that inherits the
+// listening socket, so it accepts connections while this process drains. It returns
+// once the new process serves; if it exits or does not serve within successorTimeout,
+// it is stopped and an error returned, so this process keeps serving.
+func startSuccessor(ln net.Listener) (int, error) {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return 0, fmt.Errorf("cannot pass a %T to a new process", ln)
+	}
+	file, err := tcp.File()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	// The new process reports that it serves by writing to this pipe
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at descriptor 3, after stdin, stdout and stderr
+	cmd.ExtraFiles = []*os.File{file, readyWriter}
+	cmd.Env = append(os.Environ(), inheritedListenerEnv+"=3", readyEnv+"=4")
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Reading fails once the new process exits without reporting
+	served := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		served <- err
+	}()
+	timer := time.NewTimer(successorTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-served:
+		if err == nil {
+			return pid, nil
+		}
+		return 0, fmt.Errorf("process %d exited before serving: %v", pid, exitStatus(<-exited))
+	case err := <-exited:
+		return 0, fmt.Errorf("process %d exited before serving: %v", pid, exitStatus(err))
+	case <-timer.C:
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("process %d did not serve within %v and was stopped", pid, successorTimeout)
+	}
+}
+
+// exitStatus describes how a process that should have kept running ended
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// System prompt modes
+const (
+	// SystemPromptDefault prepends the system prompt only when the request has none
+	SystemPromptDefault = "default"
+	// SystemPromptEnforce always prepends the system prompt
+	SystemPromptEnforce = "enforce"
+)
+
+// decodeJSON parses a JSON document, keeping numbers as json.Number so that
+// re-encoding a rewritten body does not alter them
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	return v, nil
+}
+
+// rewriteRequestBody applies the configured rewrites to a parsed request body
+// and reports whether anything was changed
+func (s *Server) rewriteRequestBody(r *http.Request, body map[string]interface{}, clientID string) bool {
+	changed := s.resolveAliasModel(r, body)
+	if s.disableStreaming(r, body, clientID) {
+		log.Printf("Converted streaming %s %s from client %q to a non-streaming request", r.Method, r.URL.Path, clientID)
+		changed = true
+	}
+	if s.injectSystemPrompt(body) {
+		log.Printf("Injected system prompt into %s %s", r.Method, r.URL.Path)
+		changed = true
+	}
+	if seed, ok := s.seedFor(r, body, clientID); ok {
+		body["seed"] = seed
+		log.Printf("Injected seed %d into %s %s", seed, r.Method, r.URL.Path)
+		changed = true
+	}
+	if s.requireUsage(body, clientID) {
+		log.Printf("Requested usage of streaming %s %s from budgeted client %q", r.Method, r.URL.Path, clientID)
+		changed = true
+	}
+	if previous, ok := s.enforceJSONMode(r, body); ok {
+		if previous == "" {
+			log.Printf("Enforced JSON mode on %s %s", r.Method, r.URL.Path)
+		} else {
+			log.Printf("Enforced JSON mode on %s %s, replacing response_format %q", r.Method, r.URL.Path, previous)
+		}
+		changed = true
+	}
+	return changed
+}
+
+// injectSystemPrompt prepends the configured system message to chat requests
+func (s *Server) injectSystemPrompt(body map[string]interface{}) bool {
+	if s.systemPrompt == "" {
+		return false
+	}
+	messages, ok := body["messages"].([]interface{})
+	if !ok {
+		return false
+	}
+
+	if s.systemPromptMode != SystemPromptEnforce {
+		for _, message := range messages {
+			if m, ok := message.(map[string]interface{}); ok && (m["role"] == "system" || m["role"] == "developer") {
+				return false
+			}
+		}
+	}
+
+	systemMessage := map[string]interface{}{
+		"role":    "system",
+		"content": s.systemPrompt,
+	}
+	body["messages"] = append([]interface{}{systemMessage}, messages...)
+	return true
+}
+
+// requireUsage sets stream_options.include_usage on streaming requests of clients with
+// a budget, as streams report the usage they are charged for only then
+func (s *Server) requireUsage(body map[string]interface{}, clientID string) bool {
+	if s.budgets == nil || body["stream"] != true || !s.budgets.Limited(clientID) {
+		return false
+	}
+	options, _ := body["stream_options"].(map[string]interface{})
+	if options == nil {
+		options = map[string]interface{}{}
+	}
+	if options["include_usage"] == true {
+		return false
+	}
+	options["include_usage"] = true
+	body["stream_options"] = options
+	return true
+}
+
+// setRequestBody replaces the request body with the JSON encoding of body
+func setRequestBody(r *http.Request, body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(body); err != nil {
+		return nil, err
+	}
+	bodyBytes := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	r.ContentLength = int64(len(bodyBytes))
+	r.Header.Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+	r.Header.Del("Content-Encoding")
+	return bodyBytes, nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/config"
+)
+
+// routeSettings are the settings of a request after route overrides are applied
+type routeSettings struct {
+	timeout     time.Duration
+	logBodies   bool
+	maxBodySize int64
+
+	latencyRouting bool // send the request to the fastest backend
+}
+
+// sortRoutes orders route overrides from the most to the least specific pattern, so
+// longer patterns win over the shorter ones they overlap with
+func sortRoutes(routes []config.Route) []config.Route {
+	sorted := append([]config.Route(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Pattern) > len(sorted[j].Pattern) })
+	return sorted
+}
+
+// matchRoute reports whether a request path matches a route pattern. A trailing /*
+// matches any number of segments rather than just one.
+func matchRoute(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		// Compare against the path cut after as many segments as the pattern has
+		segments := strings.Count(pattern, "/")
+		if strings.Count(p, "/") < segments {
+			return false
+		}
+		parts := strings.SplitN(p, "/", segments+2)
+		p = strings.Join(parts[:segments+1], "/")
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// routeFor returns the settings for requests to p: the global ones, each overridden
+// by the most specific matching route that sets it
+func (s *Server) routeFor(p string) routeSettings {
+	route := s.defaultRoute()
+	var timeoutSet, logBodiesSet, maxBodySizeSet, latencyRoutingSet bool
+	for _, r := range s.routes {
+		if !matchRoute(r.Pattern, p) {
+			continue
+		}
+		if r.Timeout > 0 && !timeoutSet {
+			route.timeout, timeoutSet = r.Timeout, true
+		}
+		if r.LogBodies != nil && !logBodiesSet {
+			route.logBodies, logBodiesSet = *r.LogBodies, true
+		}
+		if r.MaxBodySize > 0 && !maxBodySizeSet {
+			route.maxBodySize, maxBodySizeSet = r.MaxBodySize, true
+		}
+		if r.LatencyRouting != nil && !latencyRoutingSet {
+			route.latencyRouting, latencyRoutingSet = *r.LatencyRouting, true
+		}
+	}
+	return route
+}
+
+// defaultRoute returns the global settings, for paths no route matches
+func (s *Server) defaultRoute() routeSettings {
+	return routeSettings{
+		timeout:     s.upstreamTimeout,
+		logBodies:   s.logBodies,
+		maxBodySize: s.maxRequestBodySize,
+
+		latencyRouting: s.latencyRouting,
+	}
+}
+
+// routeOf returns the route settings stored in a request's context
+func (s *Server) routeOf(ctx context.Context) routeSettings {
+	if route, ok := ctx.Value(routeKey).(routeSettings); ok {
+		return route
+	}
+	return s.defaultRoute()
+}
+
+// loggedBody returns body, or nil when the request's route leaves bodies out of the log
+// and the request was not sent with X-Debug-Log
+func loggedBody(ctx context.Context, body interface{}) interface{} {
+	if debug, _ := ctx.Value(debugKey).(bool); debug {
+		return body
+	}
+	if route, ok := ctx.Value(routeKey).(routeSettings); ok && !route.logBodies {
+		return nil
+	}
+	return body
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/audit"
+)
+
+// keyScope restricts a client key to some deployments and operations. A nil set, like a
+// nil scope, allows them all.
+type keyScope struct {
+	deployments map[string]bool
+	operations  map[string]bool
+}
+
+// newKeyScope returns the scope of a client key, or nil if it is unrestricted
+func newKeyScope(key config.ClientKey) *keyScope {
+	if len(key.Deployments) == 0 && len(key.Operations) == 0 {
+		return nil
+	}
+	sc := &keyScope{}
+	if len(key.Deployments) > 0 {
+		sc.deployments = make(map[string]bool, len(key.Deployments))
+		for _, d := range key.Deployments {
+			sc.deployments[d] = true
+		}
+	}
+	if len(key.Operations) > 0 {
+		sc.operations = make(map[string]bool, len(key.Operations))
+		for _, op := range key.Operations {
+			sc.operations[op] = true
+		}
+	}
+	return sc
+}
+
+// operationOf classifies a request path as one of the operations of key scopes: chat,
+// completions, embeddings, images, audio, responses or other
+func operationOf(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return "chat"
+	case strings.HasSuffix(path, "/completions"):
+		return "completions"
+	case strings.HasSuffix(path, "/embeddings"):
+		return "embeddings"
+	case strings.Contains(path, "/images/"):
+		return "images"
+	case strings.Contains(path, "/audio/"):
+		return "audio"
+	case strings.HasSuffix(path, "/responses"), strings.Contains(path, "/responses/"):
+		return "responses"
+	}
+	return "other"
+}
+
+// deniedOperation returns why the scope refuses the operation of path, or "" if it
+// allows it
+func (sc *keyScope) deniedOperation(path string) string {
+	if sc == nil || sc.operations == nil {
+		return ""
+	}
+	if op := operationOf(path); !sc.operations[op] {
+		return fmt.Sprintf("Forbidden: key may not call %s operations", op)
+	}
+	return ""
+}
+
+// deniedDeployment returns why the scope refuses a request for a deployment, given by
+// the names it goes by such as a model alias and the deployment it stands for, or "" if
+// it allows any of them. Requests naming no deployment are refused when deployments are
+// restricted.
+func (sc *keyScope) deniedDeployment(names ...string) string {
+	if sc == nil || sc.deployments == nil {
+		return ""
+	}
+	var named string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if sc.deployments[name] {
+			return ""
+		}
+		if named == "" {
+			named = name
+		}
+	}
+	if named == "" {
+		return "Forbidden: key is restricted to some deployments and the request names none"
+	}
+	return fmt.Sprintf("Forbidden: key may not call deployment %s", named)
+}
+
+// rejectOutOfScope refuses a request outside the scope of the client's key and records
+// the denial in the audit log
+func (s *Server) rejectOutOfScope(w http.ResponseWriter, r *http.Request, start time.Time, clientID, message string) {
+	s.audit(r, clientID, "scope", audit.Failure, fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, message))
+	s.reject(w, r, start, rejectedByScope, http.StatusForbidden, message)
+}
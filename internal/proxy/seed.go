@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net/http"
+)
+
+// SeedFromClient derives the injected seed from the client ID
+const SeedFromClient = "client"
+
+// seedFor returns the seed to inject into a chat request that has none, and whether to
+// inject one at all. Per-client seeds take precedence over the configured seed source.
+func (s *Server) seedFor(r *http.Request, body map[string]interface{}, clientID string) (int64, bool) {
+	if _, ok := body["seed"]; ok {
+		return 0, false
+	}
+	if _, ok := body["messages"]; !ok {
+		return 0, false
+	}
+	if len(s.seedDeployments) > 0 && !s.seedDeployments[modelName(r.URL.Path, body)] {
+		return 0, false
+	}
+
+	if seed, ok := s.clientSeeds[clientID]; ok {
+		return int64(seed), true
+	}
+	switch {
+	case s.seedSource == SeedFromClient:
+		h := fnv.New32a()
+		h.Write([]byte(clientID))
+		return int64(h.Sum32()), true
+	case s.seedSource != "":
+		return s.seed, true
+	}
+	return 0, false
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/internal/cache"
+)
+
+// embeddingTimeout bounds the embeddings call made for a semantic cache lookup
+const embeddingTimeout = 10 * time.Second
+
+// semanticCache finds cached responses to prompts similar to a new one by comparing
+// prompt embeddings. Per scope (everything about a request except its prompt) it keeps
+// an index of recent prompt embeddings and the cache keys of their responses, stored
+// in the cache backend next to the responses so it is shared like them.
+type semanticCache struct {
+	deployment string // embeddings deployment
+	apiVersion string
+	threshold  float64 // minimum cosine similarity of a hit
+}
+
+// semanticCandidate is a cached prompt in a scope's index
+type semanticCandidate struct {
+	Key       string
+	Embedding []float32
+}
+
+// semanticLookup is what a request missing the semantic cache needs to be indexed
+// once its response is cached
+type semanticLookup struct {
+	scope     string
+	embedding []float32
+}
+
+// semanticPrompt returns the text of a request compared by similarity: the last user
+// message of a chat, or the prompt and input otherwise. The other messages of a chat,
+// such as its system prompt and earlier turns, are returned to be matched exactly.
+func semanticPrompt(body map[string]interface{}) (string, []interface{}) {
+	messages, ok := body["messages"].([]interface{})
+	if !ok {
+		return promptText(body), nil
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		m, ok := messages[i].(map[string]interface{})
+		if !ok || m["role"] != "user" {
+			continue
+		}
+		rest := append(append([]interface{}{}, messages[:i]...), messages[i+1:]...)
+		return strings.Join(appendText(nil, m["content"]), "\n"), rest
+	}
+	return "", nil
+}
+
+// semanticScope returns the cache key of the index of requests of the client that
+// differ from this one only in the text returned by semanticPrompt
+func semanticScope(r *http.Request, body map[string]interface{}, clientID string) string {
+	rest := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		switch key {
+		case "messages", "prompt", "input":
+		default:
+			rest[key] = value
+		}
+	}
+	if _, conversation := semanticPrompt(body); conversation != nil {
+		rest["messages"] = conversation
+	}
+	if hash := requestHash(r, rest, clientID); hash != "" {
+		return "semantic:" + hash
+	}
+	return ""
+}
+
+// serveSimilar answers a request that missed the exact cache with the cached response
+// to the most similar prompt in its scope, if that is similar enough. When nothing is
+// served it returns what is needed to index the request's response.
+func (s *Server) serveSimilar(w http.ResponseWriter, r *http.Request, start time.Time, body map[string]interface{}, clientID string) (*semanticLookup, bool) {
+	text, _ := semanticPrompt(body)
+	scope := semanticScope(r, body, clientID)
+	if text == "" || scope == "" {
+		return nil, false
+	}
+	embedding, err := s.embed(r, text)
+	if err != nil {
+		log.Printf("Warning: semantic cache lookup skipped, embedding failed: %v", err)
+		return nil, false
+	}
+	lookup := &semanticLookup{scope: scope, embedding: embedding}
+
+	candidates, err := loadCandidates(r.Context(), s.cache, scope)
+	if err != nil {
+		log.Printf("Warning: semantic cache index lookup failed: %v", err)
+		return lookup, false
+	}
+	best, similarity := -1, s.semantic.threshold
+	for i, candidate := range candidates {
+		if sim := cosineSimilarity(embedding, candidate.Embedding); sim >= similarity {
+			best, similarity = i, sim
+		}
+	}
+	if best < 0 {
+		return lookup, false
+	}
+
+	entry, err := s.cache.Get(r.Context(), candidates[best].Key)
+	if err != nil || entry == nil {
+		return lookup, false
+	}
+	log.Printf("Serving %s %s from the semantic cache (similarity %.4f)", r.Method, r.URL.Path, similarity)
+	s.cacheRequests.Inc("semantic_hit")
+	s.writeCached(w, r, start, entry, body, clientID)
+	return nil, true
+}
+
+// embed returns the embedding of text from the configured embeddings deployment,
+// calling it with the client's credentials
+func (s *Server) embed(r *http.Request, text string) ([]float32, error) {
+	target := s.current().balancer.next()
+	endpoint := target.url.JoinPath(deploymentPrefix, s.semantic.deployment, "embeddings")
+	endpoint.RawQuery = url.Values{"api-version": {s.semantic.apiVersion}}.Encode()
+
+	payload, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), embeddingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range []string{"api-key", "Authorization"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	target.authorize(req)
+	s.renameHeaders(req)
+
+	resp, err := s.upstreamTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings deployment %s returned %d: %s", s.semantic.deployment, resp.StatusCode, bytes.TrimSpace(data))
+	}
+
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("embeddings deployment %s returned no embedding", s.semantic.deployment)
+	}
+	return result.Data[0].Embedding, nil
+}
+
+// loadCandidates reads the index of a scope from the cache
+func loadCandidates(ctx context.Context, c cache.Cache, scope string) ([]semanticCandidate, error) {
+	entry, err := c.Get(ctx, scope)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var candidates []semanticCandidate
+	if err := json.Unmarshal(entry.Body, &candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// indexSemantic adds the prompt of a newly cached response to its scope's index,
+// dropping the oldest prompts beyond the configured maximum. Concurrent updates of
+// one scope may lose a prompt, which only costs a future hit.
+func (t *loggingTransport) indexSemantic(ctx context.Context, lookup *semanticLookup, key string) {
+	candidates, err := loadCandidates(ctx, t.cache, lookup.scope)
+	if err != nil {
+		log.Printf("Warning: could not read semantic cache index: %v", err)
+	}
+	candidates = append(candidates, semanticCandidate{Key: key, Embedding: lookup.embedding})
+	if excess := len(candidates) - t.semanticMaxCandidates; excess > 0 {
+		candidates = candidates[excess:]
+	}
+
+	data, err := json.Marshal(candidates)
+	if err != nil {
+		log.Printf("Warning: could not encode semantic cache index: %v", err)
+		return
+	}
+	entry := &cache.Entry{Status: http.StatusOK, ContentType: "application/json", Body: data}
+	if err := t.cache.Set(ctx, lookup.scope, entry, t.cacheTTL); err != nil {
+		log.Printf("Warning: could not store semantic cache index: %v", err)
+	}
+}
+
+// cosineSimilarity returns the cosine of the angle between two vectors, or 0 if
+// their dimensions differ
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sizeRoute sends requests to a deployment to target instead once they exceed a
+// threshold, in estimated prompt tokens or, with bytes set, in body bytes
+type sizeRoute struct {
+	threshold int
+	bytes     bool
+	target    string
+}
+
+// parseSizeRoutes parses routes per deployment, each a "|"-separated list of
+// threshold:target pairs such as "8000:gpt-4o-32k|32000:gpt-4o-128k". A threshold
+// ending in "B" is a body size in bytes, otherwise an estimated token count.
+func parseSizeRoutes(values map[string]string) (map[string][]sizeRoute, error) {
+	routes := make(map[string][]sizeRoute, len(values))
+	for deployment, value := range values {
+		for _, rule := range strings.Split(value, "|") {
+			threshold, target, ok := strings.Cut(strings.TrimSpace(rule), ":")
+			if !ok || target == "" {
+				return nil, fmt.Errorf("invalid size route %q for %s, expected threshold:deployment", rule, deployment)
+			}
+			route := sizeRoute{target: target}
+			threshold, route.bytes = strings.CutSuffix(threshold, "B")
+			n, err := strconv.Atoi(threshold)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid size route threshold %q for %s", threshold, deployment)
+			}
+			route.threshold = n
+			routes[deployment] = append(routes[deployment], route)
+		}
+		// Check the largest thresholds first so the biggest matching tier wins
+		sort.Slice(routes[deployment], func(i, j int) bool {
+			return routes[deployment][i].threshold > routes[deployment][j].threshold
+		})
+	}
+	return routes, nil
+}
+
+// routeBySize rewrites the deployment in the path of a request whose body exceeds one
+// of its deployment's size routes. It returns the original deployment if the request
+// was rerouted, or "".
+func (s *Server) routeBySize(r *http.Request, rawBody []byte, body map[string]interface{}) string {
+	deployment := deploymentFromPath(r.URL.Path)
+	routes := s.current().sizeRoutes[deployment]
+	if len(routes) == 0 {
+		return ""
+	}
+
+	tokens := -1 // estimated on first use
+	for _, route := range routes {
+		size, unit := len(rawBody), "bytes"
+		if !route.bytes {
+			if tokens < 0 {
+				tokens = estimatePromptTokens(body, s.charsPerToken)
+			}
+			size, unit = tokens, "estimated tokens"
+		}
+		if size <= route.threshold {
+			continue
+		}
+
+		log.Printf("Routing %s %s to deployment %s: %d %s exceed %d", r.Method, r.URL.Path, route.target, size, unit, route.threshold)
+		setDeployment(r, deployment, route.target)
+		return deployment
+	}
+	return ""
+}
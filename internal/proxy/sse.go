@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/internal/logging"
+)
+
+// isEventStream reports whether a response is a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// streamRecorder passes a response body through while keeping a copy of it and
+// timing the arrival of its events, and calls done with both once the body has been
+// read to the end or closed early
+type streamRecorder struct {
+	io.ReadCloser
+	done func(body []byte, timing *logging.StreamTiming)
+	once sync.Once
+
+	mu     sync.Mutex // Close may be called while another goroutine reads
+	buf    bytes.Buffer
+	timing logging.StreamTiming
+	first  time.Time
+	last   time.Time
+
+	lineLength int // bytes received since the last newline
+}
+
+// Read implements io.Reader
+func (r *streamRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	r.record(p[:n], time.Now())
+	r.mu.Unlock()
+	if err != nil {
+		r.finish()
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *streamRecorder) Close() error {
+	err := r.ReadCloser.Close()
+	r.finish()
+	return err
+}
+
+// finish hands the recorded body to done, once
+func (r *streamRecorder) finish() {
+	r.once.Do(func() {
+		r.mu.Lock()
+		body := bytes.Clone(r.buf.Bytes())
+		timing := r.timing
+		r.mu.Unlock()
+		r.done(body, &timing)
+	})
+}
+
+// record appends data to the copy and timestamps every event it completes. Events
+// end with a blank line, which may be split across reads. Callers must hold r.mu.
+func (r *streamRecorder) record(data []byte, now time.Time) {
+	for _, b := range data {
+		switch b {
+		case '\n':
+			if r.lineLength == 0 && r.buf.Len() > 0 {
+				r.chunk(now)
+			}
+			r.lineLength = 0
+		case '\r':
+		default:
+			r.lineLength++
+		}
+		r.buf.WriteByte(b)
+	}
+}
+
+// chunk records the arrival of an event
+func (r *streamRecorder) chunk(now time.Time) {
+	if r.timing.Chunks == 0 {
+		r.first = now
+	} else {
+		r.timing.MaxGap = max(r.timing.MaxGap, now.Sub(r.last))
+	}
+	r.last = now
+	r.timing.Chunks++
+	r.timing.FirstToLast = now.Sub(r.first)
+}
+
+// readEvent reads the next event of a stream, including the blank line that ends it.
+// At the end of the stream it returns whatever was left, with io.EOF.
+func readEvent(r *bufio.Reader) ([]byte, error) {
+	var event []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		event = append(event, line...)
+		if err != nil {
+			return event, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return event, nil
+		}
+	}
+}
+
+// eventData returns the payload of an event made of a single data line
+func eventData(event []byte) ([]byte, bool) {
+	line := bytes.TrimRight(event, "\r\n")
+	if bytes.ContainsAny(line, "\n") {
+		return nil, false
+	}
+	return bytes.CutPrefix(line, []byte("data: "))
+}
+
+// pipeBody replaces a response body with the output of produce, which runs in its own
+// goroutine reading from the original body. Closing the new body closes the original.
+func pipeBody(body io.ReadCloser, produce func(body io.Reader, w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		err := produce(body, pw)
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return &multiReadCloser{
+		Reader: pr,
+		Closer: closerFunc(func() error {
+			pr.Close()
+			return body.Close()
+		}),
+	}
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+// Close implements io.Closer
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// gapTracker keeps the longest inter-chunk gap observed since it was last reset
+type gapTracker struct {
+	mu  sync.Mutex
+	max time.Duration
+}
+
+// observe records the longest gap of a stream
+func (g *gapTracker) observe(gap time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.max = max(g.max, gap)
+}
+
+// reset returns the longest gap in seconds and starts over
+func (g *gapTracker) reset() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gap := g.max
+	g.max = 0
+	return gap.Seconds()
+}
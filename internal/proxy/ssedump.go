@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/internal/features"
+)
+
+// unsafeFileChars matches characters not allowed in stream dump file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// sseDumper writes the raw bytes of selected streamed responses to files, for
+// debugging framing issues the reconstructed log entry hides
+type sseDumper struct {
+	dir         string
+	deployments map[string]bool
+}
+
+// shouldDump reports whether the stream of a request is dumped: those of debug
+// requests and of the configured deployments, as far as the sse_dump flag is rolled out
+func (d *sseDumper) shouldDump(req *http.Request, path string) bool {
+	if d == nil {
+		return false
+	}
+	if debug, _ := req.Context().Value(debugKey).(bool); debug {
+		return true
+	}
+	clientID, _ := req.Context().Value(clientIDKey).(string)
+	return d.deployments[deploymentFromPath(path)] && featureEnabled(req.Context(), features.SSEDump, path, clientID)
+}
+
+// dump writes a raw stream to a file named after the request's correlation ID and
+// returns its path, or "" if it could not be written
+func (d *sseDumper) dump(correlationID string, body []byte) string {
+	name := strings.TrimLeft(unsafeFileChars.ReplaceAllString(correlationID, "_"), ".")
+	if name == "" {
+		name = fmt.Sprintf("stream-%d", time.Now().UnixNano())
+	}
+	filename := filepath.Join(d.dir, name+".sse")
+
+	if err := os.WriteFile(filename, body, 0o644); err != nil {
+		log.Printf("Error writing stream dump %s: %v", filename, err)
+		return ""
+	}
+	return filename
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// modifyResponse applies the configured transformations to responses before they are
+// returned to the client
+func (s *Server) modifyResponse(resp *http.Response) error {
+	if s.correlationHeader != "" {
+		resp.Header.Del(s.correlationHeader)
+	}
+	if err := s.stripResponse(resp); err != nil {
+		return err
+	}
+	s.mergeChunks(resp)
+	markDegraded(resp)
+	return nil
+}
+
+// shouldStrip reports whether response fields are stripped for a deployment and client.
+// With no deployments or clients configured, fields are stripped from every response.
+func (s *Server) shouldStrip(deployment, clientID string) bool {
+	if len(s.stripFields) == 0 {
+		return false
+	}
+	if len(s.stripDeployments) == 0 && len(s.stripClients) == 0 {
+		return true
+	}
+	return s.stripDeployments[deployment] || s.stripClients[clientID]
+}
+
+// stripResponse removes the configured fields from a response. It runs after the
+// logging transport, so the log keeps the full response.
+func (s *Server) stripResponse(resp *http.Response) error {
+	ctx := resp.Request.Context()
+	clientID, _ := ctx.Value(clientIDKey).(string)
+	body, _ := ctx.Value(requestBodyKey).(map[string]interface{})
+	if !s.shouldStrip(modelName(resp.Request.URL.Path, body), clientID) {
+		return nil
+	}
+
+	if isEventStream(resp) {
+		resp.Body = pipeBody(resp.Body, s.stripEvents)
+		return nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	data = s.stripResponseFields(data)
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// stripResponseFields removes the configured fields from a JSON response. Bodies that
+// can't be parsed are returned as is.
+func (s *Server) stripResponseFields(data []byte) []byte {
+	stripped, ok := s.stripJSON(data)
+	if !ok {
+		return data
+	}
+	return stripped
+}
+
+// stripEvents removes the configured fields from each event of a stream as it passes through
+func (s *Server) stripEvents(body io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(body)
+	for {
+		event, err := readEvent(reader)
+		if data, ok := eventData(event); ok {
+			if stripped, ok := s.stripJSON(data); ok {
+				event = []byte("data: " + string(stripped) + "\n\n")
+			}
+		}
+		if _, werr := w.Write(event); werr != nil {
+			return werr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stripJSON removes the configured fields at any depth of a JSON document
+func (s *Server) stripJSON(data []byte) ([]byte, bool) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, false
+	}
+	if !s.stripValue(v) {
+		return data, true
+	}
+	stripped, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding stripped response: %v", err)
+		return nil, false
+	}
+	return stripped, true
+}
+
+// stripValue deletes the configured fields from v in place and reports whether any were found
+func (s *Server) stripValue(v interface{}) bool {
+	changed := false
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if s.stripFields[key] {
+				delete(value, key)
+				changed = true
+				continue
+			}
+			changed = s.stripValue(child) || changed
+		}
+	case []interface{}:
+		for _, child := range value {
+			changed = s.stripValue(child) || changed
+		}
+	}
+	return changed
+}
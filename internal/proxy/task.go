@@ -0,0 +1,21 @@
+package proxy
+
+import "net/http"
+
+const (
+	// taskIDHeader groups the many calls an agent makes for one logical task
+	taskIDHeader = "X-Task-ID"
+	// maxTaskIDLength caps client-supplied task IDs
+	maxTaskIDLength = 128
+	// maxTrackedTasks bounds the memory used for per-task totals
+	maxTrackedTasks = 10000
+)
+
+// taskID returns the client-supplied task ID of a request, or "" when absent or too long
+func taskID(r *http.Request) string {
+	id := r.Header.Get(taskIDHeader)
+	if len(id) > maxTaskIDLength {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/config"
+)
+
+// Client certificate modes
+const (
+	// ClientCertRequire rejects connections without a valid client certificate
+	ClientCertRequire = "require"
+	// ClientCertOptional verifies client certificates when presented, letting other
+	// clients authenticate with an API key instead
+	ClientCertOptional = "optional"
+)
+
+// tlsReloadCheckInterval is how often the certificate, key and client CA files are
+// checked for changes, so short-lived certificates such as SVIDs can be rotated
+const tlsReloadCheckInterval = 5 * time.Second
+
+// newTLSConfig builds the listener's TLS configuration, or returns nil when TLS is not
+// configured. With a client CA, client certificates are verified during the handshake.
+// Handshakes use the files' latest contents, reloaded when they change.
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil || tlsConfig == nil {
+		return nil, err
+	}
+	files := &tlsFiles{cfg: *cfg, current: tlsConfig, checked: time.Now()}
+	files.loaded = files.modTime()
+	served := tlsConfig.Clone()
+	served.GetConfigForClient = files.configForClient
+	return served, nil
+}
+
+// tlsFiles keeps the TLS configuration up to date with the files it was loaded from
+type tlsFiles struct {
+	cfg config.Config
+
+	mu      sync.Mutex
+	current *tls.Config
+	loaded  time.Time // latest modification time of the files when current was loaded
+	checked time.Time
+}
+
+// configForClient returns the configuration for a handshake, reloading the files first
+// if they changed since they were loaded. If they cannot be loaded, e.g. because a
+// new certificate was written but its key not yet, the current configuration stays.
+func (f *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) < tlsReloadCheckInterval {
+		return f.current, nil
+	}
+	f.checked = time.Now()
+	modTime := f.modTime()
+	if modTime.Equal(f.loaded) {
+		return f.current, nil
+	}
+	next, err := loadTLSConfig(&f.cfg)
+	if err != nil {
+		log.Printf("Warning: keeping the current TLS certificates, failed to reload them: %v", err)
+		return f.current, nil
+	}
+	f.current, f.loaded = next, modTime
+	log.Printf("Reloaded TLS certificates from %s", f.cfg.TLSCertFile)
+	return f.current, nil
+}
+
+// modTime returns the latest modification time of the certificate, key and client CA
+// files
+func (f *tlsFiles) modTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{f.cfg.TLSCertFile, f.cfg.TLSKeyFile, f.cfg.TLSClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// loadTLSConfig reads the certificate, key and client CA files into a TLS configuration
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate authentication requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLSClientCAFile == "" {
+		if len(cfg.TLSClientIdentities) > 0 {
+			return nil, fmt.Errorf("TLS_CLIENT_IDENTITIES requires TLS_CLIENT_CA_FILE")
+		}
+		if len(cfg.SPIFFEIdentities) > 0 {
+			return nil, fmt.Errorf("SPIFFE_IDS requires TLS_CLIENT_CA_FILE with the trust bundle")
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.TLSClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch cfg.TLSClientAuth {
+	case ClientCertRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientCertOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client certificate mode %q", cfg.TLSClientAuth)
+	}
+	return tlsConfig, nil
+}
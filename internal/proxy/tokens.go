@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// tokensPerMessage approximates the per-message formatting overhead of chat prompts
+const tokensPerMessage = 4
+
+// estimatePromptTokens estimates the prompt size of a request body with a
+// character-based heuristic. It counts chat messages, completion prompts and
+// embedding inputs.
+func estimatePromptTokens(body map[string]interface{}, charsPerToken float64) int {
+	chars := 0
+	overhead := 0
+
+	if messages, ok := body["messages"].([]interface{}); ok {
+		for _, message := range messages {
+			m, ok := message.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			overhead += tokensPerMessage
+			chars += textLength(m["content"])
+		}
+	}
+	chars += textLength(body["prompt"])
+	chars += textLength(body["input"])
+
+	return int(math.Ceil(float64(chars)/charsPerToken)) + overhead
+}
+
+// textLength returns the number of characters of text in a content value: a string,
+// a list of strings, or a list of content parts with "text" fields
+func textLength(content interface{}) int {
+	switch c := content.(type) {
+	case string:
+		return len([]rune(c))
+	case []interface{}:
+		total := 0
+		for _, part := range c {
+			if p, ok := part.(map[string]interface{}); ok {
+				total += textLength(p["text"])
+			} else {
+				total += textLength(part)
+			}
+		}
+		return total
+	}
+	return 0
+}
+
+// checkPromptSize compares the estimated prompt size with the context limit of the
+// targeted model. It returns false and a message for the client when the prompt is too large.
+func (s *Server) checkPromptSize(r *http.Request, body map[string]interface{}) (string, bool) {
+	model := modelName(r.URL.Path, body)
+	limit, ok := s.contextLimits[model]
+	if !ok {
+		return "", true
+	}
+
+	estimate := estimatePromptTokens(body, s.charsPerToken)
+	if estimate > limit {
+		return fmt.Sprintf("Bad Request: estimated prompt size of %d tokens exceeds the %d token context window of %s", estimate, limit, model), false
+	}
+	log.Printf("Estimated %d prompt tokens for %s (limit %d), forwarding", estimate, model, limit)
+	return "", true
+}
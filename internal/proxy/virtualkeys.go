@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/auth"
+	"azure-ai-proxy/internal/budget"
+	"azure-ai-proxy/internal/virtualkeys"
+)
+
+// maxKeyRequestSize caps the body of POST /admin/keys
+const maxKeyRequestSize = 64 << 10
+
+// keyRequest is the body of POST /admin/keys. Expiry is given either as a time or as a
+// duration from now, such as "720h".
+type keyRequest struct {
+	Name        string            `json:"name"`
+	Owner       string            `json:"owner"`
+	Deployments []string          `json:"deployments"`
+	Operations  []string          `json:"operations"`
+	Budget      string            `json:"budget"`
+	Tags        map[string]string `json:"tags"`
+	Windows     []string          `json:"windows"`
+	Timezone    string            `json:"timezone"`
+	ExpiresAt   *time.Time        `json:"expires_at"`
+	ExpiresIn   string            `json:"expires_in"`
+}
+
+// createdKey is the response to POST /admin/keys, the only one to include the key itself
+type createdKey struct {
+	virtualkeys.Key
+	Secret string `json:"key"`
+}
+
+// authenticator returns the authenticator of the current settings, preceded by the
+// virtual keys when they are enabled
+func (s *Server) authenticator() auth.Authenticator {
+	authenticator := s.current().authenticator
+	switch {
+	case s.virtualKeys == nil:
+		return authenticator
+	case authenticator == nil:
+		return s.virtualKeys
+	}
+	return auth.Chain{s.virtualKeys, authenticator}
+}
+
+// ownerOf returns the owner of a client's key, configured or virtual
+func (s *Server) ownerOf(clientID string) string {
+	if owner, ok := s.current().clientOwners[clientID]; ok || s.virtualKeys == nil {
+		return owner
+	}
+	k, _ := s.virtualKeys.Get(clientID)
+	return k.Owner
+}
+
+// tagsOf returns the tags of a client's key, configured or virtual
+func (s *Server) tagsOf(clientID string) map[string]string {
+	if tags, ok := s.current().clientTags[clientID]; ok || s.virtualKeys == nil {
+		return tags
+	}
+	k, _ := s.virtualKeys.Get(clientID)
+	return k.Tags
+}
+
+// scopeOf returns the scope of a client's key, configured or virtual, or nil if it is
+// unrestricted
+func (s *Server) scopeOf(clientID string) *keyScope {
+	if scope, ok := s.current().scopes[clientID]; ok || s.virtualKeys == nil {
+		return scope
+	}
+	k, _ := s.virtualKeys.Get(clientID)
+	return newKeyScope(config.ClientKey{Deployments: k.Deployments, Operations: k.Operations})
+}
+
+// virtualKeyLimit returns the budget of a virtual key, or nil if it has none
+func virtualKeyLimit(k virtualkeys.Key) (*budget.Limit, error) {
+	if k.Budget == "" {
+		return nil, nil
+	}
+	limits, err := budget.ParseLimits(map[string]string{k.Name: k.Budget})
+	if err != nil {
+		return nil, err
+	}
+	limit := limits[k.Name]
+	return &limit, nil
+}
+
+// requireVirtualKeys answers 404 when virtual keys are not enabled
+func (s *Server) requireVirtualKeys(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.virtualKeys == nil {
+			http.Error(w, "Virtual keys are not enabled, set VIRTUAL_KEYS_FILE", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleKeys lists the virtual keys
+func (s *Server) handleKeys(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.virtualKeys.List())
+}
+
+// handleKeyCreate creates a virtual key and returns it, including the key itself
+func (s *Server) handleKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var req keyRequest
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxKeyRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: invalid key request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	k, err := s.newVirtualKey(req)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := virtualKeyLimit(k)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	k, secret, err := s.virtualKeys.Create(k)
+	if errors.Is(err, virtualkeys.ErrExists) {
+		http.Error(w, fmt.Sprintf("Conflict: virtual key %s already exists", req.Name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating virtual key %s: %v", req.Name, err)
+		http.Error(w, "Error saving virtual key", http.StatusInternalServerError)
+		return
+	}
+	if s.budgets != nil {
+		s.budgets.SetLimit(k.Name, limit)
+	}
+	log.Printf("Virtual key %s created via admin endpoint", k.Name)
+	writeJSON(w, http.StatusCreated, createdKey{Key: k, Secret: secret})
+}
+
+// newVirtualKey checks a key request and returns the key it asks for
+func (s *Server) newVirtualKey(req keyRequest) (virtualkeys.Key, error) {
+	switch {
+	case req.Name == "" || strings.ContainsAny(req.Name, " \t\r\n/"):
+		return virtualkeys.Key{}, fmt.Errorf("name must be non-empty without whitespace or '/'")
+	case req.Name == "default" || s.current().clientKeys[req.Name]:
+		return virtualkeys.Key{}, fmt.Errorf("name %s is taken by a configured client key", req.Name)
+	case req.ExpiresAt != nil && req.ExpiresIn != "":
+		return virtualkeys.Key{}, fmt.Errorf("give either expires_at or expires_in, not both")
+	}
+	for _, op := range req.Operations {
+		if !slices.Contains(config.ClientKeyOperations, op) {
+			return virtualkeys.Key{}, fmt.Errorf("unknown operation %q, expected one of %s", op, strings.Join(config.ClientKeyOperations, ", "))
+		}
+	}
+
+	if _, err := config.ParseAccessWindows(req.Windows, req.Timezone); err != nil {
+		return virtualkeys.Key{}, err
+	}
+
+	k := virtualkeys.Key{
+		Name:        req.Name,
+		Owner:       req.Owner,
+		Deployments: req.Deployments,
+		Operations:  req.Operations,
+		Budget:      req.Budget,
+		Tags:        req.Tags,
+		Windows:     req.Windows,
+		Timezone:    req.Timezone,
+		ExpiresAt:   req.ExpiresAt,
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			return virtualkeys.Key{}, fmt.Errorf("invalid expires_in %q, expected a positive duration such as 720h", req.ExpiresIn)
+		}
+		expires := time.Now().Add(d).UTC().Truncate(time.Second)
+		k.ExpiresAt = &expires
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		return virtualkeys.Key{}, fmt.Errorf("expires_at %s is in the past", k.ExpiresAt.Format(time.RFC3339))
+	}
+	return k, nil
+}
+
+// handleKeyDisable disables a virtual key, refusing its requests until it is enabled again
+func (s *Server) handleKeyDisable(w http.ResponseWriter, r *http.Request) {
+	s.setKeyDisabled(w, r, true)
+}
+
+// handleKeyEnable enables a disabled virtual key
+func (s *Server) handleKeyEnable(w http.ResponseWriter, r *http.Request) {
+	s.setKeyDisabled(w, r, false)
+}
+
+// setKeyDisabled disables or enables the virtual key named in the path
+func (s *Server) setKeyDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	name := r.PathValue("name")
+	k, err := s.virtualKeys.SetDisabled(name, disabled)
+	if errors.Is(err, virtualkeys.ErrNotFound) {
+		http.Error(w, "Unknown virtual key", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving virtual key %s: %v", name, err)
+		http.Error(w, "Error saving virtual key", http.StatusInternalServerError)
+		return
+	}
+	state := "enabled"
+	if disabled {
+		state = "disabled"
+	}
+	log.Printf("Virtual key %s %s via admin endpoint", name, state)
+	writeJSON(w, http.StatusOK, k)
+}
+
+// handleKeyDelete deletes a virtual key
+func (s *Server) handleKeyDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := s.virtualKeys.Delete(name)
+	if errors.Is(err, virtualkeys.ErrNotFound) {
+		http.Error(w, "Unknown virtual key", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting virtual key %s: %v", name, err)
+		http.Error(w, "Error saving virtual key", http.StatusInternalServerError)
+		return
+	}
+	if s.budgets != nil {
+		s.budgets.SetLimit(name, nil)
+	}
+	log.Printf("Virtual key %s deleted via admin endpoint", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// warmup opens connections to an upstream in the background so the first real
+// requests don't pay for TCP and TLS setup, at startup, when a reload adds it and when
+// it recovers. It is bounded by the warmup timeout and never blocks the caller.
+func (s *Server) warmup(target *url.URL) {
+	if s.warmupConnections <= 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.warmupTimeout)
+		defer cancel()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		warmed := 0
+		for i := 0; i < s.warmupConnections; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := probe(ctx, s.baseTransport, target); err != nil {
+					log.Printf("Warmup probe to %s failed: %v", target.Host, err)
+					return
+				}
+				mu.Lock()
+				warmed++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		log.Printf("Warmed up %d/%d connections to %s in %v", warmed, s.warmupConnections, target.Host, time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+// probe sends a HEAD request to the upstream root and drains the response so the
+// connection is returned to the idle pool. Any status code counts as success.
+func probe(ctx context.Context, transport http.RoundTripper, target *url.URL) error {
+	probeURL := url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/audit"
+)
+
+// windowsOf returns the access windows of a client's key, configured or virtual, or nil
+// if it may be used at any time
+func (s *Server) windowsOf(clientID string) *config.AccessWindows {
+	if windows, ok := s.current().windows[clientID]; ok || s.virtualKeys == nil {
+		return windows
+	}
+	k, _ := s.virtualKeys.Get(clientID)
+	// Windows were checked when the key was created
+	windows, _ := config.ParseAccessWindows(k.Windows, k.Timezone)
+	return windows
+}
+
+// rejectOutsideWindow refuses a request made outside the access windows of the client's
+// key and records the denial in the audit log
+func (s *Server) rejectOutsideWindow(w http.ResponseWriter, r *http.Request, start time.Time, clientID string, windows *config.AccessWindows) {
+	message := fmt.Sprintf("Forbidden: key may only be used %s, it is %s there now",
+		windows, start.In(windows.Location).Format("Mon 15:04"))
+	s.audit(r, clientID, "window", audit.Failure, fmt.Sprintf("%s %s: %s", r.Method, r.URL.Path, message))
+	s.reject(w, r, start, rejectedByWindow, http.StatusForbidden, message)
+}
@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter is a token bucket whose rate follows an AIMD (additive-increase,
+// multiplicative-decrease) scheme driven by upstream 429 responses: the rate is cut
+// when Azure throttles and grows back slowly while requests succeed.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // requests per second
+	initial  float64
+	minRate  float64
+	maxRate  float64
+	increase float64
+	decrease float64
+	interval time.Duration
+
+	tokens       float64
+	lastRefill   time.Time
+	lastIncrease time.Time
+	lastDecrease time.Time
+	throttled    bool // a 429 was seen since the last increase
+}
+
+// NewAdaptiveLimiter creates a limiter starting at initial requests per second that
+// moves between minRate and maxRate. Every interval without throttling the rate grows
+// by increase; a 429 multiplies it by decrease, at most once per interval.
+func NewAdaptiveLimiter(initial, minRate, maxRate, increase, decrease float64, interval time.Duration) *AdaptiveLimiter {
+	now := time.Now()
+	return &AdaptiveLimiter{
+		rate:         initial,
+		initial:      initial,
+		minRate:      minRate,
+		maxRate:      maxRate,
+		increase:     increase,
+		decrease:     decrease,
+		interval:     interval,
+		tokens:       burst(initial),
+		lastRefill:   now,
+		lastIncrease: now,
+	}
+}
+
+// Allow reports whether a request may proceed now, consuming a token if so
+func (l *AdaptiveLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.adjust(now)
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Observe feeds an upstream response status into the rate adjustment
+func (l *AdaptiveLimiter) Observe(status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if status == http.StatusTooManyRequests {
+		l.throttled = true
+		if now.Sub(l.lastDecrease) >= l.interval {
+			l.refill(now)
+			l.rate = max(l.minRate, l.rate*l.decrease)
+			l.tokens = min(l.tokens, burst(l.rate))
+			l.lastDecrease = now
+		}
+	}
+	l.adjust(now)
+}
+
+// Rate returns the current effective rate in requests per second
+func (l *AdaptiveLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// State is a snapshot of an adaptive limiter
+type State struct {
+	Rate      float64 `json:"rate"`
+	MinRate   float64 `json:"min_rate"`
+	MaxRate   float64 `json:"max_rate"`
+	Tokens    float64 `json:"tokens"`
+	Burst     float64 `json:"burst"`
+	Throttled bool    `json:"throttled"`
+}
+
+// State returns the current state of the limiter
+func (l *AdaptiveLimiter) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	return State{
+		Rate:      l.rate,
+		MinRate:   l.minRate,
+		MaxRate:   l.maxRate,
+		Tokens:    l.tokens,
+		Burst:     burst(l.rate),
+		Throttled: l.throttled,
+	}
+}
+
+// Reset restores the initial rate and a full bucket
+func (l *AdaptiveLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.rate = l.initial
+	l.tokens = burst(l.initial)
+	l.lastRefill = now
+	l.lastIncrease = now
+	l.lastDecrease = time.Time{}
+	l.throttled = false
+}
+
+// SetBounds changes the range the rate moves in and how fast it moves, keeping the
+// current rate within the new range
+func (l *AdaptiveLimiter) SetBounds(minRate, maxRate, increase, decrease float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.minRate = minRate
+	l.maxRate = maxRate
+	l.increase = increase
+	l.decrease = decrease
+	l.rate = min(maxRate, max(minRate, l.rate))
+	l.tokens = min(l.tokens, burst(l.rate))
+}
+
+// adjust applies the additive increase once per healthy interval
+func (l *AdaptiveLimiter) adjust(now time.Time) {
+	if now.Sub(l.lastIncrease) < l.interval {
+		return
+	}
+	if !l.throttled {
+		l.refill(now)
+		l.rate = min(l.maxRate, l.rate+l.increase)
+	}
+	l.throttled = false
+	l.lastIncrease = now
+}
+
+// refill adds the tokens accrued since the last refill
+func (l *AdaptiveLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.lastRefill).Seconds()
+	l.tokens = min(burst(l.rate), l.tokens+elapsed*l.rate)
+	l.lastRefill = now
+}
+
+// burst returns the bucket capacity for a rate: one second's worth of requests
+func burst(rate float64) float64 {
+	return max(1, rate)
+}
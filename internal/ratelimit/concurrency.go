@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrencyLimiter caps the number of in-flight requests per client, so a single
+// client cannot take all of the proxy's upstream concurrency
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	defaultLimit int
+	limits       map[string]int
+	slots        map[string]chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter allowing defaultLimit concurrent requests per
+// client, overridden per client ID by limits. A limit of zero means unlimited.
+func NewConcurrencyLimiter(defaultLimit int, limits map[string]int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		defaultLimit: defaultLimit,
+		limits:       limits,
+		slots:        make(map[string]chan struct{}),
+	}
+}
+
+// Limit returns the concurrency limit of a client, zero if it is unlimited
+func (c *ConcurrencyLimiter) Limit(clientID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit(clientID)
+}
+
+// limit returns the concurrency limit of a client. Callers must hold c.mu.
+func (c *ConcurrencyLimiter) limit(clientID string) int {
+	if limit, ok := c.limits[clientID]; ok {
+		return limit
+	}
+	return c.defaultLimit
+}
+
+// SetLimits replaces the limits. Requests in flight keep their slots, but are not
+// counted against the new limits.
+func (c *ConcurrencyLimiter) SetLimits(defaultLimit int, limits map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.defaultLimit = defaultLimit
+	c.limits = limits
+	c.slots = make(map[string]chan struct{})
+}
+
+// semaphore returns the slots of a client, or nil if it is unlimited
+func (c *ConcurrencyLimiter) semaphore(clientID string) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := c.limit(clientID)
+	if limit <= 0 {
+		return nil
+	}
+	slots, ok := c.slots[clientID]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		c.slots[clientID] = slots
+	}
+	return slots
+}
+
+// ClientState is a snapshot of a client's slots
+type ClientState struct {
+	InFlight int `json:"in_flight"`
+	Limit    int `json:"limit"`
+}
+
+// States returns the slots of every limited client that sent requests since the
+// limits were last set
+func (c *ConcurrencyLimiter) States() map[string]ClientState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[string]ClientState, len(c.slots))
+	for clientID, slots := range c.slots {
+		states[clientID] = ClientState{InFlight: len(slots), Limit: cap(slots)}
+	}
+	return states
+}
+
+// Reset frees all slots of a client and reports whether it had any. Requests in flight
+// keep running but are no longer counted against the limit.
+func (c *ConcurrencyLimiter) Reset(clientID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.slots[clientID]
+	delete(c.slots, clientID)
+	return ok
+}
+
+// Acquire takes one of a client's slots. Without wait it fails immediately when all
+// slots are taken; with wait it queues until a slot frees up or ctx is done. On
+// success the returned function must be called to release the slot.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context, clientID string, wait bool) (release func(), ok bool) {
+	slots := c.semaphore(clientID)
+	if slots == nil {
+		return func() {}, true
+	}
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if !wait {
+		return nil, false
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
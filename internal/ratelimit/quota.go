@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// remainingTokensHeader is the response header in which Azure reports how many
+// tokens are left in the deployment's current rate-limit window
+const remainingTokensHeader = "x-ratelimit-remaining-tokens"
+
+// QuotaTracker remembers the remaining token quota Azure last reported for each
+// deployment on each upstream, so requests that would certainly be throttled can be
+// rejected without a round trip. Readings older than staleAfter are ignored.
+type QuotaTracker struct {
+	mu         sync.Mutex
+	reserve    int64
+	staleAfter time.Duration
+	upstreams  int
+	readings   map[string]map[string]quotaReading // deployment -> upstream host -> reading
+}
+
+// quotaReading is a remaining-tokens value and when it was seen
+type quotaReading struct {
+	remaining int64
+	seen      time.Time
+}
+
+// NewQuotaTracker creates a tracker that considers a deployment exhausted when fewer
+// than reserve tokens remain on every one of the upstreams requests are spread over
+func NewQuotaTracker(reserve int64, staleAfter time.Duration, upstreams int) *QuotaTracker {
+	return &QuotaTracker{
+		reserve:    reserve,
+		staleAfter: staleAfter,
+		upstreams:  upstreams,
+		readings:   make(map[string]map[string]quotaReading),
+	}
+}
+
+// Observe records the remaining tokens reported in the headers of a response from
+// a deployment on an upstream. Responses without the header are ignored.
+func (q *QuotaTracker) Observe(deployment, upstream string, header http.Header) {
+	value := header.Get(remainingTokensHeader)
+	if value == "" {
+		return
+	}
+	remaining, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.readings[deployment] == nil {
+		q.readings[deployment] = make(map[string]quotaReading)
+	}
+	q.readings[deployment][upstream] = quotaReading{remaining: remaining, seen: time.Now()}
+}
+
+// Exhausted reports whether a deployment is below the reserve on every upstream. It
+// also returns the highest remaining quota and how long until the freshest reading
+// goes stale, which is when a request will next be let through.
+func (q *QuotaTracker) Exhausted(deployment string) (remaining int64, retryAfter time.Duration, exhausted bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.exhausted(deployment, time.Now())
+}
+
+// exhausted implements Exhausted. Callers must hold q.mu.
+func (q *QuotaTracker) exhausted(deployment string, now time.Time) (remaining int64, retryAfter time.Duration, exhausted bool) {
+	fresh := 0
+	for _, reading := range q.readings[deployment] {
+		age := now.Sub(reading.seen)
+		if age >= q.staleAfter {
+			continue
+		}
+		if reading.remaining >= q.reserve {
+			return 0, 0, false
+		}
+		if fresh == 0 || reading.remaining > remaining {
+			remaining = reading.remaining
+		}
+		if wait := q.staleAfter - age; wait > retryAfter {
+			retryAfter = wait
+		}
+		fresh++
+	}
+	if fresh < q.upstreams {
+		return 0, 0, false
+	}
+	return remaining, retryAfter, true
+}
+
+// DeploymentQuota is a snapshot of the quota readings of a deployment
+type DeploymentQuota struct {
+	Exhausted bool                     `json:"exhausted"`
+	Upstreams map[string]UpstreamQuota `json:"upstreams"`
+}
+
+// UpstreamQuota is the last quota reading of a deployment on one upstream
+type UpstreamQuota struct {
+	RemainingTokens int64     `json:"remaining_tokens"`
+	Seen            time.Time `json:"seen"`
+	Stale           bool      `json:"stale"`
+}
+
+// States returns the readings of every deployment a quota was reported for
+func (q *QuotaTracker) States() map[string]DeploymentQuota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	states := make(map[string]DeploymentQuota, len(q.readings))
+	for deployment, readings := range q.readings {
+		_, _, exhausted := q.exhausted(deployment, now)
+		state := DeploymentQuota{Exhausted: exhausted, Upstreams: make(map[string]UpstreamQuota, len(readings))}
+		for upstream, reading := range readings {
+			state.Upstreams[upstream] = UpstreamQuota{
+				RemainingTokens: reading.remaining,
+				Seen:            reading.seen,
+				Stale:           now.Sub(reading.seen) >= q.staleAfter,
+			}
+		}
+		states[deployment] = state
+	}
+	return states
+}
+
+// Reset forgets the readings of a deployment, letting its requests through until Azure
+// reports its quota again, and reports whether there were any
+func (q *QuotaTracker) Reset(deployment string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.readings[deployment]
+	delete(q.readings, deployment)
+	return ok
+}
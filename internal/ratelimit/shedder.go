@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"azure-ai-proxy/internal/stats"
+)
+
+const (
+	// maxLatencySamples bounds the latencies kept for the percentile
+	maxLatencySamples = 1000
+	// evaluateEvery is how often the shedding decision is recomputed
+	evaluateEvery = 100 * time.Millisecond
+)
+
+// latencySample is the latency of one response and when it was observed
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// LoadShedder rejects new requests while the proxy is overloaded, in the spirit of
+// CoDel: it starts shedding only once the recent latency percentile has stayed above
+// the target for a whole interval while enough requests were in flight, so short
+// bursts are absorbed, and stops as soon as either drops back.
+type LoadShedder struct {
+	target     time.Duration
+	percentile float64
+	depth      int64
+	interval   time.Duration
+	window     time.Duration
+
+	inFlight atomic.Int64
+
+	mu         sync.Mutex
+	samples    []latencySample // ring buffer of the most recent samples
+	next       int
+	aboveSince time.Time // when the thresholds were first exceeded, zero while they are not
+	shedding   bool
+	lastEval   time.Time
+}
+
+// NewLoadShedder creates a shedder that sheds while the given percentile (0 < p <= 1)
+// of the latencies observed in the last window exceeds target and at least depth
+// requests are in flight, once both have held for interval
+func NewLoadShedder(target time.Duration, percentile float64, depth int, interval, window time.Duration) *LoadShedder {
+	return &LoadShedder{
+		target:     target,
+		percentile: percentile,
+		depth:      int64(depth),
+		interval:   interval,
+		window:     window,
+		samples:    make([]latencySample, 0, maxLatencySamples),
+	}
+}
+
+// Begin counts a request as in flight until the returned function is called
+func (l *LoadShedder) Begin() (done func()) {
+	l.inFlight.Add(1)
+	return func() { l.inFlight.Add(-1) }
+}
+
+// InFlight returns the number of requests currently in flight
+func (l *LoadShedder) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// Observe records the latency of a response
+func (l *LoadShedder) Observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sample := latencySample{at: time.Now(), latency: latency}
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, sample)
+		return
+	}
+	l.samples[l.next] = sample
+	l.next = (l.next + 1) % maxLatencySamples
+}
+
+// Allow reports whether a new request may be admitted
+func (l *LoadShedder) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastEval) >= evaluateEvery {
+		l.lastEval = now
+		l.evaluate(now)
+	}
+	return !l.shedding
+}
+
+// Latency returns the latency percentile over the last window
+func (l *LoadShedder) Latency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latency(time.Now())
+}
+
+// evaluate updates the shedding state. Callers must hold l.mu.
+func (l *LoadShedder) evaluate(now time.Time) {
+	depth := l.inFlight.Load()
+	latency := l.latency(now)
+	overloaded := depth >= l.depth && latency > l.target
+
+	switch {
+	case !overloaded:
+		if l.shedding {
+			log.Printf("Load shedding stopped: p%.0f latency %v, %d requests in flight", l.percentile*100, latency, depth)
+		}
+		l.aboveSince = time.Time{}
+		l.shedding = false
+	case l.aboveSince.IsZero():
+		l.aboveSince = now
+	case !l.shedding && now.Sub(l.aboveSince) >= l.interval:
+		log.Printf("Warning: shedding load, p%.0f latency %v above %v with %d requests in flight for %v",
+			l.percentile*100, latency, l.target, depth, now.Sub(l.aboveSince).Round(time.Millisecond))
+		l.shedding = true
+	}
+}
+
+// latency computes the latency percentile of the samples within the window. Callers
+// must hold l.mu.
+func (l *LoadShedder) latency(now time.Time) time.Duration {
+	recent := make([]time.Duration, 0, len(l.samples))
+	for _, sample := range l.samples {
+		if now.Sub(sample.at) <= l.window {
+			recent = append(recent, sample.latency)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return stats.Percentile(recent, l.percentile)
+}
@@ -0,0 +1,169 @@
+package schema
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Schema is a JSON Schema fragment inferred from observed values. Observing more
+// values widens the schema: types are unioned and object properties that are not
+// present in every observation become optional.
+type Schema struct {
+	types      map[string]bool
+	properties map[string]*Schema
+	presence   map[string]int // number of objects each property was present in
+	objects    int            // number of objects observed
+	items      *Schema
+}
+
+// New returns an empty schema
+func New() *Schema {
+	return &Schema{types: make(map[string]bool)}
+}
+
+// Observe merges a decoded JSON value into the schema
+func (s *Schema) Observe(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		s.types["null"] = true
+	case bool:
+		s.types["boolean"] = true
+	case string:
+		s.types["string"] = true
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			s.types["integer"] = true
+		} else {
+			s.types["number"] = true
+		}
+	case float64:
+		if v == math.Trunc(v) {
+			s.types["integer"] = true
+		} else {
+			s.types["number"] = true
+		}
+	case []interface{}:
+		s.types["array"] = true
+		if s.items == nil {
+			s.items = New()
+		}
+		for _, item := range v {
+			s.items.Observe(item)
+		}
+	case map[string]interface{}:
+		s.types["object"] = true
+		if s.properties == nil {
+			s.properties = make(map[string]*Schema)
+			s.presence = make(map[string]int)
+		}
+		s.objects++
+		for key, item := range v {
+			property, ok := s.properties[key]
+			if !ok {
+				property = New()
+				s.properties[key] = property
+			}
+			property.Observe(item)
+			s.presence[key]++
+		}
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		s.Observe(items)
+	}
+}
+
+// MarshalJSON renders the schema as JSON Schema
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{})
+
+	// "integer" is a subset of "number", so only keep the wider type when both were seen
+	types := make([]string, 0, len(s.types))
+	for t := range s.types {
+		if t == "integer" && s.types["number"] {
+			continue
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	switch len(types) {
+	case 0:
+	case 1:
+		out["type"] = types[0]
+	default:
+		out["type"] = types
+	}
+
+	if s.properties != nil {
+		out["properties"] = s.properties
+		var required []string
+		for key, count := range s.presence {
+			if count == s.objects {
+				required = append(required, key)
+			}
+		}
+		sort.Strings(required)
+		if len(required) > 0 {
+			out["required"] = required
+		}
+	}
+	if s.items != nil {
+		out["items"] = s.items
+	}
+
+	return json.Marshal(out)
+}
+
+// pathSchemas holds the schemas inferred for a single path
+type pathSchemas struct {
+	Observations int     `json:"observations"`
+	Request      *Schema `json:"request"`
+	Response     *Schema `json:"response"`
+}
+
+// Inferrer accumulates request and response schemas per path
+type Inferrer struct {
+	mu    sync.Mutex
+	paths map[string]*pathSchemas
+}
+
+// NewInferrer creates an empty inferrer
+func NewInferrer() *Inferrer {
+	return &Inferrer{paths: make(map[string]*pathSchemas)}
+}
+
+// Observe records a request and response body seen for a path. Nil bodies are
+// skipped, e.g. when the request body was streamed and never parsed.
+func (i *Inferrer) Observe(path string, request, response interface{}) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	schemas, ok := i.paths[path]
+	if !ok {
+		schemas = &pathSchemas{Request: New(), Response: New()}
+		i.paths[path] = schemas
+	}
+	schemas.Observations++
+	if request != nil {
+		schemas.Request.Observe(request)
+	}
+	if response != nil {
+		schemas.Response.Observe(response)
+	}
+}
+
+// WriteFile writes the inferred schemas, keyed by path, to a JSON file
+func (i *Inferrer) WriteFile(filename string) error {
+	i.mu.Lock()
+	data, err := json.MarshalIndent(i.paths, "", "  ")
+	i.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// topPathCount is the number of busiest paths included in a summary
+const topPathCount = 5
+
+// Collector accumulates request statistics between summaries
+type Collector struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	tokens   atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	paths     map[string]int64
+	since     time.Time
+}
+
+// Summary holds the statistics collected since the previous summary
+type Summary struct {
+	Period     time.Duration
+	Requests   int64
+	Errors     int64
+	Tokens     int64
+	AvgLatency time.Duration
+	P95Latency time.Duration
+	TopPaths   []PathCount
+}
+
+// PathCount is the number of requests seen for a path
+type PathCount struct {
+	Path  string
+	Count int64
+}
+
+// NewCollector creates an empty collector
+func NewCollector() *Collector {
+	return &Collector{
+		paths: make(map[string]int64),
+		since: time.Now(),
+	}
+}
+
+// Record adds a completed request to the statistics. A status of 0 means the
+// request failed before a response was received.
+func (c *Collector) Record(path string, status int, duration time.Duration, tokens int64) {
+	c.requests.Add(1)
+	if status == 0 || status >= 400 {
+		c.errors.Add(1)
+	}
+	c.tokens.Add(tokens)
+
+	c.mu.Lock()
+	c.latencies = append(c.latencies, duration)
+	c.paths[path]++
+	c.mu.Unlock()
+}
+
+// Snapshot returns the statistics collected so far and resets the collector
+func (c *Collector) Snapshot() Summary {
+	c.mu.Lock()
+	latencies := c.latencies
+	paths := c.paths
+	since := c.since
+	c.latencies = nil
+	c.paths = make(map[string]int64)
+	c.since = time.Now()
+	c.mu.Unlock()
+
+	summary := Summary{
+		Period:   time.Since(since),
+		Requests: c.requests.Swap(0),
+		Errors:   c.errors.Swap(0),
+		Tokens:   c.tokens.Swap(0),
+	}
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		summary.AvgLatency = total / time.Duration(len(latencies))
+		summary.P95Latency = Percentile(latencies, 0.95)
+	}
+
+	for path, count := range paths {
+		summary.TopPaths = append(summary.TopPaths, PathCount{Path: path, Count: count})
+	}
+	sort.Slice(summary.TopPaths, func(i, j int) bool {
+		if summary.TopPaths[i].Count != summary.TopPaths[j].Count {
+			return summary.TopPaths[i].Count > summary.TopPaths[j].Count
+		}
+		return summary.TopPaths[i].Path < summary.TopPaths[j].Path
+	})
+	if len(summary.TopPaths) > topPathCount {
+		summary.TopPaths = summary.TopPaths[:topPathCount]
+	}
+
+	return summary
+}
+
+// Run emits a summary log line every interval until stop is closed
+func (c *Collector) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Summary: %s", c.Snapshot())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// String formats the summary as a single log line
+func (s Summary) String() string {
+	paths := make([]string, 0, len(s.TopPaths))
+	for _, path := range s.TopPaths {
+		paths = append(paths, fmt.Sprintf("%s=%d", path.Path, path.Count))
+	}
+	return fmt.Sprintf("%d requests, %d errors, avg latency %v, p95 latency %v, %d tokens in the last %v, top paths: [%s]",
+		s.Requests, s.Errors, s.AvgLatency, s.P95Latency, s.Tokens, s.Period.Round(time.Second), strings.Join(paths, ", "))
+}
+
+// Percentile returns the p-th percentile (0 < p <= 1) of sorted durations
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(math.Ceil(float64(len(sorted))*p)) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
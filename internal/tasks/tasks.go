@@ -0,0 +1,143 @@
+package tasks
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Summary aggregates the requests made for one logical task, such as an agent run
+// that makes many sequential LLM calls
+type Summary struct {
+	TaskID       string        `json:"task_id"`
+	Requests     int           `json:"requests"`
+	Errors       int           `json:"errors"`
+	TotalLatency time.Duration `json:"total_latency_ns"`
+	Tokens       int64         `json:"tokens"`
+	FirstSeen    time.Time     `json:"first_seen"`
+	LastSeen     time.Time     `json:"last_seen"`
+
+	// ToolCallRounds counts responses that requested tool calls, and ToolCalls the
+	// calls per tool name, to follow the progression of agentic flows
+	ToolCallRounds int            `json:"tool_call_rounds"`
+	ToolCalls      map[string]int `json:"tool_calls,omitempty"`
+}
+
+// clone returns a copy of the summary that doesn't share its tool call counts
+func (s *Summary) clone() Summary {
+	c := *s
+	if s.ToolCalls != nil {
+		c.ToolCalls = make(map[string]int, len(s.ToolCalls))
+		for name, count := range s.ToolCalls {
+			c.ToolCalls[name] = count
+		}
+	}
+	return c
+}
+
+// Tracker aggregates latency and token usage per task ID. Tasks idle for longer than
+// the retention period are dropped, and at most maxTasks are kept.
+type Tracker struct {
+	mu        sync.Mutex
+	tasks     map[string]*Summary
+	retention time.Duration
+	maxTasks  int
+}
+
+// NewTracker creates a tracker
+func NewTracker(retention time.Duration, maxTasks int) *Tracker {
+	return &Tracker{
+		tasks:     make(map[string]*Summary),
+		retention: retention,
+		maxTasks:  maxTasks,
+	}
+}
+
+// Record adds a completed request to its task
+func (t *Tracker) Record(taskID string, status int, latency time.Duration, tokens int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	summary, ok := t.tasks[taskID]
+	if !ok {
+		t.evict(now)
+		summary = &Summary{TaskID: taskID, FirstSeen: now}
+		t.tasks[taskID] = summary
+	}
+	summary.Requests++
+	if status == 0 || status >= 400 {
+		summary.Errors++
+	}
+	summary.TotalLatency += latency
+	summary.Tokens += tokens
+	summary.LastSeen = now
+}
+
+// RecordToolCalls adds a response that requested the named tools to its task and
+// returns the task's tool-call round number
+func (t *Tracker) RecordToolCalls(taskID string, names []string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	summary, ok := t.tasks[taskID]
+	if !ok {
+		t.evict(now)
+		summary = &Summary{TaskID: taskID, FirstSeen: now, LastSeen: now}
+		t.tasks[taskID] = summary
+	}
+	if summary.ToolCalls == nil {
+		summary.ToolCalls = make(map[string]int)
+	}
+	summary.ToolCallRounds++
+	for _, name := range names {
+		summary.ToolCalls[name]++
+	}
+	return summary.ToolCallRounds
+}
+
+// Get returns the summary of a task
+func (t *Tracker) Get(taskID string) (Summary, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summary, ok := t.tasks[taskID]
+	if !ok || time.Since(summary.LastSeen) > t.retention {
+		return Summary{}, false
+	}
+	return summary.clone(), true
+}
+
+// List returns all retained tasks, most recently active first
+func (t *Tracker) List() []Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(time.Now())
+	list := make([]Summary, 0, len(t.tasks))
+	for _, summary := range t.tasks {
+		list = append(list, summary.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// evict drops expired tasks and, if still full, the least recently active one.
+// Callers must hold t.mu.
+func (t *Tracker) evict(now time.Time) {
+	var oldestID string
+	var oldest time.Time
+	for id, summary := range t.tasks {
+		if now.Sub(summary.LastSeen) > t.retention {
+			delete(t.tasks, id)
+			continue
+		}
+		if oldestID == "" || summary.LastSeen.Before(oldest) {
+			oldestID, oldest = id, summary.LastSeen
+		}
+	}
+	if t.maxTasks > 0 && len(t.tasks) >= t.maxTasks {
+		delete(t.tasks, oldestID)
+	}
+}
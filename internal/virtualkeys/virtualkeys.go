@@ -0,0 +1,230 @@
+// Package virtualkeys manages client keys created at runtime through the admin API,
+// persisted to a file so they survive restarts
+package virtualkeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"azure-ai-proxy/internal/auth"
+)
+
+// keyPrefix starts every generated key, so they are easy to recognize, e.g. by secret scanners
+const keyPrefix = "vk-"
+
+var (
+	// ErrExists is returned when creating a key under a name already taken
+	ErrExists = errors.New("a key with that name already exists")
+	// ErrNotFound is returned for names without a key
+	ErrNotFound = errors.New("no key with that name")
+)
+
+// Key is a virtual key. The key itself is only known to its holder; the store keeps
+// its SHA-256, which is enough for random keys of this length.
+type Key struct {
+	Name        string            `json:"name"`
+	Hash        string            `json:"hash"`
+	Owner       string            `json:"owner,omitempty"`
+	Deployments []string          `json:"deployments,omitempty"`
+	Operations  []string          `json:"operations,omitempty"`
+	Budget      string            `json:"budget,omitempty"` // e.g. "100/daily", like CLIENT_BUDGETS
+	Tags        map[string]string `json:"tags,omitempty"`
+	Windows     []string          `json:"windows,omitempty"` // e.g. "mon-fri/09:00-17:00", like PROXY_API_KEY_WINDOWS
+	Timezone    string            `json:"timezone,omitempty"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Disabled    bool              `json:"disabled"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// Expired reports whether the key has expired
+func (k *Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// Store holds the virtual keys and persists them to a file
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string]*Key // by name
+	hashes map[string]*Key // by hash
+}
+
+// Open creates a store backed by path, loading the keys it holds if the file exists
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]*Key), hashes: make(map[string]*Key)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid virtual key file %s: %v", path, err)
+	}
+	for _, k := range keys {
+		s.keys[k.Name] = k
+		s.hashes[k.Hash] = k
+	}
+	return s, nil
+}
+
+// Create generates a key for k.Name with k's settings, stores it and returns it along
+// with the key itself, which is not kept
+func (s *Store) Create(k Key) (Key, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[k.Name]; ok {
+		return Key{}, "", ErrExists
+	}
+	k.Hash = hashKey(key)
+	k.CreatedAt = time.Now().UTC()
+	s.keys[k.Name] = &k
+	s.hashes[k.Hash] = &k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.Name)
+		delete(s.hashes, k.Hash)
+		return Key{}, "", err
+	}
+	return k, key, nil
+}
+
+// List returns the keys, ordered by name
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Get returns the key named name
+func (s *Store) Get(name string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[name]
+	if !ok {
+		return Key{}, false
+	}
+	return *k, true
+}
+
+// SetDisabled disables or re-enables the key named name and returns it
+func (s *Store) SetDisabled(name string, disabled bool) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[name]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+	previous := k.Disabled
+	k.Disabled = disabled
+	if err := s.save(); err != nil {
+		k.Disabled = previous
+		return Key{}, err
+	}
+	return *k, nil
+}
+
+// Delete removes the key named name
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.keys, name)
+	delete(s.hashes, k.Hash)
+	if err := s.save(); err != nil {
+		s.keys[name] = k
+		s.hashes[k.Hash] = k
+		return err
+	}
+	return nil
+}
+
+// Authenticate implements auth.Authenticator for client keys in any of auth.KeyHeaders.
+// Keys the store does not know are left to the other authenticators.
+func (s *Store) Authenticate(r *http.Request) (auth.Identity, error) {
+	key, header, err := auth.KeyCredential(r)
+	if err != nil {
+		return auth.Identity{}, err
+	}
+	s.mu.RLock()
+	k, ok := s.hashes[hashKey(key)]
+	var disabled, expired bool
+	var name string
+	if ok {
+		name, disabled, expired = k.Name, k.Disabled, k.Expired(time.Now())
+	}
+	s.mu.RUnlock()
+
+	switch {
+	case !ok:
+		return auth.Identity{}, auth.ErrNoCredentials
+	case disabled:
+		log.Printf("Rejected virtual key %s from %s: key is disabled", name, r.RemoteAddr)
+		return auth.Identity{}, auth.ErrInvalidCredentials
+	case expired:
+		log.Printf("Rejected virtual key %s from %s: key has expired", name, r.RemoteAddr)
+		return auth.Identity{ClientID: name}, auth.ErrExpiredCredentials
+	}
+	return auth.Identity{ClientID: name, Header: header}, nil
+}
+
+// save writes the keys to the store's file, replacing it atomically. Callers must hold
+// s.mu for writing.
+func (s *Store) save() error {
+	keys := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// hashKey returns the hex SHA-256 of a key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -3,34 +3,171 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/url"
 	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // allows LOG_TIMEZONE to work on hosts without a zoneinfo database
 
 	"azure-ai-proxy/config"
 	"azure-ai-proxy/internal/logging"
 	"azure-ai-proxy/internal/proxy"
 )
 
-func run() error {
-	// Load configuration
-	cfg := config.NewDefaultConfig()
+// loadOptions reads the configuration with remote settings and overrides, such as
+// settings changed at runtime, and then the command-line options applied on top
+func loadOptions(opts options, remote, overrides map[string]interface{}) (*config.Config, error) {
+	cfg, err := config.LoadSources(config.Sources{Path: opts.configFile, Remote: remote, Overrides: overrides})
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadRemote reads the configuration like loadOptions, layering the settings of the
+// App Configuration store over it when one is configured. It also returns the store and
+// its settings, both nil without one.
+func loadRemote(opts options) (*config.Config, *config.AppConfig, map[string]interface{}, error) {
+	cfg, err := loadOptions(opts, nil, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remote, err := newRemoteConfig(cfg)
+	if err != nil || remote == nil {
+		return cfg, nil, nil, err
+	}
+	remoteSettings, _, err := fetchRemote(remote, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cfg, err = loadOptions(opts, remoteSettings, nil); err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, remote, remoteSettings, nil
+}
+
+// loadValidated reads the configuration like loadRemote, replaces its Key Vault
+// references with their secrets and validates it, as the proxy starts with it. It also
+// returns the store and its settings, and the secret provider, nil without a vault.
+func loadValidated(opts options) (*config.Config, *config.AppConfig, map[string]interface{}, config.SecretProvider, error) {
+	cfg, remote, remoteSettings, err := loadRemote(opts)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	secrets, err := newSecretProvider(cfg)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err := resolveSecrets(cfg, secrets); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	return cfg, remote, remoteSettings, secrets, nil
+}
+
+func run(args []string) error {
+	opts, ok, err := parseFlags(args)
+	if err != nil || !ok {
+		return err
+	}
+
+	// Load configuration and refuse to start with settings that cannot work
+	cfg, remote, remoteSettings, secrets, err := loadValidated(opts)
+	if err != nil {
+		return err
+	}
+	if err := config.CheckLogFile(cfg.LogFilePath); err != nil {
+		return err
+	}
+	// A restarted process takes over the socket its predecessor still holds
+	if !proxy.InheritsListener() {
+		if err := config.CheckListen(cfg.ListenAddr); err != nil {
+			return err
+		}
+	}
 
 	// Create a logger
-	logger, err := logging.NewFileLogger(cfg.LogFilePath)
+	logging.SetDebug(strings.EqualFold(cfg.LogLevel, "debug"))
+
+	location, err := time.LoadLocation(cfg.LogTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid log timezone: %v", err)
+	}
+	logOpts := []logging.Option{logging.WithTimestampFormat(cfg.LogTimestampFormat, location)}
+
+	// Keep prompts and responses out of the log in plaintext if configured
+	key, err := logging.LoadKey(cfg.LogEncryptionKey, cfg.LogEncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		aead, err := logging.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		logOpts = append(logOpts, logging.WithEncryption(aead))
+	}
+
+	var logger logging.Logger
+	logger, err = logging.NewFileLogger(cfg.LogFilePath, logOpts...)
 	if err != nil {
 		return fmt.Errorf("failed to create logger: %v", err)
 	}
-	defer logger.Close()
+	defer func() { logger.Close() }() // closes the decorators wrapped around it below too
 
-	// Parse the target URL
-	targetURL, err := url.Parse(cfg.AzureOpenAIEndpoint)
+	// Sample entries if configured, keeping per-client overrides. The sampler is always
+	// in place so reloads can change the rates.
+	clientRates, err := logging.ParseSampleRates(cfg.ClientLogSampling)
 	if err != nil {
-		return fmt.Errorf("failed to parse target URL: %v", err)
+		return err
+	}
+	sampled := logging.NewSampledLogger(logger, cfg.LogSampleRate, clientRates)
+	logger = sampled
+
+	// Keep error floods during outages from drowning out other entries
+	if cfg.LogDedupErrors {
+		logger = logging.NewDedupLogger(logger, cfg.LogDedupWindow)
 	}
 
 	// Create and start the proxy server
-	server := proxy.New(targetURL, logger, cfg.APIKey)
+	server, err := proxy.New(cfg.EffectiveBackends(), logger, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy server: %v", err)
+	}
+	defer server.Close()
+
+	// Reload settings on SIGHUP, when the config or client key file changes and when
+	// secrets are due for a refresh
+	var refresh time.Duration
+	if secrets != nil && cfg.UsesSecrets() {
+		refresh = cfg.KeyVaultRefreshInterval
+	}
+	done := make(chan struct{})
+	defer close(done)
+	reloader := &reloader{opts: opts, secrets: secrets, remote: remote, remoteSettings: remoteSettings, server: server, sampled: sampled}
+	server.SetConfigManager(reloader)
+	var watched []string
+	for _, path := range []string{opts.configFile, cfg.ClientKeysFile} {
+		if path != "" {
+			watched = append(watched, path)
+		}
+	}
+	go watchConfig(watched, refresh, reloader.reload, done)
+	if remote != nil {
+		go watchRemote(cfg.AppConfigPollInterval, reloader.poll, done)
+	}
+
+	if cfg.Profile != "" {
+		log.Printf("Using configuration profile %s", cfg.Profile)
+	}
 	log.Printf("Logging requests and responses to %s", cfg.LogFilePath)
+	if cfg.DeadLetterFilePath != "" {
+		log.Printf("Writing failed requests to dead-letter queue %s", cfg.DeadLetterFilePath)
+	}
 	if err := server.Run(cfg.ListenAddr); err != nil {
 		return fmt.Errorf("server error: %v", err)
 	}
@@ -39,7 +176,28 @@ func run() error {
 }
 
 func main() {
-	if err := run(); err != nil {
+	// Variables of a .env file spare developers exporting them, for every subcommand
+	envFile, err := config.LoadEnvFile()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if envFile != "" {
+		log.Printf("Read environment variables from %s", envFile)
+	}
+
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "replay":
+		err = runReplay(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "decrypt-logs":
+		err = runDecryptLogs(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "config":
+		err = runConfig(os.Args[2:])
+	default:
+		err = run(os.Args[1:])
+	}
+
+	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"azure-ai-proxy/config"
+	"azure-ai-proxy/internal/logging"
+	"azure-ai-proxy/internal/proxy"
+)
+
+// configPollInterval is how often the config and client key files are checked for changes
+const configPollInterval = 2 * time.Second
+
+// watchConfig calls reload on SIGHUP, every refresh interval if it is non-zero and
+// whenever the modification time of one of the files at paths changes, until done is
+// closed
+func watchConfig(paths []string, refresh time.Duration, reload func(), done <-chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	modified := make(map[string]time.Time, len(paths))
+	if len(paths) > 0 {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				modified[path] = info.ModTime()
+			}
+		}
+	}
+
+	var refreshes <-chan time.Time
+	if refresh > 0 {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		refreshes = ticker.C
+	}
+
+	for {
+		select {
+		case <-hangup:
+			log.Printf("Received SIGHUP, reloading configuration")
+			reload()
+		case <-poll:
+			var changed []string
+			for _, path := range paths {
+				info, err := os.Stat(path)
+				if err != nil || info.ModTime().Equal(modified[path]) {
+					continue
+				}
+				modified[path] = info.ModTime()
+				changed = append(changed, path)
+			}
+			if len(changed) > 0 {
+				log.Printf("%s changed, reloading configuration", strings.Join(changed, " and "))
+				reload()
+			}
+		case <-refreshes:
+			log.Printf("Refreshing secrets")
+			reload()
+		case <-done:
+			return
+		}
+	}
+}
+
+// reloader applies configuration changes while the proxy is serving
+type reloader struct {
+	mu             sync.Mutex
+	opts           options
+	secrets        config.SecretProvider
+	remote         *config.AppConfig      // nil without App Configuration
+	remoteSettings map[string]interface{} // settings last fetched from remote
+	server         *proxy.Server
+	sampled        *logging.SampledLogger
+	patch          map[string]interface{} // settings changed at runtime, kept across reloads
+}
+
+// reload reads the configuration again, with the remote settings and runtime changes
+// on top, and applies the settings that can change while serving: routing, keys,
+// limits and logging. The previous settings stay in effect if the new configuration
+// is invalid.
+func (r *reloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remoteSettings := r.remoteSettings
+	if r.remote != nil {
+		settings, _, err := fetchRemote(r.remote, true)
+		if err != nil {
+			log.Printf("Warning: using the previous remote settings: %v", err)
+		} else {
+			remoteSettings = settings
+		}
+	}
+	if err := r.apply(remoteSettings, r.patch, "system"); err != nil {
+		log.Printf("Error: configuration not reloaded: %v", err)
+		return
+	}
+	r.remoteSettings = remoteSettings
+}
+
+// poll applies the remote settings if they changed
+func (r *reloader) poll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.refreshRemote(false, "system"); err != nil {
+		log.Printf("Error: remote configuration not applied: %v", err)
+	}
+}
+
+// Refresh fetches the remote settings after a change notification carrying
+// syncTokens, and applies them as actor if they changed
+func (r *reloader) Refresh(syncTokens []string, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.remote == nil {
+		return proxy.ErrNoRemoteConfig
+	}
+	for _, token := range syncTokens {
+		if err := r.remote.SetSyncToken(token); err != nil {
+			return fmt.Errorf("invalid sync token: %v", err)
+		}
+	}
+	return r.refreshRemote(true, actor)
+}
+
+// refreshRemote fetches the remote settings and applies them if they changed, or
+// keeps the previous ones if the configuration would be invalid. Callers must hold r.mu.
+func (r *reloader) refreshRemote(force bool, actor string) error {
+	settings, changed, err := fetchRemote(r.remote, force)
+	if err != nil || !changed {
+		return err
+	}
+	log.Printf("Remote configuration changed, reloading configuration")
+	if err := r.apply(settings, r.patch, actor); err != nil {
+		return err
+	}
+	r.remoteSettings = settings
+	return nil
+}
+
+// Update adds settings to the runtime changes and applies them as actor. A nil value
+// drops the runtime change to a setting. If the result is invalid or sets what only
+// takes effect on restart, neither the configuration nor the runtime changes change.
+func (r *reloader) Update(settings map[string]interface{}, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changed []string
+	for name, value := range settings {
+		if value != nil {
+			changed = append(changed, name)
+		}
+	}
+	// Runtime changes are dropped on restart, so these would never take effect
+	if restart := r.server.RequiresRestart(changed); len(restart) > 0 {
+		return fmt.Errorf("%s cannot be changed at runtime, change them in the configuration and restart", strings.Join(restart, ", "))
+	}
+
+	patch := maps.Clone(r.patch)
+	if patch == nil {
+		patch = make(map[string]interface{}, len(settings))
+	}
+	for name, value := range settings {
+		name = strings.ToLower(name)
+		if value == nil {
+			delete(patch, name)
+		} else {
+			patch[name] = value
+		}
+	}
+	if err := r.apply(r.remoteSettings, patch, actor); err != nil {
+		return err
+	}
+	r.patch = patch
+	return nil
+}
+
+// apply loads and validates the configuration with remote settings and patch and
+// switches the proxy and the log sampler to it, auditing the reload as done by actor
+func (r *reloader) apply(remote, patch map[string]interface{}, actor string) error {
+	cfg, err := loadOptions(r.opts, remote, patch)
+	if err != nil {
+		return err
+	}
+	if err := resolveSecrets(cfg, r.secrets); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	clientRates, err := logging.ParseSampleRates(cfg.ClientLogSampling)
+	if err != nil {
+		return err
+	}
+	if err := r.server.ApplyConfig(cfg, actor); err != nil {
+		return err
+	}
+	r.sampled.SetRates(cfg.LogSampleRate, clientRates)
+	logging.SetDebug(strings.EqualFold(cfg.LogLevel, "debug"))
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"azure-ai-proxy/internal/deadletter"
+	"azure-ai-proxy/internal/proxy"
+)
+
+// runReplay implements the `replay` subcommand, which resends the requests in a
+// dead-letter file to the target endpoint.
+// The configuration is loaded like the proxy's, so replays use the same credentials.
+func runReplay(args []string) error {
+	var opts options
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	opts.register(flags)
+	file := flags.String("file", "", "dead-letter file to replay (default DEAD_LETTER_FILE_PATH)")
+	target := flags.String("target", "", "endpoint to replay requests against (default AZURE_OPENAI_ENDPOINT)")
+	failedFile := flags.String("failed", "", "file to write requests that fail again to (default <file>.failed)")
+	timeout := flags.Duration("timeout", 5*time.Minute, "timeout for each replayed request")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, _, _, _, err := loadValidated(opts)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		*file = cfg.DeadLetterFilePath
+	}
+	if *target == "" {
+		*target = cfg.AzureOpenAIEndpoint
+	}
+	if *file == "" {
+		return fmt.Errorf("no dead-letter file given, use -file or DEAD_LETTER_FILE_PATH")
+	}
+	if *failedFile == "" {
+		*failedFile = *file + ".failed"
+	}
+
+	targetURL, err := url.Parse(*target)
+	if err != nil {
+		return fmt.Errorf("failed to parse target URL: %v", err)
+	}
+
+	failed, err := deadletter.NewWriter(*failedFile)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", *failedFile, err)
+	}
+	defer failed.Close()
+
+	// Records are stored without credentials, so replays are sent the current ones
+	stop := make(chan struct{})
+	defer close(stop)
+	authorize, err := proxy.ReplayAuthorizer(cfg, targetURL, stop)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	replayed, failedCount, err := deadletter.Replay(*file, targetURL, client, authorize, failed)
+	if err != nil {
+		return fmt.Errorf("replay error: %v", err)
+	}
+
+	log.Printf("Replayed %d requests to %s, %d failed again and were written to %s", replayed, targetURL, failedCount, *failedFile)
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"azure-ai-proxy/config"
+)
+
+// secretTimeout bounds fetching all secrets of the configuration
+const secretTimeout = 30 * time.Second
+
+// newSecretProvider returns the Key Vault provider of the configuration, or nil if no
+// vault is configured
+func newSecretProvider(cfg *config.Config) (config.SecretProvider, error) {
+	if cfg.KeyVaultURL == "" {
+		return nil, nil
+	}
+	keyVault, err := config.NewKeyVault(cfg.KeyVaultURL)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetching secrets from Key Vault %s", cfg.KeyVaultURL)
+	return keyVault, nil
+}
+
+// resolveSecrets replaces the settings of cfg that refer to secrets with their values
+func resolveSecrets(cfg *config.Config, secrets config.SecretProvider) error {
+	if !cfg.UsesSecrets() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	return cfg.ResolveSecrets(ctx, secrets)
+}